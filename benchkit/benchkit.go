@@ -0,0 +1,164 @@
+// Package benchkit drives load through a connected GoPack2 and reports
+// throughput, acknowledgment latency, retransmissions and allocations
+package benchkit
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	gopack "github.com/codemeow5/GoPack/lib"
+)
+
+// Config of a benchmark run, zero values take defaults
+type Config struct {
+	Messages    int  // messages to commit, default 10000
+	Size        int  // payload bytes, default 128
+	Qos         byte // quality of service of every message
+	Rate        int  // messages per second, 0 is as fast as possible
+	Concurrency int  // messages awaiting acknowledgment at once, default 64
+}
+
+// Report of a benchmark run
+type Report struct {
+	Messages int // acknowledged, or transmitted for QoS0
+	Errors   int
+	Elapsed  time.Duration
+
+	// Throughput in messages and payload bytes per second
+	Throughput     float64
+	BytesPerSecond float64
+
+	// latency from commit to acknowledgment
+	P50 time.Duration
+	P99 time.Duration
+	Max time.Duration
+
+	Retransmissions int64
+
+	// heap allocations of the whole process during the run
+	Allocs           uint64
+	AllocBytes       uint64
+	AllocsPerMessage float64
+}
+
+// String formats the report on a few lines
+func (r *Report) String() string {
+	return fmt.Sprintf("%d messages in %v, %d errors\n"+
+		"throughput %.0f msg/s, %.0f B/s\n"+
+		"latency p50 %v, p99 %v, max %v\n"+
+		"retransmissions %d\n"+
+		"allocs %d (%.1f per message), %d bytes",
+		r.Messages, r.Elapsed, r.Errors,
+		r.Throughput, r.BytesPerSecond,
+		r.P50, r.P99, r.Max,
+		r.Retransmissions,
+		r.Allocs, r.AllocsPerMessage, r.AllocBytes)
+}
+
+// Run commits cfg.Messages messages through gopk and waits for each to
+// be acknowledged, gopk should be started and its peer reachable,
+// stops early with ctx.Err() once ctx is done
+func Run(ctx context.Context, gopk *gopack.GoPack2, cfg Config) (*Report, error) {
+	if cfg.Messages == 0 {
+		cfg.Messages = 10000
+	}
+	if cfg.Size == 0 {
+		cfg.Size = 128
+	}
+	if cfg.Concurrency == 0 {
+		cfg.Concurrency = 64
+	}
+	var interval time.Duration
+	if cfg.Rate > 0 {
+		interval = time.Second / time.Duration(cfg.Rate)
+	}
+	payload := make([]byte, cfg.Size)
+
+	var (
+		latencies = make([]time.Duration, 0, cfg.Messages)
+		failed    int
+		mux       sync.Mutex
+		wg        sync.WaitGroup
+	)
+	slots := make(chan struct{}, cfg.Concurrency)
+	retransmissions := gopk.Stats().Retransmissions
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	next := start
+
+	var err error
+	for i := 0; i < cfg.Messages; i++ {
+		if interval > 0 {
+			next = next.Add(interval)
+			if wait := time.Until(next); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+				}
+			}
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			committed := time.Now()
+			_, err := gopk.PublishContext(ctx, &gopack.Message{Qos: cfg.Qos, Payload: payload})
+			latency := time.Since(committed)
+			mux.Lock()
+			defer mux.Unlock()
+			if err != nil {
+				failed++
+				return
+			}
+			latencies = append(latencies, latency)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	report := &Report{
+		Messages:        len(latencies),
+		Errors:          failed,
+		Elapsed:         elapsed,
+		Throughput:      float64(len(latencies)) / elapsed.Seconds(),
+		BytesPerSecond:  float64(len(latencies)*cfg.Size) / elapsed.Seconds(),
+		P50:             quantile(latencies, 0.5),
+		P99:             quantile(latencies, 0.99),
+		Retransmissions: gopk.Stats().Retransmissions - retransmissions,
+		Allocs:          after.Mallocs - before.Mallocs,
+		AllocBytes:      after.TotalAlloc - before.TotalAlloc,
+	}
+	if len(latencies) > 0 {
+		report.Max = latencies[len(latencies)-1]
+		report.AllocsPerMessage = float64(report.Allocs) / float64(len(latencies))
+	}
+	return report, err
+}
+
+// quantile returns the q quantile of sorted latencies
+func quantile(sorted []time.Duration, q float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(q * float64(len(sorted)))
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
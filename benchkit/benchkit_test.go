@@ -0,0 +1,144 @@
+package benchkit
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	gopack "github.com/codemeow5/GoPack/lib"
+)
+
+// serveAcks acknowledges every message read from conn
+func serveAcks(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	header := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return
+		}
+		frame := make([]byte, 5+int(binary.BigEndian.Uint16(header[3:])))
+		copy(frame, header)
+		if _, err := io.ReadFull(reader, frame[5:]); err != nil {
+			return
+		}
+		packet, err := gopack.Decode(frame)
+		if err != nil {
+			return
+		}
+		var reply *gopack.Packet
+		switch {
+		case packet.MsgType == gopack.MsgTypeSend && packet.Qos == gopack.Qos1:
+			reply = gopack.Encode(gopack.MsgTypeAck, gopack.Qos0, 0, packet.MsgID, nil)
+		case packet.MsgType == gopack.MsgTypeSend && packet.Qos == gopack.Qos2:
+			reply = gopack.Encode(gopack.MsgTypeReceived, gopack.Qos0, 0, packet.MsgID, nil)
+		case packet.MsgType == gopack.MsgTypeRelease:
+			reply = gopack.Encode(gopack.MsgTypeCompleted, gopack.Qos0, 0, packet.MsgID, nil)
+		case packet.MsgType == gopack.MsgTypePing:
+			reply = gopack.Encode(gopack.MsgTypePong, gopack.Qos0, 0, 0, nil)
+		default:
+			continue
+		}
+		if _, err := conn.Write(reply.Buffer); err != nil {
+			return
+		}
+	}
+}
+
+// started returns a started GoPack2 connected to a peer running serveAcks
+func started(t *testing.T) *gopack.GoPack2 {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveAcks(conn)
+		}
+	}()
+	gopk, err := gopack.NewGoPack(&gopack.Options{Address: ln.Addr().String(), CallbackObj: discard{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gopk.Start()
+	t.Cleanup(func() {
+		gopk.Close()
+		ln.Close()
+	})
+	return gopk
+}
+
+// discard ignores messages and errors
+type discard struct{}
+
+func (discard) Invoke(payload []byte, err error) {}
+
+func TestRun(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  Config
+	}{
+		{"qos0", Config{Messages: 200, Qos: gopack.Qos0}},
+		{"qos1", Config{Messages: 200, Qos: gopack.Qos1, Size: 16}},
+		{"qos2", Config{Messages: 200, Qos: gopack.Qos2, Concurrency: 4}},
+		{"rate", Config{Messages: 20, Qos: gopack.Qos1, Rate: 200}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			report, err := Run(context.Background(), started(t), c.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Messages != c.cfg.Messages || report.Errors != 0 {
+				t.Fatalf("report %s", report)
+			}
+			if report.P50 > report.P99 || report.P99 > report.Max || report.Throughput <= 0 {
+				t.Fatalf("report %s", report)
+			}
+			if c.cfg.Rate > 0 && report.Elapsed < time.Duration(c.cfg.Messages-1)*time.Second/time.Duration(c.cfg.Rate) {
+				t.Fatalf("rate not kept, %v", report.Elapsed)
+			}
+		})
+	}
+}
+
+func TestRunCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report, err := Run(ctx, started(t), Config{Messages: 10, Qos: gopack.Qos1})
+	if err != context.Canceled || report.Messages != 0 {
+		t.Fatalf("got %d messages, %v", report.Messages, err)
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	sorted := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	cases := []struct {
+		name   string
+		sorted []time.Duration
+		q      float64
+		want   time.Duration
+	}{
+		{"empty", nil, 0.5, 0},
+		{"median", sorted, 0.5, 6},
+		{"p99", sorted, 0.99, 10},
+		{"max", sorted, 1, 10},
+		{"min", sorted, 0, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := quantile(c.sorted, c.q); got != c.want {
+				t.Fatalf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package gopack
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ConnState describes the current connection
+type ConnState struct {
+	Connected  bool
+	Peer       string
+	PeerCaps   int
+	Inflight   int
+	Parked     int
+	Window     int
+	Idle       time.Duration
+	DeadLetter int
+}
+
+// PendingPacket describes a queued message awaiting confirmation
+type PendingPacket struct {
+	MsgID      MsgID
+	Qos        byte
+	Channel    int
+	Priority   byte
+	Size       int
+	RetryTimes int
+	CreatedAt  time.Time
+	// NextSend is zero when the message is due
+	NextSend time.Time
+}
+
+// ConnState returns the state of the current connection
+func (gopack *GoPack2) ConnState() ConnState {
+	var state ConnState
+	gopack.muxCommit.Lock()
+	state.Connected = gopack.connected
+	state.Peer = gopack.peer
+	gopack.muxCommit.Unlock()
+	if state.Connected {
+		state.PeerCaps = int(atomic.LoadInt32(&gopack.peerCaps))
+		state.Idle = gopack.idle()
+	}
+	state.Window = gopack.window()
+	gopack.muxInflight.Lock()
+	state.Inflight = len(gopack.inflight)
+	state.Parked = len(gopack.parked)
+	gopack.muxInflight.Unlock()
+	gopack.muxDeadLetters.Lock()
+	state.DeadLetter = len(gopack.deadLetters)
+	gopack.muxDeadLetters.Unlock()
+	return state
+}
+
+// PendingPackets returns queued messages awaiting confirmation
+// ordered by MsgID
+func (gopack *GoPack2) PendingPackets() []PendingPacket {
+	var packets []*Packet
+	for _, store := range []OutboundStore{gopack.storage(), gopack.draining()} {
+		if store != nil {
+			packets = append(packets, queued(store)...)
+		}
+	}
+	gopack.muxInflight.Lock()
+	for _, packet := range gopack.parked {
+		// the writer changes a packet once it is unparked
+		packets = append(packets, packet.Clone())
+	}
+	gopack.muxInflight.Unlock()
+	pending := make([]PendingPacket, 0, len(packets))
+	for _, packet := range packets {
+		if packet.MsgType != MsgTypeSend || packet.Confirm {
+			continue
+		}
+		p := PendingPacket{
+			MsgID:      packet.MsgID,
+			Qos:        packet.Qos,
+			Channel:    packet.Channel,
+			Priority:   packet.Priority,
+			Size:       len(packet.Payload),
+			RetryTimes: packet.RetryTimes,
+			CreatedAt:  time.Unix(0, packet.CreatedAt),
+		}
+		if packet.Timestamp > time.Now().Unix() {
+			p.NextSend = time.Unix(packet.Timestamp, 0)
+		}
+		pending = append(pending, p)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].MsgID < pending[j].MsgID
+	})
+	return pending
+}
+
+// AdminHandler returns a http.Handler serving JSON views of the
+// connection (/conn), stats (/stats) and pending messages (/pending),
+// mount it with http.StripPrefix under a path of choice
+func (gopack *GoPack2) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/conn", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, gopack.ConnState())
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, gopack.Stats())
+	})
+	mux.HandleFunc("/pending", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, gopack.PendingPackets())
+	})
+	return mux
+}
+
+// writeJSON writes v as an indented JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
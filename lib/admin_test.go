@@ -0,0 +1,98 @@
+package gopack
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdminHandler(t *testing.T) {
+	gopack := offline(t, &Options{})
+	for i := 0; i < 2; i++ {
+		if _, err := gopack.Commit([]byte("xy"), Qos1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := gopack.Publish(&Message{Qos: Qos2, NotBefore: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		path  string
+		value interface{}
+		check func(t *testing.T, value interface{})
+	}{
+		{"/conn", new(ConnState), func(t *testing.T, value interface{}) {
+			if state := value.(*ConnState); state.Connected || state.Window != 20 {
+				t.Fatalf("state %+v", state)
+			}
+		}},
+		{"/stats", new(Stats), func(t *testing.T, value interface{}) {
+			if stats := value.(*Stats); stats.Pending != 3 || stats.PendingBytes != 4 {
+				t.Fatalf("stats %+v", stats)
+			}
+		}},
+		{"/pending", new([]PendingPacket), func(t *testing.T, value interface{}) {
+			pending := *value.(*[]PendingPacket)
+			if len(pending) != 3 || pending[0].MsgID != 1 || pending[0].Size != 2 {
+				t.Fatalf("pending %+v", pending)
+			}
+			if !pending[0].NextSend.IsZero() || pending[2].NextSend.IsZero() {
+				t.Fatal("next send of due and delayed messages mixed up")
+			}
+		}},
+	}
+	server := httptest.NewServer(http.StripPrefix("/admin", gopack.AdminHandler()))
+	defer server.Close()
+	for _, c := range cases {
+		t.Run(c.path, func(t *testing.T) {
+			resp, err := http.Get(server.URL + "/admin" + c.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+				t.Fatalf("status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+			}
+			if err := json.NewDecoder(resp.Body).Decode(c.value); err != nil {
+				t.Fatal(err)
+			}
+			c.check(t, c.value)
+		})
+	}
+}
+
+func TestPendingPacketsWhileSending(t *testing.T) {
+	cases := []struct {
+		name  string
+		read  func(gopack *GoPack2) int
+		count int
+	}{
+		{"pending packets", func(gopack *GoPack2) int { return len(gopack.PendingPackets()) }, 4},
+		{"stats", func(gopack *GoPack2) int { return gopack.Stats().Pending }, 4},
+		{"copy storage", func(gopack *GoPack2) int {
+			to := newMemoryStorage()
+			CopyStorage(gopack.storage(), to)
+			return len(to.Queued())
+		}, 4},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// due again right away, the writer retransmits in a loop
+			gopack := offline(t, &Options{RetryInterval: 1})
+			for i := 0; i < c.count; i++ {
+				if _, err := gopack.Commit([]byte("x"), Qos1); err != nil {
+					t.Fatal(err)
+				}
+			}
+			silent(t, gopack)
+			deadline := time.Now().Add(200 * time.Millisecond)
+			for time.Now().Before(deadline) {
+				if n := c.read(gopack); n > c.count {
+					t.Fatalf("%d pending, want at most %d", n, c.count)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package gopack
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// CaptureInbound direction of a captured frame read from the peer
+const CaptureInbound = 1
+
+// CaptureOutbound direction of a captured frame written to the peer
+const CaptureOutbound = 2
+
+// Frame a captured packet as it was read or written
+type Frame struct {
+	Direction byte
+	Time      time.Time
+	Data      []byte
+}
+
+// recorder writes frames to Options.Capture, a record is
+// [u8 direction][u64 unix nano][frame], frames carry their own length
+type recorder struct {
+	w   io.Writer
+	err error
+	mux sync.Mutex
+}
+
+func newRecorder(w io.Writer) *recorder {
+	if w == nil {
+		return nil
+	}
+	return &recorder{w: w}
+}
+
+// record captures frame, the first write error stops recording
+// and is returned once
+func (r *recorder) record(direction byte, frame []byte) error {
+	if r == nil {
+		return nil
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.err != nil {
+		return nil
+	}
+	var header [9]byte
+	header[0] = direction
+	binary.BigEndian.PutUint64(header[1:], uint64(time.Now().UnixNano()))
+	if _, r.err = r.w.Write(header[:]); r.err == nil {
+		_, r.err = r.w.Write(frame)
+	}
+	return r.err
+}
+
+// capture records frame if Options.Capture is set
+func (gopack *GoPack2) capture(direction byte, frame []byte) {
+	if err := gopack.recorder.record(direction, frame); err != nil {
+		gopack.cbErr(err)
+	}
+}
+
+// CaptureReader reads frames written with Options.Capture
+type CaptureReader struct {
+	r *bufio.Reader
+}
+
+// NewCaptureReader returns a CaptureReader reading from r
+func NewCaptureReader(r io.Reader) *CaptureReader {
+	return &CaptureReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next frame, io.EOF at the end of the capture
+// and io.ErrUnexpectedEOF if it is truncated
+func (cr *CaptureReader) Next() (*Frame, error) {
+	var header [14]byte
+	if _, err := io.ReadFull(cr.r, header[:1]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(cr.r, header[1:]); err != nil {
+		return nil, unexpected(err)
+	}
+	remainingLength := int(binary.BigEndian.Uint16(header[12:]))
+	data := make([]byte, 5+remainingLength)
+	copy(data, header[9:])
+	if _, err := io.ReadFull(cr.r, data[5:]); err != nil {
+		return nil, unexpected(err)
+	}
+	return &Frame{
+		Direction: header[0],
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(header[1:9]))),
+		Data:      data,
+	}, nil
+}
+
+// unexpected turns io.EOF within a record into io.ErrUnexpectedEOF
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Replay plays the peer of a captured connection, it writes the inbound
+// frames of capture to conn and discards what conn sends back until
+// conn is closed, speed scales the recorded delays between frames
+// and 0 replays them without delay
+func Replay(ctx context.Context, capture io.Reader, conn net.Conn, speed float64) error {
+	go io.Copy(io.Discard, conn)
+	cr := NewCaptureReader(capture)
+	var last time.Time
+	for {
+		frame, err := cr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if frame.Direction != CaptureInbound {
+			continue
+		}
+		if speed > 0 && !last.IsZero() {
+			delay := time.Duration(float64(frame.Time.Sub(last)) / speed)
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+		last = frame.Time
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if _, err = conn.Write(frame.Data); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package gopack
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// lockedBuffer is a bytes.Buffer safe to write from the connection
+// goroutines while the test reads it
+type lockedBuffer struct {
+	buf bytes.Buffer
+	mux sync.Mutex
+}
+
+func (lb *lockedBuffer) Write(p []byte) (int, error) {
+	lb.mux.Lock()
+	defer lb.mux.Unlock()
+	return lb.buf.Write(p)
+}
+
+func (lb *lockedBuffer) Bytes() []byte {
+	lb.mux.Lock()
+	defer lb.mux.Unlock()
+	return append([]byte(nil), lb.buf.Bytes()...)
+}
+
+func TestCaptureReader(t *testing.T) {
+	var capture bytes.Buffer
+	r := newRecorder(&capture)
+	send := Encode(MsgTypeSend, Qos1, 0, 7, []byte("x"))
+	ack := Encode(MsgTypeAck, Qos0, 0, 7, nil)
+	r.record(CaptureInbound, send.Buffer)
+	r.record(CaptureOutbound, ack.Buffer)
+	records := capture.Bytes()
+	cases := []struct {
+		name   string
+		data   []byte
+		frames int
+		err    error
+	}{
+		{"empty", nil, 0, io.EOF},
+		{"frames", records, 2, io.EOF},
+		{"truncated header", records[:len(records)-len(ack.Buffer)-3], 1, io.ErrUnexpectedEOF},
+		{"truncated frame", records[:len(records)-1], 1, io.ErrUnexpectedEOF},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cr := NewCaptureReader(bytes.NewReader(c.data))
+			var frames []*Frame
+			var err error
+			for {
+				var frame *Frame
+				if frame, err = cr.Next(); err != nil {
+					break
+				}
+				frames = append(frames, frame)
+			}
+			if err != c.err || len(frames) != c.frames {
+				t.Fatalf("%d frames, %v, want %d, %v", len(frames), err, c.frames, c.err)
+			}
+			want := [][]byte{send.Buffer, ack.Buffer}
+			directions := []byte{CaptureInbound, CaptureOutbound}
+			for i, frame := range frames {
+				if !bytes.Equal(frame.Data, want[i]) || frame.Direction != directions[i] || frame.Time.IsZero() {
+					t.Fatalf("frame %d %+v", i, frame)
+				}
+			}
+		})
+	}
+}
+
+func TestReplay(t *testing.T) {
+	cases := []struct {
+		name  string
+		qos   byte
+		speed float64
+	}{
+		{"qos0", Qos0, 0},
+		{"qos1", Qos1, 0},
+		{"qos2 timed", Qos2, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			capture := &lockedBuffer{}
+			client, _, server, scb := pair(t, &Options{}, &Options{Capture: capture})
+			if _, err := client.Commit([]byte("captured"), c.qos); err != nil {
+				t.Fatal(err)
+			}
+			scb.next(t)
+			eventually(t, func() bool { return client.remaining() == 0 })
+			server.Close()
+
+			replayed := offline(t, &Options{})
+			cb := replayed.opts.CallbackObj.(*testCallback)
+			local, remote := net.Pipe()
+			served := make(chan struct{})
+			go func() {
+				defer close(served)
+				replayed.serve(local)
+			}()
+			err := Replay(context.Background(), bytes.NewReader(capture.Bytes()), remote, c.speed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg := cb.next(t); string(msg.Payload) != "captured" || msg.Qos != c.qos {
+				t.Fatalf("replayed %+v", msg)
+			}
+			replayed.Close()
+			remote.Close()
+			<-served
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package gopack
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNoBlobStore means that a claim-checked message was received
+// without Options.BlobStore
+var ErrNoBlobStore = errors.New("no blob store")
+
+// ClaimCheckError reports a received message whose payload
+// could not be fetched, the message is dropped
+type ClaimCheckError struct {
+	MsgID MsgID
+	Ref   string
+	Err   error
+}
+
+func (e *ClaimCheckError) Error() string {
+	return fmt.Sprintf("message %d claim check %q: %v", e.MsgID, e.Ref, e.Err)
+}
+
+func (e *ClaimCheckError) Unwrap() error {
+	return e.Err
+}
+
+// HeaderClaimCheck header holding the BlobStore reference of a payload
+// that was stored instead of sent
+const HeaderClaimCheck = "claim-check"
+
+// BlobStore keeps large payloads out of band, see Options.BlobStore
+type BlobStore interface {
+	Put(payload []byte) (ref string, err error)
+	Get(ref string) ([]byte, error)
+}
+
+// checkIn stores the payload of msg in the BlobStore if it exceeds
+// Options.ClaimCheckThreshold, returns the message to publish
+func (gopack *GoPack2) checkIn(msg *Message) (*Message, error) {
+	if gopack.opts.BlobStore == nil || len(msg.Payload) <= gopack.opts.ClaimCheckThreshold {
+		return msg, nil
+	}
+	ref, err := gopack.opts.BlobStore.Put(msg.Payload)
+	if err != nil {
+		return nil, err
+	}
+	claimed := *msg
+	claimed.Payload = nil
+	claimed.Headers = make(map[string]string, len(msg.Headers)+1)
+	for key, value := range msg.Headers {
+		claimed.Headers[key] = value
+	}
+	claimed.Headers[HeaderClaimCheck] = ref
+	return &claimed, nil
+}
+
+// checkOut replaces the payload of a received message by the one
+// it references in the BlobStore, reports false if that failed
+func (gopack *GoPack2) checkOut(msg *Message) bool {
+	ref, ok := msg.Headers[HeaderClaimCheck]
+	if !ok {
+		return true
+	}
+	if gopack.opts.BlobStore == nil {
+		gopack.invoke(nil, &ClaimCheckError{MsgID: msg.MsgID, Ref: ref, Err: ErrNoBlobStore})
+		return false
+	}
+	payload, err := gopack.opts.BlobStore.Get(ref)
+	if err != nil {
+		gopack.invoke(nil, &ClaimCheckError{MsgID: msg.MsgID, Ref: ref, Err: err})
+		return false
+	}
+	msg.Payload = payload
+	return true
+}
@@ -0,0 +1,92 @@
+package gopack
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+var errBlobStore = errors.New("blob store unavailable")
+
+// mapBlobs is a BlobStore in memory, failing Put or Get as configured
+type mapBlobs struct {
+	blobs   map[string][]byte
+	failPut bool
+	failGet bool
+	mux     sync.Mutex
+}
+
+func newMapBlobs() *mapBlobs {
+	return &mapBlobs{blobs: make(map[string][]byte)}
+}
+
+func (mb *mapBlobs) Put(payload []byte) (string, error) {
+	mb.mux.Lock()
+	defer mb.mux.Unlock()
+	if mb.failPut {
+		return "", errBlobStore
+	}
+	ref := fmt.Sprintf("blob-%d", len(mb.blobs))
+	mb.blobs[ref] = payload
+	return ref, nil
+}
+
+func (mb *mapBlobs) Get(ref string) ([]byte, error) {
+	mb.mux.Lock()
+	defer mb.mux.Unlock()
+	if mb.failGet {
+		return nil, errBlobStore
+	}
+	return mb.blobs[ref], nil
+}
+
+func TestClaimCheck(t *testing.T) {
+	large := bytes.Repeat([]byte("x"), 100)
+	cases := []struct {
+		name      string
+		payload   []byte
+		store     *mapBlobs
+		noStore   bool
+		publish   error
+		received  error
+		delivered bool
+		stored    int
+	}{
+		{"inline", []byte("small"), newMapBlobs(), false, nil, nil, true, 0},
+		{"claim checked", large, newMapBlobs(), false, nil, nil, true, 1},
+		{"put fails", large, &mapBlobs{blobs: map[string][]byte{}, failPut: true}, false, errBlobStore, nil, false, 0},
+		{"get fails", large, &mapBlobs{blobs: map[string][]byte{}, failGet: true}, false, nil, errBlobStore, false, 1},
+		{"receiver without store", large, newMapBlobs(), true, nil, ErrNoBlobStore, false, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sopts := &Options{BlobStore: c.store}
+			if c.noStore {
+				sopts.BlobStore = nil
+			}
+			client, _, _, scb := pair(t, &Options{Handshake: true, BlobStore: c.store, ClaimCheckThreshold: 50}, sopts)
+			_, err := client.Publish(&Message{Qos: Qos1, Payload: c.payload})
+			if err != c.publish {
+				t.Fatalf("publish %v, want %v", err, c.publish)
+			}
+			if len(c.store.blobs) != c.stored {
+				t.Fatalf("stored %d, want %d", len(c.store.blobs), c.stored)
+			}
+			if err != nil {
+				return
+			}
+			if c.delivered {
+				if msg := scb.next(t); !bytes.Equal(msg.Payload, c.payload) {
+					t.Fatalf("got %d bytes", len(msg.Payload))
+				}
+				return
+			}
+			var cerr *ClaimCheckError
+			if err := <-scb.errs; !errors.As(err, &cerr) || !errors.Is(err, c.received) || cerr.Ref == "" {
+				t.Fatalf("reported %v, want %v", err, c.received)
+			}
+		})
+	}
+}
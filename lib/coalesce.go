@@ -0,0 +1,72 @@
+package gopack
+
+import (
+	"sync"
+	"time"
+)
+
+// coalescer buffers outbound packets so they share writes
+type coalescer struct {
+	buf   []byte
+	since time.Time
+	mux   sync.Mutex
+}
+
+func (c *coalescer) reset() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.buf = c.buf[:0]
+}
+
+// coalesceDelay returns Options.CoalesceDelay as a duration
+func (gopack *GoPack2) coalesceDelay() time.Duration {
+	return time.Duration(gopack.opts.CoalesceDelay) * time.Millisecond
+}
+
+// coalesced returns the age of buffered packets, false if there are none
+func (gopack *GoPack2) coalesced() (time.Duration, bool) {
+	c := &gopack.coalescer
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if len(c.buf) == 0 {
+		return 0, false
+	}
+	return time.Since(c.since), true
+}
+
+// send writes b to the connection, coalesced with neighbouring
+// packets if Options.CoalesceDelay is set
+func (gopack *GoPack2) send(b []byte) (n int, err error) {
+	gopack.capture(CaptureOutbound, b)
+	if gopack.opts.CoalesceDelay <= 0 {
+		return gopack.writeRaw(b)
+	}
+	c := &gopack.coalescer
+	c.mux.Lock()
+	if len(c.buf) == 0 {
+		c.since = time.Now()
+	}
+	c.buf = append(c.buf, b...)
+	full := len(c.buf) >= gopack.opts.CoalesceBytes ||
+		time.Since(c.since) >= gopack.coalesceDelay()
+	c.mux.Unlock()
+	if full {
+		if err = gopack.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// flush writes buffered packets
+func (gopack *GoPack2) flush() error {
+	c := &gopack.coalescer
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if len(c.buf) == 0 {
+		return nil
+	}
+	_, err := gopack.writeRaw(c.buf)
+	c.buf = c.buf[:0]
+	return err
+}
@@ -0,0 +1,63 @@
+package gopack
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recordConn records the size of every write
+type recordConn struct {
+	net.Conn
+	writes []int
+}
+
+func (rc *recordConn) Write(b []byte) (int, error) {
+	rc.writes = append(rc.writes, len(b))
+	return len(b), nil
+}
+
+func (rc *recordConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func TestCoalesce(t *testing.T) {
+	cases := []struct {
+		name    string
+		delay   int
+		bytes   int
+		sends   []int
+		written []int // before the final flush
+		flushed []int
+	}{
+		{"disabled", 0, 0, []int{4, 4, 4}, []int{4, 4, 4}, []int{4, 4, 4}},
+		{"until bytes", 1000, 10, []int{4, 4, 4, 4}, []int{12}, []int{12, 4}},
+		{"large packet", 1000, 10, []int{20, 4}, []int{20}, []int{20, 4}},
+		{"held", 1000, 100, []int{4, 4}, nil, []int{8}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{CoalesceDelay: c.delay, CoalesceBytes: c.bytes})
+			conn := &recordConn{}
+			gopack.conn = conn
+			for _, size := range c.sends {
+				if n, err := gopack.send(make([]byte, size)); err != nil || n != size {
+					t.Fatalf("send %d: %d, %v", size, n, err)
+				}
+			}
+			if !reflect.DeepEqual(conn.writes, c.written) {
+				t.Fatalf("wrote %v, want %v", conn.writes, c.written)
+			}
+			if err := gopack.flush(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(conn.writes, c.flushed) {
+				t.Fatalf("flushed %v, want %v", conn.writes, c.flushed)
+			}
+			if _, ok := gopack.coalesced(); ok {
+				t.Fatal("packets left after flush")
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package gopack
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// ErrNoCodec means that no codec is registered for a content type
+var ErrNoCodec = errors.New("no codec for content type")
+
+// ContentTypeJSON content type of the built-in JSON codec
+const ContentTypeJSON = "application/json"
+
+// Codec converts values to and from payloads of one content type
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// jsonCodec implements Codec with encoding/json
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// codecs registered by content type
+type codecs struct {
+	byType map[string]Codec
+	mux    sync.RWMutex
+}
+
+func newCodecs() *codecs {
+	return &codecs{byType: map[string]Codec{ContentTypeJSON: jsonCodec{}}}
+}
+
+func (c *codecs) get(contentType string) (Codec, bool) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	codec, ok := c.byType[contentType]
+	return codec, ok
+}
+
+// RegisterCodec makes codec handle contentType, JSON is built in
+func (gopack *GoPack2) RegisterCodec(contentType string, codec Codec) {
+	gopack.codecs.mux.Lock()
+	defer gopack.codecs.mux.Unlock()
+	gopack.codecs.byType[contentType] = codec
+}
+
+// PublishValue marshals v with the codec of msg.ContentType into
+// msg.Payload and publishes msg
+func (gopack *GoPack2) PublishValue(msg *Message, v interface{}) (MsgID, error) {
+	codec, ok := gopack.codecs.get(msg.ContentType)
+	if !ok {
+		return 0, ErrNoCodec
+	}
+	payload, err := codec.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	msg.Payload = payload
+	return gopack.Publish(msg)
+}
+
+// Decode unmarshals the payload of a received message into v
+// with the codec of its content type
+func (msg *Message) Decode(v interface{}) error {
+	if msg.gopack == nil {
+		return ErrNotReceived
+	}
+	codec, ok := msg.gopack.codecs.get(msg.ContentType)
+	if !ok {
+		return ErrNoCodec
+	}
+	return codec.Unmarshal(msg.Payload, v)
+}
+
+// SubscribeValue subscribes handler to messages matching filter with
+// their payload decoded into T, messages without a codec for their
+// content type go to Options.CallbackObj as raw bytes and decoding
+// errors are reported to it
+func SubscribeValue[T any](gopack *GoPack2, filter string, handler func(msg *Message, value T)) *Subscription {
+	return gopack.Subscribe(filter, func(msg *Message) {
+		var value T
+		err := msg.Decode(&value)
+		switch {
+		case errors.Is(err, ErrNoCodec):
+			gopack.callback(msg)
+		case err != nil:
+			gopack.invoke(msg.Payload, err)
+		default:
+			handler(msg, value)
+		}
+	})
+}
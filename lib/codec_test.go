@@ -0,0 +1,102 @@
+package gopack
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// textCodec carries strings as their bytes
+type textCodec struct{}
+
+func (textCodec) Marshal(v interface{}) ([]byte, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("not a string: %T", v)
+	}
+	return []byte(s), nil
+}
+
+func (textCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*string) = string(data)
+	return nil
+}
+
+type reading struct {
+	Sensor string
+	Value  int
+}
+
+func TestPublishValue(t *testing.T) {
+	cases := []struct {
+		name        string
+		contentType string
+		value       interface{}
+		err         bool
+	}{
+		{"json", ContentTypeJSON, reading{"t1", 21}, false},
+		{"registered", "text/plain", "hello", false},
+		{"no codec", "application/x-unknown", "hello", true},
+		{"marshal error", ContentTypeJSON, make(chan int), true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{})
+			gopack.RegisterCodec("text/plain", textCodec{})
+			_, err := gopack.PublishValue(&Message{Qos: Qos1, ContentType: c.contentType}, c.value)
+			if (err != nil) != c.err {
+				t.Fatalf("err %v", err)
+			}
+			if c.contentType == "application/x-unknown" && !errors.Is(err, ErrNoCodec) {
+				t.Fatalf("err %v, want ErrNoCodec", err)
+			}
+		})
+	}
+}
+
+func TestSubscribeValue(t *testing.T) {
+	cases := []struct {
+		name        string
+		contentType string
+		payload     string
+		decoded     bool
+		raw         bool
+	}{
+		{"decoded", ContentTypeJSON, `{"Sensor":"t1","Value":21}`, true, false},
+		{"decode error", ContentTypeJSON, `{"Value":"x"}`, false, false},
+		{"no codec", "application/x-unknown", "raw", false, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, _, server, scb := pair(t, &Options{Handshake: true}, &Options{})
+			values := make(chan reading, 1)
+			SubscribeValue(server, "sensors", func(msg *Message, value reading) {
+				values <- value
+			})
+			if _, err := client.Publish(&Message{Qos: Qos1, Topic: "sensors", ContentType: c.contentType, Payload: []byte(c.payload)}); err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case c.decoded:
+				if v := <-values; v != (reading{"t1", 21}) {
+					t.Fatalf("decoded %+v", v)
+				}
+			case c.raw:
+				if msg := scb.next(t); string(msg.Payload) != c.payload {
+					t.Fatalf("callback got %q", msg.Payload)
+				}
+			default:
+				if err := <-scb.errs; err == nil {
+					t.Fatal("decode error not reported")
+				}
+			}
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	var s string
+	if err := new(Message).Decode(&s); err != ErrNotReceived {
+		t.Fatalf("got %v, want ErrNotReceived", err)
+	}
+}
@@ -0,0 +1,65 @@
+package gopack
+
+import "strings"
+
+// incompressible content type prefixes skipped by default
+var incompressible = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zstd",
+	"application/x-7z-compressed",
+	"application/octet-stream+compressed",
+}
+
+// compressible reports whether the payload of packet is worth deflating
+// under Options.Compression, Options.CompressionThreshold
+// and Options.CompressionSkipTypes
+func (gopack *GoPack2) compressible(packet *Packet) bool {
+	if !gopack.opts.Compression || packet.MsgType != MsgTypeSend ||
+		len(packet.Payload) < gopack.opts.CompressionThreshold ||
+		!gopack.capable(CapCompression) {
+		return false
+	}
+	skip := gopack.opts.CompressionSkipTypes
+	if skip == nil {
+		skip = incompressible
+	}
+	for _, prefix := range skip {
+		if strings.HasPrefix(packet.ContentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// compressed returns packet with its payload deflated,
+// packet itself if that does not make it smaller
+func compressed(packet *Packet) *Packet {
+	payload := deflate(packet.Payload)
+	if len(payload) >= len(packet.Payload) {
+		return packet
+	}
+	c := packet.Clone()
+	c.Payload = payload
+	c.Compressed = true
+	c.Pack()
+	return c
+}
+
+// decompress inflates the payload of a received compressed packet
+func (packet *Packet) decompress() error {
+	if !packet.Compressed {
+		return nil
+	}
+	payload, err := inflate(packet.Payload)
+	if err != nil {
+		return err
+	}
+	packet.Payload = payload
+	packet.Compressed = false
+	return nil
+}
@@ -0,0 +1,94 @@
+package gopack
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestCompressible(t *testing.T) {
+	text := bytes.Repeat([]byte("a"), 100)
+	cases := []struct {
+		name   string
+		opts   Options
+		caps   int
+		packet Packet
+		want   bool
+	}{
+		{"disabled", Options{CompressionThreshold: 10}, CapCompression, Packet{MsgType: MsgTypeSend, Payload: text}, false},
+		{"above threshold", Options{Compression: true, CompressionThreshold: 10}, CapCompression, Packet{MsgType: MsgTypeSend, Payload: text}, true},
+		{"below threshold", Options{Compression: true, CompressionThreshold: 101}, CapCompression, Packet{MsgType: MsgTypeSend, Payload: text}, false},
+		{"default threshold", Options{Compression: true}, CapCompression, Packet{MsgType: MsgTypeSend, Payload: text}, false},
+		{"peer without capability", Options{Compression: true, CompressionThreshold: 10}, CapProperties, Packet{MsgType: MsgTypeSend, Payload: text}, false},
+		{"not a send", Options{Compression: true, CompressionThreshold: 10}, CapCompression, Packet{MsgType: MsgTypeAck, Payload: text}, false},
+		{"skipped type", Options{Compression: true, CompressionThreshold: 10}, CapCompression, Packet{MsgType: MsgTypeSend, ContentType: "image/png", Payload: text}, false},
+		{"text type", Options{Compression: true, CompressionThreshold: 10}, CapCompression, Packet{MsgType: MsgTypeSend, ContentType: ContentTypeJSON, Payload: text}, true},
+		{"no skipped types", Options{Compression: true, CompressionThreshold: 10, CompressionSkipTypes: []string{}}, CapCompression, Packet{MsgType: MsgTypeSend, ContentType: "image/png", Payload: text}, true},
+		{"custom skipped types", Options{Compression: true, CompressionThreshold: 10, CompressionSkipTypes: []string{"text/"}}, CapCompression, Packet{MsgType: MsgTypeSend, ContentType: "text/csv", Payload: text}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			opts := c.opts
+			gopack := offline(t, &opts)
+			gopack.setPeerCaps(c.caps)
+			if got := gopack.compressible(&c.packet); got != c.want {
+				t.Fatalf("compressible %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestCompressed(t *testing.T) {
+	noise := make([]byte, 2000)
+	rand.New(rand.NewSource(1)).Read(noise)
+	cases := []struct {
+		name    string
+		payload []byte
+		smaller bool
+	}{
+		{"repetitive", bytes.Repeat([]byte("gopack "), 300), true},
+		{"noise", noise, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			packet := &Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: 1, Payload: c.payload}
+			packet.Pack()
+			sent := compressed(packet)
+			if (sent != packet) != c.smaller || sent.Compressed != c.smaller {
+				t.Fatalf("compressed %v, want %v", sent.Compressed, c.smaller)
+			}
+			decoded, err := Decode(sent.Buffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := decoded.decompress(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded.Payload, c.payload) || packet.Compressed {
+				t.Fatal("payload changed")
+			}
+		})
+	}
+}
+
+func TestCompression(t *testing.T) {
+	payload := bytes.Repeat([]byte("gopack "), 300)
+	cases := []struct {
+		name      string
+		handshake bool
+	}{
+		{"negotiated", true},
+		{"legacy peer", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, _, _, scb := pair(t, &Options{Handshake: c.handshake, Compression: true}, &Options{})
+			if _, err := client.Publish(&Message{Qos: Qos1, Payload: payload}); err != nil {
+				t.Fatal(err)
+			}
+			if msg := scb.next(t); !bytes.Equal(msg.Payload, payload) {
+				t.Fatalf("got %d bytes", len(msg.Payload))
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package gopack
+
+import (
+	"sync"
+	"time"
+)
+
+// congestion adapts the in-flight window AIMD-style: every acknowledged
+// window grows it by one, a retransmission or an inflated round trip
+// halves it at most once per round trip
+type congestion struct {
+	cwnd    float64
+	minRTT  time.Duration
+	srtt    time.Duration
+	lastCut time.Time
+	mux     sync.Mutex
+}
+
+// rttInflation round trips this many times the minimum signal congestion
+const rttInflation = 4
+
+func newCongestion() *congestion {
+	return &congestion{cwnd: 1}
+}
+
+// window returns the current window capped by max
+func (c *congestion) window(max int) int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.cwnd > float64(max) {
+		c.cwnd = float64(max)
+	}
+	return int(c.cwnd)
+}
+
+// acked grows the window on a clean acknowledgment
+func (c *congestion) acked(rtt time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.minRTT == 0 || rtt < c.minRTT {
+		c.minRTT = rtt
+	}
+	if c.srtt == 0 {
+		c.srtt = rtt
+	} else {
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	if rtt > rttInflation*c.minRTT && rtt-c.minRTT > 100*time.Millisecond {
+		c.cut()
+		return
+	}
+	c.cwnd += 1 / c.cwnd
+}
+
+// lost shrinks the window on a retransmission
+func (c *congestion) lost() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.cut()
+}
+
+func (c *congestion) cut() {
+	now := time.Now()
+	if now.Sub(c.lastCut) < c.srtt {
+		return
+	}
+	c.lastCut = now
+	c.cwnd /= 2
+	if c.cwnd < 1 {
+		c.cwnd = 1
+	}
+}
+
+// window returns the number of packets allowed in flight, 0 is unbounded
+func (gopack *GoPack2) window() int {
+	max := gopack.maxInflight()
+	if max <= 0 {
+		return 0
+	}
+	if !gopack.opts.AdaptiveWindow {
+		return max
+	}
+	return gopack.congestion.window(max)
+}
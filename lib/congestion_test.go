@@ -0,0 +1,66 @@
+package gopack
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCongestion(t *testing.T) {
+	acks := func(n int) []time.Duration {
+		rtts := make([]time.Duration, n)
+		for i := range rtts {
+			rtts[i] = 10 * time.Millisecond
+		}
+		return rtts
+	}
+	cases := []struct {
+		name   string
+		rtts   []time.Duration
+		losses int
+		max    int
+		window int
+	}{
+		{"initial", nil, 0, 20, 1},
+		{"additive increase", acks(7), 0, 20, 4},
+		{"capped", acks(50), 0, 3, 3},
+		{"loss halves", acks(7), 1, 20, 2},
+		{"once per round trip", acks(7), 3, 20, 2},
+		{"inflated round trip", append(acks(7), 500*time.Millisecond), 0, 20, 2},
+		{"never below one", nil, 2, 20, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cg := newCongestion()
+			for _, rtt := range c.rtts {
+				cg.acked(rtt)
+			}
+			for i := 0; i < c.losses; i++ {
+				cg.lost()
+			}
+			if window := cg.window(c.max); window != c.window {
+				t.Fatalf("window %d, want %d", window, c.window)
+			}
+		})
+	}
+}
+
+func TestAdaptiveWindow(t *testing.T) {
+	cases := []struct {
+		name     string
+		adaptive bool
+		max      int
+		window   int
+	}{
+		{"fixed", false, 8, 8},
+		{"adaptive", true, 8, 1},
+		{"unbounded", true, -1, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{AdaptiveWindow: c.adaptive, MaxPacketNumber: c.max})
+			if window := gopack.window(); window != c.window {
+				t.Fatalf("window %d, want %d", window, c.window)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package gopack
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"sync"
+)
+
+// ErrOverflow reported with the payload of a received message
+// dropped because the Messages channel was full
+var ErrOverflow = errors.New("message channel overflow")
+
+// OverflowBlock stops reading from the connection while the Messages
+// channel is full
+const OverflowBlock = 0
+
+// OverflowDropNewest drops a received message if the Messages channel is full
+const OverflowDropNewest = 1
+
+// OverflowDropOldest drops the oldest buffered message to make room
+// if the Messages channel is full
+const OverflowDropOldest = 2
+
+// inbox is the channel returned by Messages, created on first use
+type inbox struct {
+	ch   chan *Message
+	once sync.Once
+}
+
+// Messages returns a channel of received messages, once called they
+// are no longer passed to the callback, subscriptions still come first,
+// Options.MessageBuffer sets its capacity and Options.MessageOverflow
+// what happens when it is full
+func (gopack *GoPack2) Messages() <-chan *Message {
+	gopack.inbox.once.Do(func() {
+		ch := make(chan *Message, gopack.opts.MessageBuffer)
+		gopack.muxInbox.Lock()
+		gopack.inbox.ch = ch
+		gopack.muxInbox.Unlock()
+	})
+	return gopack.inbox.ch
+}
+
+// enqueue passes msg to the Messages channel, reports whether it
+// was queued rather than dropped, ok is false if Messages was not called
+func (gopack *GoPack2) enqueue(msg *Message, exitCh chan struct{}) (queued bool, ok bool) {
+	gopack.muxInbox.Lock()
+	ch := gopack.inbox.ch
+	gopack.muxInbox.Unlock()
+	if ch == nil {
+		return false, false
+	}
+	switch gopack.opts.MessageOverflow {
+	case OverflowDropNewest:
+		select {
+		case ch <- msg:
+			return true, true
+		default:
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case ch <- msg:
+				return true, true
+			default:
+			}
+			select {
+			case old := <-ch:
+				old.Done()
+				gopack.invoke(old.Payload, ErrOverflow)
+			default:
+			}
+		}
+	default:
+		select {
+		case ch <- msg:
+			return true, true
+		case <-exitCh:
+		case <-gopack.closeCh:
+		}
+	}
+	gopack.invoke(msg.Payload, ErrOverflow)
+	return false, true
+}
+
+// Receive blocks for the next received message, see Messages,
+// returns ctx.Err() once ctx is done or ErrClosed after Close
+func (gopack *GoPack2) Receive(ctx context.Context) (*Message, error) {
+	ch := gopack.Messages()
+	select {
+	case msg := <-ch:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-gopack.closeCh:
+		return nil, ErrClosed
+	}
+}
+
+// All iterates over received messages until ctx is done or Close,
+// see Receive
+func (gopack *GoPack2) All(ctx context.Context) iter.Seq[*Message] {
+	return func(yield func(*Message) bool) {
+		for {
+			msg, err := gopack.Receive(ctx)
+			if err != nil || !yield(msg) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package gopack
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMessages(t *testing.T) {
+	cases := []struct {
+		name     string
+		overflow int
+		want     []string
+		dropped  int
+	}{
+		{"block", OverflowBlock, []string{"a", "b", "c"}, 0},
+		{"drop newest", OverflowDropNewest, []string{"a"}, 2},
+		{"drop oldest", OverflowDropOldest, []string{"c"}, 2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, _, server, scb := pair(t, &Options{}, &Options{MessageBuffer: 1, MessageOverflow: c.overflow})
+			ch := server.Messages()
+			for _, payload := range []string{"a", "b", "c"} {
+				if _, err := client.Publish(&Message{Qos: Qos1, Payload: []byte(payload)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < c.dropped; i++ {
+				if err := <-scb.errs; !errors.Is(err, ErrOverflow) {
+					t.Fatalf("reported %v", err)
+				}
+			}
+			for _, want := range c.want {
+				if msg := <-ch; string(msg.Payload) != want {
+					t.Fatalf("got %q, want %q", msg.Payload, want)
+				}
+			}
+			select {
+			case msg := <-scb.msgs:
+				t.Fatalf("callback got %q", msg.Payload)
+			default:
+			}
+		})
+	}
+}
+
+func TestReceive(t *testing.T) {
+	cases := []struct {
+		name string
+		send int
+		stop func(cancel context.CancelFunc, gopack *GoPack2)
+		err  error
+	}{
+		{"message", 1, nil, nil},
+		{"canceled", 0, func(cancel context.CancelFunc, _ *GoPack2) { cancel() }, context.Canceled},
+		{"closed", 0, func(_ context.CancelFunc, gopack *GoPack2) { gopack.Close() }, ErrClosed},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, _, server, _ := pair(t, &Options{}, &Options{})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			server.Messages()
+			for i := 0; i < c.send; i++ {
+				if _, err := client.Publish(&Message{Qos: Qos1, Payload: []byte("x")}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if c.stop != nil {
+				time.AfterFunc(10*time.Millisecond, func() { c.stop(cancel, server) })
+			}
+			msg, err := server.Receive(ctx)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("err %v, want %v", err, c.err)
+			}
+			if (msg != nil) != (c.send > 0) {
+				t.Fatalf("message %v", msg)
+			}
+		})
+	}
+}
+
+func TestAll(t *testing.T) {
+	cases := []struct {
+		name  string
+		send  int
+		limit int
+		want  int
+	}{
+		{"break early", 3, 2, 2},
+		{"until canceled", 3, 0, 3},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, _, server, _ := pair(t, &Options{}, &Options{})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			server.Messages()
+			for i := 0; i < c.send; i++ {
+				if _, err := client.Publish(&Message{Qos: Qos1, Payload: []byte{byte(i)}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got := 0
+			for msg := range server.All(ctx) {
+				if msg.Payload[0] != byte(got) {
+					t.Fatalf("got %v at %d", msg.Payload, got)
+				}
+				got++
+				if got == c.limit {
+					break
+				}
+				if got == c.send {
+					cancel()
+				}
+			}
+			if got != c.want {
+				t.Fatalf("iterated %d, want %d", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package gopack
+
+import "sync"
+
+// credits bounds received QoS1/QoS2 messages that are not processed yet,
+// a credit is taken before a QoS1 message is acknowledged or a QoS2
+// message is released and returned once it is processed
+type credits struct {
+	sem  chan struct{}
+	held map[MsgID]bool
+	mux  sync.Mutex
+}
+
+func newCredits(prefetch int) *credits {
+	if prefetch <= 0 {
+		return nil
+	}
+	return &credits{
+		sem:  make(chan struct{}, prefetch),
+		held: make(map[MsgID]bool),
+	}
+}
+
+// acquire takes a credit for packet unless it needs none or holds one,
+// blocks the read loop while none are left, reports whether it took
+// one and false for ok if the connection closed meanwhile
+func (gopack *GoPack2) acquire(packet *Packet) (took bool, ok bool) {
+	c := gopack.credits
+	if c == nil || !((packet.MsgType == MsgTypeSend && packet.Qos == Qos1) ||
+		packet.MsgType == MsgTypeRelease) {
+		return false, true
+	}
+	c.mux.Lock()
+	held := c.held[packet.MsgID]
+	c.mux.Unlock()
+	if held {
+		// retransmission
+		return false, true
+	}
+	select {
+	case c.sem <- struct{}{}:
+	case <-gopack.exitCh:
+		return false, false
+	case <-gopack.closeCh:
+		return false, false
+	}
+	c.mux.Lock()
+	c.held[packet.MsgID] = true
+	c.mux.Unlock()
+	return true, true
+}
+
+// release returns the credit held for id
+func (gopack *GoPack2) release(id MsgID) {
+	c := gopack.credits
+	if c == nil {
+		return
+	}
+	c.mux.Lock()
+	held := c.held[id]
+	delete(c.held, id)
+	c.mux.Unlock()
+	if held {
+		<-c.sem
+	}
+}
+
+// credited sets msg.done to return the credit of id once
+func (gopack *GoPack2) credited(msg *Message, id MsgID) {
+	if gopack.credits == nil {
+		return
+	}
+	var once sync.Once
+	msg.done = func() {
+		once.Do(func() { gopack.release(id) })
+	}
+}
+
+// Done marks a message taken from Messages, Receive or All as processed
+// and returns its Options.Prefetch credit, messages passed to handlers
+// are done once the handler returns
+func (msg *Message) Done() {
+	if msg.done != nil {
+		msg.done()
+	}
+}
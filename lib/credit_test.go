@@ -0,0 +1,53 @@
+package gopack
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPrefetch(t *testing.T) {
+	cases := []struct {
+		name     string
+		prefetch int
+		qos      byte
+		held     int
+	}{
+		{"unbounded", 0, Qos1, 4},
+		{"qos0 needs no credit", 2, Qos0, 4},
+		{"qos1", 2, Qos1, 2},
+		{"qos2", 2, Qos2, 2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, _, server, _ := pair(t, &Options{}, &Options{Prefetch: c.prefetch})
+			ch := server.Messages()
+			for i := 0; i < 4; i++ {
+				if _, err := client.Publish(&Message{Qos: c.qos, Payload: []byte{byte(i)}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var got []*Message
+			for len(got) < c.held {
+				got = append(got, <-ch)
+			}
+			select {
+			case msg := <-ch:
+				t.Fatalf("got %v past the prefetch", msg.Payload)
+			case <-time.After(100 * time.Millisecond):
+			}
+			for _, msg := range got {
+				msg.Done()
+			}
+			for len(got) < 4 {
+				msg := <-ch
+				msg.Done()
+				got = append(got, msg)
+			}
+			for i, msg := range got {
+				if msg.Payload[0] != byte(i) {
+					t.Fatalf("got %v at %d", msg.Payload, i)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package gopack
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// HeaderDedupKey header carrying Message.DedupKey
+const HeaderDedupKey = "dedup-key"
+
+// dedupCache remembers recently delivered dedup keys,
+// bounded by size and age, oldest first
+type dedupCache struct {
+	keys   map[string]*list.Element
+	order  *list.List
+	size   int
+	maxAge time.Duration
+	mux    sync.Mutex
+}
+
+type dedupEntry struct {
+	key string
+	at  time.Time
+}
+
+func newDedupCache(size int, maxAge time.Duration) *dedupCache {
+	if size <= 0 {
+		return nil
+	}
+	return &dedupCache{
+		keys:   make(map[string]*list.Element),
+		order:  list.New(),
+		size:   size,
+		maxAge: maxAge,
+	}
+}
+
+// seen records key and reports whether it was recorded before
+func (dc *dedupCache) seen(key string) bool {
+	dc.mux.Lock()
+	defer dc.mux.Unlock()
+	now := time.Now()
+	dc.prune(now)
+	if _, ok := dc.keys[key]; ok {
+		return true
+	}
+	dc.keys[key] = dc.order.PushBack(dedupEntry{key, now})
+	if dc.order.Len() > dc.size {
+		e := dc.order.Front()
+		dc.order.Remove(e)
+		delete(dc.keys, e.Value.(dedupEntry).key)
+	}
+	return false
+}
+
+// contains reports whether key was recorded and has not aged out
+func (dc *dedupCache) contains(key string) bool {
+	dc.mux.Lock()
+	defer dc.mux.Unlock()
+	dc.prune(time.Now())
+	_, ok := dc.keys[key]
+	return ok
+}
+
+// prune forgets keys older than maxAge, dc.mux must be held
+func (dc *dedupCache) prune(now time.Time) {
+	for e := dc.order.Front(); e != nil; e = dc.order.Front() {
+		entry := e.Value.(dedupEntry)
+		if dc.order.Len() <= dc.size && (dc.maxAge <= 0 || now.Sub(entry.at) < dc.maxAge) {
+			break
+		}
+		dc.order.Remove(e)
+		delete(dc.keys, entry.key)
+	}
+}
+
+// duplicate reports whether msg carries a dedup key delivered before
+func (gopack *GoPack2) duplicate(msg *Message) bool {
+	if gopack.dedup == nil || msg.DedupKey == "" {
+		return false
+	}
+	return gopack.dedup.seen(msg.DedupKey)
+}
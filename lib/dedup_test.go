@@ -0,0 +1,69 @@
+package gopack
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedupCache(t *testing.T) {
+	type step struct {
+		key   string
+		after time.Duration
+		seen  bool
+	}
+	cases := []struct {
+		name   string
+		size   int
+		maxAge time.Duration
+		steps  []step
+	}{
+		{"repeat", 4, 0, []step{{"a", 0, false}, {"b", 0, false}, {"a", 0, true}}},
+		{"evicted by size", 2, 0, []step{{"a", 0, false}, {"b", 0, false}, {"c", 0, false}, {"a", 0, false}, {"c", 0, true}}},
+		{"expired", 4, 20 * time.Millisecond, []step{{"a", 0, false}, {"a", 0, true}, {"a", 40 * time.Millisecond, false}}},
+		{"kept until evicted", 4, 0, []step{{"a", 0, false}, {"a", 40 * time.Millisecond, true}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dc := newDedupCache(c.size, c.maxAge)
+			for i, s := range c.steps {
+				time.Sleep(s.after)
+				if got := dc.seen(s.key); got != s.seen {
+					t.Fatalf("step %d %q seen %v, want %v", i, s.key, got, s.seen)
+				}
+			}
+		})
+	}
+}
+
+func TestDedup(t *testing.T) {
+	cases := []struct {
+		name string
+		size int
+		keys []string
+		want []string
+	}{
+		{"disabled", 0, []string{"k", "k"}, []string{"0", "1"}},
+		{"duplicate dropped", 8, []string{"k", "k", "j"}, []string{"0", "2"}},
+		{"no key", 8, []string{"", ""}, []string{"0", "1"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, _, _, scb := pair(t, &Options{Handshake: true}, &Options{DedupCacheSize: c.size})
+			for i, key := range c.keys {
+				if _, err := client.Publish(&Message{Qos: Qos1, DedupKey: key, Payload: []byte{'0' + byte(i)}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, want := range c.want {
+				if msg := scb.next(t); string(msg.Payload) != want {
+					t.Fatalf("got %q, want %q", msg.Payload, want)
+				}
+			}
+			select {
+			case msg := <-scb.msgs:
+				t.Fatalf("duplicate %q delivered", msg.Payload)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package gopack
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// DispatchSerial delivers received messages one at a time
+// on the read loop, in order of arrival
+const DispatchSerial = 0
+
+// DispatchPerTopic delivers messages of the same topic one at a time
+// in order, different topics concurrently
+const DispatchPerTopic = 1
+
+// DispatchConcurrent delivers messages concurrently without ordering
+const DispatchConcurrent = 2
+
+// dispatchQueueLength jobs buffered per worker queue
+const dispatchQueueLength = 64
+
+// workers runs delivery jobs off the read loop,
+// per topic mode has one queue per worker, concurrent mode one shared queue
+type workers struct {
+	queues  []chan func()
+	workers int
+	once    sync.Once
+	closeCh chan struct{}
+}
+
+func newWorkers(mode, count int, closeCh chan struct{}) *workers {
+	if mode == DispatchSerial {
+		return nil
+	}
+	queues := 1
+	if mode == DispatchPerTopic {
+		queues = count
+	}
+	w := &workers{
+		queues:  make([]chan func(), queues),
+		workers: count,
+		closeCh: closeCh,
+	}
+	for i := range w.queues {
+		w.queues[i] = make(chan func(), dispatchQueueLength)
+	}
+	return w
+}
+
+// start launches the workers on first use
+func (w *workers) start() {
+	w.once.Do(func() {
+		for i := 0; i < w.workers; i++ {
+			go w.run(w.queues[i%len(w.queues)])
+		}
+	})
+}
+
+func (w *workers) run(queue chan func()) {
+	for {
+		select {
+		case job := <-queue:
+			job()
+		case <-w.closeCh:
+			return
+		}
+	}
+}
+
+// submit queues job on the worker for key, blocks while it is full,
+// reports false after Close
+func (w *workers) submit(key string, job func()) bool {
+	w.start()
+	queue := w.queues[0]
+	if len(w.queues) > 1 {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		queue = w.queues[h.Sum32()%uint32(len(w.queues))]
+	}
+	select {
+	case queue <- job:
+		return true
+	case <-w.closeCh:
+		return false
+	}
+}
@@ -0,0 +1,62 @@
+package gopack
+
+import (
+	"testing"
+	"time"
+)
+
+// gateCallback holds messages with the payload "slow" until gate is closed
+type gateCallback struct {
+	*testCallback
+	gate chan struct{}
+}
+
+func (gc *gateCallback) InvokeMessage(msg *Message) {
+	if string(msg.Payload) == "slow" {
+		<-gc.gate
+	}
+	gc.testCallback.InvokeMessage(msg)
+}
+
+func TestDispatch(t *testing.T) {
+	cases := []struct {
+		name      string
+		mode      int
+		topic     string
+		overtakes bool
+	}{
+		{"serial", DispatchSerial, "b", false},
+		{"per topic same topic", DispatchPerTopic, "a", false},
+		{"per topic other topic", DispatchPerTopic, "b", true},
+		{"concurrent", DispatchConcurrent, "a", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cb := &gateCallback{testCallback: newTestCallback(), gate: make(chan struct{})}
+			gopack := offline(t, &Options{CallbackObj: cb, DispatchMode: c.mode})
+			defer gopack.Close()
+			go func() {
+				gopack.deliver(&Packet{MsgType: MsgTypeSend, Topic: "a", Payload: []byte("slow")})
+				gopack.deliver(&Packet{MsgType: MsgTypeSend, Topic: c.topic, Payload: []byte("fast")})
+			}()
+			want := []string{"slow", "fast"}
+			select {
+			case msg := <-cb.msgs:
+				if !c.overtakes || string(msg.Payload) != "fast" {
+					t.Fatalf("got %q while blocked", msg.Payload)
+				}
+				want = want[:1]
+			case <-time.After(100 * time.Millisecond):
+				if c.overtakes {
+					t.Fatal("blocked by the slow message")
+				}
+			}
+			close(cb.gate)
+			for _, payload := range want {
+				if msg := cb.next(t); string(msg.Payload) != payload {
+					t.Fatalf("got %q, want %q", msg.Payload, payload)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package gopack
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// addSeeds adds the raw packet streams in testdata/seeds to the corpus of f,
+// the first byte of a seed also selects Options.Resync in FuzzStreamReader
+func addSeeds(f *testing.F) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "seeds", "*"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+}
+
+// FuzzDecode decodes data as a packet and checks that packing
+// it again decodes to the same fields
+func FuzzDecode(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packet, err := Decode(data)
+		if err != nil {
+			return
+		}
+		packet.Pack()
+		again, err := Decode(packet.Buffer)
+		if err != nil {
+			t.Fatalf("packed packet does not decode: %v", err)
+		}
+		if !sameFields(packet, again) {
+			t.Fatalf("round trip mismatch: %+v != %+v", packet, again)
+		}
+	})
+}
+
+// FuzzStreamReader reads data as a byte stream of packets,
+// the first byte enables Options.Resync
+func FuzzStreamReader(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) == 0 {
+			return
+		}
+		gopack := fuzzGoPack(t, &Options{Resync: data[0]&1 != 0}, data[1:])
+		for {
+			if _, err := gopack.readPacket(); err != nil {
+				break
+			}
+		}
+	})
+}
+
+// FuzzHandle feeds the packets read from data into the protocol state
+// machine backed by memory storage, replies are discarded
+func FuzzHandle(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		gopack := fuzzGoPack(t, &Options{}, data)
+		for {
+			packet, err := gopack.readPacket()
+			if err != nil {
+				break
+			}
+			gopack.handle(packet)
+		}
+		close(gopack.exitCh)
+	})
+}
+
+// fuzzConn discards everything written to it
+type fuzzConn struct {
+	net.Conn
+}
+
+func (fuzzConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (fuzzConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (fuzzConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// fuzzGoPack returns a connected GoPack2 reading input,
+// closed when the test ends
+func fuzzGoPack(t *testing.T, opts *Options, input []byte) *GoPack2 {
+	opts.CallbackObj = fuzzCallback{}
+	gopack, err := NewGoPack(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(gopack.Close)
+	gopack.conn = fuzzConn{}
+	gopack.reader = bufio.NewReaderSize(bytes.NewReader(input), gopack.readBufferSize())
+	gopack.readBuf = make([]byte, gopack.readBufferSize())
+	gopack.exitCh = make(chan struct{})
+	gopack.errCh = make(chan error, 1)
+	gopack.inflight = make(map[MsgID]inflightPacket)
+	gopack.channelInflight = make(map[int]int)
+	gopack.resetHandshake()
+	gopack.setConnected(true)
+	return gopack
+}
+
+// fuzzCallback drops messages and errors
+type fuzzCallback struct{}
+
+func (fuzzCallback) Invoke([]byte, error) {}
+
+// sameFields reports whether the decoded fields of a and b match
+func sameFields(a, b *Packet) bool {
+	return a.MsgType == b.MsgType && a.Qos == b.Qos && a.Dup == b.Dup &&
+		a.MsgID == b.MsgID && a.Channel == b.Channel &&
+		a.Capabilities == b.Capabilities && a.CommitTime == b.CommitTime &&
+		a.CorrelationID == b.CorrelationID && a.Topic == b.Topic &&
+		a.ReplyTo == b.ReplyTo && a.ContentType == b.ContentType &&
+		a.Compressed == b.Compressed && a.ProducerID == b.ProducerID &&
+		a.ClientID == b.ClientID && a.Parameters == b.Parameters &&
+		a.TraceParent == b.TraceParent &&
+		// the epoch is only carried along with a producer id
+		(a.ProducerID == "" || a.ProducerEpoch == b.ProducerEpoch) &&
+		a.StreamID == b.StreamID && (a.StreamID == 0 ||
+		a.FragmentIndex == b.FragmentIndex && a.LastFragment == b.LastFragment) &&
+		reflect.DeepEqual(a.Headers, b.Headers) &&
+		bytes.Equal(a.Payload, b.Payload)
+}
@@ -1,35 +1,281 @@
 package gopack
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // ErrMissingParams missing parameters error
 var ErrMissingParams = errors.New("missing parameters")
 
+// ErrIdleTimeout no packets exchanged within Options.IdleTimeout
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// ErrAckTimeout oldest unacknowledged packet exceeds Options.AckTimeout
+var ErrAckTimeout = errors.New("acknowledgment timeout")
+
+// ErrQueueFull outbound queue limits reached and nothing can be evicted
+var ErrQueueFull = errors.New("queue full")
+
+// ErrEvicted reported with the payload of a message evicted from a full queue
+var ErrEvicted = errors.New("message evicted")
+
+// ErrPurged returned to waiters of a message dropped by Purge or PurgeBefore
+var ErrPurged = errors.New("message purged")
+
+// EvictReject rejects new messages when the outbound queue is full
+const EvictReject = 0
+
+// EvictOldestQos0 drops the oldest QoS0 message when the outbound queue is full
+const EvictOldestQos0 = 1
+
+// EvictLowestPriority drops the oldest message of the lowest priority
+// when the outbound queue is full
+const EvictLowestPriority = 2
+
+// ErrInvalidQos message QoS is not Qos0, Qos1 or Qos2
+var ErrInvalidQos = errors.New("invalid qos")
+
+// ErrInvalidChannel message channel does not fit in 16 bits on the wire
+var ErrInvalidChannel = errors.New("invalid channel")
+
+// ErrPayloadTooLarge packet exceeds Options.MaxPacketSize
+// or the 16-bit remaining length of the protocol
+var ErrPayloadTooLarge = errors.New("payload too large")
+
+// ErrNoFreeID every MsgID is taken by a message awaiting
+// acknowledgment, requeue or its turn in the queue
+var ErrNoFreeID = errors.New("no free message id")
+
+// ErrClosed means that GoPack2 was closed or is draining
+var ErrClosed = errors.New("closed")
+
+// ErrReceiveExpired reported with the payload of a received QoS2 message
+// dropped because its release did not arrive within Options.ReceiveRetention
+var ErrReceiveExpired = errors.New("unreleased message expired")
+
+// DeadLetterError reports a message that exhausted Options.MaxRetries
+// or was refused by the peer with a NACK reason,
+// it is passed to the callback together with the message payload
+type DeadLetterError struct {
+	MsgID  MsgID
+	Reason byte // NACK reason, 0 when retries are exhausted
+}
+
+func (e *DeadLetterError) Error() string {
+	if e.Reason != 0 {
+		return fmt.Sprintf("message %d refused by peer, reason %d", e.MsgID, e.Reason)
+	}
+	return fmt.Sprintf("message %d exhausted retries", e.MsgID)
+}
+
+// PacketError wraps an error reading or writing a packet with its
+// context, MsgType and MsgID are zero if no packet header was read
+type PacketError struct {
+	Op      string // "read" or "write"
+	MsgType byte
+	MsgID   MsgID
+	Remote  string
+	Err     error
+}
+
+func (e *PacketError) Error() string {
+	if e.MsgType == 0 {
+		return fmt.Sprintf("%s %s: %v", e.Op, e.Remote, e.Err)
+	}
+	return fmt.Sprintf("%s %s: packet type %d id %d: %v",
+		e.Op, e.Remote, e.MsgType, e.MsgID, e.Err)
+}
+
+func (e *PacketError) Unwrap() error {
+	return e.Err
+}
+
+// packetError wraps err with the packet context, nil if err is nil
+func (gopack *GoPack2) packetError(op string, msgType byte, msgID MsgID, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PacketError{Op: op, MsgType: msgType, MsgID: msgID, Remote: gopack.remote(), Err: err}
+}
+
 // GoPack2 GoPack2 main class
 // naming GoPack2 instead of GoPack to compatible with gomobile bind
 type GoPack2 struct {
 	opts      *Options
-	conn      *net.TCPConn
+	conn      net.Conn
+	reader    *bufio.Reader
 	errCh     chan error
 	exitCh    chan struct{}
 	waitGroup sync.WaitGroup
+
+	lastActive int64 // unix nano of the latest packet read or written
+	lastWrite  int64 // unix nano of the latest write
+
+	// packets awaiting acknowledgment on the current connection
+	inflight        map[MsgID]inflightPacket
+	channelInflight map[int]int
+	muxInflight     sync.Mutex
+
+	// new packets held back while the window is full or sending
+	// is paused, and their ids, guarded by muxInflight
+	parked    []*Packet
+	parkedIDs map[MsgID]int
+	paused    int32
+	// wakes the writer when a packet is committed or a window slot frees
+	wakeCh chan struct{}
+
+	// reused for inbound control packets, owned by the read loop
+	inbound Packet
+	readBuf []byte
+
+	settings      *settings
+	certs         *certReloader
+	limiter       *limiter
+	coalescer     coalescer
+	congestion    *congestion
+	writeThrottle *throttle
+	readThrottle  *throttle
+
+	// messages that exhausted retries, keyed by MsgID
+	deadLetters    map[MsgID]*Packet
+	muxDeadLetters sync.Mutex
+
+	muxCommit sync.Mutex
+	connected bool   // guarded by muxCommit
+	peer      string // remote address, guarded by muxCommit
+	closing   bool   // commits are refused, guarded by muxCommit
+	closeCh   chan struct{}
+	closeOnce sync.Once
+	spool     *spool
+	recovery  SpoolRecovery
+
+	// store is the active storage, old is being drained after a switch,
+	// inStore holds received QoS2 messages
+	store      OutboundStore
+	old        OutboundStore
+	inStore    InboundStore
+	muxStorage sync.RWMutex
+
+	// held for reading while a packet is sent or handled,
+	// held for writing to pause both loops
+	muxLoop sync.RWMutex
+
+	// capabilities advertised by the peer on the current connection
+	// and the identity it connected with
+	peerCaps  int32
+	peerInfo  atomic.Value // *ConnectInfo
+	connackCh chan struct{}
+	connacked sync.Once
+
+	stats         *stats
+	confirmed     *confirmLog
+	calls         *calls
+	subscriptions *subscriptions
+	interceptors  interceptors
+	inbox         inbox
+	muxInbox      sync.Mutex
+	credits       *credits
+	workers       *workers
+	dedup         *dedupCache
+	producers     *producers
+	codecs        *codecs
+	recorder      *recorder
+
+	pendingAcks    []MsgID
+	muxPendingAcks sync.Mutex
+
+	// QoS2 messages received by the peer and awaiting completion
+	receipts    map[MsgID]receipt
+	muxReceipts sync.Mutex
+
+	// fragmented payloads
+	streamID  uint32
+	streams   *streams
+	awaits    map[MsgID]chan error
+	muxAwaits sync.Mutex
+}
+
+// inflightPacket tracks a transmitted packet awaiting acknowledgment
+type inflightPacket struct {
+	sentAt  int64
+	channel int
+	retried bool
 }
 
 // StorageInterface storage class implementation
 type StorageInterface interface {
-	UniqueID() int
+	OutboundStore
+	InboundStore
+}
+
+// OutboundStore holds messages and protocol replies
+// until they are sent and acknowledged, a saved packet belongs to the
+// storage and is not changed until Unconfirmed, Confirm or Evict hand it back
+type OutboundStore interface {
+	UniqueID() MsgID
 	Save(*Packet)
 	Unconfirmed() *Packet
-	Confirm(int) *Packet
-	Receive(int, []byte)
-	Release(int) []byte
+	Confirm(MsgID) *Packet
+}
+
+// PurgeableStorage may be implemented by a storage to drop messages
+// committed before a unix nano time, for Purge and PurgeBefore
+type PurgeableStorage interface {
+	Purge(int64) []MsgID
+}
+
+// CancellableStorage may be implemented by a storage to drop a message
+// that has not been transmitted yet, for Cancel
+type CancellableStorage interface {
+	Cancel(MsgID) bool
+}
+
+// PendingStorage may be implemented by a storage to report the number
+// and payload bytes of unconfirmed messages cheaply, otherwise they are
+// counted from Queued or taken as zero
+type PendingStorage interface {
+	Pending() (int, int)
+}
+
+// EvictableStorage may be implemented by a storage to drop a message
+// chosen by Options.EvictionPolicy when the queue is full
+type EvictableStorage interface {
+	Evict(int) *Packet
+}
+
+// ListableStorage may be implemented by a storage to list the packets
+// it holds, for CopyStorage, PendingPackets and Stats, Queued returns
+// copies taken under the storage lock that the caller may read and keep
+type ListableStorage interface {
+	Queued() []*Packet
+}
+
+// InboundStore holds received QoS2 messages until they are released
+type InboundStore interface {
+	Receive(MsgID, *Packet)
+	Release(MsgID) *Packet
+	Unreleased() []*Packet
+	Expire(int64) []*Packet
+}
+
+// TransactionalStorage may be implemented by a storage to apply
+// each QoS2 state transition and its reply in a single step,
+// so a crash cannot leave one without the other
+type TransactionalStorage interface {
+	ReceiveAndSave(id MsgID, packet *Packet, reply *Packet)
+	ConfirmAndSave(id MsgID, reply *Packet) *Packet
+	ReleaseAndSave(id MsgID, reply *Packet) *Packet
 }
 
 // GoCallback be used to receive callback
@@ -37,13 +283,314 @@ type GoCallback interface {
 	Invoke([]byte, error)
 }
 
+// GoMessageCallback may be implemented by Options.CallbackObj
+// to receive messages together with their metadata,
+// Invoke is still used to report errors
+type GoMessageCallback interface {
+	InvokeMessage(*Message)
+}
+
+// Message is a message with its metadata
+type Message struct {
+	MsgID   MsgID
+	Qos     byte
+	Dup     bool // set on delivered messages that were retransmitted
+	Channel int  // 0 to 0xffff
+	Payload []byte
+
+	// CorrelationID matches responses to requests
+	CorrelationID string
+
+	// Topic routes the message to subscriptions, see Subscribe
+	Topic string
+
+	// ReplyTo topic on which the sender expects replies, see Message.Reply
+	ReplyTo string
+
+	// Origin Options.Address of the connection a message was received on,
+	// Peer its remote address, ClientID the id the peer connected with
+	Origin   string
+	Peer     string
+	ClientID string
+
+	// Headers application metadata carried along with the payload
+	Headers map[string]string
+
+	// ContentType of the payload, see RegisterCodec
+	ContentType string
+
+	// TraceParent W3C traceparent of the trace the message belongs to,
+	// set from the context of PublishContext and Call, see Message.Context
+	TraceParent string
+
+	// DedupKey identifies a message to the receiver's dedup cache,
+	// carried in the HeaderDedupKey header, see Options.DedupCacheSize
+	DedupKey string
+
+	// CommitTime of a delivered message as reported by the sender,
+	// zero unless the sender enables Options.SendTimestamp
+	CommitTime time.Time
+
+	// NotBefore delays the first transmission of an outbound message,
+	// zero value sends as soon as possible
+	NotBefore time.Time
+
+	// Priority of an outbound message, higher is sent first
+	Priority byte
+
+	// returns the prefetch credit of a received message
+	done func()
+
+	// receiver of the message, nil for outbound ones
+	gopack *GoPack2
+}
+
 // Options GoPack2 create options
 type Options struct {
 	Address         string
 	CallbackObj     GoCallback
-	MaxPacketNumber int
-	Storage         StorageInterface
-	Heartbeat       int
+	MaxPacketNumber int           // window of unacknowledged QoS1/QoS2 packets, negative is unbounded
+	AdaptiveWindow  bool          // grow and shrink the window within MaxPacketNumber on congestion
+	Storage         OutboundStore // also holds received messages if it is an InboundStore
+	Heartbeat       int           // milliseconds of write silence before a PING, see ErrKeepaliveTimeout
+
+	// TCP socket tuning, applied after dial
+	KeepAlive   int  // keepalive period in milliseconds, 0 is system default, negative disables
+	Nagle       bool // enable Nagle's algorithm (TCP_NODELAY off)
+	ReadBuffer  int  // socket receive buffer size in bytes, 0 is system default
+	WriteBuffer int  // socket send buffer size in bytes, 0 is system default
+
+	// IdleTimeout closes and re-dials the connection if no packets
+	// have been exchanged for this many milliseconds, 0 disables
+	IdleTimeout int
+
+	// AckTimeout closes and re-dials the connection if the oldest
+	// unacknowledged QoS>0 packet is older than this many milliseconds,
+	// 0 disables
+	AckTimeout int
+
+	// WriteTimeout fails the connection if a single write takes longer
+	// than this many milliseconds, default 10000, negative disables
+	WriteTimeout int
+
+	// ChannelWindow maximum unacknowledged QoS>0 packets per channel,
+	// 0 is unlimited
+	ChannelWindow int
+
+	// MaxRetries retransmissions of a QoS>0 message before it is
+	// dead-lettered, 0 retries forever
+	MaxRetries int
+
+	// RetryInterval milliseconds before a retransmission, multiplied
+	// by the number of retransmissions so far, default 5000
+	RetryInterval int
+
+	// outbound queue limits, 0 is unlimited
+	MaxQueueLength int // unconfirmed messages
+	MaxQueueBytes  int // unconfirmed message payload bytes
+	EvictionPolicy int // EvictReject, EvictOldestQos0 or EvictLowestPriority
+
+	// Schedule how the default storage orders due packets,
+	// ScheduleDueTime or ScheduleByQos
+	Schedule int
+	// RetryRatio new messages sent for every retransmission while
+	// both are due in the default storage, defaults to 1
+	RetryRatio int
+	// Qos0Watermark unconfirmed QoS1 and QoS2 messages at which
+	// QoS0 messages wait, 0 disables
+	Qos0Watermark int
+
+	// ReadyPending unconfirmed messages above which Ready fails, 0 disables
+	ReadyPending int
+
+	// SpoolPath file that holds messages committed while disconnected,
+	// they are sent once the connection is established, empty disables
+	SpoolPath     string
+	MaxSpoolBytes int // defaults to 64 MiB
+
+	// SpoolSync durability of spooled messages, SyncNone, SyncAlways,
+	// SyncOnConfirm or SyncInterval with SpoolSyncInterval milliseconds,
+	// default 1000
+	SpoolSync         int
+	SpoolSyncInterval int
+
+	// SpoolCompactRatio share of the spool held by cancelled messages,
+	// default 0.5, that triggers a rewrite once it is at least
+	// SpoolCompactBytes, default 1 MiB
+	SpoolCompactRatio float64
+	SpoolCompactBytes int
+
+	// SpoolCompression deflates spooled messages, independent of
+	// compression on the wire
+	SpoolCompression bool
+
+	// ReceiveRetention milliseconds a received QoS2 message is kept
+	// waiting for its release, defaults to 10 minutes, negative keeps forever
+	ReceiveRetention int
+
+	// StreamTimeout milliseconds an incomplete inbound stream waits for
+	// its next fragment before it is dropped with ErrStreamTimeout,
+	// defaults to 1 minute, negative waits forever
+	StreamTimeout int
+
+	// MaxStreamSize maximum size in bytes of an inbound stream reassembled
+	// in memory, larger streams are dropped with ErrStreamTooLarge,
+	// defaults to 64 MiB, negative is unlimited, streams read through a
+	// GoStreamCallback are not held in memory and not limited
+	MaxStreamSize int
+
+	// MaxPacketSize maximum size in bytes of packets sent or received,
+	// 0 is the protocol maximum
+	MaxPacketSize int
+
+	// Handshake exchanges capabilities in a CONNECT/CONNACK round trip
+	// before sending, optional features are only used when both peers
+	// advertise them, peers not answering within HandshakeTimeout
+	// milliseconds (default 2000) are spoken to with the base protocol
+	Handshake        bool
+	HandshakeTimeout int
+
+	// SendTimestamp attaches the commit time to outbound messages
+	// so receivers can measure delivery latency
+	SendTimestamp bool
+
+	// ConfirmRetention milliseconds the default storage remembers
+	// confirmed MsgIDs so they are not reassigned while late
+	// duplicates may still arrive, 0 forgets them at once
+	ConfirmRetention int
+
+	// InboundStorage holds received QoS2 messages, defaults to Storage
+	// if it is an InboundStore, otherwise to memory
+	InboundStorage InboundStore
+
+	// Checkpoints records progress of CommitStreamResumable,
+	// defaults to memory
+	Checkpoints CheckpointStore
+
+	// BatchAcks collects QoS1 acknowledgments and sends them as ranges
+	// in a single ACK packet ahead of the next outbound packet
+	BatchAcks bool
+
+	// RateLimit and ByteRateLimit cap outbound messages and bytes
+	// per second, 0 is unlimited, see SetRateLimit, acknowledgments
+	// and other protocol replies are not held back
+	RateLimit     int
+	ByteRateLimit int
+
+	// WriteBandwidth and ReadBandwidth cap raw connection traffic
+	// in bytes per second, 0 is unlimited
+	WriteBandwidth int
+	ReadBandwidth  int
+
+	// CoalesceDelay holds outbound packets for up to this many milliseconds
+	// or until CoalesceBytes are buffered, then writes them together,
+	// 0 writes every packet immediately
+	CoalesceDelay int
+	CoalesceBytes int
+
+	// TLSConfig enables TLS, CertFile and KeyFile name a client
+	// certificate that is read again for new connections once the
+	// files change, or TLSConfig.GetClientCertificate supplies one
+	TLSConfig *tls.Config
+	CertFile  string
+	KeyFile   string
+
+	// Prefetch received QoS1/QoS2 messages that may be unprocessed at
+	// a time, the next one is not read and so not acknowledged until
+	// one is done, see Message.Done, meanwhile acknowledgments of sent
+	// messages are not read either, 0 is unlimited
+	Prefetch int
+
+	// ProducerID identifies this sender across restarts in the handshake,
+	// ProducerEpoch its incarnation, default the creation time in unix nano,
+	// receivers drop connections of incarnations older than one they saw
+	ProducerID    string
+	ProducerEpoch int64
+
+	// ClientID identifies this peer in the handshake independently of its
+	// address, ConnectProperties are sent along, see Options.Authenticate
+	ClientID          string
+	ConnectProperties map[string]string
+
+	// AssignParameters are sent to peers that connect,
+	// which adopt them in place of their own options
+	AssignParameters Parameters
+
+	// MaxQos highest QoS this side handles, advertised in the handshake,
+	// messages above the level both peers handle fail with
+	// ErrQosUnsupported, or with QosDowngrade are committed at that
+	// level and reported as ErrQosDowngraded, defaults to Qos2,
+	// negative is Qos0
+	MaxQos       int
+	QosDowngrade bool
+
+	// OnDelivered is called when the peer acknowledges a QoS1 message
+	// or completes a QoS2 one, with its transmissions and the time since
+	// commit, on the reading goroutine
+	OnDelivered func(msgID MsgID, qos byte, attempts int, latency time.Duration)
+
+	// OnStage is called as outbound QoS1 and QoS2 messages advance
+	// through the protocol, on the writing goroutine for StageSent and
+	// StageReleased, on the reading goroutine otherwise
+	OnStage func(msgID MsgID, qos byte, stage Stage)
+
+	// TraceParent extracts the W3C traceparent of outbound messages from
+	// the context of PublishContext and Call, default TraceParentFromContext
+	TraceParent func(ctx context.Context) string
+
+	// Authenticate is called with the identity of a peer that connects,
+	// an error drops its connection with ErrConnectRejected
+	Authenticate func(info *ConnectInfo) error
+
+	// DedupCacheSize received dedup keys remembered to drop messages
+	// committed again with the same Message.DedupKey, for up to DedupTTL
+	// milliseconds, 0 disables, a TTL of 0 keeps keys until evicted
+	DedupCacheSize int
+	DedupTTL       int
+
+	// DispatchMode DispatchSerial, DispatchPerTopic or DispatchConcurrent,
+	// DispatchWorkers goroutines delivering messages in the latter two,
+	// default 8
+	DispatchMode    int
+	DispatchWorkers int
+
+	// MessageBuffer capacity of the Messages channel, default 64,
+	// MessageOverflow OverflowBlock, OverflowDropNewest or OverflowDropOldest
+	MessageBuffer   int
+	MessageOverflow int
+
+	// Validator checks received messages before they are acknowledged,
+	// a message it returns an error for is refused with NackRejected
+	// and reported as ValidationError instead of delivered,
+	// receive interceptors have not run yet
+	Validator func(msg *Message) error
+
+	// BlobStore holds payloads above ClaimCheckThreshold bytes, only
+	// a reference is sent and the receiver fetches the payload from
+	// its BlobStore before delivery, nil disables
+	BlobStore           BlobStore
+	ClaimCheckThreshold int
+
+	// Compression deflates payloads of at least CompressionThreshold
+	// bytes on the wire if the peer supports it, except for content types
+	// starting with one of CompressionSkipTypes, default images, audio,
+	// video and common archive formats
+	Compression          bool
+	CompressionThreshold int
+	CompressionSkipTypes []string
+
+	// Capture records every frame read or written with a timestamp,
+	// see CaptureReader and Replay
+	Capture io.Writer
+
+	// HeaderHook is called with every outbound message right before
+	// its first transmission and may add to packet.Headers,
+	// headers that make the packet too large are discarded
+	HeaderHook func(packet *Packet)
+
+	// Resync skips bytes until a plausible packet header is found
+	// when a packet fails to decode, instead of dropping the connection
+	Resync bool
 }
 
 // NewGoPack creates and initializes a new GoPack2 using opts
@@ -58,32 +605,522 @@ func NewGoPack(opts *Options) (gopack *GoPack2, err error) {
 	if opts.Heartbeat == 0 {
 		opts.Heartbeat = 1000
 	}
+	if opts.WriteTimeout == 0 {
+		opts.WriteTimeout = 10000
+	}
+	if opts.RetryInterval == 0 {
+		opts.RetryInterval = 5000
+	}
+	if opts.MaxQos == 0 || opts.MaxQos > Qos2 {
+		opts.MaxQos = Qos2
+	} else if opts.MaxQos < 0 {
+		opts.MaxQos = Qos0
+	}
 	if opts.Storage == nil {
-		opts.Storage = newMemoryStorage()
+		ms := newMemoryStorage()
+		ms.retention = time.Duration(opts.ConfirmRetention) * time.Millisecond
+		ms.schedule = opts.Schedule
+		if opts.RetryRatio > 0 {
+			ms.retryRatio = opts.RetryRatio
+		}
+		opts.Storage = ms
+	}
+	if opts.InboundStorage == nil {
+		if inbound, ok := opts.Storage.(InboundStore); ok {
+			opts.InboundStorage = inbound
+		} else {
+			opts.InboundStorage = newMemoryStorage()
+		}
+	}
+	if opts.Checkpoints == nil {
+		opts.Checkpoints = newMemoryCheckpoints()
+	}
+	if opts.ProducerID != "" && opts.ProducerEpoch == 0 {
+		opts.ProducerEpoch = time.Now().UnixNano()
+	}
+	if opts.DispatchWorkers == 0 {
+		opts.DispatchWorkers = 8
+	}
+	if opts.Compression && opts.CompressionThreshold == 0 {
+		opts.CompressionThreshold = 1 << 10
+	}
+	if opts.MessageBuffer == 0 {
+		opts.MessageBuffer = 64
+	}
+	if opts.HandshakeTimeout == 0 {
+		opts.HandshakeTimeout = 2000
+	}
+	if opts.ReceiveRetention == 0 {
+		opts.ReceiveRetention = 10 * 60 * 1000
+	}
+	if opts.StreamTimeout == 0 {
+		opts.StreamTimeout = 60 * 1000
+	}
+	if opts.MaxStreamSize == 0 {
+		opts.MaxStreamSize = 64 << 20
+	}
+	if opts.CoalesceDelay > 0 && opts.CoalesceBytes == 0 {
+		opts.CoalesceBytes = 16 << 10
+	}
+	if opts.SpoolPath != "" && opts.MaxSpoolBytes == 0 {
+		opts.MaxSpoolBytes = 64 << 20
+	}
+	if opts.SpoolSync == SyncInterval && opts.SpoolSyncInterval == 0 {
+		opts.SpoolSyncInterval = 1000
+	}
+	if opts.SpoolCompactRatio == 0 {
+		opts.SpoolCompactRatio = 0.5
+	}
+	if opts.SpoolCompactBytes == 0 {
+		opts.SpoolCompactBytes = 1 << 20
+	}
+	gopack = &GoPack2{
+		opts:          opts,
+		deadLetters:   make(map[MsgID]*Packet),
+		store:         opts.Storage,
+		inStore:       opts.InboundStorage,
+		stats:         newStats(),
+		confirmed:     newConfirmLog(),
+		calls:         newCalls(),
+		subscriptions: newSubscriptions(),
+		credits:       newCredits(opts.Prefetch),
+		producers:     newProducers(),
+		codecs:        newCodecs(),
+		recorder:      newRecorder(opts.Capture),
+		dedup:         newDedupCache(opts.DedupCacheSize, time.Duration(opts.DedupTTL)*time.Millisecond),
+		streamID:      randomUint32(),
+		streams:       newStreams(),
+		awaits:        make(map[MsgID]chan error),
+		parkedIDs:     make(map[MsgID]int),
+		receipts:      make(map[MsgID]receipt),
+		wakeCh:        make(chan struct{}, 1),
+		closeCh:       make(chan struct{}),
+		settings:      newSettings(opts),
+		limiter:       newLimiter(opts.RateLimit, opts.ByteRateLimit),
+		congestion:    newCongestion(),
+		writeThrottle: newThrottle(opts.WriteBandwidth),
+		readThrottle:  newThrottle(opts.ReadBandwidth),
+	}
+	gopack.workers = newWorkers(opts.DispatchMode, opts.DispatchWorkers, gopack.closeCh)
+	if opts.CertFile != "" {
+		gopack.certs = newCertReloader(opts.CertFile, opts.KeyFile)
+		if _, err = gopack.certs.load(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.SpoolPath != "" {
+		gopack.spool, err = openSpool(opts)
+		if err != nil {
+			return nil, err
+		}
+		// ids spooled by a previous process may collide with new ones,
+		// rewriting also drops damaged records and a truncated tail
+		err = gopack.spool.Rewrite(func(packet *Packet) *Packet {
+			packet.MsgID = opts.Storage.UniqueID()
+			packet.Pack()
+			return packet
+		})
+		if err != nil {
+			return nil, err
+		}
+		gopack.recovery = gopack.spool.recovery
 	}
-	gopack = &GoPack2{opts: opts}
 	return gopack, nil
 }
 
 func (gopack *GoPack2) cbErr(err error) {
-	gopack.opts.CallbackObj.Invoke(nil, err)
+	gopack.invoke(nil, err)
+}
+
+// tune applies socket options to conn
+func (gopack *GoPack2) tune(conn *net.TCPConn) (err error) {
+	if gopack.opts.KeepAlive > 0 {
+		if err = conn.SetKeepAlive(true); err != nil {
+			return err
+		}
+		err = conn.SetKeepAlivePeriod(
+			time.Duration(gopack.opts.KeepAlive) * time.Millisecond)
+		if err != nil {
+			return err
+		}
+	} else if gopack.opts.KeepAlive < 0 {
+		if err = conn.SetKeepAlive(false); err != nil {
+			return err
+		}
+	}
+	if err = conn.SetNoDelay(!gopack.opts.Nagle); err != nil {
+		return err
+	}
+	if gopack.opts.ReadBuffer > 0 {
+		if err = conn.SetReadBuffer(gopack.opts.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if gopack.opts.WriteBuffer > 0 {
+		if err = conn.SetWriteBuffer(gopack.opts.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fail reports err to the connection loop without blocking
+func (gopack *GoPack2) fail(err error) {
+	select {
+	case gopack.errCh <- err:
+	default:
+	}
+}
+
+// touch records packet activity on the connection
+func (gopack *GoPack2) touch() {
+	atomic.StoreInt64(&gopack.lastActive, time.Now().UnixNano())
+}
+
+// idle returns how long the connection has been silent
+func (gopack *GoPack2) idle() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&gopack.lastActive))
+}
+
+// sent records first transmission of packets expecting acknowledgment
+func (gopack *GoPack2) sent(packet *Packet) {
+	if !(packet.MsgType == MsgTypeSend && packet.Qos > Qos0) &&
+		packet.MsgType != MsgTypeRelease {
+		return
+	}
+	gopack.muxInflight.Lock()
+	defer gopack.muxInflight.Unlock()
+	if p, ok := gopack.inflight[packet.MsgID]; !ok {
+		gopack.inflight[packet.MsgID] = inflightPacket{
+			sentAt:  time.Now().UnixNano(),
+			channel: packet.Channel,
+			retried: packet.Dup,
+		}
+		gopack.channelInflight[packet.Channel]++
+	} else if packet.MsgType == MsgTypeSend {
+		p.retried = true
+		gopack.inflight[packet.MsgID] = p
+		gopack.congestion.lost()
+	}
+}
+
+// acked forgets acknowledged packet
+func (gopack *GoPack2) acked(id MsgID) {
+	gopack.done(id, nil)
+	gopack.forget(id, true)
+}
+
+// dropped forgets packet id that will not be acknowledged,
+// its waiters get err
+func (gopack *GoPack2) dropped(id MsgID, err error) {
+	gopack.done(id, err)
+	gopack.forget(id, false)
+}
+
+// forget removes packet id from the inflight window,
+// an acknowledgment also samples its round trip
+func (gopack *GoPack2) forget(id MsgID, ack bool) {
+	gopack.muxInflight.Lock()
+	defer gopack.muxInflight.Unlock()
+	if p, ok := gopack.inflight[id]; ok {
+		if ack {
+			rtt := time.Duration(time.Now().UnixNano() - p.sentAt)
+			gopack.stats.acknowledged(rtt)
+			if !p.retried {
+				gopack.congestion.acked(rtt)
+			}
+		}
+		delete(gopack.inflight, id)
+		gopack.channelInflight[p.channel]--
+		if gopack.channelInflight[p.channel] <= 0 {
+			delete(gopack.channelInflight, p.channel)
+		}
+		gopack.wake()
+	}
+}
+
+// wake interrupts the writer's idle wait
+func (gopack *GoPack2) wake() {
+	select {
+	case gopack.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// windowFull reports whether packet must wait for a free window slot
+func (gopack *GoPack2) windowFull(packet *Packet) bool {
+	window := gopack.window()
+	if window <= 0 ||
+		packet.MsgType != MsgTypeSend || packet.Qos == Qos0 {
+		return false
+	}
+	gopack.muxInflight.Lock()
+	defer gopack.muxInflight.Unlock()
+	if _, ok := gopack.inflight[packet.MsgID]; ok {
+		return false
+	}
+	return len(gopack.inflight) >= window
+}
+
+// park holds packet back until the window has room
+func (gopack *GoPack2) park(packet *Packet) {
+	gopack.muxInflight.Lock()
+	defer gopack.muxInflight.Unlock()
+	gopack.parked = append(gopack.parked, packet)
+	gopack.parkedIDs[packet.MsgID]++
+}
+
+// unparked forgets one parked packet with id, muxInflight must be held
+func (gopack *GoPack2) unparked(id MsgID) {
+	if gopack.parkedIDs[id]--; gopack.parkedIDs[id] <= 0 {
+		delete(gopack.parkedIDs, id)
+	}
+}
+
+// unpark returns the oldest parked packet once the window has room
+func (gopack *GoPack2) unpark() *Packet {
+	if gopack.Paused() {
+		return nil
+	}
+	window := gopack.window()
+	gopack.muxInflight.Lock()
+	defer gopack.muxInflight.Unlock()
+	if len(gopack.parked) == 0 ||
+		(window > 0 && len(gopack.inflight) >= window) {
+		return nil
+	}
+	packet := gopack.parked[0]
+	gopack.parked[0] = nil
+	gopack.parked = gopack.parked[1:]
+	gopack.unparked(packet.MsgID)
+	return packet
+}
+
+// Pause holds back outbound messages until Resume,
+// commits are still queued and acknowledgments still sent
+func (gopack *GoPack2) Pause() {
+	atomic.StoreInt32(&gopack.paused, 1)
+}
+
+// Resume continues sending after Pause
+func (gopack *GoPack2) Resume() {
+	atomic.StoreInt32(&gopack.paused, 0)
+	gopack.wake()
+}
+
+// Paused reports whether sending is paused
+func (gopack *GoPack2) Paused() bool {
+	return atomic.LoadInt32(&gopack.paused) != 0
+}
+
+// restoreParked moves parked packets back into storage
+func (gopack *GoPack2) restoreParked() {
+	gopack.muxInflight.Lock()
+	parked := gopack.parked
+	gopack.parked = nil
+	gopack.parkedIDs = make(map[MsgID]int)
+	gopack.muxInflight.Unlock()
+	for _, packet := range parked {
+		gopack.storage().Save(packet)
+	}
+}
+
+// dropParked removes parked packets matching fn, returns their ids
+func (gopack *GoPack2) dropParked(fn func(*Packet) bool) (ids []MsgID) {
+	gopack.muxInflight.Lock()
+	defer gopack.muxInflight.Unlock()
+	kept := gopack.parked[:0]
+	for _, packet := range gopack.parked {
+		if fn(packet) {
+			ids = append(ids, packet.MsgID)
+			gopack.unparked(packet.MsgID)
+		} else {
+			kept = append(kept, packet)
+		}
+	}
+	for i := len(kept); i < len(gopack.parked); i++ {
+		gopack.parked[i] = nil
+	}
+	gopack.parked = kept
+	return ids
+}
+
+// blocked reports whether packet must wait for its channel window
+func (gopack *GoPack2) blocked(packet *Packet) bool {
+	if gopack.opts.ChannelWindow <= 0 ||
+		packet.MsgType != MsgTypeSend || packet.Qos == Qos0 {
+		return false
+	}
+	gopack.muxInflight.Lock()
+	defer gopack.muxInflight.Unlock()
+	if _, ok := gopack.inflight[packet.MsgID]; ok {
+		// retransmission
+		return false
+	}
+	return gopack.channelInflight[packet.Channel] >= gopack.opts.ChannelWindow
+}
+
+// ackSilence returns the age of the oldest unacknowledged packet
+func (gopack *GoPack2) ackSilence() time.Duration {
+	gopack.muxInflight.Lock()
+	defer gopack.muxInflight.Unlock()
+	now := time.Now().UnixNano()
+	var oldest int64
+	for _, p := range gopack.inflight {
+		if now-p.sentAt > oldest {
+			oldest = now - p.sentAt
+		}
+	}
+	return time.Duration(oldest)
+}
+
+// expire drops received QoS2 messages whose release never came
+func (gopack *GoPack2) expire() {
+	if gopack.opts.ReceiveRetention < 0 {
+		return
+	}
+	before := time.Now().Add(
+		-time.Duration(gopack.opts.ReceiveRetention) * time.Millisecond).UnixNano()
+	expired := gopack.inboundStore().Expire(before)
+	for _, packet := range expired {
+		gopack.invoke(packet.Payload, ErrReceiveExpired)
+	}
+}
+
+// watch checks connection liveness periodically
+func (gopack *GoPack2) watch() {
+	defer gopack.waitGroup.Done()
+	idleTimeout := time.Duration(gopack.opts.IdleTimeout) * time.Millisecond
+	ackTimeout := time.Duration(gopack.opts.AckTimeout) * time.Millisecond
+	interval := time.Second
+	if idleTimeout > 0 && idleTimeout/2 < interval {
+		interval = idleTimeout / 2
+	}
+	if ackTimeout > 0 && ackTimeout/2 < interval {
+		interval = ackTimeout / 2
+	}
+	if heartbeat := gopack.heartbeat(); heartbeat/2 < interval {
+		interval = heartbeat / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-gopack.exitCh:
+			return
+		case <-ticker.C:
+			if idleTimeout > 0 && gopack.idle() > idleTimeout {
+				gopack.fail(ErrIdleTimeout)
+				return
+			}
+			if ackTimeout > 0 && gopack.ackSilence() > ackTimeout {
+				gopack.fail(ErrAckTimeout)
+				return
+			}
+			if err := gopack.ping(); err != nil {
+				gopack.fail(err)
+				return
+			}
+			gopack.expire()
+			gopack.expireStreams()
+		}
+	}
 }
 
 func (gopack *GoPack2) readPacket() (packet *Packet, err error) {
-	buffer := make([]byte, 5)
-	_, err = io.ReadFull(gopack.conn, buffer)
-	if err != nil {
-		return nil, err
+	for {
+		header, err := gopack.reader.Peek(5)
+		if err != nil {
+			return nil, gopack.packetError("read", 0, 0, err)
+		}
+		msgType, msgID := header[0]>>4, MsgID(binary.BigEndian.Uint16(header[1:]))
+		remainingLength := int(binary.BigEndian.Uint16(header[3:]))
+		if gopack.opts.Resync && !gopack.plausible(header) {
+			gopack.reader.Discard(1)
+			continue
+		}
+		if gopack.opts.MaxPacketSize > 0 &&
+			5+remainingLength > gopack.opts.MaxPacketSize {
+			return nil, gopack.packetError("read", msgType, msgID, ErrPayloadTooLarge)
+		}
+		buffer, err := gopack.reader.Peek(5 + remainingLength)
+		if err != nil {
+			return nil, gopack.packetError("read", msgType, msgID, err)
+		}
+		var view []byte
+		if msgType == MsgTypeSend {
+			// delivered packets are retained by storage and callbacks
+			packet = new(Packet)
+			view = append([]byte(nil), buffer...)
+		} else {
+			packet = &gopack.inbound
+			view = gopack.readBuf[:copy(gopack.readBuf, buffer)]
+		}
+		err = DecodeInto(packet, view)
+		if err == nil {
+			err = packet.decompress()
+		}
+		if err != nil {
+			if gopack.opts.Resync {
+				gopack.reader.Discard(1)
+				continue
+			}
+			if errors.Is(err, ErrDecodeType) {
+				// framing is intact, nobody to answer
+				gopack.capture(CaptureInbound, buffer)
+				gopack.reader.Discard(len(buffer))
+				gopack.stats.malformed()
+				continue
+			}
+			if msgType != MsgTypeSend {
+				return nil, gopack.packetError("read", msgType, msgID, err)
+			}
+			// framing is intact, refuse the message and go on
+			gopack.capture(CaptureInbound, buffer)
+			gopack.reader.Discard(len(buffer))
+			gopack.stats.malformed()
+			if !gopack.nack(msgID, NackDecode) {
+				return nil, gopack.packetError("read", msgType, msgID, err)
+			}
+			continue
+		}
+		gopack.capture(CaptureInbound, buffer)
+		gopack.reader.Discard(len(buffer))
+		return packet, nil
 	}
-	num := buffer[3:]
-	remainingLength := binary.BigEndian.Uint16(num)
-	payload := make([]byte, remainingLength)
-	_, err = io.ReadFull(gopack.conn, payload)
-	if err != nil {
-		return nil, err
+}
+
+// readBufferSize returns the size of per-connection read buffers,
+// large enough for the biggest acceptable packet
+func (gopack *GoPack2) readBufferSize() int {
+	if gopack.opts.MaxPacketSize > 0 && gopack.opts.MaxPacketSize < 5+MaxRemainingLength {
+		return gopack.opts.MaxPacketSize
+	}
+	return 5 + MaxRemainingLength
+}
+
+// plausible reports whether header may start a packet
+func (gopack *GoPack2) plausible(header []byte) bool {
+	msgType := header[0] >> 4
+	qos := (header[0] & 0xf) >> 2
+	remainingLength := int(binary.BigEndian.Uint16(header[3:]))
+	if msgType < MsgTypeSend || msgType > MsgTypePong || qos > Qos2 {
+		return false
+	}
+	if gopack.opts.MaxPacketSize > 0 && 5+remainingLength > gopack.opts.MaxPacketSize {
+		return false
+	}
+	if msgType == MsgTypeNack {
+		return remainingLength == 1
+	}
+	if msgType == MsgTypeAck && header[0]&FlagProperties == 0 {
+		return remainingLength%4 == 0
+	}
+	if msgType != MsgTypeSend {
+		// control packets carry no payload
+		return header[0]&FlagProperties != 0 || remainingLength == 0
 	}
-	buffer = append(buffer, payload...)
-	return Decode(buffer)
+	return true
 }
 
 func (gopack *GoPack2) read() {
@@ -95,92 +1132,778 @@ func (gopack *GoPack2) read() {
 		default:
 			packet, err := gopack.readPacket()
 			if err != nil {
-				gopack.errCh <- err
+				gopack.fail(err)
 				return
 			}
+			gopack.touch()
+			gopack.stats.received()
 			gopack.handle(packet)
 		}
 	}
 }
 
-func (gopack *GoPack2) retry(packet *Packet) (retryPacket *Packet) {
+// retry returns a copy of a sent packet scheduled for its next
+// transmission, nil if it is not retransmitted, the copy shares the
+// payload and, once it carries the DUP bit, the buffer of packet
+func (gopack *GoPack2) retry(packet *Packet) *Packet {
 	if packet.Qos == Qos0 {
 		return nil
 	}
-	if packet.RetryTimes > 0 {
-		retryPacket = packet.Clone()
-		retryPacket.RetryTimes++
-		retryPacket.Timestamp = time.Now().Add(
-			time.Duration(5*retryPacket.RetryTimes) * time.Second).Unix()
-	} else {
-		retryPacket = Encode(packet.MsgType, packet.Qos, 1, packet.MsgID, packet.Payload)
-		retryPacket.RetryTimes = 1
-		retryPacket.Timestamp = time.Now().Add(
-			time.Duration(5*retryPacket.RetryTimes) * time.Second).Unix()
+	next := packet.Clone()
+	if !next.Dup {
+		// every retransmission carries the DUP bit, the first
+		// transmission still writes the original buffer
+		next.Dup = true
+		next.Buffer = append([]byte(nil), next.Buffer...)
+		next.Buffer[0] |= FlagDup
 	}
-	return retryPacket
+	next.RetryTimes++
+	next.Timestamp = time.Now().Add(
+		time.Duration(next.RetryTimes) * gopack.retryInterval()).Unix()
+	return next
+}
+
+// exhausted reports whether packet used up its retransmissions
+func (gopack *GoPack2) exhausted(packet *Packet) bool {
+	return gopack.maxRetries() > 0 &&
+		packet.MsgType == MsgTypeSend &&
+		packet.RetryTimes > gopack.maxRetries()
+}
+
+// deadLetter moves packet out of the outbound queue,
+// reason is the NACK reason or 0 when retries are exhausted
+func (gopack *GoPack2) deadLetter(packet *Packet, reason byte) {
+	gopack.dropped(packet.MsgID, &DeadLetterError{MsgID: packet.MsgID, Reason: reason})
+	gopack.muxDeadLetters.Lock()
+	gopack.deadLetters[packet.MsgID] = packet
+	gopack.muxDeadLetters.Unlock()
 }
 
 func (gopack *GoPack2) write() {
 	defer gopack.waitGroup.Done()
+	if gopack.opts.Handshake {
+		if err := gopack.handshake(); err != nil {
+			gopack.fail(err)
+			return
+		}
+	}
 	for {
 		select {
 		case <-gopack.exitCh:
 			return
 		default:
-			packet := gopack.opts.Storage.Unconfirmed()
-			if packet == nil {
-				time.Sleep(time.Duration(gopack.opts.Heartbeat) * time.Millisecond)
-				continue
-			}
-			retryPacket := gopack.retry(packet)
-			if retryPacket != nil {
-				gopack.opts.Storage.Save(retryPacket)
+			sent, dead, err := gopack.writeNext()
+			if dead != nil {
+				gopack.invoke(dead.Payload, &DeadLetterError{MsgID: dead.MsgID})
 			}
-			_, err := gopack.conn.Write(packet.Buffer)
 			if err != nil {
-				gopack.errCh <- err
+				gopack.fail(err)
 				return
 			}
+			if !sent {
+				timeout := gopack.idleWait()
+				if debt := gopack.limiter.delay(); debt > timeout {
+					// messages wait for the rate limit, replies wake the writer
+					timeout = debt
+					if timeout > retryPoll {
+						timeout = retryPoll
+					}
+				}
+				if age, ok := gopack.coalesced(); ok {
+					if remain := gopack.coalesceDelay() - age; remain > 0 && remain < timeout {
+						timeout = remain
+					} else if remain <= 0 {
+						if err = gopack.flush(); err != nil {
+							gopack.fail(gopack.packetError("write", 0, 0, err))
+							return
+						}
+						continue
+					}
+				}
+				select {
+				case <-gopack.exitCh:
+					return
+				case <-gopack.wakeCh:
+				case <-time.After(timeout):
+				}
+			}
 		}
 	}
 }
 
+// writeNext sends the next due packet, reports whether there was one
+// and returns it if it was dead-lettered instead
+func (gopack *GoPack2) writeNext() (sent bool, dead *Packet, err error) {
+	gopack.muxLoop.RLock()
+	defer gopack.muxLoop.RUnlock()
+	if err = gopack.flushAcks(); err != nil {
+		return true, nil, err
+	}
+	var store OutboundStore
+	packet := gopack.unpark()
+	if packet != nil {
+		store = gopack.storage()
+	} else {
+		store, packet = gopack.unconfirmed()
+	}
+	if packet == nil {
+		return false, nil, nil
+	}
+	if packet.MsgType == MsgTypeSend && gopack.limiter.delay() > 0 {
+		// only messages are paced, acknowledgments and the other
+		// protocol replies go out so the peer does not retransmit
+		store.Save(packet)
+		return false, nil, nil
+	}
+	if gopack.blocked(packet) || gopack.held(packet) {
+		// let other channels and reliable messages go ahead
+		packet.Timestamp = time.Now().Add(retryPoll).Unix()
+		store.Save(packet)
+		return true, nil, nil
+	}
+	if gopack.windowFull(packet) ||
+		(packet.MsgType == MsgTypeSend && gopack.Paused()) {
+		// keep retransmissions and acks flowing
+		gopack.park(packet)
+		return true, nil, nil
+	}
+	if gopack.exhausted(packet) {
+		gopack.deadLetter(packet, 0)
+		return true, packet, nil
+	}
+	if packet.MsgType == MsgTypeSend && packet.RetryTimes == 0 {
+		gopack.injectHeaders(packet)
+	}
+	b := gopack.wire(packet)
+	msgType, qos, id := packet.MsgType, packet.Qos, packet.MsgID
+	stage := StageSent
+	if msgType == MsgTypeRelease {
+		stage = StageReleased
+	}
+	retransmission := packet.RetryTimes > 0
+	size := len(packet.Buffer)
+	// track and reschedule the packet before it is written, the peer may
+	// acknowledge it before the write returns and must find it in storage
+	gopack.sent(packet)
+	if next := gopack.retry(packet); next != nil {
+		store.Save(next)
+	}
+	_, err = gopack.send(b)
+	err = gopack.packetError("write", msgType, id, err)
+	if err == nil {
+		gopack.touch()
+		gopack.stats.sent()
+		if retransmission {
+			gopack.stats.retransmitted()
+		}
+		if msgType == MsgTypeSend {
+			gopack.limiter.sent(size)
+		}
+		if msgType == MsgTypeSend && qos == Qos0 {
+			gopack.done(id, nil)
+		}
+		gopack.stage(msgType, qos, id, stage)
+	}
+	return true, nil, err
+}
+
+// injectHeaders lets Options.HeaderHook add headers to packet
+func (gopack *GoPack2) injectHeaders(packet *Packet) {
+	if gopack.opts.HeaderHook == nil {
+		return
+	}
+	headers := make(map[string]string, len(packet.Headers))
+	for key, value := range packet.Headers {
+		headers[key] = value
+	}
+	original := packet.Headers
+	packet.Headers = headers
+	gopack.protect(func() {
+		gopack.opts.HeaderHook(packet)
+	})
+	packet.Pack()
+	if packet.RemainingLength > MaxRemainingLength ||
+		(gopack.sendLimit() > 0 && packet.TotalLength > gopack.sendLimit()) {
+		packet.Headers = original
+		packet.Pack()
+		gopack.cbErr(ErrPayloadTooLarge)
+	}
+}
+
+// deliver passes received packet to the callback
+func (gopack *GoPack2) deliver(packet *Packet) {
+	kept := false
+	gopack.protect(func() {
+		kept = gopack.interceptors.receive(packet)
+	})
+	if !kept {
+		gopack.release(packet.MsgID)
+		return
+	}
+	if packet.CommitTime != 0 {
+		gopack.stats.delivered(time.Since(time.Unix(0, packet.CommitTime)))
+	}
+	msg := gopack.message(packet)
+	if packet.StreamID != 0 {
+		gopack.feed(packet, msg)
+		gopack.release(packet.MsgID)
+		return
+	}
+	if gopack.duplicate(msg) || !gopack.checkOut(msg) {
+		gopack.release(packet.MsgID)
+		return
+	}
+	gopack.credited(msg, packet.MsgID)
+	if gopack.workers == nil {
+		if !gopack.dispatch(msg, gopack.exitCh) {
+			msg.Done()
+		}
+		return
+	}
+	// workers outlive the connection, so they never give up on the channel
+	submitted := gopack.workers.submit(msg.Topic, func() {
+		if !gopack.dispatch(msg, nil) {
+			msg.Done()
+		}
+	})
+	if !submitted {
+		msg.Done()
+	}
+}
+
+// message returns the Message of a received packet
+func (gopack *GoPack2) message(packet *Packet) *Message {
+	var commitTime time.Time
+	if packet.CommitTime != 0 {
+		commitTime = time.Unix(0, packet.CommitTime)
+	}
+	return &Message{
+		MsgID:         packet.MsgID,
+		Qos:           packet.Qos,
+		Dup:           packet.Dup,
+		Channel:       packet.Channel,
+		Payload:       packet.Payload,
+		CorrelationID: packet.CorrelationID,
+		Topic:         packet.Topic,
+		ReplyTo:       packet.ReplyTo,
+		Origin:        gopack.opts.Address,
+		Peer:          gopack.remote(),
+		ClientID:      gopack.peerClientID(),
+		Headers:       packet.Headers,
+		DedupKey:      packet.Headers[HeaderDedupKey],
+		ContentType:   packet.ContentType,
+		TraceParent:   packet.TraceParent,
+		CommitTime:    commitTime,
+		gopack:        gopack,
+	}
+}
+
+// dispatch passes a complete message to matching subscriptions,
+// if there are none to the Messages channel or the callback,
+// reports whether it was queued on the Messages channel,
+// a full channel is given up on once exitCh is closed
+func (gopack *GoPack2) dispatch(msg *Message, exitCh chan struct{}) bool {
+	if msg.CorrelationID != "" && gopack.calls.resolve(msg) {
+		return false
+	}
+	if gopack.subscriptions.dispatch(msg, gopack.protect) {
+		return false
+	}
+	if queued, ok := gopack.enqueue(msg, exitCh); ok {
+		return queued
+	}
+	gopack.callback(msg)
+	return false
+}
+
+// callback passes msg to Options.CallbackObj
+func (gopack *GoPack2) callback(msg *Message) {
+	if cb, ok := gopack.opts.CallbackObj.(GoMessageCallback); ok {
+		gopack.protect(func() {
+			cb.InvokeMessage(msg)
+		})
+		return
+	}
+	gopack.invoke(msg.Payload, nil)
+}
+
 func (gopack *GoPack2) handle(packet *Packet) {
+	took, ok := gopack.acquire(packet)
+	if !ok {
+		return
+	}
+	if !gopack.valid(packet) || !gopack.streamable(packet) {
+		if took {
+			gopack.release(packet.MsgID)
+		}
+		gopack.wake()
+		return
+	}
+	delivery, dead := gopack.process(packet)
+	if took && delivery == nil {
+		// duplicate release
+		gopack.release(packet.MsgID)
+	}
+	// send queued replies without waiting for the next tick
+	gopack.wake()
+	if dead != nil {
+		gopack.invoke(dead.Payload,
+			&DeadLetterError{MsgID: dead.MsgID, Reason: packet.Payload[0]})
+	}
+	if delivery != nil {
+		gopack.deliver(delivery)
+	}
+}
+
+// ack acknowledges QoS1 message id
+func (gopack *GoPack2) ack(id MsgID) {
+	if gopack.opts.BatchAcks && gopack.capable(CapBatchAck) {
+		gopack.muxPendingAcks.Lock()
+		gopack.pendingAcks = append(gopack.pendingAcks, id)
+		gopack.muxPendingAcks.Unlock()
+	} else {
+		reply := Encode(MsgTypeAck, Qos0, 0, id, nil)
+		gopack.storage().Save(reply)
+	}
+}
+
+// flushAcks sends collected acknowledgments in one packet
+func (gopack *GoPack2) flushAcks() error {
+	gopack.muxPendingAcks.Lock()
+	ids := gopack.pendingAcks
+	gopack.pendingAcks = nil
+	gopack.muxPendingAcks.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := gopack.send(EncodeAckRanges(ids).Buffer)
+	return gopack.packetError("write", MsgTypeAck, ids[0], err)
+}
+
+// nack refuses message id with reason, reports false
+// if the peer does not understand NACK
+func (gopack *GoPack2) nack(id MsgID, reason byte) bool {
+	if !gopack.capable(CapNack) {
+		return false
+	}
+	reply := Encode(MsgTypeNack, Qos0, 0, id, []byte{reason})
+	gopack.storage().Save(reply)
+	return true
+}
+
+// refused handles a NACK of message id, returns the message
+// if it was dead-lettered
+func (gopack *GoPack2) refused(id MsgID, reason byte) (dead *Packet) {
+	gopack.forget(id, false)
+	packet := gopack.storage().Confirm(id)
+	if packet == nil {
+		if old := gopack.draining(); old != nil {
+			packet = old.Confirm(id)
+		}
+	}
+	if packet == nil || packet.MsgType != MsgTypeSend {
+		return nil
+	}
+	packet.Confirm = false
+	// the stored packet counts its transmissions, a retransmission
+	// the peer cannot decode either will not get better
+	if reason == NackQuota || (reason == NackDecode && packet.RetryTimes <= 1) {
+		packet.Timestamp = time.Now().Add(
+			time.Duration(packet.RetryTimes) * gopack.retryInterval()).Unix()
+		gopack.storage().Save(packet)
+		return nil
+	}
+	gopack.deadLetter(packet, reason)
+	return packet
+}
+
+// process advances protocol state by packet,
+// returns the packet to deliver and the one dead-lettered if any
+func (gopack *GoPack2) process(packet *Packet) (delivery *Packet, dead *Packet) {
+	gopack.muxLoop.RLock()
+	defer gopack.muxLoop.RUnlock()
 	if packet.MsgType == MsgTypeSend {
 		if packet.Qos == Qos0 {
-			gopack.opts.CallbackObj.Invoke(packet.Payload, nil)
+			return packet, nil
 		} else if packet.Qos == Qos1 {
-			reply := Encode(MsgTypeAck, Qos0, 0, packet.MsgID, nil)
-			gopack.opts.Storage.Save(reply)
-			gopack.opts.CallbackObj.Invoke(packet.Payload, nil)
+			gopack.ack(packet.MsgID)
+			return packet, nil
 		} else if packet.Qos == Qos2 {
-			gopack.opts.Storage.Receive(packet.MsgID, packet.Payload)
 			reply := Encode(MsgTypeReceived, Qos0, 0, packet.MsgID, nil)
-			gopack.opts.Storage.Save(reply)
+			gopack.receiveAndSave(packet.MsgID, packet, reply)
 		}
 	} else if packet.MsgType == MsgTypeAck {
-		gopack.opts.Storage.Confirm(packet.MsgID)
+		for _, id := range AckRanges(packet) {
+			gopack.acked(id)
+			gopack.settle(id)
+		}
 	} else if packet.MsgType == MsgTypeReceived {
-		gopack.opts.Storage.Confirm(packet.MsgID)
+		gopack.acked(packet.MsgID)
 		reply := Encode(MsgTypeRelease, Qos1, 0, packet.MsgID, nil)
-		gopack.opts.Storage.Save(reply)
-	} else if packet.MsgType == MsgTypeRelease {
-		payload := gopack.opts.Storage.Release(packet.MsgID)
-		if payload != nil {
-			gopack.opts.CallbackObj.Invoke(payload, nil)
+		confirmed := gopack.confirmAndSave(packet.MsgID, reply)
+		if confirmed != nil {
+			gopack.received(confirmed)
+			gopack.stage(confirmed.MsgType, confirmed.Qos, confirmed.MsgID, StageReceived)
 		}
+	} else if packet.MsgType == MsgTypeRelease {
 		reply := Encode(MsgTypeCompleted, Qos0, 0, packet.MsgID, nil)
-		gopack.opts.Storage.Save(reply)
+		received := gopack.releaseAndSave(packet.MsgID, reply)
+		return received, nil
 	} else if packet.MsgType == MsgTypeCompleted {
-		gopack.opts.Storage.Confirm(packet.MsgID)
+		gopack.acked(packet.MsgID)
+		gopack.settle(packet.MsgID)
+	} else if packet.MsgType == MsgTypeConnect {
+		if gopack.fenced(packet) {
+			gopack.fail(ErrFenced)
+			return nil, nil
+		}
+		if err := gopack.authenticate(packet); err != nil {
+			gopack.fail(err)
+			return nil, nil
+		}
+		gopack.setPeerCaps(packet.Capabilities)
+		if err := gopack.connAck(); err != nil {
+			gopack.fail(err)
+		}
+	} else if packet.MsgType == MsgTypePing {
+		if err := gopack.pong(); err != nil {
+			gopack.fail(err)
+		}
+	} else if packet.MsgType == MsgTypeConnAck {
+		gopack.setPeerCaps(packet.Capabilities)
+		gopack.adopt(packet.Parameters)
+		gopack.connacked.Do(func() { close(gopack.connackCh) })
+	} else if packet.MsgType == MsgTypeNack && len(packet.Payload) == 1 {
+		return nil, gopack.refused(packet.MsgID, packet.Payload[0])
 	}
+	return nil, nil
+}
+
+// Commit is used to commit message to GoPack2,
+// returns the assigned MsgID
+func (gopack *GoPack2) Commit(payload []byte, qos byte) (MsgID, error) {
+	return gopack.Publish(&Message{Qos: qos, Payload: payload})
+}
+
+// CommitPriority is used to commit message with priority,
+// higher priority messages overtake queued ones,
+// returns the assigned MsgID
+func (gopack *GoPack2) CommitPriority(payload []byte, qos byte, priority byte) (MsgID, error) {
+	return gopack.Publish(&Message{Qos: qos, Payload: payload, Priority: priority})
 }
 
-// Commit is used to commit message to GoPack2
-func (gopack *GoPack2) Commit(payload []byte, qos byte) {
-	packet := Encode(MsgTypeSend, qos, 0, gopack.opts.Storage.UniqueID(), payload)
-	gopack.opts.Storage.Save(packet)
+// CommitWithHeaders is used to commit message with headers,
+// the receiver finds them in Message.Headers,
+// returns the assigned MsgID
+func (gopack *GoPack2) CommitWithHeaders(payload []byte, qos byte, headers map[string]string) (MsgID, error) {
+	return gopack.Publish(&Message{Qos: qos, Payload: payload, Headers: headers})
+}
+
+// CommitAt is used to commit message that must not be sent before notBefore,
+// returns the assigned MsgID
+func (gopack *GoPack2) CommitAt(payload []byte, qos byte, notBefore time.Time) (MsgID, error) {
+	return gopack.Publish(&Message{Qos: qos, Payload: payload, NotBefore: notBefore})
+}
+
+// Publish is used to commit message with metadata to GoPack2,
+// returns the assigned MsgID which is also set to msg.MsgID
+func (gopack *GoPack2) Publish(msg *Message) (MsgID, error) {
+	return gopack.commit(msg, nil)
+}
+
+// PublishContext commits msg and waits until it is acknowledged,
+// or transmitted for QoS0, a dead-lettered message returns its
+// *DeadLetterError, if ctx is done first the message is cancelled
+// and ctx.Err() returned
+func (gopack *GoPack2) PublishContext(ctx context.Context, msg *Message) (MsgID, error) {
+	var acked chan error
+	traceParent := gopack.traceParent(ctx)
+	msgID, err := gopack.commit(msg, func(packet *Packet) {
+		if packet.TraceParent == "" {
+			packet.TraceParent = traceParent
+		}
+		acked = gopack.await(packet.MsgID)
+	})
+	if err != nil {
+		if acked != nil {
+			gopack.done(msg.MsgID, err)
+		}
+		return 0, err
+	}
+	select {
+	case err = <-acked:
+		return msgID, err
+	case <-ctx.Done():
+		gopack.Cancel(msgID)
+		gopack.done(msgID, ctx.Err())
+		return msgID, ctx.Err()
+	}
+}
+
+// commit queues msg, prepare may set packet fields before packing
+func (gopack *GoPack2) commit(msg *Message, prepare func(*Packet)) (MsgID, error) {
+	if msg.Qos > Qos2 {
+		return 0, ErrInvalidQos
+	}
+	claimed, downgraded, err := gopack.negotiate(msg)
+	if err != nil {
+		return 0, err
+	}
+	claimed, err = gopack.checkIn(claimed)
+	if err != nil {
+		return 0, err
+	}
+	evicted, err := gopack.publish(claimed, prepare)
+	msg.MsgID = claimed.MsgID
+	for _, packet := range evicted {
+		gopack.invoke(packet.Payload, ErrEvicted)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if downgraded {
+		gopack.invoke(msg.Payload, ErrQosDowngraded)
+	}
+	return msg.MsgID, nil
+}
+
+func (gopack *GoPack2) publish(msg *Message, prepare func(*Packet)) (evicted []*Packet, err error) {
+	gopack.muxCommit.Lock()
+	defer gopack.muxCommit.Unlock()
+	if gopack.closing {
+		return nil, ErrClosed
+	}
+	if msg.Channel < 0 || msg.Channel > 0xffff {
+		// counted under a channel it does not arrive on otherwise
+		return nil, ErrInvalidChannel
+	}
+	if msg.MsgID, err = gopack.uniqueID(); err != nil {
+		return nil, err
+	}
+	packet := &Packet{
+		MsgType:       MsgTypeSend,
+		Qos:           msg.Qos,
+		MsgID:         msg.MsgID,
+		Payload:       msg.Payload,
+		Channel:       msg.Channel,
+		CorrelationID: msg.CorrelationID,
+		Topic:         msg.Topic,
+		ReplyTo:       msg.ReplyTo,
+		ContentType:   msg.ContentType,
+		TraceParent:   msg.TraceParent,
+		CreatedAt:     time.Now().UnixNano(),
+		Priority:      msg.Priority,
+	}
+	if !msg.NotBefore.IsZero() {
+		packet.Timestamp = msg.NotBefore.Unix()
+	}
+	if gopack.opts.SendTimestamp {
+		packet.CommitTime = packet.CreatedAt
+	}
+	if len(msg.Headers) > 0 || msg.DedupKey != "" {
+		packet.Headers = make(map[string]string, len(msg.Headers)+1)
+		for key, value := range msg.Headers {
+			packet.Headers[key] = value
+		}
+		if msg.DedupKey != "" {
+			packet.Headers[HeaderDedupKey] = msg.DedupKey
+		}
+	}
+	if prepare != nil {
+		prepare(packet)
+	}
+	if !gopack.interceptors.send(packet) {
+		return nil, ErrDropped
+	}
+	packet.Pack()
+	if packet.RemainingLength > MaxRemainingLength ||
+		(gopack.sendLimit() > 0 && packet.TotalLength > gopack.sendLimit()) {
+		return nil, ErrPayloadTooLarge
+	}
+	evicted, err = gopack.reserve(len(msg.Payload))
+	if err != nil {
+		return evicted, err
+	}
+	if gopack.spool != nil && !gopack.connected {
+		return evicted, gopack.spool.Append(packet)
+	}
+	gopack.storage().Save(packet)
+	gopack.wake()
+	return evicted, nil
+}
+
+// uniqueID returns a MsgID that is not used by a message
+// awaiting acknowledgment or requeue, after the 16-bit id space
+// wrapped around, ErrNoFreeID if every id is in use
+func (gopack *GoPack2) uniqueID() (MsgID, error) {
+	store := gopack.storage()
+	for i := 0; i < 0xffff; i++ {
+		id := store.UniqueID()
+		if id == 0 {
+			break
+		}
+		if !gopack.inUse(id) {
+			return id, nil
+		}
+	}
+	return 0, ErrNoFreeID
+}
+
+// inUse reports whether id belongs to an unfinished outbound message
+func (gopack *GoPack2) inUse(id MsgID) bool {
+	gopack.muxInflight.Lock()
+	_, ok := gopack.inflight[id]
+	ok = ok || gopack.parkedIDs[id] > 0
+	gopack.muxInflight.Unlock()
+	if ok {
+		return true
+	}
+	gopack.muxDeadLetters.Lock()
+	_, ok = gopack.deadLetters[id]
+	gopack.muxDeadLetters.Unlock()
+	if ok || (gopack.spool != nil && gopack.spool.has(id)) {
+		return true
+	}
+	// a wrapped around sequence may reach ids still queued in the
+	// storage being drained, an ACK confirms them in both
+	old := gopack.draining()
+	return old != nil && holds(old, id)
+}
+
+// setConnected switches Commit between storage and spool,
+// spooled messages are moved into storage on connection
+func (gopack *GoPack2) setConnected(connected bool) {
+	gopack.muxCommit.Lock()
+	gopack.connected = connected
+	gopack.peer = ""
+	if connected && gopack.conn != nil {
+		gopack.peer = gopack.conn.RemoteAddr().String()
+	}
+	var err error
+	if connected && gopack.spool != nil {
+		err = gopack.spool.Drain(gopack.storage().Save)
+	}
+	gopack.muxCommit.Unlock()
+	if err != nil {
+		gopack.cbErr(err)
+	}
+}
+
+// remote returns the remote address of the connection
+func (gopack *GoPack2) remote() string {
+	gopack.muxCommit.Lock()
+	defer gopack.muxCommit.Unlock()
+	return gopack.peer
+}
+
+// full reports whether a payload of size bytes exceeds queue limits
+func (gopack *GoPack2) full(size int) bool {
+	count, bytes := pending(gopack.storage())
+	return (gopack.opts.MaxQueueLength > 0 && count+1 > gopack.opts.MaxQueueLength) ||
+		(gopack.opts.MaxQueueBytes > 0 && bytes+size > gopack.opts.MaxQueueBytes)
+}
+
+// reserve evicts queued messages until a payload of size bytes fits
+func (gopack *GoPack2) reserve(size int) (evicted []*Packet, err error) {
+	if gopack.opts.MaxQueueBytes > 0 && size > gopack.opts.MaxQueueBytes {
+		return nil, ErrQueueFull
+	}
+	for gopack.full(size) {
+		es, ok := gopack.storage().(EvictableStorage)
+		if !ok || gopack.opts.EvictionPolicy == EvictReject {
+			return evicted, ErrQueueFull
+		}
+		packet := es.Evict(gopack.opts.EvictionPolicy)
+		if packet == nil {
+			return evicted, ErrQueueFull
+		}
+		gopack.dropped(packet.MsgID, ErrEvicted)
+		evicted = append(evicted, packet)
+	}
+	return evicted, nil
+}
+
+// Cancel removes a committed message that has not been transmitted yet,
+// returns false if it is unknown, already on the wire or held by a
+// storage that does not implement CancellableStorage
+func (gopack *GoPack2) Cancel(msgID MsgID) bool {
+	parked := gopack.dropParked(func(packet *Packet) bool {
+		return packet.MsgID == msgID
+	})
+	if len(parked) > 0 {
+		return true
+	}
+	if gopack.spool != nil && gopack.spool.Cancel(msgID) {
+		return true
+	}
+	for _, store := range []OutboundStore{gopack.draining(), gopack.storage()} {
+		if cs, ok := store.(CancellableStorage); ok && cs.Cancel(msgID) {
+			return true
+		}
+	}
+	return false
+}
+
+// Purge drops all unconfirmed messages that are parked, spooled or in
+// a PurgeableStorage, returns the number of dropped messages
+func (gopack *GoPack2) Purge() int {
+	return gopack.purge(math.MaxInt64)
+}
+
+// PurgeBefore drops unconfirmed messages committed before t,
+// returns the number of dropped messages
+func (gopack *GoPack2) PurgeBefore(t time.Time) int {
+	return gopack.purge(t.UnixNano())
+}
+
+func (gopack *GoPack2) purge(before int64) int {
+	ids := gopack.dropParked(func(packet *Packet) bool {
+		return packet.CreatedAt < before
+	})
+	if gopack.spool != nil {
+		ids = append(ids, gopack.spool.Purge(before)...)
+	}
+	for _, store := range []OutboundStore{gopack.storage(), gopack.draining()} {
+		if ps, ok := store.(PurgeableStorage); ok {
+			ids = append(ids, ps.Purge(before)...)
+		}
+	}
+	for _, id := range ids {
+		gopack.dropped(id, ErrPurged)
+	}
+	return len(ids)
+}
+
+// Requeue pushes a dead-lettered message back into the outbound queue,
+// returns false if msgID is not dead-lettered
+func (gopack *GoPack2) Requeue(msgID MsgID) bool {
+	gopack.muxDeadLetters.Lock()
+	packet, ok := gopack.deadLetters[msgID]
+	delete(gopack.deadLetters, msgID)
+	gopack.muxDeadLetters.Unlock()
+	if ok {
+		gopack.requeue(packet)
+	}
+	return ok
+}
+
+// RequeueAll pushes all dead-lettered messages back into the outbound queue,
+// returns the number of requeued messages
+func (gopack *GoPack2) RequeueAll() int {
+	gopack.muxDeadLetters.Lock()
+	packets := gopack.deadLetters
+	gopack.deadLetters = make(map[MsgID]*Packet)
+	gopack.muxDeadLetters.Unlock()
+	for _, packet := range packets {
+		gopack.requeue(packet)
+	}
+	return len(packets)
+}
+
+func (gopack *GoPack2) requeue(packet *Packet) {
+	packet.RetryTimes = 0
+	packet.Timestamp = 0
+	gopack.storage().Save(packet)
 }
 
 // Start internal connection loop
@@ -188,31 +1911,140 @@ func (gopack *GoPack2) Start() {
 	go gopack.Conn()
 }
 
+// Close stops the connection loop, commits fail with ErrClosed,
+// unconfirmed messages stay in storage
+func (gopack *GoPack2) Close() {
+	gopack.muxCommit.Lock()
+	gopack.closing = true
+	gopack.muxCommit.Unlock()
+	gopack.closeOnce.Do(func() {
+		close(gopack.closeCh)
+	})
+}
+
+// Drain refuses new commits and waits until every QoS1 and QoS2
+// message is confirmed or ctx is done, then closes,
+// returns the number of messages left unconfirmed
+func (gopack *GoPack2) Drain(ctx context.Context) (int, error) {
+	gopack.muxCommit.Lock()
+	gopack.closing = true
+	gopack.muxCommit.Unlock()
+	defer gopack.Close()
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		remaining := gopack.unconfirmedRemaining()
+		if remaining == 0 {
+			return 0, nil
+		}
+		select {
+		case <-ctx.Done():
+			return remaining, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// remaining returns the number of queued, parked and spooled messages
+func (gopack *GoPack2) remaining() int {
+	count, _ := pending(gopack.storage())
+	if old := gopack.draining(); old != nil {
+		n, _ := pending(old)
+		count += n
+	}
+	gopack.muxInflight.Lock()
+	count += len(gopack.parked)
+	gopack.muxInflight.Unlock()
+	if gopack.spool != nil {
+		count += gopack.spool.count()
+	}
+	return count
+}
+
+// unconfirmedRemaining returns the number of queued, parked and
+// spooled QoS1 and QoS2 messages
+func (gopack *GoPack2) unconfirmedRemaining() int {
+	count := reliableCount(gopack.storage())
+	if old := gopack.draining(); old != nil {
+		count += reliableCount(old)
+	}
+	gopack.muxInflight.Lock()
+	for _, packet := range gopack.parked {
+		if packet.MsgType == MsgTypeSend && packet.Qos != Qos0 {
+			count++
+		}
+	}
+	gopack.muxInflight.Unlock()
+	if gopack.spool != nil {
+		count += gopack.spool.reliable()
+	}
+	return count
+}
+
+// serve runs the read, write and watch loops over an established
+// connection until it fails or gopack is closed
+func (gopack *GoPack2) serve(conn net.Conn) (err error) {
+	gopack.conn = conn
+	gopack.reader = bufio.NewReaderSize(gopack.source(conn), gopack.readBufferSize())
+	gopack.readBuf = make([]byte, gopack.readBufferSize())
+	gopack.exitCh = make(chan struct{})
+	gopack.errCh = make(chan error, 1)
+	gopack.touch()
+	gopack.resetKeepalive()
+	gopack.muxInflight.Lock()
+	gopack.inflight = make(map[MsgID]inflightPacket)
+	gopack.channelInflight = make(map[int]int)
+	gopack.muxInflight.Unlock()
+	gopack.resetHandshake()
+	gopack.coalescer.reset()
+	gopack.setConnected(true)
+	gopack.waitGroup.Add(3)
+	go gopack.read()
+	go gopack.write()
+	go gopack.watch()
+	select {
+	case err = <-gopack.errCh:
+	case <-gopack.closeCh:
+	}
+	close(gopack.exitCh)
+	// unblock pending reads and writes
+	conn.Close()
+	gopack.waitGroup.Wait()
+	gopack.restoreParked()
+	close(gopack.errCh)
+	gopack.setConnected(false)
+	return err
+}
+
 // Conn internal connection loop (synchronization)
 func (gopack *GoPack2) Conn() {
 	for {
+		select {
+		case <-gopack.closeCh:
+			return
+		default:
+		}
 		conn, err := net.DialTimeout("tcp", gopack.opts.Address, 2*time.Second)
+		if err == nil {
+			err = gopack.tune(conn.(*net.TCPConn))
+		}
+		if err == nil {
+			conn, err = gopack.secure(conn)
+		}
+		if err == nil {
+			err = gopack.serve(conn)
+		}
 		if err != nil {
 			gopack.cbErr(err)
-		} else {
-			gopack.conn = conn.(*net.TCPConn)
-			gopack.exitCh = make(chan struct{})
-			gopack.errCh = make(chan error, 2)
-			gopack.waitGroup.Add(2)
-			go gopack.read()
-			go gopack.write()
-			err = <-gopack.errCh
-			close(gopack.exitCh)
-			gopack.waitGroup.Wait()
-			close(gopack.errCh)
-			if err != nil {
-				gopack.cbErr(err)
-			}
 		}
 		if conn != nil {
 			conn.Close()
 		}
 		gopack.conn = nil
-		time.Sleep(3 * time.Second)
+		select {
+		case <-gopack.closeCh:
+			return
+		case <-time.After(3 * time.Second):
+		}
 	}
 }
@@ -0,0 +1,1164 @@
+package gopack
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type testCallback struct {
+	msgs chan *Message
+	errs chan error
+}
+
+func newTestCallback() *testCallback {
+	return &testCallback{msgs: make(chan *Message, 256), errs: make(chan error, 256)}
+}
+
+func (cb *testCallback) Invoke(payload []byte, err error) {
+	if err == nil {
+		return
+	}
+	select {
+	case cb.errs <- err:
+	default:
+	}
+}
+
+func (cb *testCallback) InvokeMessage(msg *Message) {
+	cb.msgs <- msg
+}
+
+// next waits for the next delivered message
+func (cb *testCallback) next(t *testing.T) *Message {
+	t.Helper()
+	select {
+	case msg := <-cb.msgs:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for message")
+		return nil
+	}
+}
+
+// pair connects a client built from copts to a peer built from sopts
+// that serves the accepted connection, both are closed on cleanup
+func pair(t *testing.T, copts, sopts *Options) (client *GoPack2, ccb *testCallback, server *GoPack2, scb *testCallback) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ccb, scb = newTestCallback(), newTestCallback()
+	copts.Address = ln.Addr().String()
+	copts.CallbackObj = ccb
+	sopts.CallbackObj = scb
+	if client, err = NewGoPack(copts); err != nil {
+		t.Fatal(err)
+	}
+	if server, err = NewGoPack(sopts); err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		conn, err := ln.Accept()
+		ln.Close()
+		if err != nil {
+			return
+		}
+		server.serve(conn)
+	}()
+	client.Start()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+		ln.Close()
+		<-served
+	})
+	return
+}
+
+// offline returns a GoPack2 that is not connected, with the state of
+// a connection so protocol steps can be driven by hand
+func offline(t *testing.T, opts *Options) *GoPack2 {
+	t.Helper()
+	if opts.CallbackObj == nil {
+		opts.CallbackObj = newTestCallback()
+	}
+	gopack, err := NewGoPack(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gopack.inflight = make(map[MsgID]inflightPacket)
+	gopack.channelInflight = make(map[int]int)
+	return gopack
+}
+
+// eventually polls cond until it holds or a few seconds passed
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	cases := []struct {
+		name string
+		qos  byte
+	}{
+		{"qos0", Qos0},
+		{"qos1", Qos1},
+		{"qos2", Qos2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, _, _, scb := pair(t, &Options{}, &Options{})
+			if _, err := client.Commit([]byte(c.name), c.qos); err != nil {
+				t.Fatal(err)
+			}
+			msg := scb.next(t)
+			if string(msg.Payload) != c.name || msg.Qos != c.qos {
+				t.Fatalf("got %q qos %d", msg.Payload, msg.Qos)
+			}
+			eventually(t, func() bool { return client.remaining() == 0 })
+		})
+	}
+}
+
+func TestInUse(t *testing.T) {
+	cases := []struct {
+		name string
+		take func(gopack *GoPack2, id MsgID)
+	}{
+		{"inflight", func(gopack *GoPack2, id MsgID) {
+			gopack.sent(&Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: id})
+		}},
+		{"parked", func(gopack *GoPack2, id MsgID) {
+			gopack.park(&Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: id})
+		}},
+		{"dead-lettered", func(gopack *GoPack2, id MsgID) {
+			gopack.deadLetter(&Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: id}, 0)
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{})
+			gopack.storage().(SequencedStorage).SetLastID(9)
+			c.take(gopack, 10)
+			if !gopack.inUse(10) {
+				t.Fatal("id not in use")
+			}
+			if id, err := gopack.uniqueID(); err != nil || id != 11 {
+				t.Fatalf("got id %d, %v, want 11", id, err)
+			}
+		})
+	}
+}
+
+func TestParkedIDs(t *testing.T) {
+	gopack := offline(t, &Options{})
+	gopack.Pause()
+	for id := MsgID(1); id <= 3; id++ {
+		gopack.park(&Packet{MsgType: MsgTypeSend, MsgID: id})
+	}
+	gopack.dropParked(func(packet *Packet) bool { return packet.MsgID == 2 })
+	gopack.Resume()
+	if packet := gopack.unpark(); packet == nil || packet.MsgID != 1 {
+		t.Fatalf("unparked %v", packet)
+	}
+	for id, want := range map[MsgID]bool{1: false, 2: false, 3: true} {
+		if gopack.inUse(id) != want {
+			t.Fatalf("id %d in use %v, want %v", id, !want, want)
+		}
+	}
+	gopack.restoreParked()
+	if len(gopack.parkedIDs) != 0 {
+		t.Fatalf("parked ids %v left", gopack.parkedIDs)
+	}
+}
+
+func TestNoFreeID(t *testing.T) {
+	gopack := offline(t, &Options{})
+	for i := 0; i < 0xffff; i++ {
+		if _, err := gopack.Commit(nil, Qos1); err != nil {
+			t.Fatalf("commit %d: %v", i, err)
+		}
+	}
+	if _, err := gopack.Commit(nil, Qos1); err != ErrNoFreeID {
+		t.Fatalf("got %v, want ErrNoFreeID", err)
+	}
+	id := gopack.storage().Unconfirmed().MsgID
+	gopack.confirm(id)
+	if got, err := gopack.Commit(nil, Qos1); err != nil || got != id {
+		t.Fatalf("got id %d, %v, want the confirmed %d", got, err, id)
+	}
+}
+
+func TestNotBefore(t *testing.T) {
+	cases := []struct {
+		name      string
+		notBefore time.Duration
+		due       bool
+	}{
+		{"unset", 0, true},
+		{"past", -time.Minute, true},
+		{"future", time.Hour, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{})
+			msg := &Message{Qos: Qos1, Payload: []byte("x")}
+			if c.notBefore != 0 {
+				msg.NotBefore = time.Now().Add(c.notBefore)
+			}
+			if _, err := gopack.Publish(msg); err != nil {
+				t.Fatal(err)
+			}
+			if due := gopack.storage().Unconfirmed() != nil; due != c.due {
+				t.Fatalf("due %v, want %v", due, c.due)
+			}
+			if !c.due && gopack.remaining() != 1 {
+				t.Fatalf("%d pending, want the delayed message counted", gopack.remaining())
+			}
+		})
+	}
+}
+
+func TestPurge(t *testing.T) {
+	cases := []struct {
+		name   string
+		purge  func(gopack *GoPack2, cut time.Time) int
+		purged int
+	}{
+		{"all", func(gopack *GoPack2, cut time.Time) int { return gopack.Purge() }, 4},
+		{"before", func(gopack *GoPack2, cut time.Time) int { return gopack.PurgeBefore(cut) }, 2},
+		{"before start", func(gopack *GoPack2, cut time.Time) int { return gopack.PurgeBefore(time.Unix(0, 0)) }, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{})
+			var waiters []chan error
+			var cut time.Time
+			for i := 0; i < 4; i++ {
+				if i == 2 {
+					time.Sleep(time.Millisecond)
+					cut = time.Now()
+					time.Sleep(time.Millisecond)
+				}
+				_, err := gopack.commit(&Message{Qos: Qos1}, func(packet *Packet) {
+					waiters = append(waiters, gopack.await(packet.MsgID))
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			// one message waits parked while paused
+			gopack.Pause()
+			gopack.park(gopack.storage().Unconfirmed())
+			if n := c.purge(gopack, cut); n != c.purged {
+				t.Fatalf("purged %d, want %d", n, c.purged)
+			}
+			if left := gopack.remaining(); left != 4-c.purged {
+				t.Fatalf("%d left, want %d", left, 4-c.purged)
+			}
+			for i, waiter := range waiters {
+				select {
+				case err := <-waiter:
+					if i >= c.purged || err != ErrPurged {
+						t.Fatalf("waiter %d released with %v", i, err)
+					}
+				default:
+					if i < c.purged {
+						t.Fatalf("waiter %d of purged message not released", i)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRequeue(t *testing.T) {
+	cases := []struct {
+		name     string
+		requeue  func(gopack *GoPack2, ids []MsgID) int
+		requeued int
+	}{
+		{"one", func(gopack *GoPack2, ids []MsgID) int {
+			if gopack.Requeue(ids[0]) {
+				return 1
+			}
+			return 0
+		}, 1},
+		{"unknown", func(gopack *GoPack2, ids []MsgID) int {
+			if gopack.Requeue(ids[1] + 1) {
+				return 1
+			}
+			return 0
+		}, 0},
+		{"all", func(gopack *GoPack2, ids []MsgID) int { return gopack.RequeueAll() }, 2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{MaxRetries: 2})
+			var ids []MsgID
+			for i := 0; i < 2; i++ {
+				id, err := gopack.Commit(nil, Qos1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, id)
+			}
+			for range ids {
+				packet := gopack.storage().Unconfirmed()
+				packet.RetryTimes = 3
+				gopack.storage().Save(packet)
+				if _, dead, err := gopack.writeNext(); err != nil || dead == nil {
+					t.Fatalf("message %d not dead-lettered: %v", packet.MsgID, err)
+				}
+			}
+			if gopack.remaining() != 0 || !gopack.inUse(ids[0]) {
+				t.Fatal("dead-lettered messages left the queue or released their ids")
+			}
+			if n := c.requeue(gopack, ids); n != c.requeued {
+				t.Fatalf("requeued %d, want %d", n, c.requeued)
+			}
+			if gopack.remaining() != c.requeued {
+				t.Fatalf("%d queued, want %d", gopack.remaining(), c.requeued)
+			}
+			if packet := gopack.storage().Unconfirmed(); packet != nil && packet.RetryTimes != 0 {
+				t.Fatalf("requeued with %d retries", packet.RetryTimes)
+			}
+		})
+	}
+}
+
+func TestCancel(t *testing.T) {
+	cases := []struct {
+		name     string
+		prepare  func(gopack *GoPack2, id MsgID)
+		canceled bool
+	}{
+		{"queued", func(gopack *GoPack2, id MsgID) {}, true},
+		{"parked", func(gopack *GoPack2, id MsgID) {
+			gopack.Pause()
+			gopack.park(gopack.storage().Unconfirmed())
+		}, true},
+		{"transmitted", func(gopack *GoPack2, id MsgID) { transmit(t, gopack) }, false},
+		{"unknown", func(gopack *GoPack2, id MsgID) { gopack.storage().Confirm(id) }, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{})
+			id, err := gopack.Commit([]byte("x"), Qos1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.prepare(gopack, id)
+			if gopack.Cancel(id) != c.canceled {
+				t.Fatalf("canceled %v, want %v", !c.canceled, c.canceled)
+			}
+			if c.canceled && gopack.remaining() != 0 {
+				t.Fatal("canceled message still queued")
+			}
+		})
+	}
+}
+
+func TestTune(t *testing.T) {
+	cases := []struct {
+		name string
+		opts Options
+	}{
+		{"defaults", Options{}},
+		{"keepalive", Options{KeepAlive: 15000}},
+		{"no keepalive", Options{KeepAlive: -1}},
+		{"nagle", Options{Nagle: true}},
+		{"buffers", Options{ReadBuffer: 1 << 16, WriteBuffer: 1 << 16}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			gopack := offline(t, &c.opts)
+			if err := gopack.tune(conn.(*net.TCPConn)); err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			if err := gopack.tune(conn.(*net.TCPConn)); err == nil {
+				t.Fatal("tuning a closed connection succeeded")
+			}
+		})
+	}
+}
+
+func TestChannelWindow(t *testing.T) {
+	cases := []struct {
+		name    string
+		window  int
+		packet  *Packet
+		blocked bool
+	}{
+		{"disabled", 0, &Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: 9, Channel: 1}, false},
+		{"full channel", 2, &Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: 9, Channel: 1}, true},
+		{"other channel", 2, &Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: 9, Channel: 2}, false},
+		{"qos0", 2, &Packet{MsgType: MsgTypeSend, Qos: Qos0, MsgID: 9, Channel: 1}, false},
+		{"retransmission", 2, &Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: 1, Channel: 1}, false},
+		{"release", 2, &Packet{MsgType: MsgTypeRelease, Qos: Qos2, MsgID: 9, Channel: 1}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{ChannelWindow: c.window})
+			for id := MsgID(1); id <= 2; id++ {
+				gopack.sent(&Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: id, Channel: 1})
+			}
+			if blocked := gopack.blocked(c.packet); blocked != c.blocked {
+				t.Fatalf("blocked %v, want %v", blocked, c.blocked)
+			}
+			gopack.acked(1)
+			if gopack.blocked(c.packet) {
+				t.Fatal("still blocked after an acknowledgment")
+			}
+		})
+	}
+}
+
+func TestReceiveRetention(t *testing.T) {
+	cases := []struct {
+		name      string
+		retention int
+		expired   bool
+	}{
+		{"expired", 10, true},
+		{"within retention", 60000, false},
+		{"kept forever", -1, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cb := newTestCallback()
+			gopack := offline(t, &Options{CallbackObj: cb, ReceiveRetention: c.retention})
+			gopack.inboundStore().Receive(1, &Packet{MsgType: MsgTypeSend, Qos: Qos2, MsgID: 1, Payload: []byte("x")})
+			time.Sleep(20 * time.Millisecond)
+			gopack.expire()
+			if released := gopack.inboundStore().Release(1) != nil; released == c.expired {
+				t.Fatalf("released %v after expiry", released)
+			}
+			select {
+			case err := <-cb.errs:
+				if !c.expired || err != ErrReceiveExpired {
+					t.Fatalf("reported %v", err)
+				}
+			default:
+				if c.expired {
+					t.Fatal("expiry not reported")
+				}
+			}
+		})
+	}
+}
+
+func TestMaxPacketSize(t *testing.T) {
+	cases := []struct {
+		name  string
+		limit int
+		size  int
+		err   error
+	}{
+		{"unlimited", 0, 1000, nil},
+		{"fits", 64, 32, nil},
+		{"too large", 64, 100, ErrPayloadTooLarge},
+		{"protocol maximum", 0, MaxRemainingLength + 1, ErrPayloadTooLarge},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{MaxPacketSize: c.limit})
+			if _, err := gopack.Commit(make([]byte, c.size), Qos1); err != c.err {
+				t.Fatalf("commit got %v, want %v", err, c.err)
+			}
+			conn, peer := net.Pipe()
+			defer peer.Close()
+			served := make(chan error, 1)
+			go func() { served <- gopack.serve(conn) }()
+			go io.Copy(io.Discard, peer)
+			packet := &Packet{MsgType: MsgTypeSend, Qos: Qos0, MsgID: 1, Payload: make([]byte, c.size)}
+			packet.Pack()
+			if c.size <= MaxRemainingLength {
+				go peer.Write(packet.Buffer)
+			}
+			select {
+			case err := <-served:
+				if c.err == nil || !errors.Is(err, c.err) {
+					t.Fatalf("read got %v, want %v", err, c.err)
+				}
+			case <-time.After(200 * time.Millisecond):
+				if c.err != nil && c.size <= MaxRemainingLength {
+					t.Fatal("oversized packet accepted")
+				}
+				gopack.Close()
+				<-served
+			}
+		})
+	}
+}
+
+func TestResync(t *testing.T) {
+	cases := []struct {
+		name    string
+		resync  bool
+		garbage []byte
+		deliver bool
+	}{
+		{"clean", false, nil, true},
+		{"unknown type", true, []byte{0xf0, 0, 1, 0, 0}, true},
+		{"control with payload", true, []byte{MsgTypeAck << 4, 0, 1, 0, 3, 1, 2, 3}, true},
+		{"short garbage", true, []byte{0xff, 0xff}, true},
+		{"malformed properties", true, []byte{MsgTypeAck<<4 | FlagProperties, 0, 1, 0, 2, 0xff, 0xff}, true},
+		{"without resync", false, []byte{MsgTypeAck<<4 | FlagProperties, 0, 1, 0, 2, 0xff, 0xff}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cb := newTestCallback()
+			gopack := offline(t, &Options{CallbackObj: cb, Resync: c.resync})
+			conn, peer := net.Pipe()
+			defer peer.Close()
+			served := make(chan error, 1)
+			go func() { served <- gopack.serve(conn) }()
+			defer func() {
+				gopack.Close()
+				<-served
+			}()
+			go io.Copy(io.Discard, peer)
+			packet := &Packet{MsgType: MsgTypeSend, Qos: Qos0, MsgID: 7, Payload: []byte("ok")}
+			packet.Pack()
+			go peer.Write(append(append([]byte(nil), c.garbage...), packet.Buffer...))
+			select {
+			case msg := <-cb.msgs:
+				if !c.deliver || string(msg.Payload) != "ok" {
+					t.Fatalf("delivered %q", msg.Payload)
+				}
+			case err := <-served:
+				served <- err
+				if c.deliver {
+					t.Fatalf("connection failed: %v", err)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("neither delivered nor failed")
+			}
+		})
+	}
+}
+
+func TestRetryDup(t *testing.T) {
+	cases := []struct {
+		name    string
+		qos     byte
+		retries int
+		dup     bool
+	}{
+		{"qos0", Qos0, 1, false},
+		{"first retransmission", Qos1, 1, true},
+		{"later retransmission", Qos2, 3, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{})
+			packet := &Packet{MsgType: MsgTypeSend, Qos: c.qos, MsgID: 1, Payload: []byte("x")}
+			packet.Pack()
+			original := packet.Buffer
+			for i := 0; i < c.retries; i++ {
+				if next := gopack.retry(packet); next != nil {
+					packet = next
+				}
+			}
+			if packet.Dup != c.dup || (packet.Buffer[0]&FlagDup != 0) != c.dup {
+				t.Fatalf("dup %v, flag %#x, want %v", packet.Dup, packet.Buffer[0], c.dup)
+			}
+			if original[0]&FlagDup != 0 {
+				t.Fatal("buffer of the first transmission changed")
+			}
+			decoded, err := Decode(packet.Buffer)
+			if err != nil || decoded.Dup != c.dup {
+				t.Fatalf("decoded dup %v, %v", decoded.Dup, err)
+			}
+		})
+	}
+}
+
+func TestBatchAcks(t *testing.T) {
+	cases := []struct {
+		name      string
+		handshake bool
+	}{
+		{"batched", true},
+		{"legacy peer", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, _, _, scb := pair(t, &Options{Handshake: c.handshake}, &Options{BatchAcks: true})
+			for i := 0; i < 50; i++ {
+				if _, err := client.Commit([]byte("x"), Qos1); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < 50; i++ {
+				scb.next(t)
+			}
+			eventually(t, func() bool { return client.remaining() == 0 && client.ackSilence() == 0 })
+		})
+	}
+}
+
+func TestWindow(t *testing.T) {
+	cases := []struct {
+		name   string
+		window int
+		packet *Packet
+		full   bool
+	}{
+		{"room", 3, &Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: 9}, false},
+		{"full", 2, &Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: 9}, true},
+		{"unbounded", -1, &Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: 9}, false},
+		{"qos0", 2, &Packet{MsgType: MsgTypeSend, Qos: Qos0, MsgID: 9}, false},
+		{"retransmission", 2, &Packet{MsgType: MsgTypeSend, Qos: Qos2, MsgID: 1}, false},
+		{"acknowledgment", 2, &Packet{MsgType: MsgTypeAck, MsgID: 9}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{MaxPacketNumber: c.window})
+			for id := MsgID(1); id <= 2; id++ {
+				gopack.sent(&Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: id})
+			}
+			if full := gopack.windowFull(c.packet); full != c.full {
+				t.Fatalf("full %v, want %v", full, c.full)
+			}
+		})
+	}
+}
+
+// TestPipeline pushes a burst through a small window, parked messages
+// must go out as acknowledgments come in
+func TestPipeline(t *testing.T) {
+	client, _, _, scb := pair(t, &Options{MaxPacketNumber: 2}, &Options{})
+	for i := 0; i < 30; i++ {
+		if _, err := client.Commit([]byte("x"), Qos2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 30; i++ {
+		scb.next(t)
+	}
+	eventually(t, func() bool { return client.remaining() == 0 })
+}
+
+func TestRetryCopy(t *testing.T) {
+	cases := []struct {
+		name    string
+		retries int
+	}{
+		{"first", 1},
+		{"third", 3},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{RetryInterval: 2000})
+			if _, err := gopack.Commit([]byte("x"), Qos1); err != nil {
+				t.Fatal(err)
+			}
+			var packet *Packet
+			for i := 0; i < c.retries; i++ {
+				if packet != nil {
+					// due again once the interval passed
+					gopack.storage().Confirm(packet.MsgID)
+					packet.Confirm = false
+					packet.Timestamp = 0
+					gopack.storage().Save(packet)
+				}
+				sent := transmit(t, gopack)
+				if packet != nil && sent == packet {
+					t.Fatal("retransmission changed the stored packet")
+				}
+				if packet != nil && (&sent.Payload[0] != &packet.Payload[0] ||
+					&sent.Buffer[0] != &packet.Buffer[0]) {
+					t.Fatal("retransmission copied the payload")
+				}
+				packet = sent
+			}
+			if packet.RetryTimes != c.retries {
+				t.Fatalf("%d retries, want %d", packet.RetryTimes, c.retries)
+			}
+			due := time.Unix(packet.Timestamp, 0)
+			want := time.Now().Add(time.Duration(c.retries) * 2 * time.Second)
+			if due.Before(want.Add(-time.Second)) || due.After(want.Add(time.Second)) {
+				t.Fatalf("due %v, want about %v", due, want)
+			}
+		})
+	}
+}
+
+func TestReadBuffer(t *testing.T) {
+	cases := []struct {
+		name  string
+		limit int
+		size  int
+	}{
+		{"protocol maximum", 0, 5 + MaxRemainingLength},
+		{"bounded", 1000, 1000},
+		{"above protocol maximum", 1 << 20, 5 + MaxRemainingLength},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, _, server, scb := pair(t, &Options{}, &Options{MaxPacketSize: c.limit})
+			if size := server.readBufferSize(); size != c.size {
+				t.Fatalf("buffer of %d bytes, want %d", size, c.size)
+			}
+			// the largest packet the server accepts fits
+			payload := make([]byte, c.size-5)
+			for i := range payload {
+				payload[i] = byte(i)
+			}
+			if _, err := client.Commit(payload, Qos1); err != nil {
+				t.Fatal(err)
+			}
+			if msg := scb.next(t); !bytes.Equal(msg.Payload, payload) {
+				t.Fatal("payload corrupted")
+			}
+		})
+	}
+}
+
+func TestDrain(t *testing.T) {
+	cases := []struct {
+		name      string
+		connected bool
+		qos0      int
+		remaining int
+		err       error
+	}{
+		{"acknowledged", true, 0, 0, nil},
+		{"peer gone", false, 0, 3, context.DeadlineExceeded},
+		{"qos0 not counted", false, 2, 3, context.DeadlineExceeded},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var gopack *GoPack2
+			if c.connected {
+				gopack, _, _, _ = pair(t, &Options{}, &Options{})
+			} else {
+				gopack = offline(t, &Options{})
+			}
+			for i := 0; i < 3; i++ {
+				if _, err := gopack.Commit([]byte("x"), Qos2); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < c.qos0; i++ {
+				if _, err := gopack.Commit([]byte("x"), Qos0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			remaining, err := gopack.Drain(ctx)
+			if remaining != c.remaining || err != c.err {
+				t.Fatalf("drained with %d left, %v, want %d, %v", remaining, err, c.remaining, c.err)
+			}
+			if _, err := gopack.Commit([]byte("x"), Qos1); err != ErrClosed {
+				t.Fatalf("commit after drain got %v, want ErrClosed", err)
+			}
+		})
+	}
+}
+
+func TestPause(t *testing.T) {
+	cases := []struct {
+		name string
+		qos  byte
+	}{
+		{"qos0", Qos0},
+		{"qos1", Qos1},
+		{"qos2", Qos2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, ccb, server, scb := pair(t, &Options{}, &Options{})
+			client.Pause()
+			if _, err := client.Commit([]byte("held"), c.qos); err != nil {
+				t.Fatal(err)
+			}
+			// the paused side still acknowledges what it receives
+			if _, err := server.Commit([]byte("in"), c.qos); err != nil {
+				t.Fatal(err)
+			}
+			ccb.next(t)
+			eventually(t, func() bool { return server.remaining() == 0 })
+			select {
+			case msg := <-scb.msgs:
+				t.Fatalf("%q sent while paused", msg.Payload)
+			case <-time.After(100 * time.Millisecond):
+			}
+			client.Resume()
+			if msg := scb.next(t); string(msg.Payload) != "held" {
+				t.Fatalf("got %q", msg.Payload)
+			}
+		})
+	}
+}
+
+func TestHeaderHook(t *testing.T) {
+	cases := []struct {
+		name   string
+		hook   func(packet *Packet)
+		header string
+		err    func(error) bool
+	}{
+		{"added", func(packet *Packet) { packet.Headers["hop"] = "edge-1" }, "edge-1", nil},
+		{"too large", func(packet *Packet) { packet.Headers["hop"] = string(make([]byte, 2000)) }, "", func(err error) bool { return errors.Is(err, ErrPayloadTooLarge) }},
+		{"panic", func(packet *Packet) { panic("hook") }, "", func(err error) bool {
+			var perr *PanicError
+			return errors.As(err, &perr)
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, ccb, _, scb := pair(t, &Options{Handshake: true, HeaderHook: c.hook, MaxPacketSize: 1000}, &Options{})
+			if _, err := client.Publish(&Message{Qos: Qos1, Headers: map[string]string{"k": "v"}, Payload: []byte("x")}); err != nil {
+				t.Fatal(err)
+			}
+			msg := scb.next(t)
+			if msg.Headers["hop"] != c.header || msg.Headers["k"] != "v" {
+				t.Fatalf("headers %v", msg.Headers)
+			}
+			select {
+			case err := <-ccb.errs:
+				if c.err == nil || !c.err(err) {
+					t.Fatalf("reported %v", err)
+				}
+			case <-time.After(100 * time.Millisecond):
+				if c.err != nil {
+					t.Fatal("failed hook not reported")
+				}
+			}
+		})
+	}
+}
+
+func TestPublishContext(t *testing.T) {
+	cases := []struct {
+		name      string
+		connected bool
+		qos       byte
+		err       error
+	}{
+		{"qos0 transmitted", true, Qos0, nil},
+		{"qos1 acked", true, Qos1, nil},
+		{"qos2 acked", true, Qos2, nil},
+		{"deadline", false, Qos1, context.DeadlineExceeded},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var client *GoPack2
+			if c.connected {
+				client, _, _, _ = pair(t, &Options{}, &Options{})
+			} else {
+				client = offline(t, &Options{})
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			_, err := client.PublishContext(ctx, &Message{Qos: c.qos, Payload: []byte("x")})
+			if !errors.Is(err, c.err) {
+				t.Fatalf("err %v, want %v", err, c.err)
+			}
+			if err != nil && client.remaining() != 0 {
+				t.Fatal("abandoned message still queued")
+			}
+		})
+	}
+}
+
+func TestPeer(t *testing.T) {
+	cases := []struct {
+		name   string
+		toPeer bool
+	}{
+		{"received by the client", false},
+		{"received by the peer", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, ccb, server, scb := pair(t, &Options{}, &Options{})
+			from, cb, want := server, ccb, client.opts.Address
+			if c.toPeer {
+				from, cb, want = client, scb, ""
+			}
+			eventually(t, func() bool { return from.ConnState().Connected })
+			if _, err := from.Commit([]byte("x"), Qos1); err != nil {
+				t.Fatal(err)
+			}
+			msg := cb.next(t)
+			host, _, err := net.SplitHostPort(msg.Peer)
+			if err != nil || host != "127.0.0.1" || (want != "" && msg.Peer != want) {
+				t.Fatalf("peer %q", msg.Peer)
+			}
+		})
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	cases := []struct {
+		name      string
+		handshake bool
+		headers   map[string]string
+		dedupKey  string
+		want      map[string]string
+	}{
+		{"headers", true, map[string]string{"a": "1", "b": "2"}, "", map[string]string{"a": "1", "b": "2"}},
+		{"with dedup key", true, map[string]string{"a": "1"}, "k", map[string]string{"a": "1", HeaderDedupKey: "k"}},
+		{"none", true, nil, "", nil},
+		{"legacy peer", false, map[string]string{"a": "1"}, "", nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, _, _, scb := pair(t, &Options{Handshake: c.handshake}, &Options{})
+			sent := len(c.headers)
+			if _, err := client.Publish(&Message{Qos: Qos1, Headers: c.headers, DedupKey: c.dedupKey, Payload: []byte("x")}); err != nil {
+				t.Fatal(err)
+			}
+			if len(c.headers) != sent {
+				t.Fatal("caller headers modified")
+			}
+			msg := scb.next(t)
+			if len(msg.Headers) != len(c.want) {
+				t.Fatalf("headers %v, want %v", msg.Headers, c.want)
+			}
+			for key, value := range c.want {
+				if msg.Headers[key] != value {
+					t.Fatalf("headers %v, want %v", msg.Headers, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCommitWithHeaders(t *testing.T) {
+	client, _, _, scb := pair(t, &Options{Handshake: true}, &Options{})
+	if _, err := client.CommitWithHeaders([]byte("x"), Qos2, map[string]string{"k": "v"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := scb.next(t); msg.Headers["k"] != "v" || msg.Qos != Qos2 {
+		t.Fatalf("got %+v", msg)
+	}
+}
+
+func TestPacketError(t *testing.T) {
+	ackProps := byte(MsgTypeAck<<4 | FlagProperties)
+	cases := []struct {
+		name    string
+		opts    Options
+		frames  []byte
+		msgType byte
+		msgID   MsgID
+		err     error
+	}{
+		{"closed", Options{}, nil, 0, 0, io.EOF},
+		{"too large", Options{MaxPacketSize: 64}, []byte{MsgTypeSend<<4 | Qos1<<2, 0, 7, 1, 0}, MsgTypeSend, 7, ErrPayloadTooLarge},
+		{"truncated", Options{}, []byte{MsgTypeSend<<4 | Qos1<<2, 0, 7, 0, 9, 'x'}, MsgTypeSend, 7, io.EOF},
+		{"malformed", Options{}, []byte{ackProps, 0, 3, 0, 6, 0, 4, PropHeader, 0, 1, 'x'}, MsgTypeAck, 3, ErrDecodeProperty},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			opts := c.opts
+			gopack := offline(t, &opts)
+			conn, peer := net.Pipe()
+			go io.Copy(io.Discard, peer)
+			served := make(chan error, 1)
+			go func() { served <- gopack.serve(conn) }()
+			peer.Write(c.frames)
+			peer.Close()
+			err := <-served
+			gopack.Close()
+			var perr *PacketError
+			if !errors.As(err, &perr) || !errors.Is(err, c.err) {
+				t.Fatalf("got %v, want a PacketError wrapping %v", err, c.err)
+			}
+			if perr.Op != "read" || perr.MsgType != c.msgType || perr.MsgID != c.msgID {
+				t.Fatalf("got %+v", perr)
+			}
+		})
+	}
+}
+
+func TestPacketErrorString(t *testing.T) {
+	cases := []struct {
+		name string
+		err  *PacketError
+		want string
+	}{
+		{"no header", &PacketError{Op: "read", Remote: "10.0.0.1:7000", Err: io.EOF}, "read 10.0.0.1:7000: EOF"},
+		{"packet", &PacketError{Op: "write", MsgType: MsgTypeSend, MsgID: 9, Remote: "10.0.0.1:7000", Err: io.ErrClosedPipe},
+			"write 10.0.0.1:7000: packet type 1 id 9: io: read/write on closed pipe"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.err.Error(); got != c.want {
+				t.Fatalf("got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+// ackingConn acknowledges every QoS1 message while it is being written,
+// as a fast peer whose ACK is read before the write returns
+type ackingConn struct {
+	net.Conn
+	gopack *GoPack2
+	frames [][]byte
+}
+
+func (ac *ackingConn) Write(b []byte) (int, error) {
+	ac.frames = append(ac.frames, append([]byte(nil), b...))
+	if packet, err := Decode(b); err == nil && packet.MsgType == MsgTypeSend && packet.Qos == Qos1 {
+		ac.gopack.process(Encode(MsgTypeAck, Qos0, 0, packet.MsgID, nil))
+	}
+	return len(b), nil
+}
+
+func (ac *ackingConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func TestAckedDuringWrite(t *testing.T) {
+	cases := []struct {
+		name    string
+		retries int
+	}{
+		{"first transmission", 0},
+		{"retransmission", 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{})
+			id, err := gopack.Commit([]byte("x"), Qos1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < c.retries; i++ {
+				transmit(t, gopack)
+				packet := gopack.storage().Confirm(id)
+				packet.Confirm = false
+				packet.Timestamp = 0
+				gopack.storage().Save(packet)
+			}
+			conn := &ackingConn{gopack: gopack}
+			gopack.conn = conn
+			if sent, _, err := gopack.writeNext(); !sent || err != nil {
+				t.Fatalf("sent %v, %v", sent, err)
+			}
+			if dup := conn.frames[0][0]&FlagDup != 0; dup != (c.retries > 0) {
+				t.Fatalf("dup %v", dup)
+			}
+			if packet := gopack.storage().Unconfirmed(); packet != nil || gopack.remaining() != 0 {
+				t.Fatal("acknowledged message rescheduled")
+			}
+		})
+	}
+}
+
+func TestInvalidQos(t *testing.T) {
+	cases := []struct {
+		name string
+		qos  byte
+		err  error
+	}{
+		{"qos2", Qos2, nil},
+		{"qos3", 3, ErrInvalidQos},
+		{"out of range", 0xff, ErrInvalidQos},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{})
+			if _, err := gopack.Commit([]byte("x"), c.qos); err != c.err {
+				t.Fatalf("err %v, want %v", err, c.err)
+			}
+			if queued := gopack.remaining(); (queued == 0) != (c.err != nil) {
+				t.Fatalf("%d queued", queued)
+			}
+		})
+	}
+}
+
+func TestInvalidChannel(t *testing.T) {
+	cases := []struct {
+		name    string
+		channel int
+		err     error
+	}{
+		{"default", 0, nil},
+		{"largest", 0xffff, nil},
+		{"too large", 0x10000, ErrInvalidChannel},
+		{"negative", -1, ErrInvalidChannel},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{})
+			if _, err := gopack.Publish(&Message{Qos: Qos1, Channel: c.channel, Payload: []byte("x")}); err != c.err {
+				t.Fatalf("err %v, want %v", err, c.err)
+			}
+			if queued := gopack.remaining(); (queued == 0) != (c.err != nil) {
+				t.Fatalf("%d queued", queued)
+			}
+		})
+	}
+}
+
+func TestUnknownFrames(t *testing.T) {
+	valid := Encode(MsgTypeSend, Qos0, 0, 1, []byte("ok")).Buffer
+	cases := []struct {
+		name      string
+		frame     []byte
+		malformed int64
+	}{
+		{"valid only", nil, 0},
+		{"unknown type", []byte{0xf0, 0, 2, 0, 1, 'x'}, 1},
+		{"unknown qos", []byte{MsgTypeSend<<4 | 3<<2, 0, 2, 0, 1, 'x'}, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{})
+			cb := gopack.opts.CallbackObj.(*testCallback)
+			conn, peer := net.Pipe()
+			go io.Copy(io.Discard, peer)
+			served := make(chan error, 1)
+			go func() { served <- gopack.serve(conn) }()
+			defer func() {
+				gopack.Close()
+				peer.Close()
+				<-served
+			}()
+			if _, err := peer.Write(append(append([]byte(nil), c.frame...), valid...)); err != nil {
+				t.Fatal(err)
+			}
+			if msg := cb.next(t); string(msg.Payload) != "ok" {
+				t.Fatalf("got %q", msg.Payload)
+			}
+			if n := gopack.Stats().MalformedPackets; n != c.malformed {
+				t.Fatalf("%d malformed, want %d", n, c.malformed)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package gopack
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// capabilities optional features implemented by this package
+const capabilities = CapProperties | CapBatchAck | CapTopics | CapCompression | CapPing | CapNack
+
+// resetHandshake forgets peer capabilities of the previous connection
+func (gopack *GoPack2) resetHandshake() {
+	atomic.StoreInt32(&gopack.peerCaps, 0)
+	gopack.peerInfo.Store((*ConnectInfo)(nil))
+	gopack.resetParameters()
+	gopack.connackCh = make(chan struct{})
+	gopack.connacked = sync.Once{}
+}
+
+func (gopack *GoPack2) setPeerCaps(caps int) {
+	atomic.StoreInt32(&gopack.peerCaps, int32(caps))
+}
+
+// capable reports whether both peers advertised the capability in a
+// handshake on the current connection, without one only the base
+// protocol is used so peers that predate it keep working
+func (gopack *GoPack2) capable(capability int) bool {
+	if capabilities&capability == 0 {
+		return false
+	}
+	return int(atomic.LoadInt32(&gopack.peerCaps))&capability != 0
+}
+
+// handshake sends CONNECT and waits for CONNACK,
+// falls back to the base protocol on timeout
+func (gopack *GoPack2) handshake() error {
+	connect := &Packet{
+		MsgType:       MsgTypeConnect,
+		Capabilities:  gopack.advertised(),
+		ProducerID:    gopack.opts.ProducerID,
+		ProducerEpoch: gopack.opts.ProducerEpoch,
+		ClientID:      gopack.opts.ClientID,
+		Headers:       gopack.opts.ConnectProperties,
+	}
+	connect.Pack()
+	if _, err := gopack.send(connect.Buffer); err != nil {
+		return gopack.packetError("write", MsgTypeConnect, 0, err)
+	}
+	if err := gopack.flush(); err != nil {
+		return gopack.packetError("write", MsgTypeConnect, 0, err)
+	}
+	gopack.touch()
+	select {
+	case <-gopack.connackCh:
+	case <-gopack.exitCh:
+	case <-time.After(time.Duration(gopack.opts.HandshakeTimeout) * time.Millisecond):
+	}
+	return nil
+}
+
+// connAck answers CONNECT directly, bypassing the outbound queue
+func (gopack *GoPack2) connAck() error {
+	connack := &Packet{
+		MsgType:      MsgTypeConnAck,
+		Capabilities: gopack.advertised(),
+		Parameters:   gopack.opts.AssignParameters,
+	}
+	connack.Pack()
+	if _, err := gopack.send(connack.Buffer); err != nil {
+		return gopack.packetError("write", MsgTypeConnAck, 0, err)
+	}
+	return gopack.packetError("write", MsgTypeConnAck, 0, gopack.flush())
+}
+
+// wire returns the bytes of packet restricted to negotiated capabilities
+func (gopack *GoPack2) wire(packet *Packet) []byte {
+	if gopack.compressible(packet) && gopack.capable(CapProperties) {
+		return compressed(packet).Buffer
+	}
+	if packet.Buffer[0]&FlagProperties == 0 || gopack.capable(CapProperties) {
+		return packet.Buffer
+	}
+	stripped := packet.Clone()
+	stripped.pack(false)
+	return stripped.Buffer
+}
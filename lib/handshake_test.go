@@ -0,0 +1,74 @@
+package gopack
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandshakeCapabilities(t *testing.T) {
+	cases := []struct {
+		name      string
+		handshake bool
+		capable   bool
+		channel   int
+	}{
+		{"handshake", true, true, 7},
+		{"legacy", false, false, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, _, server, scb := pair(t, &Options{Handshake: c.handshake}, &Options{})
+			if _, err := client.Publish(&Message{Qos: Qos1, Channel: 7, Payload: []byte("x")}); err != nil {
+				t.Fatal(err)
+			}
+			if msg := scb.next(t); msg.Channel != c.channel {
+				t.Fatalf("channel %d, want %d", msg.Channel, c.channel)
+			}
+			for _, capability := range []int{CapProperties, CapBatchAck, CapCompression, CapPing, CapNack} {
+				if client.capable(capability) != c.capable || server.capable(capability) != c.capable {
+					t.Fatalf("capability %#x: client %v server %v, want %v", capability,
+						client.capable(capability), server.capable(capability), c.capable)
+				}
+			}
+		})
+	}
+}
+
+// TestLegacyPeer checks that a peer which never handshakes only sees
+// base protocol frames
+func TestLegacyPeer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := NewGoPack(&Options{
+		Address:     ln.Addr().String(),
+		CallbackObj: newTestCallback(),
+		Compression: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	payload := make([]byte, 4096)
+	if _, err := client.Publish(&Message{Qos: Qos1, Channel: 3, Headers: map[string]string{"k": "v"}, Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	client.Start()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header, err := bufio.NewReader(conn).Peek(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header[0]&FlagProperties != 0 {
+		t.Fatalf("legacy peer got a properties section in %#x", header[0])
+	}
+}
@@ -0,0 +1,84 @@
+package gopack
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrNotConnected means that there is no established connection
+var ErrNotConnected = errors.New("not connected")
+
+// ErrBacklog means that the outbound queue is above Options.ReadyPending
+var ErrBacklog = errors.New("outbound backlog")
+
+// Pinger may be implemented by a storage to report whether
+// its backing store is reachable
+type Pinger interface {
+	Ping() error
+}
+
+// Ping reports whether the spool file is still accessible
+func (sp *spool) Ping() error {
+	sp.mux.Lock()
+	defer sp.mux.Unlock()
+	_, err := sp.file.Stat()
+	return err
+}
+
+// Healthy returns nil if the storages and the spool are reachable
+func (gopack *GoPack2) Healthy() error {
+	stores := []interface{}{gopack.storage(), gopack.inboundStore()}
+	if gopack.spool != nil {
+		stores = append(stores, gopack.spool)
+	}
+	for _, s := range stores {
+		if p, ok := s.(Pinger); ok {
+			if err := p.Ping(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Ready returns nil if GoPack2 is healthy, connected
+// and the outbound queue is within Options.ReadyPending
+func (gopack *GoPack2) Ready() error {
+	if err := gopack.Healthy(); err != nil {
+		return err
+	}
+	gopack.muxCommit.Lock()
+	connected := gopack.connected
+	gopack.muxCommit.Unlock()
+	if !connected {
+		return ErrNotConnected
+	}
+	if gopack.opts.ReadyPending > 0 {
+		if count, _ := pending(gopack.storage()); count > gopack.opts.ReadyPending {
+			return ErrBacklog
+		}
+	}
+	return nil
+}
+
+// ProbeHandler returns a http.Handler answering /healthz and /readyz
+// with 200 or 503 and the reason
+func (gopack *GoPack2) ProbeHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		probe(w, gopack.Healthy())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		probe(w, gopack.Ready())
+	})
+	return mux
+}
+
+// probe writes the outcome of a health check
+func probe(w http.ResponseWriter, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,53 @@
+package gopack
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// brokenStorage is a storage whose backing store is unreachable
+type brokenStorage struct {
+	*memoryStorage
+}
+
+func (bs brokenStorage) Ping() error {
+	return errors.New("disk gone")
+}
+
+func TestProbes(t *testing.T) {
+	cases := []struct {
+		name      string
+		storage   OutboundStore
+		connected bool
+		queued    int
+		healthz   int
+		readyz    int
+	}{
+		{"ready", nil, true, 0, http.StatusOK, http.StatusOK},
+		{"not connected", nil, false, 0, http.StatusOK, http.StatusServiceUnavailable},
+		{"within backlog", nil, true, 2, http.StatusOK, http.StatusOK},
+		{"backlog", nil, true, 3, http.StatusOK, http.StatusServiceUnavailable},
+		{"broken storage", brokenStorage{newMemoryStorage()}, true, 0, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{Storage: c.storage, ReadyPending: 2})
+			for i := 0; i < c.queued; i++ {
+				if _, err := gopack.Commit(nil, Qos1); err != nil {
+					t.Fatal(err)
+				}
+			}
+			gopack.setConnected(c.connected)
+			handler := gopack.ProbeHandler()
+			for path, want := range map[string]int{"/healthz": c.healthz, "/readyz": c.readyz} {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+				if w.Code != want {
+					t.Fatalf("%s answered %d %q, want %d", path, w.Code, w.Body, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package gopack
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrDropped means that an interceptor dropped the message
+var ErrDropped = errors.New("message dropped")
+
+// Interceptor observes or mutates messages, Send is called for
+// committed messages before they are queued, Receive for received
+// messages before they are delivered, returning false drops the message,
+// a received message is still acknowledged,
+// Send must not commit messages itself
+type Interceptor interface {
+	Send(packet *Packet) bool
+	Receive(packet *Packet) bool
+}
+
+// interceptors chain in the order of Use
+type interceptors struct {
+	chain []Interceptor
+	mux   sync.RWMutex
+}
+
+func (ic *interceptors) use(i Interceptor) {
+	ic.mux.Lock()
+	defer ic.mux.Unlock()
+	ic.chain = append(ic.chain, i)
+}
+
+func (ic *interceptors) snapshot() []Interceptor {
+	ic.mux.RLock()
+	defer ic.mux.RUnlock()
+	return ic.chain
+}
+
+// send runs the chain in order, reports whether packet is kept
+func (ic *interceptors) send(packet *Packet) bool {
+	for _, i := range ic.snapshot() {
+		if !i.Send(packet) {
+			return false
+		}
+	}
+	return true
+}
+
+// receive runs the chain in reverse order, reports whether packet is kept
+func (ic *interceptors) receive(packet *Packet) bool {
+	chain := ic.snapshot()
+	for n := len(chain) - 1; n >= 0; n-- {
+		if !chain[n].Receive(packet) {
+			return false
+		}
+	}
+	return true
+}
+
+// Use appends i to the interceptor chain, outbound messages pass
+// interceptors in the order they were added, inbound ones in reverse
+func (gopack *GoPack2) Use(i Interceptor) {
+	gopack.interceptors.use(i)
+}
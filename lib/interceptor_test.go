@@ -0,0 +1,66 @@
+package gopack
+
+import (
+	"testing"
+	"time"
+)
+
+// tagInterceptor appends its name to the payload, dropping as configured
+type tagInterceptor struct {
+	name        string
+	dropSend    bool
+	dropReceive bool
+}
+
+func (ti *tagInterceptor) Send(packet *Packet) bool {
+	packet.Payload = append(packet.Payload, ti.name...)
+	return !ti.dropSend
+}
+
+func (ti *tagInterceptor) Receive(packet *Packet) bool {
+	packet.Payload = append(packet.Payload, ti.name...)
+	return !ti.dropReceive
+}
+
+func TestInterceptors(t *testing.T) {
+	cases := []struct {
+		name     string
+		client   []*tagInterceptor
+		server   []*tagInterceptor
+		err      error
+		received string
+	}{
+		{"none", nil, nil, nil, "m"},
+		{"send in order", []*tagInterceptor{{name: "a"}, {name: "b"}}, nil, nil, "mab"},
+		{"receive in reverse", nil, []*tagInterceptor{{name: "a"}, {name: "b"}}, nil, "mba"},
+		{"dropped on send", []*tagInterceptor{{name: "a", dropSend: true}, {name: "b"}}, nil, ErrDropped, ""},
+		{"dropped on receive", nil, []*tagInterceptor{{name: "a"}, {name: "b", dropReceive: true}}, nil, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, _, server, scb := pair(t, &Options{}, &Options{})
+			for _, i := range c.client {
+				client.Use(i)
+			}
+			for _, i := range c.server {
+				server.Use(i)
+			}
+			if _, err := client.Commit([]byte("m"), Qos1); err != c.err {
+				t.Fatalf("commit got %v, want %v", err, c.err)
+			}
+			if c.received != "" {
+				if msg := scb.next(t); string(msg.Payload) != c.received {
+					t.Fatalf("received %q, want %q", msg.Payload, c.received)
+				}
+			} else {
+				select {
+				case msg := <-scb.msgs:
+					t.Fatalf("dropped message %q delivered", msg.Payload)
+				case <-time.After(100 * time.Millisecond):
+				}
+			}
+			// dropped messages are still acknowledged
+			eventually(t, func() bool { return client.remaining() == 0 && client.ackSilence() == 0 })
+		})
+	}
+}
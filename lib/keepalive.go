@@ -0,0 +1,153 @@
+package gopack
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// keepaliveMisses heartbeats without inbound traffic
+// after which the peer is considered dead
+const keepaliveMisses = 3
+
+// retryPoll longest idle wait of the writer, retransmissions
+// are scheduled in seconds
+const retryPoll = time.Second
+
+// ErrKeepaliveTimeout means that the peer sent nothing,
+// not even a PONG, for several heartbeats
+var ErrKeepaliveTimeout = errors.New("keepalive timeout")
+
+// ErrWriteTimeout means that a write did not complete
+// within Options.WriteTimeout
+var ErrWriteTimeout = errors.New("write timeout")
+
+// dueStore may be implemented by an OutboundStore to tell
+// when its next scheduled packet is due
+type dueStore interface {
+	nextDue() (time.Time, bool)
+}
+
+// nextDue returns the unix time of the earliest scheduled packet,
+// false if none is waiting
+func (ms *memoryStorage) nextDue() (time.Time, bool) {
+	ms.muxPriorityQueue.Lock()
+	defer ms.muxPriorityQueue.Unlock()
+	if ms.ready.Len() > 0 || ms.retrying.Len() > 0 || ms.promoted.Len() > 0 {
+		return time.Time{}, true
+	}
+	if ms.waiting.Len() == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(ms.waiting.queue[0].Timestamp, 0), true
+}
+
+// idleWait returns how long the writer may wait for a wake up
+// before a scheduled packet is due
+func (gopack *GoPack2) idleWait() time.Duration {
+	wait := retryPoll
+	for _, store := range []OutboundStore{gopack.storage(), gopack.draining()} {
+		ds, ok := store.(dueStore)
+		if !ok {
+			continue
+		}
+		if due, ok := ds.nextDue(); ok {
+			if until := time.Until(due); until < wait {
+				wait = until
+			}
+		}
+	}
+	if wait < time.Millisecond {
+		wait = time.Millisecond
+	}
+	return wait
+}
+
+// resetKeepalive starts keepalive timing of a new connection
+func (gopack *GoPack2) resetKeepalive() {
+	atomic.StoreInt64(&gopack.lastWrite, time.Now().UnixNano())
+}
+
+// writeSilence returns how long nothing has been written
+func (gopack *GoPack2) writeSilence() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&gopack.lastWrite))
+}
+
+// ping sends PING once nothing was written for a heartbeat,
+// only to a peer that advertised CapPing in the handshake
+func (gopack *GoPack2) ping() error {
+	if !gopack.capable(CapPing) || gopack.writeSilence() < gopack.heartbeat() {
+		return nil
+	}
+	return gopack.control(MsgTypePing)
+}
+
+// pong answers PING
+func (gopack *GoPack2) pong() error {
+	return gopack.control(MsgTypePong)
+}
+
+// control writes a PING or PONG straight to the connection, past the
+// outbound queue, coalescing and bandwidth limits, so keepalives flow
+// while the writer is busy, every write holds whole packets
+func (gopack *GoPack2) control(msgType byte) error {
+	packet := Encode(msgType, Qos0, 0, 0, nil)
+	gopack.capture(CaptureOutbound, packet.Buffer)
+	_, err := gopack.writeConn(packet.Buffer)
+	return gopack.packetError("write", msgType, 0, err)
+}
+
+// writeConn writes b to the connection within Options.WriteTimeout,
+// a peer that stops reading fails the connection with ErrWriteTimeout
+// instead of blocking the writer for good
+func (gopack *GoPack2) writeConn(b []byte) (n int, err error) {
+	if timeout := gopack.opts.WriteTimeout; timeout > 0 {
+		deadline := time.Now().Add(time.Duration(timeout) * time.Millisecond)
+		if err = gopack.conn.SetWriteDeadline(deadline); err != nil {
+			return 0, err
+		}
+	}
+	n, err = gopack.conn.Write(b)
+	if n > 0 {
+		atomic.StoreInt64(&gopack.lastWrite, time.Now().UnixNano())
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		err = ErrWriteTimeout
+	}
+	return n, err
+}
+
+// deadlineReader is a connection that takes read deadlines
+type deadlineReader interface {
+	io.Reader
+	SetReadDeadline(time.Time) error
+}
+
+// keepaliveReader reads from the connection with a deadline of
+// keepaliveMisses heartbeats once the peer advertised CapPing in its
+// CONNECT or CONNACK, so a half-open connection fails within seconds
+// while a silent peer that predates PING is never timed out, every
+// read extends the deadline, a large packet on a slow link is traffic
+// before it is complete
+type keepaliveReader struct {
+	r      io.Reader
+	gopack *GoPack2
+}
+
+func (kr *keepaliveReader) Read(p []byte) (n int, err error) {
+	if conn, ok := kr.r.(deadlineReader); ok && kr.gopack.capable(CapPing) {
+		deadline := time.Now().Add(keepaliveMisses * kr.gopack.heartbeat())
+		if err = conn.SetReadDeadline(deadline); err != nil {
+			return 0, err
+		}
+	}
+	n, err = kr.r.Read(p)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		err = ErrKeepaliveTimeout
+	}
+	return n, err
+}
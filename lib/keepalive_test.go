@@ -0,0 +1,167 @@
+package gopack
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestKeepalive runs a client against a peer that goes silent, only a
+// peer that advertised CapPing is expected to answer PINGs
+func TestKeepalive(t *testing.T) {
+	cases := []struct {
+		name    string
+		connack *Packet
+		timeout bool
+	}{
+		{"legacy", nil, false},
+		{"without ping", &Packet{MsgType: MsgTypeConnAck, Capabilities: CapProperties}, false},
+		{"with ping", &Packet{MsgType: MsgTypeConnAck, Capabilities: CapProperties | CapPing}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			cb := newTestCallback()
+			client, err := NewGoPack(&Options{
+				Address:          ln.Addr().String(),
+				CallbackObj:      cb,
+				Heartbeat:        20,
+				Handshake:        c.connack != nil,
+				HandshakeTimeout: 1000,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			client.Start()
+			conn, err := ln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if c.connack != nil {
+				c.connack.Pack()
+				if _, err := conn.Write(c.connack.Buffer); err != nil {
+					t.Fatal(err)
+				}
+			}
+			select {
+			case err := <-cb.errs:
+				if !c.timeout || !errors.Is(err, ErrKeepaliveTimeout) {
+					t.Fatalf("unexpected error %v", err)
+				}
+			case <-time.After(20 * keepaliveMisses * 20 * time.Millisecond):
+				if c.timeout {
+					t.Fatal("silent peer was not timed out")
+				}
+			}
+		})
+	}
+}
+
+// TestPingPong idles a connection for many heartbeats, PINGs
+// answered with PONGs keep it up
+func TestPingPong(t *testing.T) {
+	cases := []struct {
+		name      string
+		heartbeat int // of the peer, the client's is 20
+	}{
+		{"peer answers", 60000},
+		{"both ping", 20},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, ccb, _, scb := pair(t, &Options{Handshake: true, Heartbeat: 20}, &Options{Heartbeat: c.heartbeat})
+			eventually(t, func() bool { return client.capable(CapPing) })
+			time.Sleep(10 * keepaliveMisses * 20 * time.Millisecond)
+			for _, cb := range []*testCallback{ccb, scb} {
+				select {
+				case err := <-cb.errs:
+					t.Fatalf("idle connection failed: %v", err)
+				default:
+				}
+			}
+			if _, err := client.Commit([]byte("x"), Qos1); err != nil {
+				t.Fatal(err)
+			}
+			scb.next(t)
+		})
+	}
+}
+
+func TestIdleWait(t *testing.T) {
+	cases := []struct {
+		name    string
+		prepare func(gopack *GoPack2)
+		min     time.Duration
+		max     time.Duration
+	}{
+		{"nothing queued", func(*GoPack2) {}, retryPoll, retryPoll},
+		{"ready", func(gopack *GoPack2) { gopack.Commit([]byte("x"), Qos1) }, time.Millisecond, time.Millisecond},
+		{"retry due soon", func(gopack *GoPack2) {
+			gopack.Commit([]byte("x"), Qos1)
+			packet := gopack.storage().Unconfirmed()
+			packet.Timestamp = time.Now().Unix() + 1
+			gopack.storage().Save(packet)
+		}, time.Millisecond, retryPoll},
+		{"retry due later", func(gopack *GoPack2) {
+			gopack.Commit([]byte("x"), Qos1)
+			packet := gopack.storage().Unconfirmed()
+			packet.Timestamp = time.Now().Unix() + 60
+			gopack.storage().Save(packet)
+		}, retryPoll, retryPoll},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{})
+			c.prepare(gopack)
+			if wait := gopack.idleWait(); wait < c.min || wait > c.max {
+				t.Fatalf("wait %v, want between %v and %v", wait, c.min, c.max)
+			}
+		})
+	}
+}
+
+// TestWriteTimeout serves a connection whose peer never reads
+func TestWriteTimeout(t *testing.T) {
+	cases := []struct {
+		name    string
+		timeout int
+		err     error
+	}{
+		{"deadline", 50, ErrWriteTimeout},
+		{"disabled", -1, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{WriteTimeout: c.timeout, Heartbeat: 60000})
+			conn, peer := net.Pipe()
+			served := make(chan error, 1)
+			go func() { served <- gopack.serve(conn) }()
+			defer func() {
+				gopack.Close()
+				peer.Close()
+				<-served
+			}()
+			if _, err := gopack.Commit([]byte("x"), Qos1); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case err := <-served:
+				served <- err
+				if c.err == nil || !errors.Is(err, c.err) {
+					t.Fatalf("served %v, want %v", err, c.err)
+				}
+			case <-time.After(300 * time.Millisecond):
+				if c.err != nil {
+					t.Fatal("blocked write did not time out")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package gopack
+
+import "sync"
+
+// lateAckMemory confirmed MsgIDs remembered to recognize late acknowledgments
+const lateAckMemory = 1024
+
+// confirmLog remembers the most recently confirmed MsgIDs
+type confirmLog struct {
+	ids  [lateAckMemory]MsgID
+	next int
+	seen map[MsgID]int // occurrences in ids
+	mux  sync.Mutex
+}
+
+func newConfirmLog() *confirmLog {
+	return &confirmLog{seen: make(map[MsgID]int)}
+}
+
+// add records confirmed id, forgetting the oldest one when full
+func (cl *confirmLog) add(id MsgID) {
+	cl.mux.Lock()
+	defer cl.mux.Unlock()
+	if old := cl.ids[cl.next]; old != 0 {
+		if cl.seen[old]--; cl.seen[old] <= 0 {
+			delete(cl.seen, old)
+		}
+	}
+	cl.ids[cl.next] = id
+	cl.seen[id]++
+	cl.next = (cl.next + 1) % lateAckMemory
+}
+
+// has reports whether id was confirmed recently
+func (cl *confirmLog) has(id MsgID) bool {
+	cl.mux.Lock()
+	defer cl.mux.Unlock()
+	return cl.seen[id] > 0
+}
+
+// settle confirms acknowledged id, an acknowledgment of an id that was
+// confirmed recently is a late duplicate and is counted and ignored,
+// one of an id never sent is counted as unknown
+func (gopack *GoPack2) settle(id MsgID) {
+	if packet := gopack.confirm(id); packet != nil {
+		gopack.confirmed.add(id)
+		stage := StageAcked
+		if packet.MsgType == MsgTypeRelease {
+			stage = StageCompleted
+		}
+		gopack.stage(packet.MsgType, packet.Qos, id, stage)
+		gopack.delivered(packet)
+		return
+	}
+	if gopack.confirmed.has(id) {
+		gopack.stats.lateAck()
+	} else {
+		gopack.stats.unknownAck()
+	}
+}
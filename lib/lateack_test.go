@@ -0,0 +1,77 @@
+package gopack
+
+import "testing"
+
+func TestConfirmLog(t *testing.T) {
+	ids := func(from, to int) (out []MsgID) {
+		for id := from; id <= to; id++ {
+			out = append(out, MsgID(id))
+		}
+		return
+	}
+	cases := []struct {
+		name  string
+		added []MsgID
+		has   []MsgID
+		not   []MsgID
+	}{
+		{"empty", nil, nil, []MsgID{1}},
+		{"recent", []MsgID{1, 2}, []MsgID{1, 2}, []MsgID{3}},
+		{"oldest forgotten", ids(1, lateAckMemory+1), ids(2, lateAckMemory+1), []MsgID{1}},
+		{"reused id kept", append([]MsgID{1}, append(ids(2, lateAckMemory), 1)...), []MsgID{1, 2}, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cl := newConfirmLog()
+			for _, id := range c.added {
+				cl.add(id)
+			}
+			for _, id := range c.has {
+				if !cl.has(id) {
+					t.Fatalf("%d forgotten", id)
+				}
+			}
+			for _, id := range c.not {
+				if cl.has(id) {
+					t.Fatalf("%d remembered", id)
+				}
+			}
+		})
+	}
+}
+
+func TestLateAck(t *testing.T) {
+	cases := []struct {
+		name    string
+		acks    int
+		unknown bool
+		late    int64
+	}{
+		{"on time", 1, false, 0},
+		{"duplicate", 3, false, 2},
+		{"never sent", 1, true, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{})
+			id, err := gopack.Commit([]byte("x"), Qos1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			transmit(t, gopack)
+			if c.unknown {
+				id += 100
+			}
+			for i := 0; i < c.acks; i++ {
+				gopack.settle(id)
+			}
+			stats := gopack.Stats()
+			if stats.LateAcks != c.late || (stats.UnknownAcks == 1) != c.unknown {
+				t.Fatalf("late %d, unknown %d", stats.LateAcks, stats.UnknownAcks)
+			}
+			if !c.unknown && gopack.remaining() != 0 {
+				t.Fatal("message not confirmed")
+			}
+		})
+	}
+}
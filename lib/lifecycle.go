@@ -0,0 +1,52 @@
+package gopack
+
+// Stage of an outbound QoS1 or QoS2 message in the protocol
+type Stage int
+
+// StageSent message transmitted, again on every retransmission
+const StageSent Stage = 0
+
+// StageAcked QoS1 message acknowledged by ACK
+const StageAcked Stage = 1
+
+// StageReceived QoS2 message confirmed by RECEIVED
+const StageReceived Stage = 2
+
+// StageReleased RELEASE of a QoS2 message transmitted
+const StageReleased Stage = 3
+
+// StageCompleted QoS2 message confirmed by COMPLETED
+const StageCompleted Stage = 4
+
+// String returns the name of the stage
+func (s Stage) String() string {
+	switch s {
+	case StageSent:
+		return "sent"
+	case StageAcked:
+		return "acked"
+	case StageReceived:
+		return "received"
+	case StageReleased:
+		return "released"
+	case StageCompleted:
+		return "completed"
+	}
+	return "unknown"
+}
+
+// stage passes a protocol step of a message or its release
+// to Options.OnStage
+func (gopack *GoPack2) stage(msgType, qos byte, id MsgID, stage Stage) {
+	if gopack.opts.OnStage == nil {
+		return
+	}
+	if msgType == MsgTypeRelease {
+		qos = Qos2
+	} else if msgType != MsgTypeSend || qos == Qos0 {
+		return
+	}
+	gopack.protect(func() {
+		gopack.opts.OnStage(id, qos, stage)
+	})
+}
@@ -0,0 +1,80 @@
+package gopack
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestOnStage(t *testing.T) {
+	cases := []struct {
+		name   string
+		qos    byte
+		stages []Stage
+	}{
+		{"qos0", Qos0, nil},
+		{"qos1", Qos1, []Stage{StageSent, StageAcked}},
+		{"qos2", Qos2, []Stage{StageSent, StageReceived, StageReleased, StageCompleted}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			type step struct {
+				id    MsgID
+				qos   byte
+				stage Stage
+			}
+			ch := make(chan step, 16)
+			hook := func(id MsgID, qos byte, stage Stage) {
+				ch <- step{id, qos, stage}
+			}
+			client, _, _, scb := pair(t, &Options{OnStage: hook}, &Options{})
+			id, err := client.Commit([]byte("x"), c.qos)
+			if err != nil {
+				t.Fatal(err)
+			}
+			scb.next(t)
+			eventually(t, func() bool { return client.remaining() == 0 })
+			var stages []Stage
+			for len(stages) < len(c.stages) {
+				s := <-ch
+				if s.id != id || s.qos != c.qos {
+					t.Fatalf("stage %v of %d at qos %d", s.stage, s.id, s.qos)
+				}
+				stages = append(stages, s.stage)
+			}
+			select {
+			case s := <-ch:
+				t.Fatalf("unexpected stage %v", s.stage)
+			case <-time.After(50 * time.Millisecond):
+			}
+			// sent and released are reported by the writer after the write
+			// returns, the reader may report the next stage first
+			sort.Slice(stages, func(i, j int) bool { return stages[i] < stages[j] })
+			if !reflect.DeepEqual(stages, c.stages) {
+				t.Fatalf("stages %v, want %v", stages, c.stages)
+			}
+		})
+	}
+}
+
+func TestStageString(t *testing.T) {
+	cases := []struct {
+		stage Stage
+		want  string
+	}{
+		{StageSent, "sent"},
+		{StageAcked, "acked"},
+		{StageReceived, "received"},
+		{StageReleased, "released"},
+		{StageCompleted, "completed"},
+		{Stage(9), "unknown"},
+	}
+	for _, c := range cases {
+		t.Run(c.want, func(t *testing.T) {
+			if got := c.stage.String(); got != c.want {
+				t.Fatalf("got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
@@ -9,139 +9,577 @@ import (
 // newMemoryStorage creates and initializes a new memoryStorage
 func newMemoryStorage() *memoryStorage {
 	ms := new(memoryStorage)
-	ms.index = make(map[int]int)
-	ms.packets = make(map[int][]byte)
+	ready := func(a, b *Packet) bool {
+		if ms.schedule == ScheduleByQos {
+			if class1, class2 := scheduleClass(a), scheduleClass(b); class1 != class2 {
+				return class1 < class2
+			}
+		}
+		key1, key2 := queueKey(a), queueKey(b)
+		if key1 == key2 {
+			return a.MsgID < b.MsgID
+		}
+		return key1 < key2
+	}
+	ms.ready = newPacketHeap(ready)
+	ms.retrying = newPacketHeap(ready)
+	ms.promoted = newPacketHeap(func(a, b *Packet) bool {
+		return ms.promotedAt[a.MsgID] < ms.promotedAt[b.MsgID]
+	})
+	ms.promotedAt = make(map[MsgID]uint64)
+	ms.waiting = newPacketHeap(func(a, b *Packet) bool {
+		if a.Timestamp == b.Timestamp {
+			return a.MsgID < b.MsgID
+		}
+		return a.Timestamp < b.Timestamp
+	})
+	ms.retryRatio = 1
+	ms.packets = make(map[MsgID]*Packet)
+	ms.receivedAt = make(map[MsgID]int64)
+	ms.confirmedAt = make(map[MsgID]int64)
 	return ms
 }
 
 // memoryStorage is used to save packet data
 type memoryStorage struct {
-	uniqueID int // incoming packet id
-	index    map[int]int
-	packets  map[int][]byte
+	uniqueID MsgID // last assigned packet id
+	packets  map[MsgID]*Packet
+
+	receivedAt map[MsgID]int64 // unix nano of receipt by packet id
 
-	// A PriorityQueue implements heap.
-	priorityQueue []*Packet
+	// due first transmissions and due retransmissions by priority,
+	// packets scheduled for later transmission by due time,
+	// promoted messages in the order of promotion
+	ready    *packetHeap
+	retrying *packetHeap
+	waiting  *packetHeap
+	promoted *packetHeap
+
+	promotedAt map[MsgID]uint64 // promotion sequence by id
+	promotions uint64
+
+	// new packets sent for every retransmission while both are due,
+	// fresh counts new packets sent since the last retransmission
+	retryRatio int
+	fresh      int
+
+	// unconfirmed messages in the queues
+	pendingCount  int
+	pendingBytes  int
+	reliableCount int
+
+	schedule int // ScheduleDueTime or ScheduleByQos
+
+	// ids confirmed within retention are not reassigned,
+	// confirmedAt holds unix nano by id, confirmedLog in confirm order
+	retention    time.Duration
+	confirmedAt  map[MsgID]int64
+	confirmedLog []confirmation
 
 	muxUniqueID      sync.Mutex
 	muxPriorityQueue sync.Mutex
 	muxPackets       sync.Mutex
 }
 
-// Len is the number of elements in the priority queue
-func (ms *memoryStorage) Len() int {
-	return len(ms.priorityQueue)
+// confirmation records when a packet was confirmed
+type confirmation struct {
+	id MsgID
+	at int64
+}
+
+// packetHeap implements heap ordered by less and tracks positions
+// of packets awaiting confirmation by MsgID
+type packetHeap struct {
+	queue []*Packet
+	less  func(a, b *Packet) bool
+	index map[MsgID]int
+}
+
+func newPacketHeap(less func(a, b *Packet) bool) *packetHeap {
+	return &packetHeap{less: less, index: make(map[MsgID]int)}
+}
+
+// confirmable reports whether packet waits for an acknowledgment,
+// replies share the id space of the peer and are not indexed
+func confirmable(packet *Packet) bool {
+	return packet.MsgType == MsgTypeSend || packet.MsgType == MsgTypeRelease
+}
+
+// Len is the number of elements in the heap
+func (h *packetHeap) Len() int {
+	return len(h.queue)
 }
 
 // Less reports whether the element with
 // index i should sort before the element with index j.
-func (ms *memoryStorage) Less(i, j int) bool {
-	item1 := ms.priorityQueue[i]
-	item2 := ms.priorityQueue[j]
-	if item1.Confirm && !item2.Confirm {
-		return true
-	} else if !item1.Confirm && item2.Confirm {
-		return false
-	}
-	if item1.Timestamp == item2.Timestamp {
-		return item1.MsgID < item2.MsgID
-	}
-	return item1.Timestamp < item2.Timestamp
+func (h *packetHeap) Less(i, j int) bool {
+	return h.less(h.queue[i], h.queue[j])
 }
 
 // Swap swaps the elements with indexes i and j
-func (ms *memoryStorage) Swap(i, j int) {
-	n := len(ms.priorityQueue)
-	if i >= 0 && i < n && j >= 0 && j < n {
-		ms.priorityQueue[i], ms.priorityQueue[j] = ms.priorityQueue[j], ms.priorityQueue[i]
-		ms.index[ms.priorityQueue[i].MsgID] = i
-		ms.index[ms.priorityQueue[j].MsgID] = j
+func (h *packetHeap) Swap(i, j int) {
+	item1, item2 := h.queue[i], h.queue[j]
+	h.queue[i], h.queue[j] = item2, item1
+	// only move index entries that point at the swapped packets,
+	// stale packets may share the id of an indexed one
+	if index, ok := h.index[item1.MsgID]; ok && index == i && confirmable(item1) {
+		h.index[item1.MsgID] = j
+	}
+	if index, ok := h.index[item2.MsgID]; ok && index == j && confirmable(item2) {
+		h.index[item2.MsgID] = i
 	}
 }
 
 // Push add x as element Len()
-func (ms *memoryStorage) Push(x interface{}) {
-	index := len(ms.priorityQueue)
+func (h *packetHeap) Push(x interface{}) {
 	packet := x.(*Packet)
-	ms.priorityQueue = append(ms.priorityQueue, packet)
-	ms.index[packet.MsgID] = index
+	if confirmable(packet) {
+		h.index[packet.MsgID] = len(h.queue)
+	}
+	h.queue = append(h.queue, packet)
 }
 
 // Pop remove and return element Len() - 1
-func (ms *memoryStorage) Pop() interface{} {
-	old := ms.priorityQueue
-	n := len(old)
-	if n > 0 {
-		packet := old[n-1]
-		ms.priorityQueue = old[0 : n-1]
-		return packet
+func (h *packetHeap) Pop() interface{} {
+	n := len(h.queue)
+	packet := h.queue[n-1]
+	h.queue[n-1] = nil
+	h.queue = h.queue[:n-1]
+	if cap(h.queue) > minQueueCapacity && len(h.queue) < cap(h.queue)/4 {
+		// give back memory after a burst
+		h.queue = append(make([]*Packet, 0, cap(h.queue)/2), h.queue...)
 	}
-	return nil
+	if index, ok := h.index[packet.MsgID]; ok && index == n-1 && confirmable(packet) {
+		delete(h.index, packet.MsgID)
+	}
+	return packet
+}
+
+// lookup returns the position of confirmable packet id
+func (h *packetHeap) lookup(id MsgID) (int, bool) {
+	index, ok := h.index[id]
+	return index, ok
+}
+
+// filter drops packets for which keep is false and returns them
+func (h *packetHeap) filter(keep func(*Packet) bool) (dropped []*Packet) {
+	queue := h.queue[:0]
+	for _, packet := range h.queue {
+		if keep(packet) {
+			queue = append(queue, packet)
+		} else {
+			dropped = append(dropped, packet)
+		}
+	}
+	for i := len(queue); i < len(h.queue); i++ {
+		h.queue[i] = nil
+	}
+	h.queue = queue
+	h.index = make(map[MsgID]int)
+	for i, packet := range queue {
+		if confirmable(packet) {
+			h.index[packet.MsgID] = i
+		}
+	}
+	heap.Init(h)
+	return dropped
 }
 
-// UniqueID generate unique id for new packet
-func (ms *memoryStorage) UniqueID() int {
+// minQueueCapacity heap capacity that is never given back
+const minQueueCapacity = 64
+
+// priorityAging seconds of queueing each priority level is worth
+const priorityAging = 1
+
+// queueKey orders packets by due time credited with their priority,
+// so urgent packets overtake a backlog while old low priority
+// packets eventually come first
+func queueKey(packet *Packet) int64 {
+	due := packet.Timestamp
+	if due == 0 {
+		due = packet.CreatedAt / int64(time.Second)
+	}
+	return due - int64(packet.Priority)*priorityAging
+}
+
+// count adjusts pending counters by packet when it is an unconfirmed message
+func (ms *memoryStorage) count(packet *Packet, sign int) {
+	if packet.MsgType == MsgTypeSend && !packet.Confirm {
+		ms.pendingCount += sign
+		ms.pendingBytes += sign * len(packet.Payload)
+		if packet.Qos != Qos0 {
+			ms.reliableCount += sign
+		}
+	}
+}
+
+// heaps returns every queue of outbound packets
+func (ms *memoryStorage) heaps() []*packetHeap {
+	return []*packetHeap{ms.promoted, ms.ready, ms.retrying, ms.waiting}
+}
+
+// find returns the queue holding confirmable packet id and its position
+func (ms *memoryStorage) find(id MsgID) (*packetHeap, int) {
+	for _, h := range ms.heaps() {
+		if index, ok := h.lookup(id); ok {
+			return h, index
+		}
+	}
+	return nil, 0
+}
+
+// UniqueID generate unique id for new packet, ids wrap around
+// skipping 0, ids of queued packets and recently confirmed ones,
+// returns 0 if every id is taken
+func (ms *memoryStorage) UniqueID() MsgID {
+	ms.muxUniqueID.Lock()
+	defer ms.muxUniqueID.Unlock()
+	ms.muxPriorityQueue.Lock()
+	defer ms.muxPriorityQueue.Unlock()
+	for i := 0; i < 0xffff; i++ {
+		ms.uniqueID++
+		if ms.uniqueID == 0 {
+			ms.uniqueID++
+		}
+		if h, _ := ms.find(ms.uniqueID); h == nil && !ms.retained(ms.uniqueID) {
+			return ms.uniqueID
+		}
+	}
+	return 0
+}
+
+// LastID returns the id last returned by UniqueID
+func (ms *memoryStorage) LastID() MsgID {
 	ms.muxUniqueID.Lock()
 	defer ms.muxUniqueID.Unlock()
-	ms.uniqueID++
 	return ms.uniqueID
 }
 
+// SetLastID makes UniqueID continue after id
+func (ms *memoryStorage) SetLastID(id MsgID) {
+	ms.muxUniqueID.Lock()
+	defer ms.muxUniqueID.Unlock()
+	ms.uniqueID = id
+}
+
+// holds reports whether packet id is queued or its confirmation retained
+func (ms *memoryStorage) holds(id MsgID) bool {
+	ms.muxPriorityQueue.Lock()
+	defer ms.muxPriorityQueue.Unlock()
+	h, _ := ms.find(id)
+	return h != nil || ms.retained(id)
+}
+
 // Save insert packet into queue
 func (ms *memoryStorage) Save(packet *Packet) {
 	ms.muxPriorityQueue.Lock()
 	defer ms.muxPriorityQueue.Unlock()
-	heap.Push(ms, packet)
+	ms.save(packet)
+}
+
+func (ms *memoryStorage) save(packet *Packet) {
+	if packet.Timestamp > time.Now().Unix() {
+		heap.Push(ms.waiting, packet)
+	} else {
+		ms.push(packet)
+	}
+	ms.count(packet, 1)
+}
+
+// push queues a due packet, retransmissions apart from the rest
+func (ms *memoryStorage) push(packet *Packet) {
+	if packet.RetryTimes > 0 {
+		heap.Push(ms.retrying, packet)
+	} else {
+		heap.Push(ms.ready, packet)
+	}
+}
+
+// next picks the queue of the next due packet, replies and promoted
+// messages go first, then new packets and retransmissions take turns by
+// retryRatio so neither a backlog nor a message that is never
+// acknowledged starves the other
+func (ms *memoryStorage) next() *packetHeap {
+	if ms.promoted.Len() > 0 &&
+		(ms.ready.Len() == 0 || confirmable(ms.ready.queue[0])) {
+		return ms.promoted
+	}
+	if ms.retrying.Len() == 0 {
+		return ms.ready
+	}
+	if ms.ready.Len() == 0 {
+		return ms.retrying
+	}
+	if !confirmable(ms.ready.queue[0]) || ms.fresh < ms.retryRatio {
+		return ms.ready
+	}
+	return ms.retrying
 }
 
 // Unconfirmed is used to return latest unconfirmed packet
 func (ms *memoryStorage) Unconfirmed() *Packet {
 	ms.muxPriorityQueue.Lock()
 	defer ms.muxPriorityQueue.Unlock()
-	for {
-		packet, ok := heap.Pop(ms).(*Packet)
-		if ok {
-			delete(ms.index, packet.MsgID)
-			if packet.Confirm {
-				continue
-			} else {
-				if packet.Timestamp > time.Now().Unix() {
-					heap.Push(ms, packet)
-				} else {
-					return packet
-				}
-			}
-		}
+	now := time.Now().Unix()
+	for ms.waiting.Len() > 0 && ms.waiting.queue[0].Timestamp <= now {
+		ms.push(heap.Pop(ms.waiting).(*Packet))
+	}
+	h := ms.next()
+	if h.Len() == 0 {
 		return nil
 	}
+	packet := heap.Pop(h).(*Packet)
+	if h == ms.promoted {
+		delete(ms.promotedAt, packet.MsgID)
+	} else if h == ms.retrying {
+		ms.fresh = 0
+	} else if confirmable(packet) {
+		ms.fresh++
+	}
+	ms.count(packet, -1)
+	return packet
 }
 
-// Confirm is used to set element.Confirm to true and Fix priority queue
-func (ms *memoryStorage) Confirm(id int) *Packet {
+// Confirm is used to set element.Confirm to true and remove it from the queue
+func (ms *memoryStorage) Confirm(id MsgID) *Packet {
 	ms.muxPriorityQueue.Lock()
 	defer ms.muxPriorityQueue.Unlock()
-	index, ok := ms.index[id]
-	if ok {
-		packet := ms.priorityQueue[index]
-		packet.Confirm = true
-		heap.Fix(ms, index)
-		return packet
+	return ms.confirm(id)
+}
+
+func (ms *memoryStorage) confirm(id MsgID) *Packet {
+	h, index := ms.find(id)
+	if h == nil {
+		return nil
+	}
+	packet := heap.Remove(h, index).(*Packet)
+	ms.count(packet, -1)
+	packet.Confirm = true
+	ms.retain(id)
+	return packet
+}
+
+// retain remembers confirmed id for the retention window
+// and forgets ids confirmed before it
+func (ms *memoryStorage) retain(id MsgID) {
+	if ms.retention <= 0 {
+		return
 	}
-	return nil
+	now := time.Now().UnixNano()
+	ms.confirmedAt[id] = now
+	ms.confirmedLog = append(ms.confirmedLog, confirmation{id, now})
+	before := now - int64(ms.retention)
+	i := 0
+	for ; i < len(ms.confirmedLog) && ms.confirmedLog[i].at < before; i++ {
+		c := ms.confirmedLog[i]
+		if ms.confirmedAt[c.id] == c.at {
+			delete(ms.confirmedAt, c.id)
+		}
+	}
+	if i > 0 {
+		ms.confirmedLog = append(ms.confirmedLog[:0:0], ms.confirmedLog[i:]...)
+	}
+}
+
+// retained reports whether id was confirmed within the retention window
+func (ms *memoryStorage) retained(id MsgID) bool {
+	at, ok := ms.confirmedAt[id]
+	return ok && time.Now().UnixNano()-at < int64(ms.retention)
+}
+
+// ConfirmAndSave confirms id and saves reply in one step
+func (ms *memoryStorage) ConfirmAndSave(id MsgID, reply *Packet) *Packet {
+	ms.muxPriorityQueue.Lock()
+	defer ms.muxPriorityQueue.Unlock()
+	packet := ms.confirm(id)
+	ms.save(reply)
+	return packet
+}
+
+// ReceiveAndSave receives packet and saves reply in one step
+func (ms *memoryStorage) ReceiveAndSave(id MsgID, packet *Packet, reply *Packet) {
+	ms.muxPackets.Lock()
+	defer ms.muxPackets.Unlock()
+	ms.muxPriorityQueue.Lock()
+	defer ms.muxPriorityQueue.Unlock()
+	ms.receive(id, packet)
+	ms.save(reply)
+}
+
+// ReleaseAndSave releases id and saves reply in one step
+func (ms *memoryStorage) ReleaseAndSave(id MsgID, reply *Packet) *Packet {
+	ms.muxPackets.Lock()
+	defer ms.muxPackets.Unlock()
+	ms.muxPriorityQueue.Lock()
+	defer ms.muxPriorityQueue.Unlock()
+	packet := ms.release(id)
+	ms.save(reply)
+	return packet
 }
 
 // Receive and save packet
-func (ms *memoryStorage) Receive(id int, payload []byte) {
+func (ms *memoryStorage) Receive(id MsgID, packet *Packet) {
 	ms.muxPackets.Lock()
 	defer ms.muxPackets.Unlock()
-	ms.packets[id] = payload
+	ms.receive(id, packet)
+}
+
+func (ms *memoryStorage) receive(id MsgID, packet *Packet) {
+	ms.packets[id] = packet
+	if _, ok := ms.receivedAt[id]; !ok {
+		ms.receivedAt[id] = time.Now().UnixNano()
+	}
 }
 
 // Release and delete packet
-func (ms *memoryStorage) Release(id int) []byte {
+func (ms *memoryStorage) Release(id MsgID) *Packet {
 	ms.muxPackets.Lock()
 	defer ms.muxPackets.Unlock()
+	return ms.release(id)
+}
+
+func (ms *memoryStorage) release(id MsgID) *Packet {
 	packet := ms.packets[id]
 	delete(ms.packets, id)
+	delete(ms.receivedAt, id)
 	return packet
 }
+
+// Purge drops unconfirmed messages committed before the unix nano time,
+// returns their ids
+func (ms *memoryStorage) Purge(before int64) (ids []MsgID) {
+	ms.muxPriorityQueue.Lock()
+	defer ms.muxPriorityQueue.Unlock()
+	keep := func(packet *Packet) bool {
+		return packet.MsgType != MsgTypeSend || packet.CreatedAt >= before
+	}
+	var dropped []*Packet
+	for _, h := range ms.heaps() {
+		dropped = append(dropped, h.filter(keep)...)
+	}
+	for _, packet := range dropped {
+		ms.count(packet, -1)
+		ids = append(ids, packet.MsgID)
+	}
+	return ids
+}
+
+// Cancel removes message packet that has not been transmitted yet
+func (ms *memoryStorage) Cancel(id MsgID) bool {
+	ms.muxPriorityQueue.Lock()
+	defer ms.muxPriorityQueue.Unlock()
+	h, index := ms.find(id)
+	if h == nil {
+		return false
+	}
+	packet := h.queue[index]
+	if packet.MsgType != MsgTypeSend || packet.RetryTimes > 0 {
+		return false
+	}
+	heap.Remove(h, index)
+	ms.count(packet, -1)
+	return true
+}
+
+// Pending returns the number and payload bytes of unconfirmed messages
+func (ms *memoryStorage) Pending() (int, int) {
+	ms.muxPriorityQueue.Lock()
+	defer ms.muxPriorityQueue.Unlock()
+	return ms.pendingCount, ms.pendingBytes
+}
+
+// Evict removes and returns one unconfirmed message chosen by policy,
+// nil if there is no candidate
+func (ms *memoryStorage) Evict(policy int) *Packet {
+	ms.muxPriorityQueue.Lock()
+	defer ms.muxPriorityQueue.Unlock()
+	var victimHeap *packetHeap
+	victim := -1
+	for _, h := range ms.heaps() {
+		for i, packet := range h.queue {
+			if packet.MsgType != MsgTypeSend {
+				continue
+			}
+			if policy == EvictOldestQos0 && packet.Qos != Qos0 {
+				continue
+			}
+			if victim < 0 {
+				victimHeap, victim = h, i
+				continue
+			}
+			current := victimHeap.queue[victim]
+			if policy == EvictLowestPriority && packet.Priority != current.Priority {
+				if packet.Priority < current.Priority {
+					victimHeap, victim = h, i
+				}
+				continue
+			}
+			if packet.CreatedAt < current.CreatedAt {
+				victimHeap, victim = h, i
+			}
+		}
+	}
+	if victim < 0 {
+		return nil
+	}
+	packet := heap.Remove(victimHeap, victim).(*Packet)
+	ms.count(packet, -1)
+	return packet
+}
+
+// Queued returns copies of the unconfirmed packets in the queue
+func (ms *memoryStorage) Queued() (packets []*Packet) {
+	ms.muxPriorityQueue.Lock()
+	defer ms.muxPriorityQueue.Unlock()
+	for _, h := range ms.heaps() {
+		for _, packet := range h.queue {
+			packets = append(packets, packet.Clone())
+		}
+	}
+	return packets
+}
+
+// OldestPending returns the age of the oldest unconfirmed message
+func (ms *memoryStorage) OldestPending() time.Duration {
+	ms.muxPriorityQueue.Lock()
+	defer ms.muxPriorityQueue.Unlock()
+	var oldest time.Duration
+	for _, h := range ms.heaps() {
+		if age := oldestPending(h.queue); age > oldest {
+			oldest = age
+		}
+	}
+	return oldest
+}
+
+// ReceiveBuffered returns the number of received packets waiting for release
+func (ms *memoryStorage) ReceiveBuffered() int {
+	ms.muxPackets.Lock()
+	defer ms.muxPackets.Unlock()
+	return len(ms.packets)
+}
+
+// Unreleased returns received packets waiting for release
+func (ms *memoryStorage) Unreleased() (packets []*Packet) {
+	ms.muxPackets.Lock()
+	defer ms.muxPackets.Unlock()
+	for _, packet := range ms.packets {
+		packets = append(packets, packet)
+	}
+	return packets
+}
+
+// Expire drops received packets waiting for release since before
+// the unix nano time and returns them
+func (ms *memoryStorage) Expire(before int64) (packets []*Packet) {
+	ms.muxPackets.Lock()
+	defer ms.muxPackets.Unlock()
+	for id, receivedAt := range ms.receivedAt {
+		if receivedAt < before {
+			packets = append(packets, ms.packets[id])
+			delete(ms.packets, id)
+			delete(ms.receivedAt, id)
+		}
+	}
+	return packets
+}
@@ -0,0 +1,338 @@
+package gopack
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// order pops every due packet of ms and returns their ids
+func order(ms *memoryStorage) (ids []MsgID) {
+	for packet := ms.Unconfirmed(); packet != nil; packet = ms.Unconfirmed() {
+		ids = append(ids, packet.MsgID)
+	}
+	return ids
+}
+
+func TestSchedule(t *testing.T) {
+	packets := []*Packet{
+		{MsgType: MsgTypeSend, Qos: Qos0, MsgID: 1, CreatedAt: 1e9},
+		{MsgType: MsgTypeSend, Qos: Qos1, MsgID: 2, CreatedAt: 2e9},
+		{MsgType: MsgTypeSend, Qos: Qos2, MsgID: 3, CreatedAt: 3e9},
+		{MsgType: MsgTypeAck, MsgID: 4, CreatedAt: 4e9},
+	}
+	cases := []struct {
+		name     string
+		schedule int
+		want     []MsgID
+	}{
+		{"due time", ScheduleDueTime, []MsgID{1, 2, 3, 4}},
+		{"by qos", ScheduleByQos, []MsgID{4, 3, 2, 1}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ms := newMemoryStorage()
+			ms.schedule = c.schedule
+			for _, packet := range packets {
+				copyPacket := *packet
+				ms.Save(&copyPacket)
+			}
+			if got := order(ms); !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestQos0Watermark(t *testing.T) {
+	cases := []struct {
+		name      string
+		watermark int
+		reliable  int
+		held      bool
+	}{
+		{"disabled", 0, 5, false},
+		{"below", 3, 2, false},
+		{"at", 3, 3, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{Qos0Watermark: c.watermark})
+			for i := 0; i < c.reliable; i++ {
+				if _, err := gopack.Commit(nil, Qos1); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if held := gopack.held(&Packet{MsgType: MsgTypeSend, Qos: Qos0}); held != c.held {
+				t.Fatalf("held %v, want %v", held, c.held)
+			}
+			if gopack.held(&Packet{MsgType: MsgTypeSend, Qos: Qos1}) {
+				t.Fatal("reliable message held")
+			}
+		})
+	}
+}
+
+func TestPriority(t *testing.T) {
+	cases := []struct {
+		name     string
+		created  []int64 // seconds, by id from 1
+		priority []byte
+		want     []MsgID
+	}{
+		{"fifo", []int64{1, 2, 3}, []byte{0, 0, 0}, []MsgID{1, 2, 3}},
+		{"higher first", []int64{1, 1, 1}, []byte{0, 5, 3}, []MsgID{2, 3, 1}},
+		{"aged past priority", []int64{1, 10, 11}, []byte{0, 5, 0}, []MsgID{1, 2, 3}},
+		{"priority within age", []int64{1, 3, 4}, []byte{0, 5, 0}, []MsgID{2, 1, 3}},
+		{"tie by id", []int64{2, 1}, []byte{1, 0}, []MsgID{1, 2}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ms := newMemoryStorage()
+			for i := range c.created {
+				ms.Save(&Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: MsgID(i + 1),
+					CreatedAt: c.created[i] * 1e9, Priority: c.priority[i]})
+			}
+			if got := order(ms); !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestRetryRatio(t *testing.T) {
+	cases := []struct {
+		name  string
+		ratio int
+		want  []MsgID
+	}{
+		{"alternate", 1, []MsgID{1, 11, 2, 12, 3, 4}},
+		{"two new per retry", 2, []MsgID{1, 2, 11, 3, 4, 12}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ms := newMemoryStorage()
+			ms.retryRatio = c.ratio
+			for id := MsgID(1); id <= 4; id++ {
+				ms.Save(&Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: id, CreatedAt: int64(id) * 1e9})
+			}
+			for id := MsgID(11); id <= 12; id++ {
+				ms.Save(&Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: id, CreatedAt: 1e9, RetryTimes: 1})
+			}
+			if got := order(ms); !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestEviction(t *testing.T) {
+	type queuedMsg struct {
+		qos      byte
+		priority byte
+		payload  string
+	}
+	queue := []queuedMsg{{Qos1, 1, "a"}, {Qos0, 2, "b"}, {Qos1, 0, "c"}}
+	cases := []struct {
+		name    string
+		policy  int
+		length  int
+		bytes   int
+		publish queuedMsg
+		err     error
+		evicted string
+	}{
+		{"room", EvictReject, 4, 0, queuedMsg{Qos1, 0, "d"}, nil, ""},
+		{"reject", EvictReject, 3, 0, queuedMsg{Qos1, 0, "d"}, ErrQueueFull, ""},
+		{"oldest qos0", EvictOldestQos0, 3, 0, queuedMsg{Qos1, 0, "d"}, nil, "b"},
+		{"lowest priority", EvictLowestPriority, 3, 0, queuedMsg{Qos1, 0, "d"}, nil, "c"},
+		{"bytes", EvictLowestPriority, 0, 4, queuedMsg{Qos1, 0, "dd"}, nil, "c"},
+		{"larger than queue", EvictLowestPriority, 0, 4, queuedMsg{Qos1, 0, "ddddd"}, ErrQueueFull, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cb := newTestCallback()
+			gopack := offline(t, &Options{CallbackObj: cb, EvictionPolicy: c.policy,
+				MaxQueueLength: c.length, MaxQueueBytes: c.bytes})
+			for _, m := range append(queue, c.publish) {
+				_, err := gopack.Publish(&Message{Qos: m.qos, Priority: m.priority, Payload: []byte(m.payload)})
+				if m == c.publish && err != c.err {
+					t.Fatalf("got %v, want %v", err, c.err)
+				} else if m != c.publish && err != nil {
+					t.Fatal(err)
+				}
+			}
+			left := map[string]bool{}
+			for _, packet := range queued(gopack.storage()) {
+				left[string(packet.Payload)] = true
+			}
+			if c.evicted != "" && left[c.evicted] {
+				t.Fatalf("%q not evicted", c.evicted)
+			}
+			if left[c.publish.payload] != (c.err == nil) {
+				t.Fatalf("%q queued %v", c.publish.payload, left[c.publish.payload])
+			}
+			select {
+			case err := <-cb.errs:
+				if c.evicted == "" || err != ErrEvicted {
+					t.Fatalf("reported %v", err)
+				}
+			default:
+				if c.evicted != "" {
+					t.Fatal("eviction not reported")
+				}
+			}
+		})
+	}
+}
+
+// TestIndex confirms and cancels packets out of order, every remaining
+// one must still come out exactly once
+func TestIndex(t *testing.T) {
+	cases := []struct {
+		name    string
+		confirm func(id MsgID) bool
+	}{
+		{"none", func(id MsgID) bool { return false }},
+		{"evens", func(id MsgID) bool { return id%2 == 0 }},
+		{"head", func(id MsgID) bool { return id <= 10 }},
+		{"tail", func(id MsgID) bool { return id > 90 }},
+		{"all", func(id MsgID) bool { return true }},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ms := newMemoryStorage()
+			for id := MsgID(100); id >= 1; id-- {
+				retries := 0
+				if id%3 == 0 {
+					retries = 1
+				}
+				ms.Save(&Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: id, CreatedAt: int64(id) * 1e9, RetryTimes: retries})
+			}
+			var want []MsgID
+			for id := MsgID(1); id <= 100; id++ {
+				switch {
+				case !c.confirm(id):
+					want = append(want, id)
+				case id%5 == 0 && id%3 != 0:
+					if !ms.Cancel(id) {
+						t.Fatalf("cancel %d failed", id)
+					}
+				default:
+					if packet := ms.Confirm(id); packet == nil || packet.MsgID != id {
+						t.Fatalf("confirm %d returned %v", id, packet)
+					}
+				}
+				if ms.holds(id) == c.confirm(id) {
+					t.Fatalf("holds %d %v", id, !c.confirm(id))
+				}
+			}
+			got := order(ms)
+			sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+			if len(got) != len(want) || (len(want) > 0 && !reflect.DeepEqual(got, want)) {
+				t.Fatalf("left %v, want %v", got, want)
+			}
+			if count, _ := ms.Pending(); count != 0 {
+				t.Fatalf("%d pending after draining", count)
+			}
+		})
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	message := func() *Packet { return &Packet{MsgType: MsgTypeSend, Qos: Qos2, MsgID: 1, Payload: []byte("x")} }
+	cases := []struct {
+		name       string
+		setup      func(ms *memoryStorage)
+		apply      func(ms *memoryStorage, reply *Packet) *Packet
+		returned   bool
+		unreleased int
+	}{
+		{"receive", func(ms *memoryStorage) {}, func(ms *memoryStorage, reply *Packet) *Packet {
+			ms.ReceiveAndSave(1, message(), reply)
+			return nil
+		}, false, 1},
+		{"confirm", func(ms *memoryStorage) { ms.Save(message()) }, func(ms *memoryStorage, reply *Packet) *Packet {
+			return ms.ConfirmAndSave(1, reply)
+		}, true, 0},
+		{"confirm unknown", func(ms *memoryStorage) {}, func(ms *memoryStorage, reply *Packet) *Packet {
+			return ms.ConfirmAndSave(1, reply)
+		}, false, 0},
+		{"release", func(ms *memoryStorage) { ms.Receive(1, message()) }, func(ms *memoryStorage, reply *Packet) *Packet {
+			return ms.ReleaseAndSave(1, reply)
+		}, true, 0},
+		{"release unknown", func(ms *memoryStorage) {}, func(ms *memoryStorage, reply *Packet) *Packet {
+			return ms.ReleaseAndSave(1, reply)
+		}, false, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ms := newMemoryStorage()
+			c.setup(ms)
+			reply := &Packet{MsgType: MsgTypeReceived, MsgID: 1}
+			if packet := c.apply(ms, reply); (packet != nil) != c.returned {
+				t.Fatalf("returned %v", packet)
+			}
+			if n := len(ms.Unreleased()); n != c.unreleased {
+				t.Fatalf("%d unreleased, want %d", n, c.unreleased)
+			}
+			if packet := ms.Unconfirmed(); packet != reply {
+				t.Fatalf("queued %v, want the reply", packet)
+			}
+			if packet := ms.Unconfirmed(); packet != nil {
+				t.Fatalf("%v left in the queue", packet)
+			}
+		})
+	}
+}
+
+func TestConfirmRetention(t *testing.T) {
+	cases := []struct {
+		name      string
+		retention time.Duration
+		wait      time.Duration
+		next      MsgID
+	}{
+		{"disabled", 0, 0, 1},
+		{"within window", time.Hour, 0, 2},
+		{"window passed", 10 * time.Millisecond, 20 * time.Millisecond, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ms := newMemoryStorage()
+			ms.retention = c.retention
+			ms.Save(&Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: ms.UniqueID()})
+			ms.Confirm(1)
+			time.Sleep(c.wait)
+			ms.SetLastID(0)
+			if id := ms.UniqueID(); id != c.next {
+				t.Fatalf("next id %d, want %d", id, c.next)
+			}
+		})
+	}
+}
+
+func TestQueueShrinks(t *testing.T) {
+	cases := []struct {
+		name  string
+		burst int
+	}{
+		{"small", minQueueCapacity},
+		{"burst", 10000},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ms := newMemoryStorage()
+			for id := 1; id <= c.burst; id++ {
+				ms.Save(&Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: MsgID(id)})
+			}
+			if n := len(order(ms)); n != c.burst {
+				t.Fatalf("%d packets drained, want %d", n, c.burst)
+			}
+			if capacity := cap(ms.ready.queue); capacity > 2*minQueueCapacity {
+				t.Fatalf("drained queue keeps capacity %d", capacity)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package gopack
+
+// CopyStorage copies queued packets of a ListableStorage and, if both
+// are inbound stores, unreleased QoS2 messages from one storage into
+// another and continues the MsgID sequence of from
+func CopyStorage(from, to OutboundStore) {
+	copyQueued(from, to)
+	copyInbound(from, to)
+	continueIDs(from, to)
+}
+
+// copyQueued copies queued packets from one storage into another
+func copyQueued(from, to OutboundStore) {
+	for _, packet := range queued(from) {
+		to.Save(packet)
+	}
+}
+
+// queued returns copies of the packets held by store, nil if it does not
+// implement ListableStorage
+func queued(store OutboundStore) []*Packet {
+	if ls, ok := store.(ListableStorage); ok {
+		return ls.Queued()
+	}
+	return nil
+}
+
+// pending returns the number and payload bytes of unconfirmed messages
+// in store, counted from its queue if it does not implement PendingStorage
+func pending(store OutboundStore) (count, bytes int) {
+	if ps, ok := store.(PendingStorage); ok {
+		return ps.Pending()
+	}
+	for _, packet := range queued(store) {
+		if packet.MsgType == MsgTypeSend && !packet.Confirm {
+			count++
+			bytes += len(packet.Payload)
+		}
+	}
+	return count, bytes
+}
+
+// drained reports whether store holds nothing left to send or confirm,
+// a storage that cannot tell is never drained
+func drained(store OutboundStore) bool {
+	if _, ok := store.(ListableStorage); ok {
+		return len(queued(store)) == 0
+	}
+	return false
+}
+
+// copyInbound copies unreleased QoS2 messages if from and to are inbound stores
+func copyInbound(from, to interface{}) {
+	in, ok := from.(InboundStore)
+	out, ok2 := to.(InboundStore)
+	if !ok || !ok2 {
+		return
+	}
+	for _, packet := range in.Unreleased() {
+		out.Receive(packet.MsgID, packet)
+	}
+}
+
+// SequencedStorage may be implemented by an OutboundStore whose
+// MsgID sequence can be continued by another storage
+type SequencedStorage interface {
+	LastID() MsgID   // id last returned by UniqueID
+	SetLastID(MsgID) // continue UniqueID after id
+}
+
+// continueIDs continues the MsgID sequence of to after the one of from,
+// from is left untouched, nothing happens unless both are sequenced
+func continueIDs(from, to OutboundStore) {
+	src, ok := from.(SequencedStorage)
+	dst, ok2 := to.(SequencedStorage)
+	if ok && ok2 {
+		dst.SetLastID(src.LastID())
+	}
+}
+
+// holderStore may be implemented by an OutboundStore to look up
+// a packet by id without listing the queue
+type holderStore interface {
+	holds(MsgID) bool
+}
+
+// holds reports whether store keeps packet id queued or unconfirmed
+func holds(store OutboundStore, id MsgID) bool {
+	if hs, ok := store.(holderStore); ok {
+		return hs.holds(id)
+	}
+	for _, packet := range queued(store) {
+		if packet.MsgID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// SwitchStorage directs new messages and protocol state to storage s,
+// packets queued in the current storage are still sent and confirmed
+// until it is drained, after which it is released
+func (gopack *GoPack2) SwitchStorage(s OutboundStore) {
+	gopack.muxCommit.Lock()
+	defer gopack.muxCommit.Unlock()
+	// a packet the writer took from a storage being merged
+	// must be saved back before the storage is dropped
+	gopack.muxLoop.Lock()
+	defer gopack.muxLoop.Unlock()
+	gopack.muxStorage.Lock()
+	defer gopack.muxStorage.Unlock()
+	if gopack.old != nil {
+		// still draining a previous switch, merge it into the current
+		// one, whose ids already continue the ones of the previous
+		copyQueued(gopack.old, gopack.store)
+		copyInbound(gopack.old, gopack.store)
+	}
+	continueIDs(gopack.store, s)
+	gopack.moveInbound(s)
+	gopack.old = gopack.store
+	gopack.store = s
+}
+
+// moveInbound makes s the inbound store if it is one and the current
+// inbound store is the outbound storage, guarded by muxStorage
+func (gopack *GoPack2) moveInbound(s OutboundStore) {
+	in, ok := s.(InboundStore)
+	if !ok || interface{}(gopack.inStore) != interface{}(gopack.store) {
+		return
+	}
+	copyInbound(gopack.inStore, s)
+	gopack.inStore = in
+}
+
+// SetStorage pauses sending and receiving, moves all queued and
+// unreleased state into storage s, makes it the active storage and resumes
+func (gopack *GoPack2) SetStorage(s OutboundStore) {
+	gopack.muxCommit.Lock()
+	defer gopack.muxCommit.Unlock()
+	gopack.muxLoop.Lock()
+	defer gopack.muxLoop.Unlock()
+	gopack.muxStorage.Lock()
+	defer gopack.muxStorage.Unlock()
+	if gopack.old != nil {
+		CopyStorage(gopack.old, s)
+		gopack.old = nil
+	}
+	shared := interface{}(gopack.inStore) == interface{}(gopack.store)
+	CopyStorage(gopack.store, s)
+	if in, ok := s.(InboundStore); ok && shared {
+		gopack.inStore = in
+	}
+	gopack.store = s
+}
+
+// storage returns the active storage
+func (gopack *GoPack2) storage() OutboundStore {
+	gopack.muxStorage.RLock()
+	defer gopack.muxStorage.RUnlock()
+	return gopack.store
+}
+
+// draining returns the storage being drained, nil if none
+func (gopack *GoPack2) draining() OutboundStore {
+	gopack.muxStorage.RLock()
+	defer gopack.muxStorage.RUnlock()
+	return gopack.old
+}
+
+// unconfirmed returns the next packet to send and the storage it came from,
+// a storage being drained goes first
+func (gopack *GoPack2) unconfirmed() (OutboundStore, *Packet) {
+	if old := gopack.draining(); old != nil {
+		if packet := old.Unconfirmed(); packet != nil {
+			return old, packet
+		}
+		if drained(old) {
+			gopack.muxStorage.Lock()
+			if gopack.old == old {
+				gopack.old = nil
+			}
+			gopack.muxStorage.Unlock()
+		}
+	}
+	store := gopack.storage()
+	return store, store.Unconfirmed()
+}
+
+// confirm confirms id in the active storage and the one being drained,
+// returns the confirmed packet, nil if neither held it
+func (gopack *GoPack2) confirm(id MsgID) *Packet {
+	var packet *Packet
+	if old := gopack.draining(); old != nil {
+		packet = old.Confirm(id)
+	}
+	if confirmed := gopack.storage().Confirm(id); confirmed != nil {
+		packet = confirmed
+	}
+	return packet
+}
+
+// inboundStore returns the store of received QoS2 messages
+func (gopack *GoPack2) inboundStore() InboundStore {
+	gopack.muxStorage.RLock()
+	defer gopack.muxStorage.RUnlock()
+	return gopack.inStore
+}
+
+// transactional returns the active storage if it also holds
+// received messages and applies transitions atomically
+func (gopack *GoPack2) transactional() TransactionalStorage {
+	gopack.muxStorage.RLock()
+	defer gopack.muxStorage.RUnlock()
+	if tx, ok := gopack.store.(TransactionalStorage); ok &&
+		interface{}(gopack.inStore) == interface{}(gopack.store) {
+		return tx
+	}
+	return nil
+}
+
+// receiveAndSave records a received QoS2 packet and queues reply
+func (gopack *GoPack2) receiveAndSave(id MsgID, packet *Packet, reply *Packet) {
+	if tx := gopack.transactional(); tx != nil {
+		tx.ReceiveAndSave(id, packet, reply)
+		return
+	}
+	gopack.inboundStore().Receive(id, packet)
+	gopack.storage().Save(reply)
+}
+
+// confirmAndSave confirms id and queues reply,
+// returns the confirmed packet if any
+func (gopack *GoPack2) confirmAndSave(id MsgID, reply *Packet) *Packet {
+	var packet *Packet
+	if old := gopack.draining(); old != nil {
+		packet = old.Confirm(id)
+	}
+	store := gopack.storage()
+	var confirmed *Packet
+	if tx, ok := store.(TransactionalStorage); ok {
+		confirmed = tx.ConfirmAndSave(id, reply)
+	} else {
+		confirmed = store.Confirm(id)
+		store.Save(reply)
+	}
+	if confirmed != nil {
+		packet = confirmed
+	}
+	return packet
+}
+
+// releaseAndSave releases id and queues reply
+func (gopack *GoPack2) releaseAndSave(id MsgID, reply *Packet) *Packet {
+	if tx := gopack.transactional(); tx != nil {
+		return tx.ReleaseAndSave(id, reply)
+	}
+	received := gopack.inboundStore().Release(id)
+	gopack.storage().Save(reply)
+	return received
+}
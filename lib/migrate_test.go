@@ -0,0 +1,155 @@
+package gopack
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCopyStorage(t *testing.T) {
+	cases := []struct {
+		name  string
+		count int
+		last  MsgID
+	}{
+		{"empty", 0, 0},
+		{"queued", 3, 0},
+		{"wrapped", 2, 0xffff},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			from, to := newMemoryStorage(), newMemoryStorage()
+			from.SetLastID(c.last)
+			for i := 0; i < c.count; i++ {
+				from.Save(&Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: from.UniqueID()})
+			}
+			last := from.LastID()
+			CopyStorage(from, to)
+			if from.LastID() != last || len(from.Queued()) != c.count {
+				t.Fatalf("source changed: last id %d, %d queued", from.LastID(), len(from.Queued()))
+			}
+			if n := len(to.Queued()); n != c.count {
+				t.Fatalf("%d packets copied, want %d", n, c.count)
+			}
+			id := to.UniqueID()
+			if want := last + 1; id != want {
+				t.Fatalf("next id %d, want %d", id, want)
+			}
+		})
+	}
+}
+
+// TestSwitchStorageIDs wraps the new storage around to an id still
+// queued in the storage being drained
+func TestSwitchStorageIDs(t *testing.T) {
+	gopack := offline(t, &Options{})
+	queued, err := gopack.Commit([]byte("old"), Qos1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newMemoryStorage()
+	gopack.SwitchStorage(store)
+	store.SetLastID(queued - 1)
+	id, err := gopack.Commit([]byte("new"), Qos1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == queued {
+		t.Fatalf("id %d of the draining storage reassigned", id)
+	}
+	if packet := gopack.confirm(queued); packet == nil || string(packet.Payload) != "old" {
+		t.Fatalf("confirmed %v", packet)
+	}
+	if !holds(store, id) {
+		t.Fatalf("message %d lost", id)
+	}
+}
+
+// TestHotSwap replaces the storage of a connected client halfway
+// through a burst, every message must arrive once
+func TestHotSwap(t *testing.T) {
+	cases := []struct {
+		name string
+		swap func(gopack *GoPack2, s OutboundStore)
+	}{
+		{"set", (*GoPack2).SetStorage},
+		{"switch", (*GoPack2).SwitchStorage},
+		{"switch twice", func(gopack *GoPack2, s OutboundStore) {
+			gopack.SwitchStorage(newMemoryStorage())
+			gopack.SwitchStorage(s)
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, _, _, scb := pair(t, &Options{}, &Options{})
+			store := newMemoryStorage()
+			for i := 0; i < 20; i++ {
+				if i == 10 {
+					c.swap(client, store)
+				}
+				if _, err := client.Commit([]byte(fmt.Sprint(i)), Qos2); err != nil {
+					t.Fatal(err)
+				}
+			}
+			seen := make(map[string]bool)
+			for len(seen) < 20 {
+				payload := string(scb.next(t).Payload)
+				if seen[payload] {
+					t.Fatalf("%s delivered twice", payload)
+				}
+				seen[payload] = true
+			}
+			eventually(t, func() bool { return client.remaining() == 0 && client.draining() == nil })
+			if client.storage() != OutboundStore(store) {
+				t.Fatal("new storage not active")
+			}
+		})
+	}
+}
+
+// TestSwitchStorageInFlight switches storage while the writer holds
+// a packet it took from the storage being drained
+func TestSwitchStorageInFlight(t *testing.T) {
+	cases := []struct {
+		name     string
+		switches int
+	}{
+		{"first switch", 1},
+		{"second switch", 2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{})
+			id, err := gopack.Commit([]byte("x"), Qos1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 1; i < c.switches; i++ {
+				gopack.SwitchStorage(newMemoryStorage())
+			}
+			// as writeNext does between taking and saving back a packet
+			gopack.muxLoop.RLock()
+			store, packet := gopack.unconfirmed()
+			if packet == nil || packet.MsgID != id {
+				t.Fatalf("took %v", packet)
+			}
+			switched := make(chan struct{})
+			go func() {
+				gopack.SwitchStorage(newMemoryStorage())
+				close(switched)
+			}()
+			select {
+			case <-switched:
+				t.Fatal("switched while a packet was in flight")
+			case <-time.After(50 * time.Millisecond):
+			}
+			store.Save(gopack.retry(packet))
+			gopack.muxLoop.RUnlock()
+			<-switched
+			if !holds(gopack.storage(), id) &&
+				(gopack.draining() == nil || !holds(gopack.draining(), id)) {
+				t.Fatalf("message %d lost", id)
+			}
+		})
+	}
+}
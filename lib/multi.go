@@ -0,0 +1,97 @@
+package gopack
+
+import "errors"
+
+// ErrUnknownPeer means that an address is not one of the MultiClient peers
+var ErrUnknownPeer = errors.New("unknown peer")
+
+// ErrSharedStorage means that Options name a storage or spool
+// that would be shared between peers
+var ErrSharedStorage = errors.New("storage cannot be shared between peers")
+
+// MultiClient keeps a GoPack2 connection to each of several addresses,
+// received messages carry the address in Message.Origin
+type MultiClient struct {
+	peers     map[string]*GoPack2
+	addresses []string
+}
+
+// NewMultiClient creates a GoPack2 for every address from a copy of opts,
+// each with its own memory storage
+func NewMultiClient(opts *Options, addresses ...string) (*MultiClient, error) {
+	if opts == nil || len(addresses) == 0 {
+		return nil, ErrMissingParams
+	}
+	if opts.Storage != nil || opts.InboundStorage != nil || opts.SpoolPath != "" {
+		return nil, ErrSharedStorage
+	}
+	mc := &MultiClient{peers: make(map[string]*GoPack2)}
+	for _, address := range addresses {
+		peerOpts := *opts
+		peerOpts.Address = address
+		gopack, err := NewGoPack(&peerOpts)
+		if err != nil {
+			return nil, err
+		}
+		mc.peers[address] = gopack
+		mc.addresses = append(mc.addresses, address)
+	}
+	return mc, nil
+}
+
+// Start connects to every peer
+func (mc *MultiClient) Start() {
+	for _, gopack := range mc.peers {
+		gopack.Start()
+	}
+}
+
+// Close stops every connection
+func (mc *MultiClient) Close() {
+	for _, gopack := range mc.peers {
+		gopack.Close()
+	}
+}
+
+// Peers returns the peer addresses in the order given
+func (mc *MultiClient) Peers() []string {
+	return append([]string(nil), mc.addresses...)
+}
+
+// Peer returns the GoPack2 of address, nil if it is not a peer
+func (mc *MultiClient) Peer(address string) *GoPack2 {
+	return mc.peers[address]
+}
+
+// Commit is used to commit message to the peer at address
+func (mc *MultiClient) Commit(address string, payload []byte, qos byte) (MsgID, error) {
+	return mc.Publish(address, &Message{Qos: qos, Payload: payload})
+}
+
+// Publish is used to commit message with metadata to the peer at address
+func (mc *MultiClient) Publish(address string, msg *Message) (MsgID, error) {
+	gopack, ok := mc.peers[address]
+	if !ok {
+		return 0, ErrUnknownPeer
+	}
+	return gopack.Publish(msg)
+}
+
+// Broadcast commits a copy of msg to every peer,
+// returns the MsgIDs by address and the first error
+func (mc *MultiClient) Broadcast(msg *Message) (map[string]MsgID, error) {
+	ids := make(map[string]MsgID, len(mc.peers))
+	var first error
+	for _, address := range mc.addresses {
+		copied := *msg
+		id, err := mc.peers[address].Publish(&copied)
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		ids[address] = id
+	}
+	return ids, first
+}
@@ -0,0 +1,120 @@
+package gopack
+
+import (
+	"net"
+	"testing"
+)
+
+// listen serves the first connection accepted on a loopback port,
+// returns its address, the serving peer and its callback
+func listen(t *testing.T, opts *Options) (string, *GoPack2, *testCallback) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb := newTestCallback()
+	opts.CallbackObj = cb
+	server, err := NewGoPack(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		conn, err := ln.Accept()
+		ln.Close()
+		if err != nil {
+			return
+		}
+		server.serve(conn)
+	}()
+	t.Cleanup(func() {
+		server.Close()
+		ln.Close()
+		<-served
+	})
+	return ln.Addr().String(), server, cb
+}
+
+func TestNewMultiClient(t *testing.T) {
+	cases := []struct {
+		name      string
+		opts      *Options
+		addresses []string
+		err       error
+	}{
+		{"peers", &Options{}, []string{"a:1", "b:1"}, nil},
+		{"no options", nil, []string{"a:1"}, ErrMissingParams},
+		{"no peers", &Options{}, nil, ErrMissingParams},
+		{"shared storage", &Options{Storage: newMemoryStorage()}, []string{"a:1"}, ErrSharedStorage},
+		{"shared spool", &Options{SpoolPath: "spool"}, []string{"a:1"}, ErrSharedStorage},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if c.opts != nil {
+				c.opts.CallbackObj = newTestCallback()
+			}
+			mc, err := NewMultiClient(c.opts, c.addresses...)
+			if err != c.err {
+				t.Fatalf("err %v, want %v", err, c.err)
+			}
+			if err != nil {
+				return
+			}
+			defer mc.Close()
+			if got := mc.Peers(); len(got) != 2 || got[0] != "a:1" || got[1] != "b:1" {
+				t.Fatalf("peers %v", got)
+			}
+			if mc.Peer("a:1") == mc.Peer("b:1") || mc.Peer("a:1").storage() == mc.Peer("b:1").storage() {
+				t.Fatal("peers share state")
+			}
+			if _, err := mc.Commit("c:1", []byte("x"), Qos1); err != ErrUnknownPeer {
+				t.Fatalf("err %v, want ErrUnknownPeer", err)
+			}
+		})
+	}
+}
+
+func TestMultiClient(t *testing.T) {
+	cases := []struct {
+		name  string
+		peers int
+	}{
+		{"one peer", 1},
+		{"three peers", 3},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			addresses := make([]string, c.peers)
+			servers := make(map[string]*GoPack2)
+			callbacks := make(map[string]*testCallback)
+			for i := range addresses {
+				address, server, cb := listen(t, &Options{})
+				addresses[i], servers[address], callbacks[address] = address, server, cb
+			}
+			ccb := newTestCallback()
+			mc, err := NewMultiClient(&Options{CallbackObj: ccb}, addresses...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mc.Start()
+			defer mc.Close()
+			ids, err := mc.Broadcast(&Message{Qos: Qos1, Payload: []byte("all")})
+			if err != nil || len(ids) != c.peers {
+				t.Fatalf("ids %v, err %v", ids, err)
+			}
+			for _, address := range addresses {
+				if msg := callbacks[address].next(t); string(msg.Payload) != "all" {
+					t.Fatalf("%s got %q", address, msg.Payload)
+				}
+				if _, err := servers[address].Commit([]byte(address), Qos1); err != nil {
+					t.Fatal(err)
+				}
+				if msg := ccb.next(t); msg.Origin != address || string(msg.Payload) != address {
+					t.Fatalf("got %q from %q, want %q", msg.Payload, msg.Origin, address)
+				}
+			}
+		})
+	}
+}
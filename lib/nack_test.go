@@ -0,0 +1,79 @@
+package gopack
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// transmit takes the next due packet from storage as writeNext does
+func transmit(t *testing.T, gopack *GoPack2) *Packet {
+	t.Helper()
+	packet := gopack.storage().Unconfirmed()
+	if packet == nil {
+		t.Fatal("nothing due")
+	}
+	gopack.sent(packet)
+	if next := gopack.retry(packet); next != nil {
+		packet = next
+	}
+	gopack.storage().Save(packet)
+	return packet
+}
+
+func TestRefused(t *testing.T) {
+	cases := []struct {
+		name    string
+		reasons []byte
+		dead    bool
+	}{
+		{"decode", []byte{NackDecode}, false},
+		{"decode retransmission", []byte{NackDecode, NackDecode}, true},
+		{"quota", []byte{NackQuota, NackQuota, NackQuota}, false},
+		{"unauthorized", []byte{NackUnauthorized}, true},
+		{"rejected", []byte{NackRejected}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{RetryInterval: 2000})
+			var waiter chan error
+			id, err := gopack.commit(&Message{Qos: Qos1, Payload: []byte("x")}, func(packet *Packet) {
+				waiter = gopack.await(packet.MsgID)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var dead *Packet
+			for i, reason := range c.reasons {
+				if i > 0 {
+					// resent once the backoff passed
+					packet := gopack.storage().Confirm(id)
+					packet.Confirm = false
+					packet.Timestamp = 0
+					gopack.storage().Save(packet)
+				}
+				transmit(t, gopack)
+				if dead = gopack.refused(id, reason); dead != nil && i < len(c.reasons)-1 {
+					t.Fatalf("dead-lettered after NACK %d", i+1)
+				}
+				if dead == nil && gopack.storage().Unconfirmed() != nil {
+					t.Fatal("refused message resent without backoff")
+				}
+			}
+			if (dead != nil) != c.dead {
+				t.Fatalf("dead-lettered %v, want %v", dead != nil, c.dead)
+			}
+			select {
+			case err := <-waiter:
+				var dle *DeadLetterError
+				if !c.dead || !errors.As(err, &dle) || dle.Reason != c.reasons[len(c.reasons)-1] {
+					t.Fatalf("waiter released with %v", err)
+				}
+			case <-time.After(10 * time.Millisecond):
+				if c.dead {
+					t.Fatal("waiter of dead-lettered message not released")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package gopack
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrFenced means that a peer connected as a producer incarnation
+// older than one already seen, its connection is dropped
+var ErrFenced = errors.New("stale producer epoch")
+
+// producers highest epoch seen per producer id
+type producers struct {
+	epochs map[string]int64
+	mux    sync.Mutex
+}
+
+func newProducers() *producers {
+	return &producers{epochs: make(map[string]int64)}
+}
+
+// admit records epoch of id, reports false if a newer one was seen
+func (p *producers) admit(id string, epoch int64) bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if epoch < p.epochs[id] {
+		return false
+	}
+	p.epochs[id] = epoch
+	return true
+}
+
+// fenced reports whether CONNECT comes from a stale producer incarnation
+func (gopack *GoPack2) fenced(connect *Packet) bool {
+	if connect.ProducerID == "" {
+		return false
+	}
+	return !gopack.producers.admit(connect.ProducerID, connect.ProducerEpoch)
+}
@@ -0,0 +1,53 @@
+package gopack
+
+import "testing"
+
+func TestFenced(t *testing.T) {
+	type connect struct {
+		id     string
+		epoch  int64
+		fenced bool
+	}
+	cases := []struct {
+		name     string
+		connects []connect
+	}{
+		{"anonymous", []connect{{"", 5, false}, {"", 1, false}}},
+		{"newer incarnation", []connect{{"p", 1, false}, {"p", 2, false}}},
+		{"same incarnation reconnects", []connect{{"p", 2, false}, {"p", 2, false}}},
+		{"stale incarnation", []connect{{"p", 2, false}, {"p", 1, true}, {"p", 3, false}}},
+		{"per producer", []connect{{"p", 2, false}, {"q", 1, false}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{})
+			for i, conn := range c.connects {
+				packet := &Packet{MsgType: MsgTypeConnect, ProducerID: conn.id, ProducerEpoch: conn.epoch}
+				if got := gopack.fenced(packet); got != conn.fenced {
+					t.Fatalf("connect %d fenced %v, want %v", i, got, conn.fenced)
+				}
+			}
+		})
+	}
+}
+
+func TestProducerEpoch(t *testing.T) {
+	cases := []struct {
+		name  string
+		opts  Options
+		epoch bool
+	}{
+		{"no producer", Options{}, false},
+		{"default epoch", Options{ProducerID: "p"}, true},
+		{"given epoch", Options{ProducerID: "p", ProducerEpoch: 3}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			opts := c.opts
+			offline(t, &opts)
+			if (opts.ProducerEpoch != 0) != c.epoch || (c.opts.ProducerEpoch != 0 && opts.ProducerEpoch != c.opts.ProducerEpoch) {
+				t.Fatalf("epoch %d", opts.ProducerEpoch)
+			}
+		})
+	}
+}
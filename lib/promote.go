@@ -0,0 +1,57 @@
+package gopack
+
+import "container/heap"
+
+// PromotableStorage may be implemented by a storage to move a queued
+// message to the front of the outbound order
+type PromotableStorage interface {
+	Promote(MsgID) bool
+}
+
+// Promote moves unconfirmed message id ahead of every other message
+// and makes it due at once, its retransmission count is kept
+func (ms *memoryStorage) Promote(id MsgID) bool {
+	ms.muxPriorityQueue.Lock()
+	defer ms.muxPriorityQueue.Unlock()
+	h, index := ms.find(id)
+	if h == nil || h.queue[index].MsgType != MsgTypeSend {
+		return false
+	}
+	packet := heap.Remove(h, index).(*Packet)
+	packet.Timestamp = 0
+	ms.promotions++
+	ms.promotedAt[id] = ms.promotions
+	heap.Push(ms.promoted, packet)
+	return true
+}
+
+// Promote moves a queued message to the front of the outbound order,
+// resetting its retry timestamp so it is sent next, returns false if it
+// is unknown, already acknowledged, still spooled or the storage does
+// not implement PromotableStorage
+func (gopack *GoPack2) Promote(msgID MsgID) bool {
+	if gopack.promoteParked(msgID) {
+		return true
+	}
+	for _, store := range []OutboundStore{gopack.storage(), gopack.draining()} {
+		if ps, ok := store.(PromotableStorage); ok && ps.Promote(msgID) {
+			gopack.wake()
+			return true
+		}
+	}
+	return false
+}
+
+// promoteParked moves parked message id to the front of the parked ones
+func (gopack *GoPack2) promoteParked(id MsgID) bool {
+	gopack.muxInflight.Lock()
+	defer gopack.muxInflight.Unlock()
+	for i, packet := range gopack.parked {
+		if packet.MsgID == id && packet.MsgType == MsgTypeSend {
+			copy(gopack.parked[1:i+1], gopack.parked[:i])
+			gopack.parked[0] = packet
+			return true
+		}
+	}
+	return false
+}
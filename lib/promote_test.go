@@ -0,0 +1,57 @@
+package gopack
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPromote(t *testing.T) {
+	cases := []struct {
+		name     string
+		promote  []MsgID
+		promoted bool
+		want     []MsgID
+	}{
+		{"queued", []MsgID{3}, true, []MsgID{3, 1, 2, 4}},
+		{"in promotion order", []MsgID{4, 2}, true, []MsgID{4, 2, 1, 3}},
+		{"delayed", []MsgID{5}, true, []MsgID{5, 1, 2, 3, 4}},
+		{"unknown", []MsgID{9}, false, []MsgID{1, 2, 3, 4}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{})
+			for i := 0; i < 4; i++ {
+				if _, err := gopack.Commit(nil, Qos1); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := gopack.Publish(&Message{Qos: Qos1, NotBefore: time.Now().Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range c.promote {
+				if gopack.Promote(id) != c.promoted {
+					t.Fatalf("promote %d returned %v", id, !c.promoted)
+				}
+			}
+			if got := order(gopack.storage().(*memoryStorage)); !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestPromoteParked(t *testing.T) {
+	gopack := offline(t, &Options{})
+	gopack.Pause()
+	for id := MsgID(1); id <= 3; id++ {
+		gopack.park(&Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: id})
+	}
+	if !gopack.Promote(3) {
+		t.Fatal("parked message not promoted")
+	}
+	gopack.Resume()
+	if packet := gopack.unpark(); packet == nil || packet.MsgID != 3 {
+		t.Fatalf("unparked %v first", packet)
+	}
+}
@@ -4,15 +4,33 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"sort"
 )
 
 // MaxTime maximum datetime
 // var MaxTime = time.Date(2500, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
 
-// ErrDecode means that a exception at the time of decoding
+// ErrDecode means that a exception at the time of decoding,
+// the errors below wrap it with the part that failed
 var ErrDecode = errors.New("decode error")
 
+// ErrDecodeHeader packet is shorter than its fixed header
+var ErrDecodeHeader = fmt.Errorf("%w: short header", ErrDecode)
+
+// ErrDecodeType fixed header holds an unknown message type or QoS
+var ErrDecodeType = fmt.Errorf("%w: unknown type or qos", ErrDecode)
+
+// ErrDecodeLength remaining or properties length exceeds the packet
+var ErrDecodeLength = fmt.Errorf("%w: length out of range", ErrDecode)
+
+// ErrDecodeProperty property value is malformed
+var ErrDecodeProperty = fmt.Errorf("%w: malformed property", ErrDecode)
+
+// ErrDecodePayload compressed payload does not inflate
+var ErrDecodePayload = fmt.Errorf("%w: corrupt compressed payload", ErrDecode)
+
 // MsgTypeSend message enum type
 const MsgTypeSend = 0x1
 
@@ -28,6 +46,40 @@ const MsgTypeRelease = 0x4
 // MsgTypeCompleted message enum type
 const MsgTypeCompleted = 0x5
 
+// MsgTypeConnect message enum type, opens the capability handshake
+const MsgTypeConnect = 0x6
+
+// MsgTypeConnAck message enum type, answers MsgTypeConnect
+const MsgTypeConnAck = 0x7
+
+// MsgTypeNack message enum type, refuses a message,
+// the payload is a single reason byte
+const MsgTypeNack = 0x8
+
+// MsgTypePing message enum type, keeps an idle connection alive
+const MsgTypePing = 0x9
+
+// MsgTypePong message enum type, answers MsgTypePing
+const MsgTypePong = 0xa
+
+// NackDecode reason, the message could not be decoded, it is resent
+// once after Options.RetryInterval, a retransmission is dead-lettered
+const NackDecode = 0x1
+
+// NackQuota reason, the receiver is out of capacity, it is resent
+// with the backoff of a retransmission
+const NackQuota = 0x2
+
+// NackUnauthorized reason, the message is not allowed, it is dead-lettered
+const NackUnauthorized = 0x3
+
+// NackRejected reason, the receiver refused the message, it is dead-lettered
+const NackRejected = 0x4
+
+// NackStream reason, the receiver dropped the stream of the fragment or
+// never saw its start, it is dead-lettered and a resumable stream starts over
+const NackStream = 0x5
+
 // Qos0 quality of service level 0 (at most once)
 const Qos0 = 0
 
@@ -37,22 +89,128 @@ const Qos1 = 1
 // Qos2 quality of service level 2 (only once)
 const Qos2 = 2
 
+// MaxRemainingLength maximum packet length after the fixed header
+const MaxRemainingLength = 0xffff
+
+// FlagProperties fixed header bit marking a properties section
+// in front of the payload
+const FlagProperties = 0x1
+
+// FlagDup fixed header bit marking a retransmission
+const FlagDup = 0x2
+
+// PropChannel logical channel property identifier
+const PropChannel = 0x1
+
+// PropCapabilities capability flags property identifier,
+// carried by MsgTypeConnect and MsgTypeConnAck
+const PropCapabilities = 0x2
+
+// PropCommitTime sender commit time property identifier,
+// unix nano as 64-bit integer
+const PropCommitTime = 0x3
+
+// PropCorrelationID correlation id property identifier
+const PropCorrelationID = 0x4
+
+// PropFragment fragment property identifier,
+// 32-bit stream id, 32-bit fragment index and a last fragment byte
+const PropFragment = 0x5
+
+// PropTopic topic property identifier, levels separated by '/'
+const PropTopic = 0x6
+
+// PropHeader header property identifier, one per header,
+// 16-bit key length, key and value, may repeat
+const PropHeader = 0x7
+
+// PropReplyTo reply topic property identifier
+const PropReplyTo = 0x8
+
+// PropProducer producer identity property identifier, carried by
+// MsgTypeConnect, 64-bit epoch followed by the producer id
+const PropProducer = 0x9
+
+// PropContentType payload content type property identifier
+const PropContentType = 0xa
+
+// PropCompressed property identifier without value,
+// marks a deflated payload
+const PropCompressed = 0xb
+
+// PropClientID client id property identifier, carried by MsgTypeConnect
+const PropClientID = 0xc
+
+// PropParameters operational parameters property identifier, carried by
+// MsgTypeConnAck, 32-bit heartbeat, maximum packet size and maximum
+// in-flight packets, 0 leaves one unchanged
+const PropParameters = 0xd
+
+// PropTraceParent W3C traceparent property identifier
+const PropTraceParent = 0xe
+
+// CapProperties capability flag, peer understands FlagProperties
+const CapProperties = 0x1
+
+// CapCompression capability flag, peer inflates PropCompressed payloads
+const CapCompression = 0x2
+
+// CapLargeLength capability flag, reserved for lengths beyond 16 bits
+const CapLargeLength = 0x4
+
+// CapTopics capability flag, peer routes messages by PropTopic
+const CapTopics = 0x8
+
+// CapBatchAck capability flag, peer understands MsgTypeAck payloads
+// of inclusive MsgID ranges, 16-bit start and end each
+const CapBatchAck = 0x10
+
+// CapPing capability flag, peer answers MsgTypePing
+const CapPing = 0x20
+
+// CapNack capability flag, peer understands MsgTypeNack
+const CapNack = 0x100
+
+// MsgID identifies a packet on the wire, ids wrap around after 0xffff
+type MsgID uint16
+
 // Packet is a struct to hold a message
 // uint16 > int https://godoc.org/golang.org/x/mobile/cmd/gobind#hdr-Type_restrictions
 type Packet struct {
 	MsgType         byte
 	Qos             byte
 	Dup             bool
-	MsgID           int
+	MsgID           MsgID
 	RemainingLength int
 	TotalLength     int
 	Payload         []byte
 	Buffer          []byte
 
+	// properties
+	Channel       int
+	Capabilities  int
+	CommitTime    int64 // unix nano, sender commit time
+	CorrelationID string
+	StreamID      int // non zero for fragments of a streamed payload
+	FragmentIndex int
+	LastFragment  bool
+	Topic         string
+	Headers       map[string]string
+	ReplyTo       string
+	ProducerID    string
+	ProducerEpoch int64
+	ContentType   string
+	Compressed    bool
+	ClientID      string
+	Parameters    Parameters
+	TraceParent   string
+
 	// used to storage
 	Confirm    bool
 	RetryTimes int
 	Timestamp  int64
+	CreatedAt  int64 // unix nano of commit
+	Priority   byte  // higher is sent first
 }
 
 // Clone copy packet
@@ -65,67 +223,322 @@ func (packet *Packet) Clone() (copyPacket *Packet) {
 	copyPacket.RemainingLength = packet.RemainingLength
 	copyPacket.TotalLength = packet.TotalLength
 	copyPacket.Payload = packet.Payload
+	copyPacket.Channel = packet.Channel
+	copyPacket.Capabilities = packet.Capabilities
+	copyPacket.CommitTime = packet.CommitTime
+	copyPacket.CorrelationID = packet.CorrelationID
+	copyPacket.StreamID = packet.StreamID
+	copyPacket.FragmentIndex = packet.FragmentIndex
+	copyPacket.LastFragment = packet.LastFragment
+	copyPacket.Topic = packet.Topic
+	copyPacket.Headers = packet.Headers
+	copyPacket.ReplyTo = packet.ReplyTo
+	copyPacket.ProducerID = packet.ProducerID
+	copyPacket.ProducerEpoch = packet.ProducerEpoch
+	copyPacket.ContentType = packet.ContentType
+	copyPacket.Compressed = packet.Compressed
+	copyPacket.ClientID = packet.ClientID
+	copyPacket.Parameters = packet.Parameters
+	copyPacket.TraceParent = packet.TraceParent
 	copyPacket.Buffer = packet.Buffer
 	copyPacket.Confirm = packet.Confirm
 	copyPacket.RetryTimes = packet.RetryTimes
 	copyPacket.Timestamp = packet.Timestamp
+	copyPacket.CreatedAt = packet.CreatedAt
+	copyPacket.Priority = packet.Priority
 	return copyPacket
 }
 
 // Encode is used to convert bytes to packet struct
-func Encode(msgType byte, qos byte, dup byte, msgID int, payload []byte) *Packet {
-	var remainingLength int
-	if payload != nil {
-		remainingLength = len(payload)
+func Encode(msgType byte, qos byte, dup byte, msgID MsgID, payload []byte) *Packet {
+	packet := &Packet{
+		MsgType: msgType,
+		Qos:     qos,
+		Dup:     byteToBool(dup),
+		MsgID:   msgID,
+		Payload: payload,
+	}
+	packet.Pack()
+	return packet
+}
+
+// Pack serializes packet fields into Buffer
+func (packet *Packet) Pack() {
+	packet.pack(true)
+}
+
+// pack serializes packet fields into Buffer,
+// properties are left out unless withProperties is set
+func (packet *Packet) pack(withProperties bool) {
+	var props []byte
+	if withProperties {
+		props = packet.encodeProperties()
+	}
+	remainingLength := len(packet.Payload)
+	var flags byte
+	if props != nil {
+		flags |= FlagProperties
+		remainingLength += 2 + len(props)
 	}
 	var buffer bytes.Buffer
-	fixedHeader := byte((msgType << 4) | (qos << 2) | (dup << 1))
+	fixedHeader := byte((packet.MsgType << 4) | (packet.Qos << 2) |
+		(boolToByte(packet.Dup) << 1) | flags)
 	buffer.WriteByte(fixedHeader)
-	buffer.Write(encodeUint16(msgID))
+	buffer.Write(encodeUint16(int(packet.MsgID)))
 	buffer.Write(encodeUint16(remainingLength))
-	if payload != nil {
-		buffer.Write(payload)
+	if props != nil {
+		buffer.Write(encodeUint16(len(props)))
+		buffer.Write(props)
+	}
+	if packet.Payload != nil {
+		buffer.Write(packet.Payload)
+	}
+	packet.RemainingLength = remainingLength
+	packet.TotalLength = 5 + remainingLength
+	packet.Buffer = buffer.Bytes()
+}
+
+// encodeProperties returns TLV encoded properties, nil if none are set
+func (packet *Packet) encodeProperties() []byte {
+	var buffer bytes.Buffer
+	if packet.Channel != 0 {
+		writeProperty(&buffer, PropChannel, encodeUint16(packet.Channel))
+	}
+	if packet.Capabilities != 0 {
+		writeProperty(&buffer, PropCapabilities, encodeUint16(packet.Capabilities))
+	}
+	if packet.CommitTime != 0 {
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(packet.CommitTime))
+		writeProperty(&buffer, PropCommitTime, value)
+	}
+	if packet.CorrelationID != "" {
+		writeProperty(&buffer, PropCorrelationID, []byte(packet.CorrelationID))
+	}
+	if packet.StreamID != 0 {
+		value := make([]byte, 9)
+		binary.BigEndian.PutUint32(value, uint32(packet.StreamID))
+		binary.BigEndian.PutUint32(value[4:], uint32(packet.FragmentIndex))
+		value[8] = boolToByte(packet.LastFragment)
+		writeProperty(&buffer, PropFragment, value)
+	}
+	if packet.Topic != "" {
+		writeProperty(&buffer, PropTopic, []byte(packet.Topic))
+	}
+	if packet.ReplyTo != "" {
+		writeProperty(&buffer, PropReplyTo, []byte(packet.ReplyTo))
+	}
+	if packet.ContentType != "" {
+		writeProperty(&buffer, PropContentType, []byte(packet.ContentType))
+	}
+	if packet.Compressed {
+		writeProperty(&buffer, PropCompressed, nil)
+	}
+	if packet.ProducerID != "" {
+		value := make([]byte, 8, 8+len(packet.ProducerID))
+		binary.BigEndian.PutUint64(value, uint64(packet.ProducerEpoch))
+		writeProperty(&buffer, PropProducer, append(value, packet.ProducerID...))
+	}
+	if packet.ClientID != "" {
+		writeProperty(&buffer, PropClientID, []byte(packet.ClientID))
+	}
+	if packet.TraceParent != "" {
+		writeProperty(&buffer, PropTraceParent, []byte(packet.TraceParent))
 	}
-	return &Packet{
-		MsgType:         msgType,
-		Qos:             qos,
-		Dup:             byteToBool(dup),
-		MsgID:           msgID,
-		RemainingLength: remainingLength,
-		TotalLength:     5 + remainingLength,
-		Payload:         payload,
-		Buffer:          buffer.Bytes(),
-		Timestamp:       0,
+	if packet.Parameters != (Parameters{}) {
+		value := make([]byte, 12)
+		binary.BigEndian.PutUint32(value, uint32(packet.Parameters.Heartbeat))
+		binary.BigEndian.PutUint32(value[4:], uint32(packet.Parameters.MaxPacketSize))
+		binary.BigEndian.PutUint32(value[8:], uint32(packet.Parameters.MaxInflight))
+		writeProperty(&buffer, PropParameters, value)
 	}
+	keys := make([]string, 0, len(packet.Headers))
+	for key := range packet.Headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := encodeUint16(len(key))
+		value = append(value, key...)
+		value = append(value, packet.Headers[key]...)
+		writeProperty(&buffer, PropHeader, value)
+	}
+	if buffer.Len() == 0 {
+		return nil
+	}
+	return buffer.Bytes()
+}
+
+// decodeProperties sets packet fields from TLV encoded properties
+func (packet *Packet) decodeProperties(props []byte) error {
+	buffer := bytes.NewBuffer(props)
+	for buffer.Len() > 0 {
+		id, err := buffer.ReadByte()
+		if err != nil {
+			return ErrDecodeProperty
+		}
+		length, err := decodeUint16(buffer)
+		if err != nil || length > buffer.Len() {
+			return ErrDecodeLength
+		}
+		value := buffer.Next(length)
+		switch id {
+		case PropChannel:
+			if length != 2 {
+				return ErrDecodeProperty
+			}
+			packet.Channel = int(binary.BigEndian.Uint16(value))
+		case PropCapabilities:
+			if length != 2 {
+				return ErrDecodeProperty
+			}
+			packet.Capabilities = int(binary.BigEndian.Uint16(value))
+		case PropCommitTime:
+			if length != 8 {
+				return ErrDecodeProperty
+			}
+			packet.CommitTime = int64(binary.BigEndian.Uint64(value))
+		case PropCorrelationID:
+			packet.CorrelationID = string(value)
+		case PropFragment:
+			if length != 9 {
+				return ErrDecodeProperty
+			}
+			packet.StreamID = int(binary.BigEndian.Uint32(value))
+			packet.FragmentIndex = int(binary.BigEndian.Uint32(value[4:]))
+			packet.LastFragment = byteToBool(value[8])
+		case PropTopic:
+			packet.Topic = string(value)
+		case PropReplyTo:
+			packet.ReplyTo = string(value)
+		case PropCompressed:
+			packet.Compressed = true
+		case PropContentType:
+			packet.ContentType = string(value)
+		case PropProducer:
+			if length < 8 {
+				return ErrDecodeProperty
+			}
+			packet.ProducerEpoch = int64(binary.BigEndian.Uint64(value))
+			packet.ProducerID = string(value[8:])
+		case PropClientID:
+			packet.ClientID = string(value)
+		case PropTraceParent:
+			packet.TraceParent = string(value)
+		case PropParameters:
+			if length != 12 {
+				return ErrDecodeProperty
+			}
+			packet.Parameters = Parameters{
+				Heartbeat:     int(int32(binary.BigEndian.Uint32(value))),
+				MaxPacketSize: int(int32(binary.BigEndian.Uint32(value[4:]))),
+				MaxInflight:   int(int32(binary.BigEndian.Uint32(value[8:]))),
+			}
+		case PropHeader:
+			if length < 2 {
+				return ErrDecodeProperty
+			}
+			keyLength := int(binary.BigEndian.Uint16(value))
+			if 2+keyLength > length {
+				return ErrDecodeProperty
+			}
+			if packet.Headers == nil {
+				packet.Headers = make(map[string]string)
+			}
+			packet.Headers[string(value[2:2+keyLength])] = string(value[2+keyLength:])
+		}
+		// unknown properties are skipped
+	}
+	return nil
+}
+
+func writeProperty(buffer *bytes.Buffer, id byte, value []byte) {
+	buffer.WriteByte(id)
+	buffer.Write(encodeUint16(len(value)))
+	buffer.Write(value)
 }
 
 // Decode is used to convert packet struct to bytes
 func Decode(buf []byte) (packet *Packet, err error) {
-	buffer := bytes.NewBuffer(buf)
-	fixedHeader, err := buffer.ReadByte()
-	if err == io.EOF {
-		return nil, ErrDecode
-	}
 	packet = new(Packet)
+	if err = DecodeInto(packet, buf); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// DecodeInto decodes buf into the caller's packet,
+// Payload and Buffer of packet alias buf
+func DecodeInto(packet *Packet, buf []byte) error {
+	if len(buf) < 5 {
+		return ErrDecodeHeader
+	}
+	*packet = Packet{}
+	fixedHeader := buf[0]
 	packet.MsgType = fixedHeader >> 4
 	packet.Qos = (fixedHeader & 0xf) >> 2
-	packet.Dup = byteToBool((fixedHeader & 0x3) >> 1)
-	packet.MsgID, err = decodeUint16(buffer)
-	if err == ErrDecode {
-		return nil, ErrDecode
+	packet.Dup = fixedHeader&FlagDup != 0
+	packet.MsgID = MsgID(binary.BigEndian.Uint16(buf[1:]))
+	packet.RemainingLength = int(binary.BigEndian.Uint16(buf[3:]))
+	if packet.MsgType < MsgTypeSend || packet.MsgType > MsgTypePong || packet.Qos > Qos2 {
+		return ErrDecodeType
 	}
-	packet.RemainingLength, err = decodeUint16(buffer)
-	if err == ErrDecode {
-		return nil, ErrDecode
+	end := 5 + packet.RemainingLength
+	if len(buf) < end {
+		return ErrDecodeLength
 	}
-	packet.Payload = make([]byte, packet.RemainingLength)
-	n, err := buffer.Read(packet.Payload)
-	if err == io.EOF || n != packet.RemainingLength {
-		return nil, ErrDecode
+	offset := 5
+	if fixedHeader&FlagProperties != 0 {
+		if end-offset < 2 {
+			return ErrDecodeLength
+		}
+		propsLength := int(binary.BigEndian.Uint16(buf[offset:]))
+		offset += 2
+		if offset+propsLength > end {
+			return ErrDecodeLength
+		}
+		if err := packet.decodeProperties(buf[offset : offset+propsLength]); err != nil {
+			return err
+		}
+		offset += propsLength
 	}
+	packet.Payload = buf[offset:end:end]
+	packet.TotalLength = end
 	packet.Buffer = buf
-	packet.Timestamp = 0
-	return packet, nil
+	return nil
+}
+
+// EncodeAckRanges returns an ACK packet acknowledging ids,
+// consecutive ids are collapsed into ranges
+func EncodeAckRanges(ids []MsgID) *Packet {
+	sorted := append([]MsgID(nil), ids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var payload bytes.Buffer
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && int(sorted[j+1]) <= int(sorted[j])+1 {
+			j++
+		}
+		payload.Write(encodeUint16(int(sorted[i])))
+		payload.Write(encodeUint16(int(sorted[j])))
+		i = j + 1
+	}
+	return Encode(MsgTypeAck, Qos0, 0, sorted[0], payload.Bytes())
+}
+
+// AckRanges returns the ids acknowledged by an ACK packet
+func AckRanges(packet *Packet) []MsgID {
+	ids := []MsgID{packet.MsgID}
+	for b := packet.Payload; len(b) >= 4; b = b[4:] {
+		start := int(binary.BigEndian.Uint16(b))
+		end := int(binary.BigEndian.Uint16(b[2:]))
+		for id := start; id <= end; id++ {
+			if MsgID(id) != packet.MsgID {
+				ids = append(ids, MsgID(id))
+			}
+		}
+	}
+	return ids
 }
 
 func boolToByte(b bool) byte {
@@ -156,7 +569,7 @@ func decodeUint16(b io.Reader) (i int, err error) {
 	num := make([]byte, 2)
 	n, err := b.Read(num)
 	if err == io.EOF || n != 2 {
-		return i, ErrDecode
+		return i, ErrDecodeLength
 	}
 	val := binary.BigEndian.Uint16(num)
 	return int(val), nil
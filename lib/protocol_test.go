@@ -0,0 +1,180 @@
+package gopack
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// TestProperties round trips packets through Pack and Decode
+func TestProperties(t *testing.T) {
+	cases := []struct {
+		name   string
+		packet Packet
+	}{
+		{"none", Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: 1, Payload: []byte("x")}},
+		{"correlation id", Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: 2, CorrelationID: "req-42", Payload: []byte("x")}},
+		{"correlation id only", Packet{MsgType: MsgTypeSend, Qos: Qos0, MsgID: 3, CorrelationID: "ключ"}},
+		{"topic", Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: 5, Topic: "sensors/t1", Payload: []byte("x")}},
+		{"channel and commit time", Packet{MsgType: MsgTypeSend, Qos: Qos2, MsgID: 4, Channel: 9, CommitTime: 1e18}},
+		{"reply to", Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: 6, Topic: "rpc/sum", ReplyTo: "rpc/sum/replies", CorrelationID: "c1", Payload: []byte("x")}},
+		{"content type", Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: 7, ContentType: ContentTypeJSON, Payload: []byte("{}")}},
+		{"headers", Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: 8, Headers: map[string]string{"a": "1", "b": ""}, Payload: []byte("x")}},
+		{"compressed", Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: 9, Compressed: true, Payload: []byte{1, 2, 3}}},
+		{"producer", Packet{MsgType: MsgTypeConnect, Capabilities: capabilities, ProducerID: "orders-1", ProducerEpoch: 1700000000000000000}},
+		{"client id", Packet{MsgType: MsgTypeConnect, Capabilities: capabilities, ClientID: "sensor-7", Headers: map[string]string{"token": "t"}}},
+		{"parameters", Packet{MsgType: MsgTypeConnAck, Capabilities: capabilities, Parameters: Parameters{Heartbeat: 5000, MaxPacketSize: 4096, MaxInflight: -1}}},
+		{"trace parent", Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: 10, TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", Payload: []byte("x")}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			packet := c.packet
+			packet.Pack()
+			decoded, err := Decode(packet.Buffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, got := c.packet, *decoded
+			want.Buffer, got.Buffer = nil, nil
+			if len(got.Payload) == 0 {
+				got.Payload = want.Payload
+			}
+			want.RemainingLength, want.TotalLength = packet.RemainingLength, packet.TotalLength
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestCorrelationID(t *testing.T) {
+	cases := []struct {
+		name      string
+		handshake bool
+		want      string
+	}{
+		{"properties", true, "req-1"},
+		{"legacy peer", false, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, _, _, scb := pair(t, &Options{Handshake: c.handshake}, &Options{})
+			if _, err := client.Publish(&Message{Qos: Qos1, CorrelationID: "req-1"}); err != nil {
+				t.Fatal(err)
+			}
+			if msg := scb.next(t); msg.CorrelationID != c.want {
+				t.Fatalf("correlation id %q, want %q", msg.CorrelationID, c.want)
+			}
+		})
+	}
+}
+
+func TestAckRanges(t *testing.T) {
+	cases := []struct {
+		name   string
+		ids    []MsgID
+		ranges int
+	}{
+		{"single", []MsgID{7}, 1},
+		{"consecutive", []MsgID{3, 1, 2, 4}, 1},
+		{"gaps", []MsgID{1, 2, 5, 9, 10}, 3},
+		{"duplicates", []MsgID{4, 4, 5}, 1},
+		{"top of range", []MsgID{0xfffe, 0xffff, 1}, 2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			packet, err := Decode(EncodeAckRanges(c.ids).Buffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := len(packet.Payload) / 4; n != c.ranges {
+				t.Fatalf("%d ranges, want %d", n, c.ranges)
+			}
+			got := AckRanges(packet)
+			sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+			want := map[MsgID]bool{}
+			for _, id := range c.ids {
+				want[id] = true
+			}
+			if len(got) != len(want) {
+				t.Fatalf("acknowledged %v, want %v", got, c.ids)
+			}
+			for _, id := range got {
+				if !want[id] {
+					t.Fatalf("acknowledged %v, want %v", got, c.ids)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeInto(t *testing.T) {
+	valid := &Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: 5, Channel: 2, Payload: []byte("abc")}
+	valid.Pack()
+	cases := []struct {
+		name string
+		buf  []byte
+		err  bool
+	}{
+		{"valid", valid.Buffer, false},
+		{"trailing bytes", append(append([]byte(nil), valid.Buffer...), 0xff), false},
+		{"short header", valid.Buffer[:4], true},
+		{"truncated", valid.Buffer[:len(valid.Buffer)-1], true},
+		{"properties past end", []byte{MsgTypeAck<<4 | FlagProperties, 0, 1, 0, 2, 0, 9}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// stale state of a previous packet must not leak
+			packet := &Packet{Topic: "stale", CorrelationID: "stale", Headers: map[string]string{"k": "v"}}
+			err := DecodeInto(packet, c.buf)
+			if (err != nil) != c.err {
+				t.Fatalf("error %v, want error %v", err, c.err)
+			}
+			if c.err {
+				return
+			}
+			if packet.Topic != "" || packet.CorrelationID != "" || packet.Headers != nil {
+				t.Fatalf("stale fields kept: %+v", packet)
+			}
+			if packet.MsgID != 5 || packet.Channel != 2 || string(packet.Payload) != "abc" {
+				t.Fatalf("decoded %+v", packet)
+			}
+			if cap(packet.Payload) != len(packet.Payload) {
+				t.Fatal("payload may be appended into the buffer")
+			}
+			c.buf[len(valid.Buffer)-1] = 'z'
+			if packet.Payload[2] != 'z' {
+				t.Fatal("payload does not alias the buffer")
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	props := byte(MsgTypeSend<<4 | Qos1<<2 | FlagProperties)
+	cases := []struct {
+		name string
+		buf  []byte
+		err  error
+	}{
+		{"short header", []byte{MsgTypeSend << 4, 0, 1}, ErrDecodeHeader},
+		{"unknown type", []byte{0xf0, 0, 1, 0, 0}, ErrDecodeType},
+		{"unknown qos", []byte{MsgTypeSend<<4 | 3<<2, 0, 1, 0, 0}, ErrDecodeType},
+		{"remaining length", []byte{MsgTypeSend<<4 | Qos1<<2, 0, 1, 0, 10, 'x'}, ErrDecodeLength},
+		{"properties length", []byte{props, 0, 1, 0, 4, 0, 100, 'x', 'x'}, ErrDecodeLength},
+		{"malformed property", []byte{props, 0, 1, 0, 6, 0, 4, PropHeader, 0, 1, 'x'}, ErrDecodeProperty},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := Decode(c.buf)
+			if !errors.Is(err, c.err) || !errors.Is(err, ErrDecode) {
+				t.Fatalf("got %v, want %v", err, c.err)
+			}
+		})
+	}
+	packet := &Packet{MsgType: MsgTypeSend, Compressed: true, Payload: []byte{0xff, 0xff, 0xff}}
+	if err := packet.decompress(); !errors.Is(err, ErrDecodePayload) || !errors.Is(err, ErrDecode) {
+		t.Fatalf("got %v, want ErrDecodePayload", err)
+	}
+}
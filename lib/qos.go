@@ -0,0 +1,60 @@
+package gopack
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// CapMaxQos1 capability flag, peer handles QoS0 and QoS1 messages only
+const CapMaxQos1 = 0x40
+
+// CapMaxQos0 capability flag, peer handles QoS0 messages only
+const CapMaxQos0 = 0x80
+
+// ErrQosUnsupported means that a message asks for a higher QoS than
+// negotiated with the peer and Options.QosDowngrade is off
+var ErrQosUnsupported = errors.New("qos not supported by peer")
+
+// ErrQosDowngraded reported with the payload of a message
+// committed at the negotiated QoS instead of the requested one
+var ErrQosDowngraded = errors.New("qos downgraded")
+
+// advertised returns the capabilities sent in the handshake,
+// including the highest QoS this side handles
+func (gopack *GoPack2) advertised() int {
+	switch gopack.opts.MaxQos {
+	case Qos0:
+		return capabilities | CapMaxQos0
+	case Qos1:
+		return capabilities | CapMaxQos1
+	}
+	return capabilities
+}
+
+// maxQos returns the highest QoS both peers handle,
+// the peer is assumed to handle every level until its handshake
+func (gopack *GoPack2) maxQos() byte {
+	max := byte(gopack.opts.MaxQos)
+	peerCaps := atomic.LoadInt32(&gopack.peerCaps)
+	if peerCaps&CapMaxQos0 != 0 {
+		max = Qos0
+	} else if peerCaps&CapMaxQos1 != 0 && max > Qos1 {
+		max = Qos1
+	}
+	return max
+}
+
+// negotiate returns msg at the negotiated QoS,
+// reports whether it was downgraded
+func (gopack *GoPack2) negotiate(msg *Message) (*Message, bool, error) {
+	max := gopack.maxQos()
+	if msg.Qos <= max {
+		return msg, false, nil
+	}
+	if !gopack.opts.QosDowngrade {
+		return nil, false, ErrQosUnsupported
+	}
+	downgraded := *msg
+	downgraded.Qos = max
+	return &downgraded, true, nil
+}
@@ -0,0 +1,80 @@
+package gopack
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNegotiateQos(t *testing.T) {
+	cases := []struct {
+		name      string
+		maxQos    int
+		downgrade bool
+		peerCaps  int
+		qos       byte
+		want      byte
+		err       error
+	}{
+		{"default", 0, false, capabilities, Qos2, Qos2, nil},
+		{"before handshake", Qos1, false, 0, Qos1, Qos1, nil},
+		{"own limit", Qos1, false, capabilities, Qos2, 0, ErrQosUnsupported},
+		{"peer limit", 0, false, capabilities | CapMaxQos1, Qos2, 0, ErrQosUnsupported},
+		{"peer qos0", 0, false, capabilities | CapMaxQos0, Qos1, 0, ErrQosUnsupported},
+		{"negative is qos0", -1, false, capabilities, Qos1, 0, ErrQosUnsupported},
+		{"within limit", Qos1, false, capabilities | CapMaxQos1, Qos1, Qos1, nil},
+		{"downgraded", 0, true, capabilities | CapMaxQos1, Qos2, Qos1, nil},
+		{"downgraded to qos0", Qos1, true, capabilities | CapMaxQos0, Qos2, Qos0, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cb := newTestCallback()
+			gopack := offline(t, &Options{CallbackObj: cb, MaxQos: c.maxQos, QosDowngrade: c.downgrade})
+			gopack.setPeerCaps(c.peerCaps)
+			msg := &Message{Qos: c.qos, Payload: []byte("x")}
+			_, err := gopack.Publish(msg)
+			if err != c.err {
+				t.Fatalf("err %v, want %v", err, c.err)
+			}
+			if err != nil {
+				return
+			}
+			if packet := gopack.storage().Unconfirmed(); packet.Qos != c.want {
+				t.Fatalf("committed at qos %d, want %d", packet.Qos, c.want)
+			}
+			if msg.Qos != c.qos {
+				t.Fatal("caller message modified")
+			}
+			select {
+			case err := <-cb.errs:
+				if c.want == c.qos || !errors.Is(err, ErrQosDowngraded) {
+					t.Fatalf("reported %v", err)
+				}
+			default:
+				if c.want != c.qos {
+					t.Fatal("downgrade not reported")
+				}
+			}
+		})
+	}
+}
+
+func TestAdvertisedQos(t *testing.T) {
+	cases := []struct {
+		name   string
+		maxQos int
+		caps   int
+	}{
+		{"qos2", Qos2, capabilities},
+		{"qos1", Qos1, capabilities | CapMaxQos1},
+		{"qos0", -1, capabilities | CapMaxQos0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, _, server, _ := pair(t, &Options{Handshake: true, MaxQos: c.maxQos}, &Options{})
+			if got := client.advertised(); got != c.caps {
+				t.Fatalf("advertised %#x, want %#x", got, c.caps)
+			}
+			eventually(t, func() bool { return server.maxQos() == byte(client.opts.MaxQos) })
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package gopack
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// tokenBucket refills at rate tokens per second up to one second of burst,
+// takes may overdraw it and the debt is paid back before the next send
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) setRate(rate float64) {
+	if b.rate <= 0 {
+		// start with a full burst
+		b.tokens = rate
+	}
+	b.rate = rate
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if b.rate <= 0 {
+		b.tokens = 0
+		b.last = now
+		return
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+// delay returns how long until the bucket is out of debt
+func (b *tokenBucket) delay() time.Duration {
+	if b.rate <= 0 || b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take(n float64) {
+	if b.rate > 0 {
+		b.tokens -= n
+	}
+}
+
+// limiter paces outbound messages by count and by bytes
+type limiter struct {
+	messages tokenBucket
+	bytes    tokenBucket
+	mux      sync.Mutex
+}
+
+func newLimiter(messagesPerSecond, bytesPerSecond int) *limiter {
+	l := &limiter{}
+	l.set(messagesPerSecond, bytesPerSecond)
+	return l
+}
+
+func (l *limiter) set(messagesPerSecond, bytesPerSecond int) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	now := time.Now()
+	l.messages.refill(now)
+	l.bytes.refill(now)
+	l.messages.setRate(float64(messagesPerSecond))
+	l.bytes.setRate(float64(bytesPerSecond))
+}
+
+// delay returns how long the next send has to wait
+func (l *limiter) delay() time.Duration {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	now := time.Now()
+	l.messages.refill(now)
+	l.bytes.refill(now)
+	d := l.messages.delay()
+	if bd := l.bytes.delay(); bd > d {
+		d = bd
+	}
+	return d
+}
+
+// sent charges one message of size bytes
+func (l *limiter) sent(size int) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.messages.take(1)
+	l.bytes.take(float64(size))
+}
+
+// pace blocks until delay returns zero or exitCh is closed,
+// reports false on exit
+func pace(delay func() time.Duration, exitCh chan struct{}) bool {
+	for {
+		d := delay()
+		if d <= 0 {
+			return true
+		}
+		// recheck periodically so rate changes take effect
+		if d > 100*time.Millisecond {
+			d = 100 * time.Millisecond
+		}
+		select {
+		case <-exitCh:
+			return false
+		case <-time.After(d):
+		}
+	}
+}
+
+// throttle caps raw connection bandwidth in bytes per second
+type throttle struct {
+	bucket tokenBucket
+	mux    sync.Mutex
+}
+
+func newThrottle(bytesPerSecond int) *throttle {
+	t := &throttle{}
+	t.bucket.refill(time.Now())
+	t.bucket.setRate(float64(bytesPerSecond))
+	return t
+}
+
+func (t *throttle) delay() time.Duration {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.bucket.refill(time.Now())
+	return t.bucket.delay()
+}
+
+func (t *throttle) take(n int) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.bucket.take(float64(n))
+}
+
+// throttledReader paces reads from r
+type throttledReader struct {
+	r io.Reader
+	t *throttle
+}
+
+func (tr *throttledReader) Read(p []byte) (n int, err error) {
+	pace(tr.t.delay, nil)
+	// keep the debt of a single read within one second
+	if rate := int(tr.t.bucket.rate); rate > 0 && len(p) > rate {
+		p = p[:rate]
+	}
+	n, err = tr.r.Read(p)
+	tr.t.take(n)
+	return n, err
+}
+
+// source returns conn throttled by Options.ReadBandwidth,
+// recording inbound traffic for keepalive
+func (gopack *GoPack2) source(conn io.Reader) io.Reader {
+	conn = &keepaliveReader{r: conn, gopack: gopack}
+	if gopack.opts.ReadBandwidth <= 0 {
+		return conn
+	}
+	return &throttledReader{r: conn, t: gopack.readThrottle}
+}
+
+// writeRaw writes b to the connection within Options.WriteBandwidth
+func (gopack *GoPack2) writeRaw(b []byte) (n int, err error) {
+	if !pace(gopack.writeThrottle.delay, gopack.exitCh) {
+		return 0, net.ErrClosed
+	}
+	n, err = gopack.writeConn(b)
+	gopack.writeThrottle.take(n)
+	return n, err
+}
+
+// SetRateLimit changes the outbound message and byte rates per second,
+// zero disables the respective limit
+func (gopack *GoPack2) SetRateLimit(messagesPerSecond, bytesPerSecond int) {
+	gopack.limiter.set(messagesPerSecond, bytesPerSecond)
+	gopack.wake()
+}
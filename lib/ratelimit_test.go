@@ -0,0 +1,95 @@
+package gopack
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	cases := []struct {
+		name     string
+		messages int
+		bytes    int
+		sent     []int
+		limited  bool
+	}{
+		{"unlimited", 0, 0, []int{1 << 20, 1 << 20}, false},
+		{"within burst", 10, 0, []int{1, 1, 1}, false},
+		{"messages", 2, 0, []int{1, 1, 1}, true},
+		{"bytes", 0, 1000, []int{600, 600}, true},
+		{"single large message", 0, 1000, []int{5000}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			l := newLimiter(c.messages, c.bytes)
+			for _, size := range c.sent {
+				l.sent(size)
+			}
+			if limited := l.delay() > 0; limited != c.limited {
+				t.Fatalf("limited %v, want %v", limited, c.limited)
+			}
+			l.set(0, 0)
+			if d := l.delay(); d != 0 {
+				t.Fatalf("delay %v after lifting the limits", d)
+			}
+		})
+	}
+}
+
+// TestRateLimitReplies acknowledges messages while the rate limit
+// holds back outbound messages
+func TestRateLimitReplies(t *testing.T) {
+	client, ccb, server, scb := pair(t, &Options{ByteRateLimit: 1000}, &Options{RetryInterval: 60000})
+	if _, err := client.Commit(make([]byte, 20000), Qos0); err != nil {
+		t.Fatal(err)
+	}
+	scb.next(t)
+	if _, err := client.Commit([]byte("late"), Qos0); err != nil {
+		t.Fatal(err)
+	}
+	for _, qos := range []byte{Qos1, Qos2} {
+		if _, err := server.Commit([]byte("x"), qos); err != nil {
+			t.Fatal(err)
+		}
+		ccb.next(t)
+	}
+	eventually(t, func() bool { return server.remaining() == 0 })
+	select {
+	case msg := <-scb.msgs:
+		t.Fatalf("message %q sent over the rate limit", msg.Payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	cases := []struct {
+		name    string
+		rate    int
+		read    int // bytes asked for in one read
+		got     int // bytes returned
+		limited bool
+	}{
+		{"unlimited", 0, 4096, 4096, false},
+		{"within burst", 4096, 1024, 1024, false},
+		{"read capped at rate", 1000, 4096, 1000, false},
+		{"overdrawn", 1000, 1000, 1000, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{ReadBandwidth: c.rate})
+			r := gopack.source(bytes.NewReader(make([]byte, 8192)))
+			if c.limited {
+				// spend the burst on an earlier read
+				gopack.readThrottle.take(c.rate / 2)
+			}
+			n, err := r.Read(make([]byte, c.read))
+			if err != nil || n != c.got {
+				t.Fatalf("read %d, %v, want %d", n, err, c.got)
+			}
+			if limited := gopack.readThrottle.delay() > 0; limited != c.limited {
+				t.Fatalf("limited %v, want %v", limited, c.limited)
+			}
+		})
+	}
+}
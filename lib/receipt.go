@@ -0,0 +1,52 @@
+package gopack
+
+import "time"
+
+// receipt of a QoS2 message the peer received
+type receipt struct {
+	attempts  int
+	createdAt int64
+}
+
+// received remembers QoS2 message packet confirmed by RECEIVED
+// until the peer completes it
+func (gopack *GoPack2) received(packet *Packet) {
+	if gopack.opts.OnDelivered == nil || packet.MsgType != MsgTypeSend {
+		return
+	}
+	gopack.muxReceipts.Lock()
+	defer gopack.muxReceipts.Unlock()
+	gopack.receipts[packet.MsgID] = receipt{
+		attempts:  packet.RetryTimes,
+		createdAt: packet.CreatedAt,
+	}
+}
+
+// delivered calls Options.OnDelivered for packet confirmed by ACK,
+// or by COMPLETED for the release of a QoS2 message
+func (gopack *GoPack2) delivered(packet *Packet) {
+	if gopack.opts.OnDelivered == nil {
+		return
+	}
+	var r receipt
+	qos := packet.Qos
+	switch packet.MsgType {
+	case MsgTypeSend:
+		r = receipt{attempts: packet.RetryTimes, createdAt: packet.CreatedAt}
+	case MsgTypeRelease:
+		gopack.muxReceipts.Lock()
+		r = gopack.receipts[packet.MsgID]
+		delete(gopack.receipts, packet.MsgID)
+		gopack.muxReceipts.Unlock()
+		qos = Qos2
+	default:
+		return
+	}
+	var latency time.Duration
+	if r.createdAt != 0 {
+		latency = time.Since(time.Unix(0, r.createdAt))
+	}
+	gopack.protect(func() {
+		gopack.opts.OnDelivered(packet.MsgID, qos, r.attempts, latency)
+	})
+}
@@ -0,0 +1,99 @@
+package gopack
+
+import (
+	"testing"
+	"time"
+)
+
+type delivery struct {
+	id       MsgID
+	qos      byte
+	attempts int
+	latency  time.Duration
+}
+
+// onDelivered returns an OnDelivered hook sending to the returned channel
+func onDelivered() (func(MsgID, byte, int, time.Duration), chan delivery) {
+	ch := make(chan delivery, 16)
+	return func(id MsgID, qos byte, attempts int, latency time.Duration) {
+		ch <- delivery{id, qos, attempts, latency}
+	}, ch
+}
+
+func TestOnDelivered(t *testing.T) {
+	cases := []struct {
+		name      string
+		qos       byte
+		delivered bool
+	}{
+		{"qos0", Qos0, false},
+		{"qos1", Qos1, true},
+		{"qos2", Qos2, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			hook, ch := onDelivered()
+			client, _, _, scb := pair(t, &Options{OnDelivered: hook}, &Options{})
+			id, err := client.Commit([]byte("x"), c.qos)
+			if err != nil {
+				t.Fatal(err)
+			}
+			scb.next(t)
+			select {
+			case d := <-ch:
+				if !c.delivered || d.id != id || d.qos != c.qos || d.attempts != 1 || d.latency <= 0 {
+					t.Fatalf("delivered %+v", d)
+				}
+			case <-time.After(200 * time.Millisecond):
+				if c.delivered {
+					t.Fatal("OnDelivered not called")
+				}
+			}
+		})
+	}
+}
+
+func TestOnDeliveredAttempts(t *testing.T) {
+	cases := []struct {
+		name    string
+		qos     byte
+		retries int
+	}{
+		{"qos1 first attempt", Qos1, 0},
+		{"qos1 retransmitted", Qos1, 2},
+		{"qos2 retransmitted", Qos2, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			hook, ch := onDelivered()
+			gopack := offline(t, &Options{OnDelivered: hook})
+			id, err := gopack.Commit([]byte("x"), c.qos)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < c.retries; i++ {
+				transmit(t, gopack)
+				packet := gopack.storage().Confirm(id)
+				packet.Confirm = false
+				packet.Timestamp = 0
+				gopack.storage().Save(packet)
+			}
+			transmit(t, gopack)
+			if c.qos == Qos2 {
+				gopack.process(Encode(MsgTypeReceived, Qos0, 0, id, nil))
+				transmit(t, gopack)
+				gopack.process(Encode(MsgTypeCompleted, Qos0, 0, id, nil))
+			} else {
+				gopack.process(Encode(MsgTypeAck, Qos0, 0, id, nil))
+			}
+			select {
+			case d := <-ch:
+				if d.id != id || d.qos != c.qos || d.attempts != c.retries+1 {
+					t.Fatalf("delivered %+v", d)
+				}
+			default:
+				t.Fatal("OnDelivered not called")
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package gopack
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// PanicError reports a panic recovered from a callback, handler,
+// interceptor or hook, the connection stays up
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("callback panic: %v", e.Value)
+}
+
+// protect runs fn and reports a panic as PanicError,
+// a panic while reporting is dropped
+func (gopack *GoPack2) protect(fn func()) {
+	defer func() {
+		if v := recover(); v != nil {
+			err := &PanicError{Value: v, Stack: debug.Stack()}
+			defer func() { recover() }()
+			gopack.opts.CallbackObj.Invoke(nil, err)
+		}
+	}()
+	fn()
+}
+
+// invoke passes payload and err to the callback
+func (gopack *GoPack2) invoke(payload []byte, err error) {
+	gopack.protect(func() {
+		gopack.opts.CallbackObj.Invoke(payload, err)
+	})
+}
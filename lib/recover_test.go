@@ -0,0 +1,86 @@
+package gopack
+
+import (
+	"errors"
+	"testing"
+)
+
+// panicCallback panics on messages with the payload "boom",
+// and on every error if panicErr is set
+type panicCallback struct {
+	*testCallback
+	panicErr bool
+}
+
+func (pc *panicCallback) Invoke(payload []byte, err error) {
+	if pc.panicErr {
+		panic("error callback")
+	}
+	pc.testCallback.Invoke(payload, err)
+}
+
+func (pc *panicCallback) InvokeMessage(msg *Message) {
+	if string(msg.Payload) == "boom" {
+		panic("callback")
+	}
+	pc.testCallback.InvokeMessage(msg)
+}
+
+// panicInterceptor panics on received packets with the payload "boom"
+type panicInterceptor struct{}
+
+func (panicInterceptor) Send(packet *Packet) bool { return true }
+
+func (panicInterceptor) Receive(packet *Packet) bool {
+	if string(packet.Payload) == "boom" {
+		panic("interceptor")
+	}
+	return true
+}
+
+func TestProtect(t *testing.T) {
+	cases := []struct {
+		name     string
+		panicErr bool
+		setup    func(gopack *GoPack2, cb *testCallback)
+		reported bool
+	}{
+		{"callback", false, func(*GoPack2, *testCallback) {}, true},
+		{"error callback", true, func(*GoPack2, *testCallback) {}, false},
+		{"handler", false, func(gopack *GoPack2, cb *testCallback) {
+			gopack.Subscribe("t", func(msg *Message) {
+				if string(msg.Payload) == "boom" {
+					panic("handler")
+				}
+				cb.InvokeMessage(msg)
+			})
+		}, true},
+		{"interceptor", false, func(gopack *GoPack2, cb *testCallback) {
+			gopack.Use(panicInterceptor{})
+		}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cb := newTestCallback()
+			gopack := offline(t, &Options{CallbackObj: &panicCallback{testCallback: cb, panicErr: c.panicErr}})
+			c.setup(gopack, cb)
+			for _, payload := range []string{"boom", "ok"} {
+				gopack.deliver(&Packet{MsgType: MsgTypeSend, Qos: Qos0, Topic: "t", Payload: []byte(payload)})
+			}
+			if msg := cb.next(t); string(msg.Payload) != "ok" {
+				t.Fatalf("got %q", msg.Payload)
+			}
+			select {
+			case err := <-cb.errs:
+				var perr *PanicError
+				if !c.reported || !errors.As(err, &perr) || len(perr.Stack) == 0 {
+					t.Fatalf("reported %v", err)
+				}
+			default:
+				if c.reported {
+					t.Fatal("panic not reported")
+				}
+			}
+		})
+	}
+}
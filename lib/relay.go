@@ -0,0 +1,96 @@
+package gopack
+
+import (
+	"errors"
+	"sync"
+)
+
+// Relay connects to two peers and forwards the messages received
+// from either one to the other with their QoS and metadata,
+// each leg keeps its own storage and retry state
+type Relay struct {
+	a, b *GoPack2
+	wg   sync.WaitGroup
+}
+
+// NewRelay creates both legs of a relay, the callbacks of aopts and
+// bopts only receive errors, messages that fail to be forwarded are
+// reported to the callback of the leg they were received on
+func NewRelay(aopts, bopts *Options) (*Relay, error) {
+	if aopts == nil || bopts == nil {
+		return nil, ErrMissingParams
+	}
+	if (aopts.Storage != nil && aopts.Storage == bopts.Storage) ||
+		(aopts.SpoolPath != "" && aopts.SpoolPath == bopts.SpoolPath) {
+		return nil, ErrSharedStorage
+	}
+	a, err := NewGoPack(aopts)
+	if err != nil {
+		return nil, err
+	}
+	b, err := NewGoPack(bopts)
+	if err != nil {
+		return nil, err
+	}
+	return &Relay{a: a, b: b}, nil
+}
+
+// A returns the first leg
+func (relay *Relay) A() *GoPack2 {
+	return relay.a
+}
+
+// B returns the second leg
+func (relay *Relay) B() *GoPack2 {
+	return relay.b
+}
+
+// Start connects both legs and forwards messages until Close
+func (relay *Relay) Start() {
+	relay.wg.Add(2)
+	go relay.forward(relay.a, relay.b)
+	go relay.forward(relay.b, relay.a)
+	relay.a.Start()
+	relay.b.Start()
+}
+
+// Close stops both legs and waits for forwarding to stop,
+// messages not yet confirmed by a peer stay in the storage of its leg
+func (relay *Relay) Close() {
+	relay.a.Close()
+	relay.b.Close()
+	relay.wg.Wait()
+}
+
+// forward publishes the messages received on from to to,
+// a received message is marked done once it is queued on to
+func (relay *Relay) forward(from, to *GoPack2) {
+	defer relay.wg.Done()
+	ch := from.Messages()
+	for {
+		var msg *Message
+		select {
+		case msg = <-ch:
+		case <-from.closeCh:
+			return
+		}
+		_, err := to.Publish(&Message{
+			Qos:           msg.Qos,
+			Channel:       msg.Channel,
+			Payload:       msg.Payload,
+			CorrelationID: msg.CorrelationID,
+			Topic:         msg.Topic,
+			ReplyTo:       msg.ReplyTo,
+			Headers:       msg.Headers,
+			ContentType:   msg.ContentType,
+			TraceParent:   msg.TraceParent,
+		})
+		msg.Done()
+		if err != nil {
+			from.invoke(msg.Payload, err)
+		}
+		if errors.Is(err, ErrClosed) {
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package gopack
+
+import "testing"
+
+func TestNewRelay(t *testing.T) {
+	shared := newMemoryStorage()
+	cases := []struct {
+		name  string
+		aopts *Options
+		bopts *Options
+		err   error
+	}{
+		{"legs", &Options{}, &Options{}, nil},
+		{"missing leg", &Options{}, nil, ErrMissingParams},
+		{"shared storage", &Options{Storage: shared}, &Options{Storage: shared}, ErrSharedStorage},
+		{"shared spool", &Options{SpoolPath: "spool"}, &Options{SpoolPath: "spool"}, ErrSharedStorage},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			for _, opts := range []*Options{c.aopts, c.bopts} {
+				if opts != nil {
+					opts.CallbackObj = newTestCallback()
+				}
+			}
+			relay, err := NewRelay(c.aopts, c.bopts)
+			if err != c.err {
+				t.Fatalf("err %v, want %v", err, c.err)
+			}
+			if err == nil && (relay.A() == nil || relay.B() == nil || relay.A() == relay.B()) {
+				t.Fatal("legs not created")
+			}
+		})
+	}
+}
+
+func TestRelay(t *testing.T) {
+	cases := []struct {
+		name    string
+		fromA   bool
+		message Message
+	}{
+		{"a to b", true, Message{Qos: Qos1, Payload: []byte("x")}},
+		{"b to a", false, Message{Qos: Qos2, Payload: []byte("y")}},
+		{"qos0", true, Message{Qos: Qos0, Payload: []byte("z")}},
+		{"metadata", true, Message{Qos: Qos1, Topic: "t", ReplyTo: "r", CorrelationID: "c", ContentType: ContentTypeJSON,
+			Headers: map[string]string{"k": "v"}, Payload: []byte("{}")}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			aaddr, apeer, acb := listen(t, &Options{})
+			baddr, bpeer, bcb := listen(t, &Options{})
+			relay, err := NewRelay(
+				&Options{Address: aaddr, Handshake: true, CallbackObj: newTestCallback()},
+				&Options{Address: baddr, Handshake: true, CallbackObj: newTestCallback()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			relay.Start()
+			defer relay.Close()
+			from, to := apeer, bcb
+			if !c.fromA {
+				from, to = bpeer, acb
+			}
+			eventually(t, func() bool { return relay.A().capable(CapProperties) && relay.B().capable(CapProperties) })
+			sent := c.message
+			if _, err := from.Publish(&sent); err != nil {
+				t.Fatal(err)
+			}
+			msg := to.next(t)
+			if string(msg.Payload) != string(c.message.Payload) || msg.Qos != c.message.Qos ||
+				msg.Topic != c.message.Topic || msg.ReplyTo != c.message.ReplyTo ||
+				msg.CorrelationID != c.message.CorrelationID || msg.ContentType != c.message.ContentType ||
+				msg.Headers["k"] != c.message.Headers["k"] {
+				t.Fatalf("got %+v", msg)
+			}
+		})
+	}
+}
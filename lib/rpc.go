@@ -0,0 +1,132 @@
+package gopack
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNotReceived means that a reply was attempted on an outbound message
+var ErrNotReceived = errors.New("message was not received")
+
+// abandonedCalls correlation ids of timed out calls remembered
+// for lateReplyWindow to drop replies that arrive after all
+const abandonedCalls = 1024
+
+// lateReplyWindow time a timed out call still catches its reply
+const lateReplyWindow = 10 * time.Minute
+
+// calls tracks requests waiting for replies by correlation id
+type calls struct {
+	pending   map[string]chan *Message
+	abandoned *dedupCache
+	mux       sync.Mutex
+}
+
+func newCalls() *calls {
+	return &calls{
+		pending:   make(map[string]chan *Message),
+		abandoned: newDedupCache(abandonedCalls, lateReplyWindow),
+	}
+}
+
+func (c *calls) add(id string) chan *Message {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	ch := make(chan *Message, 1)
+	c.pending[id] = ch
+	return ch
+}
+
+func (c *calls) remove(id string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	delete(c.pending, id)
+}
+
+// abandon forgets call id that timed out and drops its late reply
+func (c *calls) abandon(id string) {
+	c.remove(id)
+	c.abandoned.seen(id)
+}
+
+// resolve hands msg to the call waiting for it or drops the reply
+// to an abandoned call, reports whether it was one of the two
+func (c *calls) resolve(msg *Message) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	ch, ok := c.pending[msg.CorrelationID]
+	if ok {
+		delete(c.pending, msg.CorrelationID)
+		ch <- msg
+	}
+	return ok || c.abandoned.contains(msg.CorrelationID)
+}
+
+// newCorrelationID returns a random correlation id
+func newCorrelationID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Call sends payload as a request and blocks until the peer answers it
+// with Reply or ctx is done, the request is cancelled if it has not
+// been transmitted by then
+func (gopack *GoPack2) Call(ctx context.Context, payload []byte, qos byte) ([]byte, error) {
+	id, err := newCorrelationID()
+	if err != nil {
+		return nil, err
+	}
+	ch := gopack.calls.add(id)
+	defer gopack.calls.remove(id)
+	msgID, err := gopack.Publish(&Message{
+		Qos:           qos,
+		Payload:       payload,
+		CorrelationID: id,
+		TraceParent:   gopack.traceParent(ctx),
+	})
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case reply := <-ch:
+		return reply.Payload, nil
+	case <-ctx.Done():
+		gopack.calls.abandon(id)
+		gopack.Cancel(msgID)
+		return nil, ctx.Err()
+	}
+}
+
+// Reply answers a request received from the peer's Call,
+// returns the assigned MsgID
+func (gopack *GoPack2) Reply(msg *Message, payload []byte) (MsgID, error) {
+	return gopack.reply(msg, payload, msg.Qos)
+}
+
+// Reply answers a received message on the connection it came from,
+// addressed to its ReplyTo topic and carrying its correlation id,
+// returns the assigned MsgID
+func (msg *Message) Reply(payload []byte, qos byte) (MsgID, error) {
+	if msg.gopack == nil {
+		return 0, ErrNotReceived
+	}
+	return msg.gopack.reply(msg, payload, qos)
+}
+
+func (gopack *GoPack2) reply(msg *Message, payload []byte, qos byte) (MsgID, error) {
+	return gopack.Publish(&Message{
+		Qos:           qos,
+		Channel:       msg.Channel,
+		Topic:         msg.ReplyTo,
+		Payload:       payload,
+		CorrelationID: msg.CorrelationID,
+		TraceParent:   msg.TraceParent,
+	})
+}
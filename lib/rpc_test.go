@@ -0,0 +1,130 @@
+package gopack
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCall(t *testing.T) {
+	cases := []struct {
+		name  string
+		reply func(server *GoPack2, msg *Message) error
+		want  string
+		err   error
+	}{
+		{"reply", func(server *GoPack2, msg *Message) error {
+			_, err := server.Reply(msg, append([]byte("re:"), msg.Payload...))
+			return err
+		}, "re:ping", nil},
+		{"message reply", func(server *GoPack2, msg *Message) error {
+			_, err := msg.Reply([]byte("pong"), Qos1)
+			return err
+		}, "pong", nil},
+		{"no reply", func(server *GoPack2, msg *Message) error { return nil }, "", context.DeadlineExceeded},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, _, server, scb := pair(t, &Options{Handshake: true}, &Options{})
+			errs := make(chan error, 1)
+			go func() {
+				select {
+				case msg := <-scb.msgs:
+					errs <- c.reply(server, msg)
+				case <-time.After(5 * time.Second):
+					errs <- nil
+				}
+			}()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			reply, err := client.Call(ctx, []byte("ping"), Qos1)
+			if err != c.err || string(reply) != c.want {
+				t.Fatalf("got %q, %v, want %q, %v", reply, err, c.want, c.err)
+			}
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestReplyNotReceived(t *testing.T) {
+	if _, err := new(Message).Reply(nil, Qos1); err != ErrNotReceived {
+		t.Fatalf("got %v, want ErrNotReceived", err)
+	}
+}
+
+func TestMessageReply(t *testing.T) {
+	cases := []struct {
+		name    string
+		replyTo string
+		qos     byte
+	}{
+		{"reply topic", "replies", Qos1},
+		{"no reply topic", "", Qos1},
+		{"qos0 reply", "replies", Qos0},
+		{"qos2 reply", "replies", Qos2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, ccb, _, scb := pair(t, &Options{Handshake: true}, &Options{})
+			if _, err := client.Publish(&Message{Qos: Qos1, Topic: "requests", ReplyTo: c.replyTo, CorrelationID: "c1", Payload: []byte("ping")}); err != nil {
+				t.Fatal(err)
+			}
+			req := scb.next(t)
+			if req.ReplyTo != c.replyTo {
+				t.Fatalf("reply to %q, want %q", req.ReplyTo, c.replyTo)
+			}
+			if _, err := req.Reply([]byte("pong"), c.qos); err != nil {
+				t.Fatal(err)
+			}
+			reply := ccb.next(t)
+			if string(reply.Payload) != "pong" || reply.Topic != c.replyTo || reply.CorrelationID != "c1" || reply.Qos != c.qos {
+				t.Fatalf("got %+v", reply)
+			}
+		})
+	}
+}
+
+// TestLateReply answers a call after it timed out, the reply is
+// dropped instead of reaching the callback as a message
+func TestLateReply(t *testing.T) {
+	cases := []struct {
+		name      string
+		reply     func(server *GoPack2, msg *Message) error
+		delivered bool
+	}{
+		{"late reply", func(server *GoPack2, msg *Message) error {
+			_, err := server.Reply(msg, []byte("late"))
+			return err
+		}, false},
+		{"other correlation id", func(server *GoPack2, msg *Message) error {
+			_, err := server.Publish(&Message{Qos: Qos1, CorrelationID: "other", Payload: []byte("late")})
+			return err
+		}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, ccb, server, scb := pair(t, &Options{Handshake: true}, &Options{})
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			if _, err := client.Call(ctx, []byte("ping"), Qos1); err != context.DeadlineExceeded {
+				t.Fatalf("call ended with %v", err)
+			}
+			if err := c.reply(server, scb.next(t)); err != nil {
+				t.Fatal(err)
+			}
+			eventually(t, func() bool { return server.remaining() == 0 })
+			select {
+			case msg := <-ccb.msgs:
+				if !c.delivered {
+					t.Fatalf("late reply %q delivered", msg.Payload)
+				}
+			case <-time.After(100 * time.Millisecond):
+				if c.delivered {
+					t.Fatal("message not delivered")
+				}
+			}
+		})
+	}
+}
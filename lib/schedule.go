@@ -0,0 +1,59 @@
+package gopack
+
+// ScheduleDueTime sends due packets by due time credited with
+// their priority, replies and releases come first
+const ScheduleDueTime = 0
+
+// ScheduleByQos sends due replies and releases first, then QoS2,
+// QoS1 and QoS0 messages, each class by due time and priority
+const ScheduleByQos = 1
+
+// reliableStore may be implemented by an OutboundStore to tell
+// how many unconfirmed QoS1 and QoS2 messages it holds
+type reliableStore interface {
+	reliable() int
+}
+
+// reliable returns the number of unconfirmed QoS1 and QoS2 messages
+func (ms *memoryStorage) reliable() int {
+	ms.muxPriorityQueue.Lock()
+	defer ms.muxPriorityQueue.Unlock()
+	return ms.reliableCount
+}
+
+// reliableCount returns the number of unconfirmed QoS1 and QoS2 messages
+// in store, counted from its queue if it does not implement reliableStore
+func reliableCount(store OutboundStore) (count int) {
+	if rs, ok := store.(reliableStore); ok {
+		return rs.reliable()
+	}
+	for _, packet := range queued(store) {
+		if packet.MsgType == MsgTypeSend && !packet.Confirm && packet.Qos != Qos0 {
+			count++
+		}
+	}
+	return count
+}
+
+// scheduleClass ranks packet under ScheduleByQos, lower goes first
+func scheduleClass(packet *Packet) int {
+	if packet.MsgType != MsgTypeSend {
+		return 0
+	}
+	return 1 + int(Qos2-packet.Qos)
+}
+
+// held reports whether QoS0 packet must wait because the reliable
+// backlog is at Options.Qos0Watermark
+func (gopack *GoPack2) held(packet *Packet) bool {
+	watermark := gopack.opts.Qos0Watermark
+	if watermark <= 0 || packet.MsgType != MsgTypeSend || packet.Qos != Qos0 {
+		return false
+	}
+	store := gopack.storage()
+	if rs, ok := store.(reliableStore); ok {
+		return rs.reliable() >= watermark
+	}
+	count, _ := pending(store)
+	return count >= watermark
+}
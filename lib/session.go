@@ -0,0 +1,53 @@
+package gopack
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrConnectRejected means that Options.Authenticate refused a peer
+var ErrConnectRejected = errors.New("connect rejected")
+
+// ConnectInfo identity a peer connected with
+type ConnectInfo struct {
+	ClientID   string
+	Properties map[string]string // Options.ConnectProperties of the peer
+	Remote     string
+}
+
+// authenticate records the identity of CONNECT and lets
+// Options.Authenticate accept it
+func (gopack *GoPack2) authenticate(connect *Packet) error {
+	info := &ConnectInfo{
+		ClientID:   connect.ClientID,
+		Properties: connect.Headers,
+		Remote:     gopack.remote(),
+	}
+	if gopack.opts.Authenticate != nil {
+		// a panicking hook rejects the peer
+		err := errors.New("authenticate panicked")
+		gopack.protect(func() {
+			err = gopack.opts.Authenticate(info)
+		})
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrConnectRejected, err)
+		}
+	}
+	gopack.peerInfo.Store(info)
+	return nil
+}
+
+// PeerInfo returns the identity the peer of the current connection
+// connected with, nil before its handshake
+func (gopack *GoPack2) PeerInfo() *ConnectInfo {
+	info, _ := gopack.peerInfo.Load().(*ConnectInfo)
+	return info
+}
+
+// peerClientID returns the client id of the current peer
+func (gopack *GoPack2) peerClientID() string {
+	if info := gopack.PeerInfo(); info != nil {
+		return info.ClientID
+	}
+	return ""
+}
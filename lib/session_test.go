@@ -0,0 +1,83 @@
+package gopack
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+var errUnknownClient = errors.New("unknown client")
+
+func TestAuthenticate(t *testing.T) {
+	cases := []struct {
+		name     string
+		clientID string
+		hook     func(info *ConnectInfo) error
+		rejected bool
+	}{
+		{"no hook", "sensor-7", nil, false},
+		{"accepted", "sensor-7", func(info *ConnectInfo) error {
+			if info.ClientID != "sensor-7" || info.Properties["token"] != "secret" {
+				return errUnknownClient
+			}
+			return nil
+		}, false},
+		{"rejected", "intruder", func(info *ConnectInfo) error { return errUnknownClient }, true},
+		{"panic", "sensor-7", func(info *ConnectInfo) error { panic("hook") }, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			scb := newTestCallback()
+			server := offline(t, &Options{CallbackObj: scb, Authenticate: c.hook})
+			client, err := NewGoPack(&Options{
+				Address:           ln.Addr().String(),
+				CallbackObj:       newTestCallback(),
+				Handshake:         true,
+				ClientID:          c.clientID,
+				ConnectProperties: map[string]string{"token": "secret"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.Start()
+			defer client.Close()
+			conn, err := ln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			served := make(chan error, 1)
+			go func() { served <- server.serve(conn) }()
+			defer func() {
+				server.Close()
+				<-served
+			}()
+			if c.rejected {
+				err := <-served
+				served <- err
+				if !errors.Is(err, ErrConnectRejected) {
+					t.Fatalf("served %v, want ErrConnectRejected", err)
+				}
+				if server.PeerInfo() != nil {
+					t.Fatal("rejected peer recorded")
+				}
+				return
+			}
+			if _, err := client.Commit([]byte("x"), Qos1); err != nil {
+				t.Fatal(err)
+			}
+			msg := scb.next(t)
+			if msg.ClientID != c.clientID {
+				t.Fatalf("client id %q", msg.ClientID)
+			}
+			info := server.PeerInfo()
+			if info == nil || info.ClientID != c.clientID || info.Properties["token"] != "secret" || info.Remote != msg.Peer {
+				t.Fatalf("peer info %+v", info)
+			}
+		})
+	}
+}
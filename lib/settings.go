@@ -0,0 +1,117 @@
+package gopack
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// settings hold options that may be changed while running
+type settings struct {
+	heartbeat     int32 // milliseconds
+	maxRetries    int32
+	retryInterval int32 // milliseconds
+	maxInflight   int32
+	sendLimit     int32 // bytes of packets sent, 0 is the protocol maximum
+
+	// values set locally, heartbeat and maxInflight return to them
+	// on every connection after a peer assigned others
+	localHeartbeat   int32
+	localMaxInflight int32
+}
+
+func newSettings(opts *Options) *settings {
+	return &settings{
+		heartbeat:        int32(opts.Heartbeat),
+		maxRetries:       int32(opts.MaxRetries),
+		retryInterval:    int32(opts.RetryInterval),
+		maxInflight:      int32(opts.MaxPacketNumber),
+		sendLimit:        int32(opts.MaxPacketSize),
+		localHeartbeat:   int32(opts.Heartbeat),
+		localMaxInflight: int32(opts.MaxPacketNumber),
+	}
+}
+
+func (gopack *GoPack2) heartbeat() time.Duration {
+	return time.Duration(atomic.LoadInt32(&gopack.settings.heartbeat)) * time.Millisecond
+}
+
+func (gopack *GoPack2) maxRetries() int {
+	return int(atomic.LoadInt32(&gopack.settings.maxRetries))
+}
+
+func (gopack *GoPack2) retryInterval() time.Duration {
+	return time.Duration(atomic.LoadInt32(&gopack.settings.retryInterval)) * time.Millisecond
+}
+
+func (gopack *GoPack2) maxInflight() int {
+	return int(atomic.LoadInt32(&gopack.settings.maxInflight))
+}
+
+func (gopack *GoPack2) sendLimit() int {
+	return int(atomic.LoadInt32(&gopack.settings.sendLimit))
+}
+
+// SetHeartbeat changes the keepalive interval in milliseconds
+func (gopack *GoPack2) SetHeartbeat(heartbeat int) {
+	if heartbeat <= 0 {
+		return
+	}
+	atomic.StoreInt32(&gopack.settings.localHeartbeat, int32(heartbeat))
+	atomic.StoreInt32(&gopack.settings.heartbeat, int32(heartbeat))
+	gopack.wake()
+}
+
+// SetRetryPolicy changes retransmissions before dead-lettering,
+// 0 retries forever, and the delay in milliseconds that grows
+// with every retransmission
+func (gopack *GoPack2) SetRetryPolicy(maxRetries int, retryInterval int) {
+	atomic.StoreInt32(&gopack.settings.maxRetries, int32(maxRetries))
+	if retryInterval > 0 {
+		atomic.StoreInt32(&gopack.settings.retryInterval, int32(retryInterval))
+	}
+}
+
+// SetMaxInflight changes the window of unacknowledged QoS1/QoS2
+// packets, negative is unbounded
+func (gopack *GoPack2) SetMaxInflight(maxInflight int) {
+	if maxInflight == 0 {
+		return
+	}
+	atomic.StoreInt32(&gopack.settings.localMaxInflight, int32(maxInflight))
+	atomic.StoreInt32(&gopack.settings.maxInflight, int32(maxInflight))
+	gopack.wake()
+}
+
+// Parameters operational settings a peer assigns in CONNACK,
+// zero values are left unchanged, assigned values hold for the
+// connection only and the local ones apply again on reconnect
+type Parameters struct {
+	Heartbeat     int // milliseconds, see SetHeartbeat
+	MaxPacketSize int // bytes of packets sent to the assigning peer
+	MaxInflight   int // see SetMaxInflight
+}
+
+// adopt applies parameters assigned by the peer for the current
+// connection, a maximum packet size only lowers Options.MaxPacketSize
+func (gopack *GoPack2) adopt(params Parameters) {
+	if params.Heartbeat > 0 {
+		atomic.StoreInt32(&gopack.settings.heartbeat, int32(params.Heartbeat))
+	}
+	if params.MaxInflight != 0 {
+		atomic.StoreInt32(&gopack.settings.maxInflight, int32(params.MaxInflight))
+	}
+	gopack.wake()
+	if limit := params.MaxPacketSize; limit > 0 &&
+		(gopack.opts.MaxPacketSize <= 0 || limit < gopack.opts.MaxPacketSize) {
+		atomic.StoreInt32(&gopack.settings.sendLimit, int32(limit))
+	}
+}
+
+// resetParameters drops parameters assigned on the previous connection
+func (gopack *GoPack2) resetParameters() {
+	atomic.StoreInt32(&gopack.settings.heartbeat,
+		atomic.LoadInt32(&gopack.settings.localHeartbeat))
+	atomic.StoreInt32(&gopack.settings.maxInflight,
+		atomic.LoadInt32(&gopack.settings.localMaxInflight))
+	atomic.StoreInt32(&gopack.settings.sendLimit, int32(gopack.opts.MaxPacketSize))
+}
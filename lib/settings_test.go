@@ -0,0 +1,116 @@
+package gopack
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSettings(t *testing.T) {
+	cases := []struct {
+		name      string
+		apply     func(gopack *GoPack2)
+		heartbeat time.Duration
+		retries   int
+		interval  time.Duration
+		inflight  int
+	}{
+		{"defaults", func(gopack *GoPack2) {}, time.Second, 0, 5 * time.Second, 20},
+		{"heartbeat", func(gopack *GoPack2) { gopack.SetHeartbeat(2000) }, 2 * time.Second, 0, 5 * time.Second, 20},
+		{"heartbeat ignored", func(gopack *GoPack2) { gopack.SetHeartbeat(0) }, time.Second, 0, 5 * time.Second, 20},
+		{"retry policy", func(gopack *GoPack2) { gopack.SetRetryPolicy(3, 100) }, time.Second, 3, 100 * time.Millisecond, 20},
+		{"retries only", func(gopack *GoPack2) { gopack.SetRetryPolicy(3, 0) }, time.Second, 3, 5 * time.Second, 20},
+		{"inflight", func(gopack *GoPack2) { gopack.SetMaxInflight(-1) }, time.Second, 0, 5 * time.Second, -1},
+		{"inflight ignored", func(gopack *GoPack2) { gopack.SetMaxInflight(0) }, time.Second, 0, 5 * time.Second, 20},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{})
+			c.apply(gopack)
+			if gopack.heartbeat() != c.heartbeat || gopack.maxRetries() != c.retries ||
+				gopack.retryInterval() != c.interval || gopack.maxInflight() != c.inflight {
+				t.Fatalf("heartbeat %v, retries %d, interval %v, inflight %d",
+					gopack.heartbeat(), gopack.maxRetries(), gopack.retryInterval(), gopack.maxInflight())
+			}
+		})
+	}
+}
+
+func TestAdopt(t *testing.T) {
+	cases := []struct {
+		name      string
+		opts      Options
+		params    Parameters
+		heartbeat time.Duration
+		limit     int
+		inflight  int
+	}{
+		{"nothing assigned", Options{}, Parameters{}, time.Second, 0, 20},
+		{"all assigned", Options{}, Parameters{Heartbeat: 5000, MaxPacketSize: 4096, MaxInflight: 4}, 5 * time.Second, 4096, 4},
+		{"lowers packet size", Options{MaxPacketSize: 8192}, Parameters{MaxPacketSize: 4096}, time.Second, 4096, 20},
+		{"never raises packet size", Options{MaxPacketSize: 1024}, Parameters{MaxPacketSize: 4096}, time.Second, 1024, 20},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			opts := c.opts
+			gopack := offline(t, &opts)
+			gopack.adopt(c.params)
+			if gopack.heartbeat() != c.heartbeat || gopack.sendLimit() != c.limit || gopack.maxInflight() != c.inflight {
+				t.Fatalf("heartbeat %v, limit %d, inflight %d", gopack.heartbeat(), gopack.sendLimit(), gopack.maxInflight())
+			}
+		})
+	}
+}
+
+// TestResetParameters reconnects after a peer assigned parameters,
+// the local settings apply again
+func TestResetParameters(t *testing.T) {
+	cases := []struct {
+		name      string
+		local     func(gopack *GoPack2)
+		heartbeat time.Duration
+		inflight  int
+	}{
+		{"options", func(gopack *GoPack2) {}, time.Second, 20},
+		{"changed locally", func(gopack *GoPack2) {
+			gopack.SetHeartbeat(3000)
+			gopack.SetMaxInflight(8)
+		}, 3 * time.Second, 8},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{})
+			c.local(gopack)
+			gopack.adopt(Parameters{Heartbeat: 5000, MaxPacketSize: 4096, MaxInflight: 4})
+			gopack.resetHandshake()
+			if gopack.heartbeat() != c.heartbeat || gopack.sendLimit() != 0 || gopack.maxInflight() != c.inflight {
+				t.Fatalf("heartbeat %v, limit %d, inflight %d", gopack.heartbeat(), gopack.sendLimit(), gopack.maxInflight())
+			}
+		})
+	}
+}
+
+func TestAssignParameters(t *testing.T) {
+	cases := []struct {
+		name      string
+		handshake bool
+		limit     int
+	}{
+		{"handshake", true, 2048},
+		{"legacy peer", false, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, _, _, _ := pair(t, &Options{Handshake: c.handshake},
+				&Options{AssignParameters: Parameters{MaxPacketSize: 2048}})
+			eventually(t, func() bool { return client.ConnState().Connected })
+			if c.handshake {
+				eventually(t, func() bool { return client.sendLimit() == c.limit })
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+			if client.sendLimit() != c.limit {
+				t.Fatalf("limit %d", client.sendLimit())
+			}
+		})
+	}
+}
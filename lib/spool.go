@@ -0,0 +1,490 @@
+package gopack
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrSpoolFull offline spool reached Options.MaxSpoolBytes
+var ErrSpoolFull = errors.New("spool full")
+
+// SyncNone leaves flushing spooled records to the operating system
+const SyncNone = 0
+
+// SyncAlways flushes every spooled record to disk before Commit returns
+const SyncAlways = 1
+
+// SyncInterval flushes spooled records at most Options.SpoolSyncInterval
+// milliseconds after they were written
+const SyncInterval = 2
+
+// SyncOnConfirm leaves flushing spooled messages to the operating system
+// and flushes the spool once messages leave it, when they are cancelled,
+// purged or handed to the storage, so they are not restored again
+const SyncOnConfirm = 3
+
+// spoolMagic starts spool files whose records carry checksums
+const spoolMagic = 0x47505332
+
+// spoolHeaderLength record length, checksum, created at, timestamp and priority
+const spoolHeaderLength = 4 + 4 + 8 + 8 + 1
+
+// errChecksum spooled record is damaged, the following ones are intact
+var errChecksum = errors.New("spool record checksum mismatch")
+
+// errTruncated spool ends within a record or its framing is lost
+var errTruncated = errors.New("spool truncated")
+
+// SpoolRecovery reports the check of the spool made by NewGoPack
+type SpoolRecovery struct {
+	Restored       int   // messages restored from the spool
+	Discarded      int   // damaged or truncated records dropped
+	TruncatedBytes int64 // unreadable bytes at the end of the spool
+}
+
+// spool is a bounded append-only file holding messages
+// committed while disconnected
+type spool struct {
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+	mux     sync.Mutex
+
+	syncPolicy   int
+	syncInterval time.Duration
+	syncPending  bool
+
+	// spooled messages by MsgID and bytes held by cancelled ones
+	live         map[MsgID]spoolEntry
+	dead         int64
+	compactMin   int64
+	compactRatio float64
+	compacting   bool
+
+	// deflate record buffers when that makes them smaller
+	compress bool
+
+	// outcome of the last full read of the spool
+	recovery SpoolRecovery
+}
+
+// spoolEntry locates a live spooled message
+type spoolEntry struct {
+	size      int64
+	createdAt int64
+	qos       byte
+}
+
+// tombstoneLength record length of a cancelled message marker
+const tombstoneLength = spoolHeaderLength + 2
+
+// openSpool opens or creates the spool file at opts.SpoolPath
+func openSpool(opts *Options) (sp *spool, err error) {
+	file, err := os.OpenFile(opts.SpoolPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	sp = &spool{
+		path:         opts.SpoolPath,
+		maxSize:      int64(opts.MaxSpoolBytes),
+		file:         file,
+		size:         info.Size(),
+		syncPolicy:   opts.SpoolSync,
+		syncInterval: time.Duration(opts.SpoolSyncInterval) * time.Millisecond,
+		live:         make(map[MsgID]spoolEntry),
+		compactMin:   int64(opts.SpoolCompactBytes),
+		compactRatio: opts.SpoolCompactRatio,
+		compress:     opts.SpoolCompression,
+	}
+	return sp, nil
+}
+
+// recordCompressed length bit of records holding a deflated buffer
+const recordCompressed = 1 << 31
+
+// encodeRecord serializes packet with its storage metadata
+func (sp *spool) encodeRecord(packet *Packet) []byte {
+	buf, flags := packet.Buffer, uint32(0)
+	if sp.compress {
+		if deflated := deflate(buf); len(deflated) < len(buf) {
+			buf, flags = deflated, recordCompressed
+		}
+	}
+	record := make([]byte, spoolHeaderLength, spoolHeaderLength+len(buf))
+	binary.BigEndian.PutUint32(record[0:], uint32(spoolHeaderLength-4+len(buf))|flags)
+	binary.BigEndian.PutUint64(record[8:], uint64(packet.CreatedAt))
+	binary.BigEndian.PutUint64(record[16:], uint64(packet.Timestamp))
+	record[24] = packet.Priority
+	return seal(append(record, buf...))
+}
+
+// deflate compresses b
+func deflate(b []byte) []byte {
+	var buffer bytes.Buffer
+	writer, _ := flate.NewWriter(&buffer, flate.BestSpeed)
+	writer.Write(b)
+	writer.Close()
+	return buffer.Bytes()
+}
+
+// inflate decompresses b, failing beyond the largest packet
+func inflate(b []byte) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(b))
+	defer reader.Close()
+	buf, err := io.ReadAll(io.LimitReader(reader, 5+MaxRemainingLength+1))
+	if err != nil || len(buf) > 5+MaxRemainingLength {
+		return nil, ErrDecodePayload
+	}
+	return buf, nil
+}
+
+// encodeTombstone serializes a marker cancelling spooled message id
+func encodeTombstone(id MsgID) []byte {
+	record := make([]byte, tombstoneLength)
+	binary.BigEndian.PutUint32(record[0:], uint32(tombstoneLength-4))
+	binary.BigEndian.PutUint16(record[spoolHeaderLength:], uint16(id))
+	return seal(record)
+}
+
+// seal stores the checksum of record
+func seal(record []byte) []byte {
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(record[8:]))
+	return record
+}
+
+// readRecord reads the next record and returns the bytes it spans,
+// io.EOF at the end of the spool, tombstones are returned as packets
+// without a MsgType
+func readRecord(r io.Reader) (packet *Packet, n int, err error) {
+	header := make([]byte, spoolHeaderLength)
+	_, err = io.ReadFull(r, header)
+	if err == io.ErrUnexpectedEOF {
+		return nil, 0, errTruncated
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	length := int(binary.BigEndian.Uint32(header[0:]) &^ recordCompressed)
+	compressed := binary.BigEndian.Uint32(header[0:])&recordCompressed != 0
+	if length < spoolHeaderLength-4 || length > spoolHeaderLength-4+5+MaxRemainingLength {
+		return nil, 0, errTruncated
+	}
+	buf := make([]byte, length-(spoolHeaderLength-4))
+	_, err = io.ReadFull(r, buf)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return nil, 0, errTruncated
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	n = 4 + length
+	sum := crc32.Update(crc32.ChecksumIEEE(header[8:]), crc32.IEEETable, buf)
+	if sum != binary.BigEndian.Uint32(header[4:]) {
+		return nil, n, errChecksum
+	}
+	if compressed {
+		if buf, err = inflate(buf); err != nil {
+			return nil, n, err
+		}
+	} else if len(buf) == tombstoneLength-spoolHeaderLength {
+		return &Packet{MsgID: MsgID(binary.BigEndian.Uint16(buf))}, n, nil
+	}
+	packet, err = Decode(buf)
+	if err != nil {
+		return nil, n, err
+	}
+	packet.CreatedAt = int64(binary.BigEndian.Uint64(header[8:]))
+	packet.Timestamp = int64(binary.BigEndian.Uint64(header[16:]))
+	packet.Priority = header[24]
+	return packet, n, nil
+}
+
+// Append writes packet at the end of the spool
+func (sp *spool) Append(packet *Packet) error {
+	sp.mux.Lock()
+	defer sp.mux.Unlock()
+	record := sp.encodeRecord(packet)
+	if sp.maxSize > 0 && sp.size+int64(len(record)) > sp.maxSize {
+		return ErrSpoolFull
+	}
+	if err := sp.write(record); err != nil {
+		return err
+	}
+	sp.live[packet.MsgID] = spoolEntry{size: int64(len(record)), createdAt: packet.CreatedAt, qos: packet.Qos}
+	return nil
+}
+
+// write appends record and flushes it according to the sync policy
+func (sp *spool) write(record []byte) error {
+	if sp.size == 0 {
+		magic := make([]byte, 4, 4+len(record))
+		binary.BigEndian.PutUint32(magic, spoolMagic)
+		record = append(magic, record...)
+	}
+	n, err := sp.file.Write(record)
+	sp.size += int64(n)
+	if err != nil {
+		return err
+	}
+	switch sp.syncPolicy {
+	case SyncAlways:
+		return sp.file.Sync()
+	case SyncInterval:
+		if !sp.syncPending {
+			sp.syncPending = true
+			time.AfterFunc(sp.syncInterval, sp.sync)
+		}
+	}
+	return nil
+}
+
+// sync flushes records written since the last sync
+func (sp *spool) sync() {
+	sp.mux.Lock()
+	defer sp.mux.Unlock()
+	sp.syncPending = false
+	sp.file.Sync()
+}
+
+// Len returns the spool size in bytes
+func (sp *spool) Len() int64 {
+	sp.mux.Lock()
+	defer sp.mux.Unlock()
+	return sp.size
+}
+
+// each calls fn for every spooled packet in order,
+// cancelled packets are skipped and damaged records dropped
+func (sp *spool) each(fn func(*Packet)) error {
+	_, err := sp.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(sp.file)
+	var recovery SpoolRecovery
+	if magic, err := reader.Peek(4); err != nil || binary.BigEndian.Uint32(magic) != spoolMagic {
+		// empty or not a spool file
+		if sp.size > 0 {
+			recovery.Discarded++
+			recovery.TruncatedBytes = sp.size
+		}
+		sp.recovery = recovery
+		return nil
+	}
+	reader.Discard(4)
+	offset := int64(4)
+	// a tombstone drops the latest preceding record with its id,
+	// a later message may reuse the id
+	var packets []*Packet
+	latest := make(map[MsgID]int)
+	for {
+		packet, n, err := readRecord(reader)
+		offset += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err == errTruncated {
+			recovery.Discarded++
+			recovery.TruncatedBytes = sp.size - offset
+			break
+		}
+		if err == errChecksum || errors.Is(err, ErrDecode) {
+			recovery.Discarded++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if packet.MsgType == 0 {
+			if i, ok := latest[packet.MsgID]; ok {
+				packets[i] = nil
+				delete(latest, packet.MsgID)
+			}
+			continue
+		}
+		latest[packet.MsgID] = len(packets)
+		packets = append(packets, packet)
+	}
+	for _, packet := range packets {
+		if packet != nil {
+			recovery.Restored++
+			fn(packet)
+		}
+	}
+	sp.recovery = recovery
+	return nil
+}
+
+// Cancel drops spooled message id, reports false if it is not spooled
+func (sp *spool) Cancel(id MsgID) bool {
+	sp.mux.Lock()
+	defer sp.mux.Unlock()
+	if _, ok := sp.live[id]; !ok {
+		return false
+	}
+	return sp.tombstone(id) == nil
+}
+
+// has reports whether message id is spooled
+func (sp *spool) has(id MsgID) bool {
+	sp.mux.Lock()
+	defer sp.mux.Unlock()
+	_, ok := sp.live[id]
+	return ok
+}
+
+// count returns the number of spooled messages
+func (sp *spool) count() int {
+	sp.mux.Lock()
+	defer sp.mux.Unlock()
+	return len(sp.live)
+}
+
+// reliable returns the number of spooled QoS1 and QoS2 messages
+func (sp *spool) reliable() (count int) {
+	sp.mux.Lock()
+	defer sp.mux.Unlock()
+	for _, entry := range sp.live {
+		if entry.qos != Qos0 {
+			count++
+		}
+	}
+	return count
+}
+
+// Purge drops spooled messages committed before the unix nano time,
+// returns their ids
+func (sp *spool) Purge(before int64) (ids []MsgID) {
+	sp.mux.Lock()
+	defer sp.mux.Unlock()
+	for id, entry := range sp.live {
+		if entry.createdAt < before && sp.tombstone(id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// tombstone marks spooled message id cancelled and compacts
+// the spool in the background once enough of it is dead
+func (sp *spool) tombstone(id MsgID) error {
+	record := encodeTombstone(id)
+	if err := sp.write(record); err != nil {
+		return err
+	}
+	if sp.syncPolicy == SyncOnConfirm {
+		if err := sp.file.Sync(); err != nil {
+			return err
+		}
+	}
+	sp.dead += sp.live[id].size + int64(len(record))
+	delete(sp.live, id)
+	if !sp.compacting && sp.dead >= sp.compactMin &&
+		float64(sp.dead) >= sp.compactRatio*float64(sp.size) {
+		sp.compacting = true
+		go sp.compact()
+	}
+	return nil
+}
+
+// compact rewrites the spool without cancelled messages
+func (sp *spool) compact() {
+	sp.Rewrite(func(packet *Packet) *Packet {
+		return packet
+	})
+	sp.mux.Lock()
+	sp.compacting = false
+	sp.mux.Unlock()
+}
+
+// Drain calls fn for every spooled packet in order and empties the spool
+func (sp *spool) Drain(fn func(*Packet)) error {
+	sp.mux.Lock()
+	defer sp.mux.Unlock()
+	if sp.size == 0 {
+		return nil
+	}
+	if err := sp.each(fn); err != nil {
+		return err
+	}
+	if err := sp.file.Truncate(0); err != nil {
+		return err
+	}
+	if sp.syncPolicy == SyncOnConfirm {
+		if err := sp.file.Sync(); err != nil {
+			return err
+		}
+	}
+	sp.size = 0
+	sp.dead = 0
+	sp.live = make(map[MsgID]spoolEntry)
+	return nil
+}
+
+// Rewrite replaces every spooled packet by the result of fn,
+// packets are dropped when fn returns nil
+func (sp *spool) Rewrite(fn func(*Packet) *Packet) error {
+	sp.mux.Lock()
+	defer sp.mux.Unlock()
+	tmpPath := sp.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	magic := make([]byte, 4)
+	binary.BigEndian.PutUint32(magic, spoolMagic)
+	writer.Write(magic)
+	size := int64(len(magic))
+	live := make(map[MsgID]spoolEntry)
+	err = sp.each(func(packet *Packet) {
+		if packet = fn(packet); packet != nil {
+			n, _ := writer.Write(sp.encodeRecord(packet))
+			size += int64(n)
+			live[packet.MsgID] = spoolEntry{size: int64(n), createdAt: packet.CreatedAt, qos: packet.Qos}
+		}
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmpPath, sp.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	sp.file.Close()
+	sp.file, err = os.OpenFile(sp.path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	sp.size = size
+	sp.dead = 0
+	sp.live = live
+	return nil
+}
+
+// SpoolRecovery returns how many spooled messages survived
+// the previous process and how many records were dropped
+func (gopack *GoPack2) SpoolRecovery() SpoolRecovery {
+	return gopack.recovery
+}
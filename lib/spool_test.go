@@ -0,0 +1,395 @@
+package gopack
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// spoolOp appends a message with a payload or cancels one when payload is empty
+type spoolOp struct {
+	id      MsgID
+	payload string
+}
+
+func testSpool(t *testing.T, opts *Options) *spool {
+	t.Helper()
+	if opts.SpoolPath == "" {
+		opts.SpoolPath = filepath.Join(t.TempDir(), "spool")
+	}
+	sp, err := openSpool(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sp.file.Close() })
+	return sp
+}
+
+func spoolPacket(id MsgID, payload string) *Packet {
+	packet := &Packet{MsgType: MsgTypeSend, Qos: Qos1, MsgID: id, Payload: []byte(payload), CreatedAt: int64(id), Priority: 3}
+	packet.Pack()
+	return packet
+}
+
+func drainSpool(t *testing.T, sp *spool) (payloads []string) {
+	t.Helper()
+	err := sp.Drain(func(packet *Packet) {
+		if packet.Priority != 3 || packet.CreatedAt != int64(packet.MsgID) {
+			t.Fatalf("metadata of %d lost", packet.MsgID)
+		}
+		payloads = append(payloads, string(packet.Payload))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sp.Len() != 0 || sp.count() != 0 {
+		t.Fatalf("spool not empty after drain, %d bytes", sp.Len())
+	}
+	return payloads
+}
+
+func TestSpoolRoundTrip(t *testing.T) {
+	cases := []struct {
+		name     string
+		compress bool
+		ops      []spoolOp
+		want     []string
+	}{
+		{"append", false, []spoolOp{{1, "a"}, {2, "b"}, {3, "c"}}, []string{"a", "b", "c"}},
+		{"cancel", false, []spoolOp{{1, "a"}, {2, "b"}, {1, ""}}, []string{"b"}},
+		{"reused id", false, []spoolOp{{5, "cancelled"}, {5, ""}, {5, "live"}}, []string{"live"}},
+		{"reused id cancelled", false, []spoolOp{{5, "a"}, {5, ""}, {5, "b"}, {5, ""}, {6, "c"}}, []string{"c"}},
+		{"compressed", true, []spoolOp{{1, string(make([]byte, 1000))}, {2, "b"}}, []string{string(make([]byte, 1000)), "b"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sp := testSpool(t, &Options{SpoolCompression: c.compress})
+			for _, op := range c.ops {
+				if op.payload == "" {
+					if !sp.Cancel(op.id) {
+						t.Fatalf("cancel %d failed", op.id)
+					}
+				} else if err := sp.Append(spoolPacket(op.id, op.payload)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := drainSpool(t, sp); !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestSpoolRewrite(t *testing.T) {
+	sp := testSpool(t, &Options{})
+	for id := MsgID(1); id <= 3; id++ {
+		if err := sp.Append(spoolPacket(id, string(rune('a'+id-1)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sp.Cancel(2)
+	err := sp.Rewrite(func(packet *Packet) *Packet {
+		if packet.MsgID == 3 {
+			return nil
+		}
+		packet.Payload = append(packet.Payload, '!')
+		packet.Pack()
+		return packet
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sp.count() != 1 || sp.has(2) || sp.has(3) {
+		t.Fatalf("live ids after rewrite: %v", sp.live)
+	}
+	if got := drainSpool(t, sp); !reflect.DeepEqual(got, []string{"a!"}) {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	sp := testSpool(t, &Options{MaxSpoolBytes: 64})
+	if err := sp.Append(spoolPacket(1, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.Append(spoolPacket(2, string(make([]byte, 64)))); err != ErrSpoolFull {
+		t.Fatalf("got %v, want ErrSpoolFull", err)
+	}
+}
+
+// TestSpoolRecovery damages a spool of three records and reopens it
+func TestSpoolRecovery(t *testing.T) {
+	cases := []struct {
+		name   string
+		damage func(file []byte, ends []int64) []byte
+		want   []string
+		report SpoolRecovery
+	}{
+		{"intact", func(file []byte, ends []int64) []byte {
+			return file
+		}, []string{"a", "b", "c"}, SpoolRecovery{Restored: 3}},
+		{"truncated", func(file []byte, ends []int64) []byte {
+			return file[:ends[1]+5]
+		}, []string{"a", "b"}, SpoolRecovery{Restored: 2, Discarded: 1, TruncatedBytes: 5}},
+		{"corrupt", func(file []byte, ends []int64) []byte {
+			file[ends[1]-1] ^= 0xff
+			return file
+		}, []string{"a", "c"}, SpoolRecovery{Restored: 2, Discarded: 1}},
+		{"garbage", func(file []byte, ends []int64) []byte {
+			return append(file, 0xff, 0xff, 0xff, 0xff, 0, 0)
+		}, []string{"a", "b", "c"}, SpoolRecovery{Restored: 3, Discarded: 1, TruncatedBytes: 6}},
+		{"not a spool", func(file []byte, ends []int64) []byte {
+			return []byte("not a spool file")
+		}, nil, SpoolRecovery{Discarded: 1, TruncatedBytes: 16}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "spool")
+			sp := testSpool(t, &Options{SpoolPath: path})
+			var ends []int64
+			for id := MsgID(1); id <= 3; id++ {
+				if err := sp.Append(spoolPacket(id, string(rune('a'+id-1)))); err != nil {
+					t.Fatal(err)
+				}
+				ends = append(ends, sp.Len())
+			}
+			sp.file.Close()
+			file, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, c.damage(file, ends), 0600); err != nil {
+				t.Fatal(err)
+			}
+			sp = testSpool(t, &Options{SpoolPath: path})
+			if err := sp.Rewrite(func(packet *Packet) *Packet { return packet }); err != nil {
+				t.Fatal(err)
+			}
+			if sp.recovery != c.report {
+				t.Fatalf("recovery %+v, want %+v", sp.recovery, c.report)
+			}
+			if got := drainSpool(t, sp); !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestSpoolSync(t *testing.T) {
+	cases := []struct {
+		name    string
+		policy  int
+		pending bool
+	}{
+		{"none", SyncNone, false},
+		{"always", SyncAlways, false},
+		{"interval", SyncInterval, true},
+		{"on confirm", SyncOnConfirm, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sp := testSpool(t, &Options{SpoolSync: c.policy, SpoolSyncInterval: 20})
+			for id := MsgID(1); id <= 3; id++ {
+				if err := sp.Append(spoolPacket(id, "a")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !sp.Cancel(1) {
+				t.Fatal("spooled message not cancelled")
+			}
+			sp.mux.Lock()
+			pending := sp.syncPending
+			sp.mux.Unlock()
+			if pending != c.pending {
+				t.Fatalf("sync pending %v, want %v", pending, c.pending)
+			}
+			eventually(t, func() bool {
+				sp.mux.Lock()
+				defer sp.mux.Unlock()
+				return !sp.syncPending
+			})
+		})
+	}
+}
+
+func TestSpoolCompaction(t *testing.T) {
+	cases := []struct {
+		name      string
+		min       int
+		cancel    int
+		compacted bool
+	}{
+		{"below ratio", 1, 1, false},
+		{"above ratio", 1, 3, true},
+		{"below minimum", 1 << 20, 3, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sp := testSpool(t, &Options{SpoolCompactRatio: 0.5, SpoolCompactBytes: c.min})
+			var ends []int64
+			for id := MsgID(1); id <= 4; id++ {
+				if err := sp.Append(spoolPacket(id, "abcdefgh")); err != nil {
+					t.Fatal(err)
+				}
+				ends = append(ends, sp.Len())
+			}
+			for id := MsgID(1); id <= MsgID(c.cancel); id++ {
+				sp.Cancel(id)
+			}
+			// what is left after a rewrite, records are of equal size
+			live := int64(4-c.cancel) * ends[0]
+			if c.compacted {
+				eventually(t, func() bool { return sp.Len() == live })
+			} else {
+				time.Sleep(20 * time.Millisecond)
+				if sp.Len() == live {
+					t.Fatal("compacted")
+				}
+			}
+			want := make([]string, 4-c.cancel)
+			for i := range want {
+				want[i] = "abcdefgh"
+			}
+			if got := drainSpool(t, sp); !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// TestSpoolRestart spools messages in one GoPack2, damages the spool
+// and hands it to a new one that delivers what survived
+func TestSpoolRestart(t *testing.T) {
+	cases := []struct {
+		name    string
+		garbage []byte
+		report  SpoolRecovery
+	}{
+		{"clean", nil, SpoolRecovery{Restored: 3}},
+		{"torn tail", []byte{0xff, 0xff, 0xff, 0xff, 0, 0}, SpoolRecovery{Restored: 3, Discarded: 1, TruncatedBytes: 6}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "spool")
+			before := offline(t, &Options{SpoolPath: path})
+			for _, payload := range []string{"a", "b", "c"} {
+				if _, err := before.Commit([]byte(payload), Qos1); err != nil {
+					t.Fatal(err)
+				}
+			}
+			before.spool.file.Close()
+			file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file.Write(c.garbage)
+			file.Close()
+			client, _, _, scb := pair(t, &Options{SpoolPath: path}, &Options{})
+			t.Cleanup(func() { client.spool.file.Close() })
+			if report := client.SpoolRecovery(); report != c.report {
+				t.Fatalf("recovery %+v, want %+v", report, c.report)
+			}
+			if _, err := client.Commit([]byte("d"), Qos1); err != nil {
+				t.Fatal(err)
+			}
+			seen := map[string]bool{}
+			for len(seen) < 4 {
+				seen[string(scb.next(t).Payload)] = true
+			}
+			for _, payload := range []string{"a", "b", "c", "d"} {
+				if !seen[payload] {
+					t.Fatalf("%q not delivered, got %v", payload, seen)
+				}
+			}
+		})
+	}
+}
+
+func TestSpoolRecordCompression(t *testing.T) {
+	random := make([]byte, 512)
+	rand.New(rand.NewSource(1)).Read(random)
+	cases := []struct {
+		name       string
+		compress   bool
+		payload    []byte
+		compressed bool
+	}{
+		{"off", false, make([]byte, 512), false},
+		{"repetitive", true, make([]byte, 512), true},
+		{"tiny", true, []byte("a"), false},
+		{"noisy", true, random, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sp := testSpool(t, &Options{SpoolCompression: c.compress})
+			packet := spoolPacket(1, string(c.payload))
+			record := sp.encodeRecord(packet)
+			flagged := binary.BigEndian.Uint32(record)&recordCompressed != 0
+			if flagged != c.compressed || (len(record) < len(packet.Buffer)) != c.compressed {
+				t.Fatalf("record of %d bytes compressed %v, want %v", len(record), flagged, c.compressed)
+			}
+			if err := sp.Append(packet); err != nil {
+				t.Fatal(err)
+			}
+			if got := drainSpool(t, sp); len(got) != 1 || got[0] != string(c.payload) {
+				t.Fatal("payload changed")
+			}
+		})
+	}
+}
+
+func TestSpoolWhileDisconnected(t *testing.T) {
+	cases := []struct {
+		name      string
+		spool     bool
+		connected bool
+		spooled   int
+	}{
+		{"no spool", false, false, 0},
+		{"disconnected", true, false, 3},
+		{"connected", true, true, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			opts := &Options{}
+			if c.spool {
+				opts.SpoolPath = filepath.Join(t.TempDir(), "spool")
+			}
+			gopack := offline(t, opts)
+			if gopack.spool != nil {
+				t.Cleanup(func() { gopack.spool.file.Close() })
+			}
+			gopack.setConnected(c.connected)
+			var ids []MsgID
+			for _, qos := range []byte{Qos0, Qos1, Qos2} {
+				id, err := gopack.Commit([]byte{'0' + qos}, qos)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, id)
+			}
+			spooled := 0
+			if gopack.spool != nil {
+				spooled = gopack.spool.count()
+			}
+			if spooled != c.spooled || gopack.remaining() != 3 {
+				t.Fatalf("%d spooled, %d remaining", spooled, gopack.remaining())
+			}
+			gopack.setConnected(true)
+			if gopack.spool != nil && gopack.spool.count() != 0 {
+				t.Fatal("spool not drained on connection")
+			}
+			for i, id := range ids {
+				packet := gopack.storage().Unconfirmed()
+				if packet == nil || packet.MsgID != id || packet.Payload[0] != '0'+byte(i) {
+					t.Fatalf("stored %+v, want %d", packet, id)
+				}
+				gopack.storage().Confirm(id)
+			}
+		})
+	}
+}
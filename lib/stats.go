@@ -0,0 +1,223 @@
+package gopack
+
+import (
+	"sync"
+	"time"
+)
+
+// latencyBounds upper bounds of latency histogram buckets
+var latencyBounds = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+	10 * time.Second,
+	time.Minute,
+}
+
+// Histogram counts latencies into buckets,
+// Counts[i] holds latencies up to Bounds[i], the last one the rest
+type Histogram struct {
+	Bounds []time.Duration
+	Counts []int64
+	Count  int64
+	Sum    time.Duration
+}
+
+func newHistogram() Histogram {
+	return Histogram{
+		Bounds: latencyBounds,
+		Counts: make([]int64, len(latencyBounds)+1),
+	}
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(h.Bounds) && d > h.Bounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+// Quantile estimates the latency below which q of the observations fall
+func (h *Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := int64(q * float64(h.Count))
+	var seen int64
+	for i, count := range h.Counts {
+		seen += count
+		if seen > rank {
+			if i < len(h.Bounds) {
+				return h.Bounds[i]
+			}
+			break
+		}
+	}
+	return h.Bounds[len(h.Bounds)-1]
+}
+
+func (h Histogram) clone() Histogram {
+	h.Counts = append([]int64(nil), h.Counts...)
+	return h
+}
+
+// Stats is a snapshot of GoPack2 counters
+type Stats struct {
+	PacketsSent     int64
+	PacketsReceived int64
+	Retransmissions int64 // packets sent again after a retry interval
+
+	// acknowledgments ignored because their message was confirmed
+	// recently, or is not known at all
+	LateAcks    int64
+	UnknownAcks int64
+
+	// MalformedPackets received packets dropped because they do not decode
+	MalformedPackets int64
+
+	// DeliveryLatency from sender commit to delivery,
+	// for messages carrying a commit time (Options.SendTimestamp),
+	// relies on synchronized clocks
+	DeliveryLatency Histogram
+
+	// RoundTripLatency from first transmission to acknowledgment
+	RoundTripLatency Histogram
+
+	// outbound queue depth and age of its oldest message,
+	// QoS2 messages received and waiting for release
+	Pending         int
+	PendingBytes    int
+	OldestPending   time.Duration
+	ReceiveBuffered int
+}
+
+// StorageStats may be implemented by a storage to report its state
+// cheaply, otherwise Stats derives it from Queued and Unreleased
+type StorageStats interface {
+	OldestPending() time.Duration
+	ReceiveBuffered() int
+}
+
+// stats accumulates Stats
+type stats struct {
+	Stats
+	mux sync.Mutex
+}
+
+func newStats() *stats {
+	s := new(stats)
+	s.DeliveryLatency = newHistogram()
+	s.RoundTripLatency = newHistogram()
+	return s
+}
+
+func (s *stats) sent() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.PacketsSent++
+}
+
+func (s *stats) retransmitted() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.Retransmissions++
+}
+
+func (s *stats) lateAck() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.LateAcks++
+}
+
+func (s *stats) unknownAck() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.UnknownAcks++
+}
+
+func (s *stats) malformed() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.MalformedPackets++
+}
+
+func (s *stats) received() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.PacketsReceived++
+}
+
+func (s *stats) delivered(latency time.Duration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.DeliveryLatency.observe(latency)
+}
+
+func (s *stats) acknowledged(latency time.Duration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.RoundTripLatency.observe(latency)
+}
+
+func (s *stats) snapshot() Stats {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	snapshot := s.Stats
+	snapshot.DeliveryLatency = s.DeliveryLatency.clone()
+	snapshot.RoundTripLatency = s.RoundTripLatency.clone()
+	return snapshot
+}
+
+// Stats returns a snapshot of counters, latency histograms
+// and storage state
+func (gopack *GoPack2) Stats() Stats {
+	snapshot := gopack.stats.snapshot()
+	stores := []OutboundStore{gopack.storage()}
+	if old := gopack.draining(); old != nil {
+		stores = append(stores, old)
+	}
+	for _, store := range stores {
+		count, size := pending(store)
+		snapshot.Pending += count
+		snapshot.PendingBytes += size
+		var oldest time.Duration
+		if ss, ok := store.(StorageStats); ok {
+			oldest = ss.OldestPending()
+		} else {
+			oldest = oldestPending(queued(store))
+		}
+		if oldest > snapshot.OldestPending {
+			snapshot.OldestPending = oldest
+		}
+	}
+	inbound := gopack.inboundStore()
+	if ss, ok := inbound.(StorageStats); ok {
+		snapshot.ReceiveBuffered = ss.ReceiveBuffered()
+	} else {
+		snapshot.ReceiveBuffered = len(inbound.Unreleased())
+	}
+	return snapshot
+}
+
+// oldestPending returns the age of the oldest message in packets
+func oldestPending(packets []*Packet) time.Duration {
+	var oldest int64
+	for _, packet := range packets {
+		if packet.MsgType == MsgTypeSend && !packet.Confirm &&
+			(oldest == 0 || packet.CreatedAt < oldest) {
+			oldest = packet.CreatedAt
+		}
+	}
+	if oldest == 0 {
+		return 0
+	}
+	return time.Duration(time.Now().UnixNano() - oldest)
+}
@@ -0,0 +1,138 @@
+package gopack
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	cases := []struct {
+		name      string
+		latencies []time.Duration
+		quantile  float64
+		want      time.Duration
+	}{
+		{"empty", nil, 0.5, 0},
+		{"single", []time.Duration{3 * time.Millisecond}, 0.5, 5 * time.Millisecond},
+		{"on bound", []time.Duration{time.Millisecond}, 0.99, time.Millisecond},
+		{"median", []time.Duration{time.Millisecond, 2 * time.Millisecond, 200 * time.Millisecond}, 0.5, 5 * time.Millisecond},
+		{"tail", []time.Duration{time.Millisecond, 2 * time.Millisecond, 200 * time.Millisecond}, 0.9, 500 * time.Millisecond},
+		{"beyond last bound", []time.Duration{time.Hour}, 0.5, time.Minute},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := newHistogram()
+			var sum time.Duration
+			for _, d := range c.latencies {
+				h.observe(d)
+				sum += d
+			}
+			if h.Count != int64(len(c.latencies)) || h.Sum != sum {
+				t.Fatalf("count %d sum %v", h.Count, h.Sum)
+			}
+			if got := h.Quantile(c.quantile); got != c.want {
+				t.Fatalf("quantile %v: got %v, want %v", c.quantile, got, c.want)
+			}
+		})
+	}
+}
+
+func TestSendTimestamp(t *testing.T) {
+	cases := []struct {
+		name      string
+		timestamp bool
+	}{
+		{"off", false},
+		{"on", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			before := time.Now()
+			client, _, server, scb := pair(t, &Options{Handshake: true, SendTimestamp: c.timestamp}, &Options{})
+			if _, err := client.Commit([]byte("x"), Qos1); err != nil {
+				t.Fatal(err)
+			}
+			msg := scb.next(t)
+			if msg.CommitTime.IsZero() == c.timestamp {
+				t.Fatalf("commit time %v", msg.CommitTime)
+			}
+			if c.timestamp && (msg.CommitTime.Before(before) || msg.CommitTime.After(time.Now())) {
+				t.Fatalf("commit time %v out of range", msg.CommitTime)
+			}
+			if n := server.Stats().DeliveryLatency.Count; (n == 1) != c.timestamp {
+				t.Fatalf("%d delivery latencies observed", n)
+			}
+		})
+	}
+}
+
+func TestStorageStats(t *testing.T) {
+	cases := []struct {
+		name     string
+		payloads []string
+		received int
+	}{
+		{"empty", nil, 0},
+		{"queued", []string{"a", "bc", "def"}, 0},
+		{"received", nil, 2},
+		{"both", []string{"abcd"}, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{})
+			size := 0
+			for _, payload := range c.payloads {
+				if _, err := gopack.Commit([]byte(payload), Qos1); err != nil {
+					t.Fatal(err)
+				}
+				size += len(payload)
+			}
+			for id := MsgID(1); id <= MsgID(c.received); id++ {
+				gopack.inboundStore().Receive(id, &Packet{MsgType: MsgTypeSend, Qos: Qos2, MsgID: id})
+			}
+			time.Sleep(10 * time.Millisecond)
+			stats := gopack.Stats()
+			if stats.Pending != len(c.payloads) || stats.PendingBytes != size {
+				t.Fatalf("%d pending of %d bytes, want %d of %d", stats.Pending, stats.PendingBytes, len(c.payloads), size)
+			}
+			if (stats.OldestPending >= 10*time.Millisecond) != (len(c.payloads) > 0) {
+				t.Fatalf("oldest pending %v", stats.OldestPending)
+			}
+			if fallback := oldestPending(queued(gopack.storage())); fallback < stats.OldestPending {
+				t.Fatalf("derived age %v below reported %v", fallback, stats.OldestPending)
+			}
+			if stats.ReceiveBuffered != c.received {
+				t.Fatalf("%d received buffered, want %d", stats.ReceiveBuffered, c.received)
+			}
+		})
+	}
+}
+
+func TestRetransmissions(t *testing.T) {
+	cases := []struct {
+		name    string
+		qos     byte
+		resends bool
+	}{
+		{"qos0", Qos0, false},
+		{"qos1 unanswered", Qos1, true},
+		{"qos2 unanswered", Qos2, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{RetryInterval: 100, Heartbeat: 60000})
+			silent(t, gopack)
+			if _, err := gopack.Commit([]byte("x"), c.qos); err != nil {
+				t.Fatal(err)
+			}
+			if c.resends {
+				eventually(t, func() bool { return gopack.Stats().Retransmissions > 0 })
+				return
+			}
+			eventually(t, func() bool { return gopack.remaining() == 0 })
+			if n := gopack.Stats().Retransmissions; n != 0 {
+				t.Fatalf("%d retransmissions", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package gopack
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	_ PurgeableStorage   = (*memoryStorage)(nil)
+	_ CancellableStorage = (*memoryStorage)(nil)
+	_ PendingStorage     = (*memoryStorage)(nil)
+	_ EvictableStorage   = (*memoryStorage)(nil)
+	_ ListableStorage    = (*memoryStorage)(nil)
+	_ SequencedStorage   = (*memoryStorage)(nil)
+)
+
+// coreStorage implements only the methods every OutboundStore needs
+type coreStorage struct {
+	id      MsgID
+	packets []*Packet
+	mux     sync.Mutex
+}
+
+func (cs *coreStorage) UniqueID() MsgID {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	cs.id++
+	return cs.id
+}
+
+func (cs *coreStorage) Save(packet *Packet) {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	cs.packets = append(cs.packets, packet)
+}
+
+func (cs *coreStorage) Unconfirmed() *Packet {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	now := time.Now().Unix()
+	for i, packet := range cs.packets {
+		if !packet.Confirm && packet.Timestamp <= now {
+			cs.packets = append(cs.packets[:i], cs.packets[i+1:]...)
+			return packet
+		}
+	}
+	return nil
+}
+
+func (cs *coreStorage) Confirm(id MsgID) *Packet {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	for i, packet := range cs.packets {
+		if packet.MsgID == id {
+			cs.packets = append(cs.packets[:i], cs.packets[i+1:]...)
+			return packet
+		}
+	}
+	return nil
+}
+
+func TestCoreStorage(t *testing.T) {
+	store := &coreStorage{}
+	client, _, _, scb := pair(t, &Options{Storage: store}, &Options{})
+	for _, qos := range []byte{Qos0, Qos1, Qos2} {
+		if _, err := client.Commit([]byte{qos}, qos); err != nil {
+			t.Fatal(err)
+		}
+		if msg := scb.next(t); msg.Qos != qos {
+			t.Fatalf("got qos %d, want %d", msg.Qos, qos)
+		}
+	}
+	eventually(t, func() bool {
+		store.mux.Lock()
+		defer store.mux.Unlock()
+		return len(store.packets) == 0
+	})
+}
+
+// TestCoreStorageOptional checks the fallbacks of the optional
+// storage interfaces
+func TestCoreStorageOptional(t *testing.T) {
+	gopack := offline(t, &Options{Storage: &coreStorage{}, MaxQueueLength: 1, EvictionPolicy: EvictOldestQos0})
+	id, err := gopack.Commit([]byte("x"), Qos0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"cancel", gopack.Cancel(id), false},
+		{"promote", gopack.Promote(id), false},
+		{"purge", gopack.Purge(), 0},
+		{"pending", gopack.Stats().Pending, 0},
+		{"pending packets", len(gopack.PendingPackets()), 0},
+	}
+	for _, c := range cases {
+		if c.got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, c.got, c.want)
+		}
+	}
+	if packet := gopack.storage().Unconfirmed(); packet == nil || packet.MsgID != id {
+		t.Fatalf("message %d lost", id)
+	}
+}
@@ -0,0 +1,528 @@
+package gopack
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// streamChunkSize default fragment payload size
+const streamChunkSize = 32 << 10
+
+// streamWindow fragments of a stream outstanding at a time
+const streamWindow = 4
+
+// streamReorder fragments past the next expected one an inbound
+// stream buffers, fragments further ahead fail the stream
+const streamReorder = 4 * streamWindow
+
+// ErrStreamTimeout an incomplete inbound stream was dropped because
+// its next fragment did not arrive within Options.StreamTimeout
+var ErrStreamTimeout = errors.New("stream timeout")
+
+// ErrStreamTooLarge an inbound stream was dropped because it
+// exceeds Options.MaxStreamSize
+var ErrStreamTooLarge = errors.New("stream too large")
+
+// ErrStreamWindow an inbound stream was dropped because a fragment
+// arrived too far ahead of the next expected one
+var ErrStreamWindow = errors.New("stream fragment out of window")
+
+// GoStreamCallback may be implemented by Options.CallbackObj to receive
+// fragmented payloads as they arrive instead of reassembled in memory,
+// msg carries the metadata of the first fragment and no payload,
+// r must be read to the end
+type GoStreamCallback interface {
+	InvokeStream(msg *Message, r io.Reader)
+}
+
+// CommitStream reads size bytes from r and commits them as a fragmented
+// message, at most a few fragments are held in memory at a time,
+// a negative size reads until io.EOF
+func (gopack *GoPack2) CommitStream(r io.Reader, size int64, qos byte) error {
+	if size >= 0 {
+		r = io.LimitReader(r, size)
+	}
+	return gopack.stream(r, qos, gopack.nextStreamID(), gopack.chunkSize(), 0, nil)
+}
+
+// CommitStreamResumable is CommitStream recording acknowledged fragments
+// in Options.Checkpoints under key, calling it again with the same key
+// after a failure or restart resumes after the last acknowledged fragment,
+// it returns once every fragment is acknowledged, or with an error once
+// one is dead-lettered, evicted or purged, if the receiver refused it with
+// NackStream because it no longer holds the stream the next call starts over
+func (gopack *GoPack2) CommitStreamResumable(key string, r io.ReadSeeker, size int64, qos byte) error {
+	cp := gopack.opts.Checkpoints.Load(key)
+	if cp == nil {
+		cp = &StreamCheckpoint{
+			StreamID:  gopack.nextStreamID(),
+			ChunkSize: gopack.chunkSize(),
+		}
+		if err := gopack.opts.Checkpoints.Store(key, cp); err != nil {
+			return err
+		}
+	}
+	offset := int64(cp.Next) * int64(cp.ChunkSize)
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	var src io.Reader = r
+	if size >= 0 {
+		src = io.LimitReader(r, size-offset)
+	}
+	err := gopack.stream(src, qos, cp.StreamID, cp.ChunkSize, cp.Next, func(index int) {
+		cp.Next = index + 1
+		gopack.opts.Checkpoints.Store(key, cp)
+	})
+	var dle *DeadLetterError
+	if errors.As(err, &dle) && dle.Reason == NackStream {
+		gopack.opts.Checkpoints.Delete(key)
+	}
+	if err != nil {
+		return err
+	}
+	return gopack.opts.Checkpoints.Delete(key)
+}
+
+// chunkSize returns the fragment payload size
+func (gopack *GoPack2) chunkSize() int {
+	if limit := gopack.sendLimit(); limit > 0 && limit-64 < streamChunkSize {
+		return limit - 64
+	}
+	return streamChunkSize
+}
+
+// stream commits fragments read from r starting at index first,
+// acked is called in order for every acknowledged fragment,
+// if acked is nil stream returns without waiting for the last ones,
+// a dropped fragment fails the stream and cancels the ones after it
+func (gopack *GoPack2) stream(r io.Reader, qos byte, streamID, chunkSize, first int, acked func(int)) (err error) {
+	type outstanding struct {
+		index int
+		msgID MsgID
+		ch    chan error
+	}
+	var window []outstanding
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, o := range window {
+			gopack.Cancel(o.msgID)
+			gopack.done(o.msgID, err)
+		}
+	}()
+	wait := func() error {
+		head := window[0]
+		window = window[1:]
+		if err := <-head.ch; err != nil {
+			return fmt.Errorf("stream %d fragment %d: %w", streamID, head.index, err)
+		}
+		if acked != nil {
+			acked(head.index)
+		}
+		return nil
+	}
+	chunk, err := readChunk(r, chunkSize)
+	if err == io.EOF {
+		if first > 0 {
+			// resumed after the last fragment
+			return nil
+		}
+		chunk, err = []byte{}, nil
+	}
+	for index := first; ; index++ {
+		if err != nil {
+			return err
+		}
+		next, nextErr := readChunk(r, chunkSize)
+		last := nextErr == io.EOF
+		if len(window) == streamWindow {
+			if err = wait(); err != nil {
+				return err
+			}
+		}
+		fragmentIndex := index
+		fragment := &Message{Qos: qos, Payload: chunk}
+		var ch chan error
+		msgID, commitErr := gopack.commit(fragment, func(packet *Packet) {
+			packet.StreamID = streamID
+			packet.FragmentIndex = fragmentIndex
+			packet.LastFragment = last
+			// before the fragment can be sent and acknowledged
+			ch = gopack.await(packet.MsgID)
+		})
+		if commitErr != nil {
+			if ch != nil {
+				gopack.done(fragment.MsgID, commitErr)
+			}
+			return commitErr
+		}
+		window = append(window, outstanding{index, msgID, ch})
+		if last {
+			for acked != nil && len(window) > 0 {
+				if err = wait(); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		chunk, err = next, nextErr
+	}
+}
+
+// readChunk reads up to size bytes, io.EOF only when nothing is left
+func readChunk(r io.Reader, size int) ([]byte, error) {
+	chunk := make([]byte, size)
+	n, err := io.ReadFull(r, chunk)
+	if err == io.ErrUnexpectedEOF || (err == nil && n == size) {
+		return chunk[:n], nil
+	}
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	return nil, err
+}
+
+// nextStreamID returns a stream id unlikely to repeat across restarts
+func (gopack *GoPack2) nextStreamID() int {
+	for {
+		id := int(atomic.AddUint32(&gopack.streamID, 1))
+		if id != 0 {
+			return id
+		}
+	}
+}
+
+func randomUint32() uint32 {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return binary.BigEndian.Uint32(b)
+}
+
+// await returns a channel receiving nil when msgID is acknowledged
+// or transmitted for QoS0, and an error if it is dropped
+func (gopack *GoPack2) await(msgID MsgID) chan error {
+	gopack.muxAwaits.Lock()
+	defer gopack.muxAwaits.Unlock()
+	ch, ok := gopack.awaits[msgID]
+	if !ok {
+		ch = make(chan error, 1)
+		gopack.awaits[msgID] = ch
+	}
+	return ch
+}
+
+// done releases waiters of msgID with err
+func (gopack *GoPack2) done(msgID MsgID, err error) {
+	gopack.muxAwaits.Lock()
+	defer gopack.muxAwaits.Unlock()
+	if ch, ok := gopack.awaits[msgID]; ok {
+		ch <- err
+		delete(gopack.awaits, msgID)
+	}
+}
+
+// assembly collects the fragments of one inbound stream
+type assembly struct {
+	msg       *Message
+	next      int
+	fragments map[int]*Packet
+	payload   []byte
+	pipe      *io.PipeWriter
+	size      int // bytes of the fragments in order so far
+	finished  bool
+	updated   int64 // unix nano time of the last fragment
+}
+
+func newAssembly() *assembly {
+	return &assembly{
+		fragments: make(map[int]*Packet),
+		updated:   time.Now().UnixNano(),
+	}
+}
+
+// finishedStreams completed or dropped stream ids remembered
+// to handle their late fragments
+const finishedStreams = 1024
+
+// streams reassembles inbound fragmented messages by stream id
+type streams struct {
+	assemblies map[int]*assembly
+	finished   map[int]error // nil once complete, why it was dropped otherwise
+	mux        sync.Mutex
+}
+
+func newStreams() *streams {
+	return &streams{
+		assemblies: make(map[int]*assembly),
+		finished:   make(map[int]error),
+	}
+}
+
+// streamable starts the assembly of an inbound stream at its first
+// fragment and refuses a QoS1/QoS2 fragment of a stream that was dropped
+// or whose start was never seen, with NackStream or acknowledged without
+// delivery if the peer does not understand NACK, so a sender resuming
+// after Options.StreamTimeout or a restart of the receiver fails instead
+// of having its fragments acknowledged and thrown away
+func (gopack *GoPack2) streamable(packet *Packet) bool {
+	if packet.MsgType != MsgTypeSend || packet.StreamID == 0 {
+		return true
+	}
+	s := gopack.streams
+	s.mux.Lock()
+	err, finished := s.finished[packet.StreamID]
+	_, known := s.assemblies[packet.StreamID]
+	if !finished && !known && packet.FragmentIndex == 0 {
+		// fragments of a QoS2 stream arrive before the first is released
+		s.assemblies[packet.StreamID] = newAssembly()
+		known = true
+	}
+	s.mux.Unlock()
+	if (finished && err == nil) || known || packet.Qos == Qos0 {
+		return true
+	}
+	if !gopack.nack(packet.MsgID, NackStream) {
+		gopack.swallow(packet)
+	}
+	return false
+}
+
+// feed adds fragment packet to its stream, msg is the fragment metadata,
+// delivers the stream through cb once complete or, when cb implements
+// GoStreamCallback, as fragments arrive in order
+func (gopack *GoPack2) feed(packet *Packet, msg *Message) {
+	s := gopack.streams
+	s.mux.Lock()
+	if _, finished := s.finished[packet.StreamID]; finished {
+		s.mux.Unlock()
+		return
+	}
+	a, ok := s.assemblies[packet.StreamID]
+	if !ok {
+		a = newAssembly()
+		s.assemblies[packet.StreamID] = a
+	}
+	if packet.FragmentIndex < a.next {
+		// duplicate
+		s.mux.Unlock()
+		return
+	}
+	if packet.FragmentIndex >= a.next+streamReorder {
+		s.finish(packet.StreamID, ErrStreamWindow)
+		s.mux.Unlock()
+		gopack.failStream(a, ErrStreamWindow)
+		return
+	}
+	a.fragments[packet.FragmentIndex] = packet
+	a.updated = time.Now().UnixNano()
+	if packet.FragmentIndex == 0 {
+		a.msg = msg
+		a.msg.Payload = nil
+		if cb, ok := gopack.opts.CallbackObj.(GoStreamCallback); ok {
+			r, w := io.Pipe()
+			a.pipe = w
+			go func(msg *Message) {
+				// fail further writes once the consumer is gone
+				defer r.Close()
+				gopack.protect(func() {
+					cb.InvokeStream(msg, r)
+				})
+			}(a.msg)
+		}
+	}
+	var chunks [][]byte
+	for {
+		fragment, ok := a.fragments[a.next]
+		if !ok {
+			break
+		}
+		delete(a.fragments, a.next)
+		a.next++
+		a.size += len(fragment.Payload)
+		chunks = append(chunks, fragment.Payload)
+		if fragment.LastFragment {
+			a.finished = true
+			s.finish(packet.StreamID, nil)
+			break
+		}
+	}
+	if limit := gopack.opts.MaxStreamSize; a.pipe == nil && limit > 0 && a.size > limit {
+		s.finish(packet.StreamID, ErrStreamTooLarge)
+		s.mux.Unlock()
+		gopack.failStream(a, ErrStreamTooLarge)
+		return
+	}
+	s.mux.Unlock()
+	if a.pipe != nil {
+		// blocks the read loop while the consumer lags behind
+		for _, chunk := range chunks {
+			a.pipe.Write(chunk)
+		}
+		if a.finished {
+			a.pipe.Close()
+		}
+		return
+	}
+	for _, chunk := range chunks {
+		a.payload = append(a.payload, chunk...)
+	}
+	if a.finished {
+		a.msg.Payload = a.payload
+		gopack.dispatch(a.msg, gopack.exitCh)
+	}
+}
+
+// finish forgets the assembly of stream id and drops its late fragments,
+// err is nil if it is complete, s.mux must be held
+func (s *streams) finish(id int, err error) {
+	delete(s.assemblies, id)
+	if len(s.finished) >= finishedStreams {
+		s.finished = make(map[int]error)
+	}
+	s.finished[id] = err
+}
+
+// expireStreams drops inbound streams whose next fragment did not
+// arrive within Options.StreamTimeout, a GoStreamCallback reading
+// one gets ErrStreamTimeout
+func (gopack *GoPack2) expireStreams() {
+	if gopack.opts.StreamTimeout < 0 {
+		return
+	}
+	before := time.Now().Add(
+		-time.Duration(gopack.opts.StreamTimeout) * time.Millisecond).UnixNano()
+	s := gopack.streams
+	var expired []*assembly
+	s.mux.Lock()
+	for id, a := range s.assemblies {
+		if a.updated < before {
+			s.finish(id, ErrStreamTimeout)
+			expired = append(expired, a)
+		}
+	}
+	s.mux.Unlock()
+	for _, a := range expired {
+		gopack.failStream(a, ErrStreamTimeout)
+	}
+}
+
+// failStream reports err to the GoStreamCallback reading a dropped
+// stream, or to the callback if it was reassembled in memory
+func (gopack *GoPack2) failStream(a *assembly, err error) {
+	if a.pipe != nil {
+		a.pipe.CloseWithError(err)
+	} else {
+		gopack.invoke(nil, err)
+	}
+}
+
+// StreamCheckpoint progress of a resumable stream
+type StreamCheckpoint struct {
+	StreamID  int
+	ChunkSize int
+	Next      int // first fragment not acknowledged
+}
+
+// CheckpointStore persists stream checkpoints by key
+type CheckpointStore interface {
+	Load(key string) *StreamCheckpoint
+	Store(key string, cp *StreamCheckpoint) error
+	Delete(key string) error
+}
+
+// memoryCheckpoints keeps checkpoints for the lifetime of the process
+type memoryCheckpoints struct {
+	checkpoints map[string]StreamCheckpoint
+	mux         sync.Mutex
+}
+
+func newMemoryCheckpoints() *memoryCheckpoints {
+	return &memoryCheckpoints{checkpoints: make(map[string]StreamCheckpoint)}
+}
+
+func (mc *memoryCheckpoints) Load(key string) *StreamCheckpoint {
+	mc.mux.Lock()
+	defer mc.mux.Unlock()
+	cp, ok := mc.checkpoints[key]
+	if !ok {
+		return nil
+	}
+	return &cp
+}
+
+func (mc *memoryCheckpoints) Store(key string, cp *StreamCheckpoint) error {
+	mc.mux.Lock()
+	defer mc.mux.Unlock()
+	mc.checkpoints[key] = *cp
+	return nil
+}
+
+func (mc *memoryCheckpoints) Delete(key string) error {
+	mc.mux.Lock()
+	defer mc.mux.Unlock()
+	delete(mc.checkpoints, key)
+	return nil
+}
+
+// FileCheckpoints keeps one small file per checkpoint in a directory
+type FileCheckpoints struct {
+	dir string
+}
+
+// NewFileCheckpoints creates a CheckpointStore in dir
+func NewFileCheckpoints(dir string) (*FileCheckpoints, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileCheckpoints{dir: dir}, nil
+}
+
+func (fc *FileCheckpoints) path(key string) string {
+	return filepath.Join(fc.dir, hex.EncodeToString([]byte(key)))
+}
+
+// Load returns the checkpoint stored under key, nil if there is none
+func (fc *FileCheckpoints) Load(key string) *StreamCheckpoint {
+	b, err := os.ReadFile(fc.path(key))
+	if err != nil || len(b) != 24 {
+		return nil
+	}
+	return &StreamCheckpoint{
+		StreamID:  int(binary.BigEndian.Uint64(b[0:])),
+		ChunkSize: int(binary.BigEndian.Uint64(b[8:])),
+		Next:      int(binary.BigEndian.Uint64(b[16:])),
+	}
+}
+
+// Store writes cp under key
+func (fc *FileCheckpoints) Store(key string, cp *StreamCheckpoint) error {
+	b := make([]byte, 24)
+	binary.BigEndian.PutUint64(b[0:], uint64(cp.StreamID))
+	binary.BigEndian.PutUint64(b[8:], uint64(cp.ChunkSize))
+	binary.BigEndian.PutUint64(b[16:], uint64(cp.Next))
+	tmp := fc.path(key) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fc.path(key))
+}
+
+// Delete removes the checkpoint stored under key
+func (fc *FileCheckpoints) Delete(key string) error {
+	err := os.Remove(fc.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,313 @@
+package gopack
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func streamData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestCommitStream(t *testing.T) {
+	cases := []struct {
+		name string
+		size int
+		qos  byte
+	}{
+		{"empty", 0, Qos1},
+		{"single fragment", 100, Qos1},
+		{"exact fragments", 2 * streamChunkSize, Qos1},
+		{"window", 5*streamChunkSize + 17, Qos1},
+		{"qos0", 3*streamChunkSize + 1, Qos0},
+		{"qos2", 2*streamChunkSize + 1, Qos2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, _, _, scb := pair(t, &Options{Handshake: true}, &Options{})
+			data := streamData(c.size)
+			if err := client.CommitStreamResumable(c.name, bytes.NewReader(data), int64(len(data)), c.qos); err != nil {
+				t.Fatal(err)
+			}
+			if msg := scb.next(t); !bytes.Equal(msg.Payload, data) {
+				t.Fatalf("got %d bytes, want %d", len(msg.Payload), len(data))
+			}
+			if cp := client.opts.Checkpoints.Load(c.name); cp != nil {
+				t.Fatalf("checkpoint %+v left behind", cp)
+			}
+		})
+	}
+}
+
+// TestStreamDropped drops fragments of a resumable stream after the
+// first one was acknowledged, the stream fails and resumes at the
+// dropped fragment
+func TestStreamDropped(t *testing.T) {
+	cases := []struct {
+		name string
+		drop func(gopack *GoPack2)
+		want func(error) bool
+	}{
+		{"purged", func(gopack *GoPack2) { gopack.Purge() }, func(err error) bool {
+			return errors.Is(err, ErrPurged)
+		}},
+		{"dead-lettered", func(gopack *GoPack2) {
+			for _, packet := range queued(gopack.storage()) {
+				if packet.FragmentIndex == 1 {
+					gopack.storage().Confirm(packet.MsgID)
+					gopack.deadLetter(packet, NackRejected)
+				}
+			}
+		}, func(err error) bool {
+			var dle *DeadLetterError
+			return errors.As(err, &dle) && dle.Reason == NackRejected
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{})
+			data := streamData(3 * streamChunkSize)
+			result := make(chan error)
+			go func() {
+				result <- gopack.CommitStreamResumable("k", bytes.NewReader(data), int64(len(data)), Qos1)
+			}()
+			eventually(t, func() bool { return len(queued(gopack.storage())) == 3 })
+			for _, packet := range queued(gopack.storage()) {
+				if packet.FragmentIndex == 0 {
+					gopack.storage().Confirm(packet.MsgID)
+					gopack.acked(packet.MsgID)
+				}
+			}
+			c.drop(gopack)
+			if err := <-result; !c.want(err) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if cp := gopack.opts.Checkpoints.Load("k"); cp == nil || cp.Next != 1 {
+				t.Fatalf("checkpoint %+v, want next fragment 1", cp)
+			}
+			if n := len(queued(gopack.storage())); n != 0 {
+				t.Fatalf("%d fragments still queued", n)
+			}
+		})
+	}
+}
+
+type testStreamCallback struct {
+	*testCallback
+	results chan error
+}
+
+func (cb *testStreamCallback) InvokeStream(msg *Message, r io.Reader) {
+	_, err := io.ReadAll(r)
+	cb.results <- err
+}
+
+// TestStreamTimeout loses the second fragment of a stream
+func TestStreamTimeout(t *testing.T) {
+	cases := []struct {
+		name string
+		pipe bool
+	}{
+		{"buffered", false},
+		{"pipe", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cb := newTestCallback()
+			var results chan error
+			opts := &Options{CallbackObj: cb, StreamTimeout: 1}
+			if c.pipe {
+				results = make(chan error, 1)
+				opts.CallbackObj = &testStreamCallback{cb, results}
+			}
+			gopack := offline(t, opts)
+			fragment := func(index int) {
+				packet := &Packet{MsgType: MsgTypeSend, Payload: []byte{byte(index)}, StreamID: 9, FragmentIndex: index, LastFragment: index == 2}
+				gopack.feed(packet, &Message{})
+			}
+			fragment(0)
+			time.Sleep(5 * time.Millisecond)
+			gopack.expireStreams()
+			if c.pipe {
+				if err := <-results; !errors.Is(err, ErrStreamTimeout) {
+					t.Fatalf("stream consumer read %v", err)
+				}
+			} else if err := <-cb.errs; !errors.Is(err, ErrStreamTimeout) {
+				t.Fatalf("got %v", err)
+			}
+			// late fragments of the dropped stream are ignored
+			fragment(1)
+			fragment(2)
+			if n := len(gopack.streams.assemblies); n != 0 {
+				t.Fatalf("%d assemblies left", n)
+			}
+			select {
+			case msg := <-cb.msgs:
+				t.Fatalf("dropped stream delivered %q", msg.Payload)
+			default:
+			}
+		})
+	}
+}
+
+// TestStreamLimits feeds streams past the reorder window and the
+// size limit, a failed stream ignores its late fragments
+func TestStreamLimits(t *testing.T) {
+	cases := []struct {
+		name    string
+		pipe    bool
+		maxSize int
+		indexes []int
+		err     error
+	}{
+		{"in order", false, 0, []int{0, 1, 2}, nil},
+		{"reordered in window", false, 0, []int{0, 2, 3, 1}, nil},
+		{"far ahead", false, 0, []int{0, streamReorder + 1, 1, 2}, ErrStreamWindow},
+		{"far ahead pipe", true, 0, []int{0, streamReorder + 1, 1, 2}, ErrStreamWindow},
+		{"too large", false, 5, []int{0, 1, 2}, ErrStreamTooLarge},
+		{"at size limit", false, 6, []int{0, 1, 2}, nil},
+		{"pipe not limited", true, 5, []int{0, 1, 2}, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cb := newTestCallback()
+			var results chan error
+			opts := &Options{CallbackObj: cb, MaxStreamSize: c.maxSize}
+			if c.pipe {
+				results = make(chan error, 1)
+				opts.CallbackObj = &testStreamCallback{cb, results}
+			}
+			gopack := offline(t, opts)
+			last := 0
+			for _, index := range c.indexes {
+				if index > last {
+					last = index
+				}
+			}
+			for _, index := range c.indexes {
+				packet := &Packet{MsgType: MsgTypeSend, Payload: []byte{byte(index), 0}, StreamID: 9, FragmentIndex: index, LastFragment: index == last}
+				gopack.feed(packet, &Message{})
+			}
+			var err error
+			if c.pipe {
+				err = <-results
+			} else if c.err != nil {
+				err = <-cb.errs
+			} else if msg := cb.next(t); len(msg.Payload) != 2*len(c.indexes) {
+				t.Fatalf("delivered %d bytes", len(msg.Payload))
+			}
+			if !errors.Is(err, c.err) {
+				t.Fatalf("stream failed with %v, want %v", err, c.err)
+			}
+			if n := len(gopack.streams.assemblies); n != 0 {
+				t.Fatalf("%d assemblies left", n)
+			}
+		})
+	}
+}
+
+var errBroken = errors.New("broken source")
+
+// brokenReader fails reads past limit, like a source that went away
+type brokenReader struct {
+	*bytes.Reader
+	limit int64
+}
+
+func (r *brokenReader) Read(p []byte) (int, error) {
+	pos := r.Size() - int64(r.Len())
+	if pos >= r.limit {
+		return 0, errBroken
+	}
+	if int64(len(p)) > r.limit-pos {
+		p = p[:r.limit-pos]
+	}
+	return r.Reader.Read(p)
+}
+
+// TestStreamResumeExpired resumes a stream the receiver dropped after
+// Options.StreamTimeout, the fragments are refused and the next call
+// starts over
+func TestStreamResumeExpired(t *testing.T) {
+	cases := []struct {
+		name string
+		qos  byte
+	}{
+		{"qos1", Qos1},
+		{"qos2", Qos2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, _, server, scb := pair(t, &Options{Handshake: true}, &Options{StreamTimeout: 200})
+			data := streamData(8 * streamChunkSize)
+			broken := &brokenReader{bytes.NewReader(data), 6 * streamChunkSize}
+			if err := client.CommitStreamResumable("k", broken, int64(len(data)), c.qos); !errors.Is(err, errBroken) {
+				t.Fatalf("interrupted with %v", err)
+			}
+			if cp := client.opts.Checkpoints.Load("k"); cp == nil || cp.Next == 0 {
+				t.Fatalf("checkpoint %+v, want fragments acknowledged", cp)
+			}
+			time.Sleep(300 * time.Millisecond)
+			server.expireStreams()
+			if err := <-scb.errs; !errors.Is(err, ErrStreamTimeout) {
+				t.Fatalf("got %v", err)
+			}
+			err := client.CommitStreamResumable("k", bytes.NewReader(data), int64(len(data)), c.qos)
+			var dle *DeadLetterError
+			if !errors.As(err, &dle) || dle.Reason != NackStream {
+				t.Fatalf("resumed with %v, want refused with NackStream", err)
+			}
+			if cp := client.opts.Checkpoints.Load("k"); cp != nil {
+				t.Fatalf("checkpoint %+v kept", cp)
+			}
+			if err := client.CommitStreamResumable("k", bytes.NewReader(data), int64(len(data)), c.qos); err != nil {
+				t.Fatal(err)
+			}
+			if msg := scb.next(t); !bytes.Equal(msg.Payload, data) {
+				t.Fatalf("got %d bytes, want %d", len(msg.Payload), len(data))
+			}
+		})
+	}
+}
+
+func TestStreamable(t *testing.T) {
+	cases := []struct {
+		name     string
+		finished map[int]error
+		index    int
+		qos      byte
+		accepted bool
+	}{
+		{"first fragment", nil, 0, Qos1, true},
+		{"unknown stream", nil, 2, Qos1, false},
+		{"unknown stream qos0", nil, 2, Qos0, true},
+		{"complete", map[int]error{9: nil}, 2, Qos1, true},
+		{"expired", map[int]error{9: ErrStreamTimeout}, 2, Qos2, false},
+		{"expired first fragment", map[int]error{9: ErrStreamTimeout}, 0, Qos1, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{})
+			gopack.setPeerCaps(CapNack)
+			for id, err := range c.finished {
+				gopack.streams.finished[id] = err
+			}
+			packet := &Packet{MsgType: MsgTypeSend, Qos: c.qos, MsgID: 5, StreamID: 9, FragmentIndex: c.index}
+			if accepted := gopack.streamable(packet); accepted != c.accepted {
+				t.Fatalf("accepted %v, want %v", accepted, c.accepted)
+			}
+			nack := gopack.storage().Unconfirmed()
+			if refused := nack != nil && nack.MsgType == MsgTypeNack; refused == c.accepted ||
+				(refused && nack.Payload[0] != NackStream) {
+				t.Fatalf("replied %+v", nack)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package gopack
+
+import (
+	"strings"
+	"sync"
+)
+
+// Subscription is a handler registered with Subscribe
+type Subscription struct {
+	filter  string
+	handler func(*Message)
+	subs    *subscriptions
+}
+
+// Filter returns the topic filter of the subscription
+func (s *Subscription) Filter() string {
+	return s.filter
+}
+
+// Unsubscribe stops delivery to the handler
+func (s *Subscription) Unsubscribe() {
+	s.subs.remove(s)
+}
+
+// subscriptions registered handlers in subscription order
+type subscriptions struct {
+	list []*Subscription
+	mux  sync.RWMutex
+}
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{}
+}
+
+func (subs *subscriptions) add(s *Subscription) {
+	subs.mux.Lock()
+	defer subs.mux.Unlock()
+	subs.list = append(subs.list, s)
+}
+
+func (subs *subscriptions) remove(s *Subscription) {
+	subs.mux.Lock()
+	defer subs.mux.Unlock()
+	for i, other := range subs.list {
+		if other == s {
+			subs.list = append(subs.list[:i:i], subs.list[i+1:]...)
+			return
+		}
+	}
+}
+
+// dispatch calls every handler whose filter matches msg.Topic
+// through call, reports whether there was one
+func (subs *subscriptions) dispatch(msg *Message, call func(func())) bool {
+	subs.mux.RLock()
+	var matched []*Subscription
+	for _, s := range subs.list {
+		if matchTopic(s.filter, msg.Topic) {
+			matched = append(matched, s)
+		}
+	}
+	subs.mux.RUnlock()
+	for _, s := range matched {
+		handler := s.handler
+		call(func() { handler(msg) })
+	}
+	return len(matched) > 0
+}
+
+// matchTopic reports whether topic matches filter, levels are
+// separated by '/', '+' matches a single level and a trailing '#'
+// any number of levels
+func matchTopic(filter, topic string) bool {
+	if filter == "#" {
+		return true
+	}
+	filters := strings.Split(filter, "/")
+	topics := strings.Split(topic, "/")
+	for i, f := range filters {
+		if f == "#" && i == len(filters)-1 {
+			return true
+		}
+		if i >= len(topics) || (f != "+" && f != topics[i]) {
+			return false
+		}
+	}
+	return len(filters) == len(topics)
+}
+
+// Subscribe calls handler for every received message whose topic
+// matches filter, a message matching no subscription goes to
+// Options.CallbackObj
+func (gopack *GoPack2) Subscribe(filter string, handler func(*Message)) *Subscription {
+	s := &Subscription{filter: filter, handler: handler, subs: gopack.subscriptions}
+	gopack.subscriptions.add(s)
+	return s
+}
@@ -0,0 +1,78 @@
+package gopack
+
+import (
+	"testing"
+)
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/b", "a/b/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"+/+/c", "a/b/c", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a", true},
+		{"a/#", "b/c", false},
+		{"#", "", true},
+		{"a/#/c", "a/b/c", false},
+		{"", "", true},
+		{"", "a", false},
+	}
+	for _, c := range cases {
+		t.Run(c.filter+" "+c.topic, func(t *testing.T) {
+			if match := matchTopic(c.filter, c.topic); match != c.match {
+				t.Fatalf("match %v, want %v", match, c.match)
+			}
+		})
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	client, _, server, scb := pair(t, &Options{Handshake: true}, &Options{})
+	got := make(chan string, 16)
+	sub := func(name string) func(*Message) {
+		return func(msg *Message) { got <- name + ":" + msg.Topic }
+	}
+	server.Subscribe("sensors/+", sub("one"))
+	second := server.Subscribe("sensors/#", sub("all"))
+	cases := []struct {
+		topic string
+		want  []string
+	}{
+		{"sensors/t1", []string{"one:sensors/t1", "all:sensors/t1"}},
+		{"sensors/t1/raw", []string{"all:sensors/t1/raw"}},
+		{"other", nil},
+	}
+	for _, c := range cases {
+		t.Run(c.topic, func(t *testing.T) {
+			if _, err := client.Publish(&Message{Qos: Qos1, Topic: c.topic, Payload: []byte("x")}); err != nil {
+				t.Fatal(err)
+			}
+			if c.want == nil {
+				// unmatched messages go to the callback
+				if msg := scb.next(t); msg.Topic != c.topic {
+					t.Fatalf("callback got topic %q", msg.Topic)
+				}
+				return
+			}
+			for _, want := range c.want {
+				if handled := <-got; handled != want {
+					t.Fatalf("got %s, want %s", handled, want)
+				}
+			}
+		})
+	}
+	second.Unsubscribe()
+	if _, err := client.Publish(&Message{Qos: Qos1, Topic: "sensors/t1/raw"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := scb.next(t); msg.Topic != "sensors/t1/raw" || len(got) != 0 {
+		t.Fatal("unsubscribed handler still called")
+	}
+}
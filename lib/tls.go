@@ -0,0 +1,127 @@
+package gopack
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader loads a certificate key pair from disk
+// and reloads it once either file changes
+type certReloader struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time
+	mux      sync.Mutex
+}
+
+func newCertReloader(certFile, keyFile string) *certReloader {
+	return &certReloader{certFile: certFile, keyFile: keyFile}
+}
+
+// modified returns the latest modification time of both files
+func (cr *certReloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// load returns the certificate, reading it again if the files changed,
+// a failed reload keeps the previous certificate
+func (cr *certReloader) load() (*tls.Certificate, error) {
+	cr.mux.Lock()
+	defer cr.mux.Unlock()
+	modTime, err := cr.modified()
+	if err == nil && (cr.cert == nil || !modTime.Equal(cr.modTime)) {
+		err = cr.read(modTime)
+	}
+	if cr.cert != nil {
+		return cr.cert, nil
+	}
+	return nil, err
+}
+
+// reload reads the certificate even if the files look unchanged,
+// on failure the previous certificate stays in use
+func (cr *certReloader) reload() error {
+	cr.mux.Lock()
+	defer cr.mux.Unlock()
+	modTime, err := cr.modified()
+	if err != nil {
+		return err
+	}
+	return cr.read(modTime)
+}
+
+// read loads the key pair and replaces the certificate on success,
+// cr.mux must be held
+func (cr *certReloader) read(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.cert, cr.modTime = &cert, modTime
+	return nil
+}
+
+// clientCertificate implements tls.Config.GetClientCertificate
+func (cr *certReloader) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return cr.load()
+}
+
+// tlsConfig returns the config used for new connections, nil without TLS,
+// the client certificate is read from disk on every handshake it changed
+func (gopack *GoPack2) tlsConfig() *tls.Config {
+	if gopack.opts.TLSConfig == nil && gopack.certs == nil {
+		return nil
+	}
+	config := &tls.Config{}
+	if gopack.opts.TLSConfig != nil {
+		config = gopack.opts.TLSConfig.Clone()
+	}
+	if gopack.certs != nil {
+		config.GetClientCertificate = gopack.certs.clientCertificate
+	}
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(gopack.opts.Address); err == nil {
+			config.ServerName = host
+		}
+	}
+	return config
+}
+
+// secure wraps conn in a TLS client connection and completes the
+// handshake, conn is returned unchanged without TLS
+func (gopack *GoPack2) secure(conn net.Conn) (net.Conn, error) {
+	config := gopack.tlsConfig()
+	if config == nil {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(2 * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		return tlsConn, err
+	}
+	return tlsConn, tlsConn.SetDeadline(time.Time{})
+}
+
+// ReloadCertificate reads Options.CertFile and Options.KeyFile again,
+// established connections keep their certificate, new ones use it,
+// if reading fails the previous certificate stays in use
+func (gopack *GoPack2) ReloadCertificate() error {
+	if gopack.certs == nil {
+		return nil
+	}
+	return gopack.certs.reload()
+}
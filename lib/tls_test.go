@@ -0,0 +1,143 @@
+package gopack
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed key pair for 127.0.0.1 named cn
+func writeCert(t *testing.T, certFile, keyFile, cn string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func commonName(t *testing.T, cert *tls.Certificate) string {
+	t.Helper()
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestReloadCertificate(t *testing.T) {
+	cases := []struct {
+		name   string
+		change func(t *testing.T, certFile, keyFile string)
+		fails  bool
+		want   string
+	}{
+		{"renewed", func(t *testing.T, certFile, keyFile string) {
+			writeCert(t, certFile, keyFile, "two")
+		}, false, "two"},
+		{"half-written key", func(t *testing.T, certFile, keyFile string) {
+			writeCert(t, certFile, keyFile, "two")
+			key, _ := os.ReadFile(keyFile)
+			os.WriteFile(keyFile, key[:len(key)/2], 0600)
+		}, true, "one"},
+		{"removed", func(t *testing.T, certFile, keyFile string) {
+			os.Remove(certFile)
+		}, true, "one"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+			writeCert(t, certFile, keyFile, "one")
+			gopack := offline(t, &Options{CertFile: certFile, KeyFile: keyFile})
+			c.change(t, certFile, keyFile)
+			if err := gopack.ReloadCertificate(); (err != nil) != c.fails {
+				t.Fatalf("reload error %v, want failure %v", err, c.fails)
+			}
+			cert, err := gopack.certs.load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cn := commonName(t, cert); cn != c.want {
+				t.Fatalf("certificate %q in use, want %q", cn, c.want)
+			}
+		})
+	}
+}
+
+// TestClientCertificate presents the client certificate to a TLS peer
+func TestClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, "client")
+	serverCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	peer := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		server := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientAuth: tls.RequireAnyClientCert})
+		if server.Handshake() == nil {
+			peer <- server.ConnectionState().PeerCertificates[0].Subject.CommonName
+		}
+		close(peer)
+	}()
+	gopack := offline(t, &Options{
+		Address:   ln.Addr().String(),
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		CertFile:  certFile,
+		KeyFile:   keyFile,
+	})
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err = gopack.secure(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if cn := <-peer; cn != "client" {
+		t.Fatalf("peer saw certificate %q", cn)
+	}
+}
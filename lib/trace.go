@@ -0,0 +1,72 @@
+package gopack
+
+import (
+	"context"
+	"encoding/hex"
+	"strings"
+)
+
+// traceParentKey context key of a W3C traceparent value
+type traceParentKey struct{}
+
+// ContextWithTraceParent returns a copy of ctx carrying the W3C
+// traceparent value tp, see Options.TraceParent
+func ContextWithTraceParent(ctx context.Context, tp string) context.Context {
+	return context.WithValue(ctx, traceParentKey{}, tp)
+}
+
+// TraceParentFromContext returns the W3C traceparent value
+// carried by ctx, empty if none
+func TraceParentFromContext(ctx context.Context) string {
+	tp, _ := ctx.Value(traceParentKey{}).(string)
+	return tp
+}
+
+// Context returns a copy of parent carrying the traceparent of
+// a received message, tracers start the span of its handling from it
+func (msg *Message) Context(parent context.Context) context.Context {
+	if msg.TraceParent == "" {
+		return parent
+	}
+	return ContextWithTraceParent(parent, msg.TraceParent)
+}
+
+// traceParent returns the traceparent of ctx for an outbound message,
+// empty unless it is well formed
+func (gopack *GoPack2) traceParent(ctx context.Context) string {
+	var tp string
+	if gopack.opts.TraceParent != nil {
+		gopack.protect(func() {
+			tp = gopack.opts.TraceParent(ctx)
+		})
+	} else {
+		tp = TraceParentFromContext(ctx)
+	}
+	if !validTraceParent(tp) {
+		return ""
+	}
+	return tp
+}
+
+// validTraceParent reports whether tp is a W3C traceparent,
+// version, trace id, parent id and flags in lower case hex,
+// neither id all zeros
+func validTraceParent(tp string) bool {
+	parts := strings.Split(tp, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return false
+	}
+	for _, part := range parts[:4] {
+		if strings.ToLower(part) != part {
+			return false
+		}
+		if _, err := hex.DecodeString(part); err != nil {
+			return false
+		}
+	}
+	return strings.Trim(parts[1], "0") != "" && strings.Trim(parts[2], "0") != ""
+}
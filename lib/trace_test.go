@@ -0,0 +1,64 @@
+package gopack
+
+import (
+	"context"
+	"testing"
+)
+
+const testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestValidTraceParent(t *testing.T) {
+	cases := []struct {
+		name string
+		tp   string
+		want bool
+	}{
+		{"valid", testTraceParent, true},
+		{"empty", "", false},
+		{"upper case", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"zero parent id", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"invalid version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"short trace id", "00-4bf92f3577b34da6-00f067aa0ba902b7-01", false},
+		{"not hex", "00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01", false},
+		{"version 00 extra field", testTraceParent + "-00", false},
+		{"future version extra field", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-ab", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := validTraceParent(c.tp); got != c.want {
+				t.Fatalf("valid %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestTraceParent(t *testing.T) {
+	cases := []struct {
+		name string
+		ctx  context.Context
+		hook func(ctx context.Context) string
+		want string
+	}{
+		{"from context", ContextWithTraceParent(context.Background(), testTraceParent), nil, testTraceParent},
+		{"none", context.Background(), nil, ""},
+		{"malformed", ContextWithTraceParent(context.Background(), "not-a-trace"), nil, ""},
+		{"hook", context.Background(), func(context.Context) string { return testTraceParent }, testTraceParent},
+		{"hook panics", context.Background(), func(context.Context) string { panic("tracer") }, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, _, _, scb := pair(t, &Options{Handshake: true, TraceParent: c.hook}, &Options{})
+			if _, err := client.PublishContext(c.ctx, &Message{Qos: Qos1, Payload: []byte("x")}); err != nil {
+				t.Fatal(err)
+			}
+			msg := scb.next(t)
+			if msg.TraceParent != c.want {
+				t.Fatalf("trace parent %q, want %q", msg.TraceParent, c.want)
+			}
+			if got := TraceParentFromContext(msg.Context(context.Background())); got != c.want {
+				t.Fatalf("context carries %q, want %q", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package gopack
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrValidatorPanic refuses a message whose validation panicked
+var ErrValidatorPanic = errors.New("validator panic")
+
+// ValidationError reports a received message refused by Options.Validator
+type ValidationError struct {
+	MsgID MsgID
+	Err   error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("message %d invalid: %v", e.MsgID, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// valid runs Options.Validator on a received message before it is
+// acknowledged, an invalid QoS1/QoS2 message is refused with
+// NackRejected so the sender dead-letters it, or acknowledged
+// without delivery if the peer does not understand NACK
+func (gopack *GoPack2) valid(packet *Packet) bool {
+	if gopack.opts.Validator == nil ||
+		packet.MsgType != MsgTypeSend || packet.StreamID != 0 {
+		return true
+	}
+	var err error
+	gopack.protect(func() {
+		// kept if the validator panics
+		err = ErrValidatorPanic
+		err = gopack.opts.Validator(gopack.message(packet))
+	})
+	if err == nil {
+		return true
+	}
+	if packet.Qos != Qos0 && !gopack.nack(packet.MsgID, NackRejected) {
+		gopack.swallow(packet)
+	}
+	gopack.invoke(packet.Payload, &ValidationError{MsgID: packet.MsgID, Err: err})
+	return false
+}
+
+// swallow acknowledges a refused QoS1/QoS2 message without keeping it,
+// so a peer that cannot be refused stops retransmitting it
+func (gopack *GoPack2) swallow(packet *Packet) {
+	if packet.Qos == Qos1 {
+		gopack.ack(packet.MsgID)
+		return
+	}
+	// the release that follows finds nothing to deliver
+	gopack.storage().Save(Encode(MsgTypeReceived, Qos0, 0, packet.MsgID, nil))
+}
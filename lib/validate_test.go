@@ -0,0 +1,72 @@
+package gopack
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var errBad = errors.New("bad payload")
+
+func TestValidator(t *testing.T) {
+	reject := func(msg *Message) error {
+		if string(msg.Payload) == "bad" {
+			return errBad
+		}
+		return nil
+	}
+	cases := []struct {
+		name      string
+		qos       byte
+		handshake bool
+		validator func(*Message) error
+		err       error
+		dead      bool
+	}{
+		{"qos0 dropped", Qos0, true, reject, errBad, false},
+		{"qos1 rejected", Qos1, true, reject, errBad, true},
+		{"qos2 rejected", Qos2, true, reject, errBad, true},
+		{"qos1 legacy peer", Qos1, false, reject, errBad, false},
+		{"qos2 legacy peer", Qos2, false, reject, errBad, false},
+		{"panic", Qos1, true, func(msg *Message) error {
+			if string(msg.Payload) == "bad" {
+				panic("validator")
+			}
+			return nil
+		}, ErrValidatorPanic, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, ccb, _, scb := pair(t, &Options{Handshake: c.handshake}, &Options{Validator: c.validator})
+			for _, payload := range []string{"bad", "ok"} {
+				if _, err := client.Publish(&Message{Qos: c.qos, Payload: []byte(payload)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if msg := scb.next(t); string(msg.Payload) != "ok" {
+				t.Fatalf("delivered %q", msg.Payload)
+			}
+			var verr *ValidationError
+			for err := range scb.errs {
+				if errors.As(err, &verr) {
+					break
+				}
+			}
+			if !errors.Is(verr, c.err) {
+				t.Fatalf("reported %v, want %v", verr, c.err)
+			}
+			eventually(t, func() bool { return client.remaining() == 0 })
+			var dead *DeadLetterError
+			select {
+			case err := <-ccb.errs:
+				if !errors.As(err, &dead) || dead.Reason != NackRejected {
+					t.Fatalf("sender got %v", err)
+				}
+			case <-time.After(50 * time.Millisecond):
+			}
+			if (dead != nil) != c.dead {
+				t.Fatalf("dead-lettered %v, want %v", dead != nil, c.dead)
+			}
+		})
+	}
+}
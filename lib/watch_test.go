@@ -0,0 +1,83 @@
+package gopack
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// silent serves gopack over a pipe whose peer reads everything and
+// never answers, the result of serve is sent on the returned channel
+func silent(t *testing.T, gopack *GoPack2) chan error {
+	t.Helper()
+	conn, peer := net.Pipe()
+	go io.Copy(io.Discard, peer)
+	served := make(chan error, 1)
+	go func() { served <- gopack.serve(conn) }()
+	t.Cleanup(func() {
+		gopack.Close()
+		peer.Close()
+		<-served
+	})
+	return served
+}
+
+func TestIdleTimeout(t *testing.T) {
+	cases := []struct {
+		name    string
+		timeout int
+		err     error
+	}{
+		{"disabled", 0, nil},
+		{"silent", 100, ErrIdleTimeout},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{IdleTimeout: c.timeout})
+			served := silent(t, gopack)
+			select {
+			case err := <-served:
+				served <- err
+				if err != c.err {
+					t.Fatalf("served until %v, want %v", err, c.err)
+				}
+			case <-time.After(time.Second):
+				if c.err != nil {
+					t.Fatalf("idle connection kept past %dms", c.timeout)
+				}
+			}
+		})
+	}
+}
+
+func TestAckTimeout(t *testing.T) {
+	cases := []struct {
+		name string
+		qos  byte
+		err  error
+	}{
+		{"unacknowledged", Qos1, ErrAckTimeout},
+		{"nothing to acknowledge", Qos0, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gopack := offline(t, &Options{AckTimeout: 100, RetryInterval: 10000})
+			if _, err := gopack.Commit([]byte("x"), c.qos); err != nil {
+				t.Fatal(err)
+			}
+			served := silent(t, gopack)
+			select {
+			case err := <-served:
+				served <- err
+				if err != c.err {
+					t.Fatalf("served until %v, want %v", err, c.err)
+				}
+			case <-time.After(time.Second):
+				if c.err != nil {
+					t.Fatal("silent acknowledgments not detected")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+// Package mobile wraps GoPack2 in types gomobile bind can export,
+// strings, byte slices, ints, bools and simple interfaces
+package mobile
+
+import (
+	gopack "github.com/codemeow5/GoPack/lib"
+)
+
+// Callback receives messages and errors
+type Callback interface {
+	OnMessage(topic string, payload []byte)
+	OnError(message string)
+}
+
+// Config client options
+type Config struct {
+	Address   string
+	Heartbeat int    // milliseconds
+	SpoolPath string // file holding messages committed while offline
+	Handshake bool
+}
+
+// NewConfig returns a config for address
+func NewConfig(address string) *Config {
+	return &Config{Address: address}
+}
+
+// Client is a GoPack2 client
+type Client struct {
+	gopk *gopack.GoPack2
+}
+
+// callback adapts Callback to gopack.GoCallback
+type callback struct {
+	cb Callback
+}
+
+func (c *callback) Invoke(payload []byte, err error) {
+	if err != nil {
+		c.cb.OnError(err.Error())
+		return
+	}
+	c.cb.OnMessage("", payload)
+}
+
+func (c *callback) InvokeMessage(msg *gopack.Message) {
+	c.cb.OnMessage(msg.Topic, msg.Payload)
+}
+
+// NewClient creates a client, call Start to connect
+func NewClient(config *Config, cb Callback) (*Client, error) {
+	gopk, err := gopack.NewGoPack(&gopack.Options{
+		Address:     config.Address,
+		CallbackObj: &callback{cb},
+		Heartbeat:   config.Heartbeat,
+		SpoolPath:   config.SpoolPath,
+		Handshake:   config.Handshake,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Client{gopk}, nil
+}
+
+// Start connects in the background and reconnects when the connection drops
+func (c *Client) Start() {
+	c.gopk.Start()
+}
+
+// Close stops the client
+func (c *Client) Close() {
+	c.gopk.Close()
+}
+
+// Commit queues payload with qos 0, 1 or 2, returns the message id
+func (c *Client) Commit(payload []byte, qos int) (int, error) {
+	return c.Publish("", payload, qos)
+}
+
+// Publish queues payload on topic with qos 0, 1 or 2, returns the message id
+func (c *Client) Publish(topic string, payload []byte, qos int) (int, error) {
+	id, err := c.gopk.Publish(&gopack.Message{
+		Qos:     byte(qos),
+		Topic:   topic,
+		Payload: payload,
+	})
+	return int(id), err
+}
+
+// Cancel drops a queued message, reports false if it is not queued
+func (c *Client) Cancel(id int) bool {
+	return c.gopk.Cancel(gopack.MsgID(id))
+}
+
+// Pending returns the number of unconfirmed messages
+func (c *Client) Pending() int {
+	return c.gopk.Stats().Pending
+}
+
+// Connected reports whether the connection is established
+func (c *Client) Connected() bool {
+	return c.gopk.ConnState().Connected
+}
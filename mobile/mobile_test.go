@@ -0,0 +1,50 @@
+package mobile
+
+import "testing"
+
+// discard ignores messages and errors
+type discard struct{}
+
+func (discard) OnMessage(topic string, payload []byte) {}
+
+func (discard) OnError(message string) {}
+
+func TestClient(t *testing.T) {
+	cases := []struct {
+		name    string
+		topic   string
+		qos     int
+		err     bool
+		pending int
+	}{
+		{"qos0", "", 0, false, 1},
+		{"qos1 on topic", "a/b", 1, false, 1},
+		{"qos2", "", 2, false, 1},
+		{"invalid qos", "", 3, true, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, err := NewClient(NewConfig("127.0.0.1:1"), discard{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			id, err := client.Publish(c.topic, []byte("x"), c.qos)
+			if (err != nil) != c.err {
+				t.Fatalf("err %v", err)
+			}
+			if client.Connected() {
+				t.Fatal("connected without Start")
+			}
+			if got := client.Pending(); got != c.pending {
+				t.Fatalf("pending %d, want %d", got, c.pending)
+			}
+			if c.err {
+				return
+			}
+			if !client.Cancel(id) || client.Pending() != 0 {
+				t.Fatal("message not canceled")
+			}
+		})
+	}
+}
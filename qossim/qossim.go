@@ -0,0 +1,435 @@
+// Package qossim checks the QoS guarantees of GoPack2 against a scripted
+// peer over a loopback connection that loses, duplicates and cuts frames
+// on a seeded random schedule
+package qossim
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	gopack "github.com/codemeow5/GoPack/lib"
+)
+
+// ErrTimeout means that messages were still outstanding at Config.Timeout
+var ErrTimeout = errors.New("simulation timed out")
+
+// ErrViolation means that a QoS invariant was broken, see Result.Violations
+var ErrViolation = errors.New("qos invariant violated")
+
+// Config of a simulation run
+type Config struct {
+	Seed           int64
+	Messages       int           // messages committed in each direction
+	DropRate       float64       // probability that a frame is lost
+	DupRate        float64       // probability that a frame arrives twice
+	DisconnectRate float64       // probability that the connection is cut after a frame
+	MaxDisconnects int           // cuts per run, each costs a redial delay
+	Timeout        time.Duration // for all messages to settle
+}
+
+// DefaultConfig returns a config with moderate faults for seed
+func DefaultConfig(seed int64) Config {
+	return Config{
+		Seed:           seed,
+		Messages:       200,
+		DropRate:       0.1,
+		DupRate:        0.1,
+		DisconnectRate: 0.005,
+		MaxDisconnects: 2,
+		Timeout:        time.Minute,
+	}
+}
+
+// Result of a simulation run
+type Result struct {
+	Frames      int // frames exchanged, including lost and duplicated ones
+	Dropped     int
+	Duplicated  int
+	Disconnects int
+	Deliveries  int
+	Violations  []string
+}
+
+// Run commits cfg.Messages messages of random QoS from a GoPack2 to the
+// peer and as many from the peer to the GoPack2, waits until every QoS1
+// and QoS2 message is delivered, then checks that QoS1 messages arrived
+// at least once, QoS2 messages exactly once and nothing else arrived
+func Run(cfg Config) (*Result, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+	sim := newSim(cfg)
+	client, err := gopack.NewGoPack(&gopack.Options{
+		Address:       ln.Addr().String(),
+		CallbackObj:   sim.client,
+		Heartbeat:     200,
+		RetryInterval: 100,
+	})
+	if err != nil {
+		return nil, err
+	}
+	go sim.accept(ln)
+	go sim.resend()
+	client.Start()
+	defer sim.close()
+	defer client.Close()
+
+	for i := 0; i < cfg.Messages; i++ {
+		qos := byte(sim.intn(3))
+		payload := []byte(fmt.Sprintf("client-%d", i))
+		sim.peer.expect(string(payload), qos)
+		if _, err := client.Commit(payload, qos); err != nil {
+			return nil, err
+		}
+		sim.commit(fmt.Sprintf("peer-%d", i), byte(sim.intn(3)))
+	}
+
+	deadline := time.After(cfg.Timeout)
+	for !sim.settled() {
+		select {
+		case <-deadline:
+			return sim.result(), ErrTimeout
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	// late duplicates would show up within a few retry rounds
+	time.Sleep(time.Second)
+	result := sim.result()
+	if len(result.Violations) > 0 {
+		return result, ErrViolation
+	}
+	return result, nil
+}
+
+// receiver counts the deliveries of one side
+type receiver struct {
+	name      string
+	qos       map[string]byte
+	delivered map[string]int
+	ghosts    []string
+	mux       sync.Mutex
+}
+
+func newReceiver(name string) *receiver {
+	return &receiver{
+		name:      name,
+		qos:       make(map[string]byte),
+		delivered: make(map[string]int),
+	}
+}
+
+// expect registers a payload sent to the receiver
+func (r *receiver) expect(payload string, qos byte) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.qos[payload] = qos
+}
+
+func (r *receiver) deliver(payload string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if _, ok := r.qos[payload]; !ok {
+		r.ghosts = append(r.ghosts, payload)
+		return
+	}
+	r.delivered[payload]++
+}
+
+// Invoke receives the messages of the GoPack2 under test
+func (r *receiver) Invoke(payload []byte, err error) {
+	if err == nil {
+		r.deliver(string(payload))
+	}
+}
+
+// settled reports whether every QoS1 and QoS2 message was delivered
+func (r *receiver) settled() bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for payload, qos := range r.qos {
+		if qos > gopack.Qos0 && r.delivered[payload] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// violations returns the broken invariants
+func (r *receiver) violations() (v []string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for payload, qos := range r.qos {
+		n := r.delivered[payload]
+		switch {
+		case qos == gopack.Qos1 && n == 0:
+			v = append(v, fmt.Sprintf("%s: QoS1 %q never delivered", r.name, payload))
+		case qos == gopack.Qos2 && n != 1:
+			v = append(v, fmt.Sprintf("%s: QoS2 %q delivered %d times", r.name, payload, n))
+		}
+	}
+	for _, payload := range r.ghosts {
+		v = append(v, fmt.Sprintf("%s: ghost delivery %q", r.name, payload))
+	}
+	return v
+}
+
+// outbound a message sent by the peer
+type outbound struct {
+	packet   *gopack.Packet
+	released bool // QoS2 message received, RELEASE is sent
+}
+
+// sim is the scripted peer, it answers the GoPack2 under test
+// like a GoPack2 would and injects faults into both directions
+type sim struct {
+	cfg    Config
+	client *receiver // deliveries of the GoPack2
+	peer   *receiver // deliveries of the peer
+
+	conn     net.Conn
+	inbound  map[gopack.MsgID][]byte // received QoS2 payloads awaiting RELEASE
+	outbound map[gopack.MsgID]*outbound
+	nextID   gopack.MsgID
+	rnd      *rand.Rand
+	res      Result
+	closed   bool
+	mux      sync.Mutex
+}
+
+func newSim(cfg Config) *sim {
+	return &sim{
+		cfg:      cfg,
+		client:   newReceiver("client"),
+		peer:     newReceiver("peer"),
+		inbound:  make(map[gopack.MsgID][]byte),
+		outbound: make(map[gopack.MsgID]*outbound),
+		rnd:      rand.New(rand.NewSource(cfg.Seed)),
+	}
+}
+
+func (s *sim) intn(n int) int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.rnd.Intn(n)
+}
+
+func (s *sim) close() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.closed = true
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+func (s *sim) settled() bool {
+	if !s.client.settled() || !s.peer.settled() {
+		return false
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.outbound) == 0
+}
+
+func (s *sim) result() *Result {
+	s.mux.Lock()
+	result := s.res
+	s.mux.Unlock()
+	result.Violations = append(s.client.violations(), s.peer.violations()...)
+	for _, r := range []*receiver{s.client, s.peer} {
+		r.mux.Lock()
+		for _, n := range r.delivered {
+			result.Deliveries += n
+		}
+		r.mux.Unlock()
+	}
+	return &result
+}
+
+// commit queues a message from the peer to the GoPack2
+func (s *sim) commit(payload string, qos byte) {
+	s.client.expect(payload, qos)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.nextID++
+	packet := gopack.Encode(gopack.MsgTypeSend, qos, 0, s.nextID, []byte(payload))
+	s.transmit(packet.Buffer)
+	if qos > gopack.Qos0 {
+		s.outbound[s.nextID] = &outbound{packet: packet}
+	}
+}
+
+// accept serves every connection of the GoPack2 in turn
+func (s *sim) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mux.Lock()
+		if s.closed {
+			s.mux.Unlock()
+			conn.Close()
+			return
+		}
+		s.conn = conn
+		// resume the session
+		for _, out := range s.outbound {
+			s.retransmit(out)
+		}
+		s.mux.Unlock()
+		s.read(conn)
+	}
+}
+
+// resend retransmits unconfirmed peer messages until close
+func (s *sim) resend() {
+	for {
+		time.Sleep(200 * time.Millisecond)
+		s.mux.Lock()
+		if s.closed {
+			s.mux.Unlock()
+			return
+		}
+		for _, out := range s.outbound {
+			s.retransmit(out)
+		}
+		s.mux.Unlock()
+	}
+}
+
+// retransmit sends the next step of out again, s.mux is held
+func (s *sim) retransmit(out *outbound) {
+	if out.released {
+		s.transmit(gopack.Encode(gopack.MsgTypeRelease, gopack.Qos0, 0, out.packet.MsgID, nil).Buffer)
+		return
+	}
+	dup := *out.packet
+	dup.Dup = true
+	dup.Pack()
+	s.transmit(dup.Buffer)
+}
+
+// transmit writes frame to the GoPack2 subject to faults, s.mux is held
+func (s *sim) transmit(frame []byte) {
+	if s.conn == nil {
+		return
+	}
+	s.res.Frames++
+	if s.rnd.Float64() < s.cfg.DropRate {
+		s.res.Dropped++
+		return
+	}
+	copies := 1
+	if s.rnd.Float64() < s.cfg.DupRate {
+		s.res.Duplicated++
+		copies = 2
+	}
+	for i := 0; i < copies; i++ {
+		if _, err := s.conn.Write(frame); err != nil {
+			return
+		}
+	}
+	s.cut()
+}
+
+// cut closes the connection per Config.DisconnectRate, s.mux is held
+func (s *sim) cut() {
+	if s.res.Disconnects >= s.cfg.MaxDisconnects || s.rnd.Float64() >= s.cfg.DisconnectRate {
+		return
+	}
+	s.res.Disconnects++
+	s.conn.Close()
+	s.conn = nil
+}
+
+// read handles the frames of conn until it is closed
+func (s *sim) read(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	header := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return
+		}
+		frame := make([]byte, 5+int(binary.BigEndian.Uint16(header[3:])))
+		copy(frame, header)
+		if _, err := io.ReadFull(reader, frame[5:]); err != nil {
+			return
+		}
+		packet, err := gopack.Decode(frame)
+		if err != nil {
+			return
+		}
+		s.mux.Lock()
+		if s.conn != conn {
+			s.mux.Unlock()
+			return
+		}
+		s.res.Frames++
+		copies := 1
+		if s.rnd.Float64() < s.cfg.DropRate {
+			s.res.Dropped++
+			copies = 0
+		} else if s.rnd.Float64() < s.cfg.DupRate {
+			s.res.Duplicated++
+			copies = 2
+		}
+		for i := 0; i < copies; i++ {
+			s.handle(packet)
+		}
+		s.mux.Unlock()
+	}
+}
+
+// handle answers packet like a GoPack2 would, s.mux is held
+func (s *sim) handle(packet *gopack.Packet) {
+	switch packet.MsgType {
+	case gopack.MsgTypeSend:
+		switch packet.Qos {
+		case gopack.Qos0:
+			s.peer.deliver(string(packet.Payload))
+		case gopack.Qos1:
+			s.peer.deliver(string(packet.Payload))
+			s.transmit(gopack.Encode(gopack.MsgTypeAck, gopack.Qos0, 0, packet.MsgID, nil).Buffer)
+		case gopack.Qos2:
+			if _, ok := s.inbound[packet.MsgID]; !ok {
+				s.inbound[packet.MsgID] = packet.Payload
+			}
+			s.transmit(gopack.Encode(gopack.MsgTypeReceived, gopack.Qos0, 0, packet.MsgID, nil).Buffer)
+		}
+	case gopack.MsgTypeRelease:
+		if payload, ok := s.inbound[packet.MsgID]; ok {
+			delete(s.inbound, packet.MsgID)
+			s.peer.deliver(string(payload))
+		}
+		s.transmit(gopack.Encode(gopack.MsgTypeCompleted, gopack.Qos0, 0, packet.MsgID, nil).Buffer)
+	case gopack.MsgTypeAck:
+		for _, id := range gopack.AckRanges(packet) {
+			if out, ok := s.outbound[id]; ok && out.packet.Qos == gopack.Qos1 {
+				delete(s.outbound, id)
+			}
+		}
+	case gopack.MsgTypeReceived:
+		if out, ok := s.outbound[packet.MsgID]; ok && out.packet.Qos == gopack.Qos2 {
+			out.released = true
+			s.retransmit(out)
+		}
+	case gopack.MsgTypeCompleted:
+		if out, ok := s.outbound[packet.MsgID]; ok && out.released {
+			delete(s.outbound, packet.MsgID)
+		}
+	case gopack.MsgTypePing:
+		s.transmit(gopack.Encode(gopack.MsgTypePong, gopack.Qos0, 0, 0, nil).Buffer)
+	case gopack.MsgTypeConnect:
+		s.transmit(gopack.Encode(gopack.MsgTypeConnAck, gopack.Qos0, 0, 0, nil).Buffer)
+	}
+}
@@ -0,0 +1,29 @@
+package qossim
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	seeds := 8
+	if testing.Short() {
+		seeds = 2
+	}
+	for seed := int64(1); seed <= int64(seeds); seed++ {
+		cfg := DefaultConfig(seed)
+		t.Run(fmt.Sprintf("seed%d", seed), func(t *testing.T) {
+			result, err := Run(cfg)
+			if err != nil {
+				if result != nil {
+					for _, violation := range result.Violations {
+						t.Error(violation)
+					}
+				}
+				t.Fatalf("seed %d: %v", cfg.Seed, err)
+			}
+			t.Logf("%d frames, %d dropped, %d duplicated, %d disconnects, %d deliveries",
+				result.Frames, result.Dropped, result.Duplicated, result.Disconnects, result.Deliveries)
+		})
+	}
+}